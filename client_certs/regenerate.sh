@@ -0,0 +1,101 @@
+#! /usr/bin/env bash
+#
+# Regenerates every certificate in the repo, valid for 20 years, with the
+# same names as Cloud Foundry would give them:
+#
+#   appRootCA                 client_certs/ca.crt, what Envoy's is checked against
+#   └ instanceIdentityCA      in Envoy's chain
+#     └ <instance GUID>       Envoy's instance identity certificate
+#   internalCA                Envoy's trusted_ca for client certificates
+#   └ gorouter_backend_tls    client_certs/client.crt, presented to Envoy
+#   localhost                 sneaky_reverse_proxy/server.crt, self-signed
+#
+# The CA keys are thrown away. Run it from the repo's root.
+
+set -euo pipefail
+
+DAYS=7300
+APP_GUID=dde7f1fb-485d-463f-87d5-5d90b1e3f050
+SPACE_GUID=ff87034d-dddb-4b9f-8f5f-88bfd1e35ddd
+ORG_GUID=c2ac7ed1-43e2-4b60-b9f1-52ace1e84e5d
+INSTANCE_GUID=ef54a148-4f48-45b9-7fd1-8436
+INSTANCE_IP=10.255.242.56
+
+tmp=$(mktemp -d)
+trap 'rm -rf "$tmp"' EXIT
+
+key() {
+  openssl genrsa -traditional -out "$1" 2048 2>/dev/null
+}
+
+# ca <name> <subject>
+ca() {
+  key "$tmp/$1.key"
+  openssl req -x509 -new -key "$tmp/$1.key" -subj "$2" -days $DAYS \
+    -addext basicConstraints=critical,CA:TRUE \
+    -addext keyUsage=critical,keyCertSign,cRLSign \
+    -out "$tmp/$1.crt"
+}
+
+# sign <name> <subject> <issuer> <extensions>
+sign() {
+  key "$tmp/$1.key"
+  openssl req -new -key "$tmp/$1.key" -subj "$2" -multivalue-rdn -out "$tmp/$1.csr"
+  printf '%b' "$4" > "$tmp/$1.ext"
+  openssl x509 -req -in "$tmp/$1.csr" -CA "$tmp/$3.crt" -CAkey "$tmp/$3.key" \
+    -CAcreateserial -days $DAYS -extfile "$tmp/$1.ext" -out "$tmp/$1.crt" 2>/dev/null
+}
+
+ca appRootCA /CN=appRootCA
+sign instanceIdentityCA /CN=instanceIdentityCA appRootCA \
+  'basicConstraints=critical,CA:TRUE\nkeyUsage=critical,keyCertSign,cRLSign\n'
+sign instance "/OU=app:$APP_GUID+OU=space:$SPACE_GUID+OU=organization:$ORG_GUID/CN=$INSTANCE_GUID" instanceIdentityCA \
+  "keyUsage=critical,digitalSignature,keyEncipherment,keyAgreement\nextendedKeyUsage=clientAuth,serverAuth\nsubjectAltName=DNS:$INSTANCE_GUID,IP:$INSTANCE_IP\n"
+
+ca internalCA /CN=internalCA
+sign client /CN=gorouter_backend_tls internalCA \
+  'basicConstraints=critical,CA:FALSE\nextendedKeyUsage=clientAuth\nsubjectAltName=DNS:gorouter.service.cf.internal\n'
+
+cp "$tmp/appRootCA.crt" client_certs/ca.crt
+cp "$tmp/client.crt" client_certs/client.crt
+cp "$tmp/client.key" client_certs/client.key
+
+openssl req -x509 -newkey rsa:2048 -nodes -days $DAYS \
+  -subj "/C=BV/ST=George/L=Jean/O=Baptiste/OU=Lozier/CN=localhost/emailAddress=jean@charles" \
+  -addext subjectAltName=DNS:localhost,IP:127.0.0.1 \
+  -keyout sneaky_reverse_proxy/server.key -out sneaky_reverse_proxy/server.crt 2>/dev/null
+
+indent() {
+  sed 's/^/        /' "$@"
+}
+
+{
+  cat <<EOF
+resources:
+- '@type': type.googleapis.com/envoy.extensions.transport_sockets.tls.v3.Secret
+  name: server-cert-and-key
+  tls_certificate:
+    certificate_chain:
+      inline_string: |
+EOF
+  indent "$tmp/instance.crt" "$tmp/instanceIdentityCA.crt"
+  cat <<EOF
+    private_key:
+      inline_string: |
+EOF
+  indent "$tmp/instance.key"
+  echo 'version_info: "0"'
+} > envoy/sds-server-cert-and-key.yaml
+
+{
+  cat <<EOF
+resources:
+- '@type': type.googleapis.com/envoy.extensions.transport_sockets.tls.v3.Secret
+  name: server-validation-context
+  validation_context:
+    trusted_ca:
+      inline_string: |
+EOF
+  indent "$tmp/internalCA.crt"
+  echo 'version_info: "0"'
+} > envoy/sds-server-validation-context.yaml
@@ -0,0 +1,348 @@
+package main
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"strconv"
+	"strings"
+	"time"
+
+	"gopkg.in/yaml.v2"
+)
+
+// The subset of Envoy's bootstrap configuration that envoy/envoy.yaml uses.
+// Anything else in the file is ignored.
+type bootstrap struct {
+	StaticResources struct {
+		Listeners []listenerConfig `yaml:"listeners"`
+		Clusters  []clusterConfig  `yaml:"clusters"`
+	} `yaml:"static_resources"`
+}
+
+type listenerConfig struct {
+	Name            string           `yaml:"name"`
+	Address         addressConfig    `yaml:"address"`
+	FilterChains    []filterChain    `yaml:"filter_chains"`
+	ListenerFilters []typedExtension `yaml:"listener_filters"`
+}
+
+type addressConfig struct {
+	SocketAddress struct {
+		Address   string `yaml:"address"`
+		PortValue int    `yaml:"port_value"`
+	} `yaml:"socket_address"`
+}
+
+func (a addressConfig) String() string {
+	return net.JoinHostPort(a.SocketAddress.Address, strconv.Itoa(a.SocketAddress.PortValue))
+}
+
+type filterChain struct {
+	Filters         []typedExtension `yaml:"filters"`
+	TransportSocket *typedExtension  `yaml:"transport_socket"`
+}
+
+// typedExtension is any of Envoy's named, typed extensions. Only the fields
+// of the types supported are read from typed_config.
+type typedExtension struct {
+	Name        string `yaml:"name"`
+	TypedConfig struct {
+		Type string `yaml:"@type"`
+
+		// TcpProxy
+		Cluster string `yaml:"cluster"`
+
+		// DownstreamTlsContext
+		CommonTLSContext         commonTLSContext `yaml:"common_tls_context"`
+		RequireClientCertificate bool             `yaml:"require_client_certificate"`
+
+		// ProxyProtocolUpstreamTransport
+		Config struct {
+			Version string `yaml:"version"`
+		} `yaml:"config"`
+	} `yaml:"typed_config"`
+}
+
+type commonTLSContext struct {
+	ALPNProtocols []string `yaml:"alpn_protocols"`
+	TLSParams     struct {
+		CipherSuites              []string `yaml:"cipher_suites"`
+		TLSMinimumProtocolVersion string   `yaml:"tls_minimum_protocol_version"`
+		TLSMaximumProtocolVersion string   `yaml:"tls_maximum_protocol_version"`
+	} `yaml:"tls_params"`
+	TLSCertificateSDSSecretConfigs   []sdsSecretConfig `yaml:"tls_certificate_sds_secret_configs"`
+	ValidationContextSDSSecretConfig *sdsSecretConfig  `yaml:"validation_context_sds_secret_config"`
+}
+
+type sdsSecretConfig struct {
+	Name      string `yaml:"name"`
+	SDSConfig struct {
+		Path string `yaml:"path"`
+	} `yaml:"sds_config"`
+}
+
+type clusterConfig struct {
+	Name            string `yaml:"name"`
+	ConnectTimeout  string `yaml:"connect_timeout"`
+	CircuitBreakers struct {
+		Thresholds []struct {
+			MaxConnections *uint32 `yaml:"max_connections"`
+		} `yaml:"thresholds"`
+	} `yaml:"circuit_breakers"`
+	LoadAssignment struct {
+		Endpoints []struct {
+			LBEndpoints []struct {
+				Endpoint struct {
+					Address addressConfig `yaml:"address"`
+				} `yaml:"endpoint"`
+			} `yaml:"lb_endpoints"`
+		} `yaml:"endpoints"`
+	} `yaml:"load_assignment"`
+	TransportSocket *typedExtension `yaml:"transport_socket"`
+}
+
+// sdsFile is a file-based SDS response holding Secrets.
+type sdsFile struct {
+	Resources []struct {
+		Name           string `yaml:"name"`
+		TLSCertificate *struct {
+			CertificateChain dataSource `yaml:"certificate_chain"`
+			PrivateKey       dataSource `yaml:"private_key"`
+		} `yaml:"tls_certificate"`
+		ValidationContext *struct {
+			TrustedCA               dataSource `yaml:"trusted_ca"`
+			AllowExpiredCertificate bool       `yaml:"allow_expired_certificate"`
+		} `yaml:"validation_context"`
+	} `yaml:"resources"`
+}
+
+type dataSource struct {
+	Filename     string `yaml:"filename"`
+	InlineString string `yaml:"inline_string"`
+}
+
+func (d dataSource) read() ([]byte, error) {
+	if d.Filename != "" {
+		return ioutil.ReadFile(d.Filename)
+	}
+	return []byte(d.InlineString), nil
+}
+
+const (
+	tcpProxyType              = "type.googleapis.com/envoy.extensions.filters.network.tcp_proxy.v3.TcpProxy"
+	downstreamTLSContextType  = "type.googleapis.com/envoy.extensions.transport_sockets.tls.v3.DownstreamTlsContext"
+	proxyProtocolFilterType   = "type.googleapis.com/envoy.extensions.filters.listener.proxy_protocol.v3.ProxyProtocol"
+	upstreamProxyProtocolType = "type.googleapis.com/envoy.extensions.transport_sockets.proxy_protocol.v3.ProxyProtocolUpstreamTransport"
+)
+
+func loadBootstrap(path string) (*bootstrap, error) {
+	b, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	var config bootstrap
+	if err := yaml.Unmarshal(b, &config); err != nil {
+		return nil, fmt.Errorf("parsing %s: %s", path, err)
+	}
+	return &config, nil
+}
+
+// loadSecret finds the named Secret in an SDS file.
+func loadSecret(config sdsSecretConfig) (*sdsFile, int, error) {
+	b, err := ioutil.ReadFile(config.SDSConfig.Path)
+	if err != nil {
+		return nil, 0, err
+	}
+	var file sdsFile
+	if err := yaml.Unmarshal(b, &file); err != nil {
+		return nil, 0, fmt.Errorf("parsing %s: %s", config.SDSConfig.Path, err)
+	}
+	for i, r := range file.Resources {
+		if r.Name == config.Name {
+			return &file, i, nil
+		}
+	}
+	return nil, 0, fmt.Errorf("no secret %q in %s", config.Name, config.SDSConfig.Path)
+}
+
+// downstreamTLSConfig builds the TLS configuration a DownstreamTlsContext
+// describes. As with Envoy, there is no ALPN unless alpn_protocols asks for
+// it.
+func downstreamTLSConfig(ext *typedExtension) (*tls.Config, error) {
+	if ext.TypedConfig.Type != downstreamTLSContextType {
+		return nil, fmt.Errorf("unsupported transport socket %q", ext.TypedConfig.Type)
+	}
+	ctx := ext.TypedConfig.CommonTLSContext
+	config := &tls.Config{MinVersion: tls.VersionTLS12}
+
+	for _, sds := range ctx.TLSCertificateSDSSecretConfigs {
+		file, i, err := loadSecret(sds)
+		if err != nil {
+			return nil, err
+		}
+		secret := file.Resources[i].TLSCertificate
+		if secret == nil {
+			return nil, fmt.Errorf("secret %q is not a tls_certificate", sds.Name)
+		}
+		chain, err := secret.CertificateChain.read()
+		if err != nil {
+			return nil, err
+		}
+		key, err := secret.PrivateKey.read()
+		if err != nil {
+			return nil, err
+		}
+		cert, err := tls.X509KeyPair(chain, key)
+		if err != nil {
+			return nil, fmt.Errorf("secret %q: %s", sds.Name, err)
+		}
+		config.Certificates = append(config.Certificates, cert)
+	}
+	if len(config.Certificates) == 0 {
+		return nil, fmt.Errorf("no tls_certificate_sds_secret_configs")
+	}
+
+	for _, p := range ctx.ALPNProtocols {
+		config.NextProtos = append(config.NextProtos, strings.Split(p, ",")...)
+	}
+
+	params := ctx.TLSParams
+	var err error
+	if params.TLSMinimumProtocolVersion != "" {
+		if config.MinVersion, err = tlsVersion(params.TLSMinimumProtocolVersion); err != nil {
+			return nil, err
+		}
+	}
+	if params.TLSMaximumProtocolVersion != "" {
+		if config.MaxVersion, err = tlsVersion(params.TLSMaximumProtocolVersion); err != nil {
+			return nil, err
+		}
+	}
+	if len(params.CipherSuites) > 0 {
+		if config.CipherSuites, err = cipherSuites(params.CipherSuites); err != nil {
+			return nil, err
+		}
+	}
+
+	if ctx.ValidationContextSDSSecretConfig != nil {
+		sds := *ctx.ValidationContextSDSSecretConfig
+		file, i, err := loadSecret(sds)
+		if err != nil {
+			return nil, err
+		}
+		secret := file.Resources[i].ValidationContext
+		if secret == nil {
+			return nil, fmt.Errorf("secret %q is not a validation_context", sds.Name)
+		}
+		pem, err := secret.TrustedCA.read()
+		if err != nil {
+			return nil, err
+		}
+		roots := x509.NewCertPool()
+		if !roots.AppendCertsFromPEM(pem) {
+			return nil, fmt.Errorf("secret %q: no certificates in trusted_ca", sds.Name)
+		}
+		// Verify by hand, so that allow_expired_certificate can be honoured.
+		config.ClientAuth = tls.RequestClientCert
+		if ext.TypedConfig.RequireClientCertificate {
+			config.ClientAuth = tls.RequireAnyClientCert
+		}
+		config.VerifyPeerCertificate = clientCertVerifier(roots, secret.AllowExpiredCertificate)
+	} else if ext.TypedConfig.RequireClientCertificate {
+		return nil, fmt.Errorf("require_client_certificate needs a validation context")
+	}
+	return config, nil
+}
+
+// clientCertVerifier checks a client's chain against roots. An expired
+// chain passes if allowExpired is set, by checking it as of when the
+// client's certificate was issued.
+func clientCertVerifier(roots *x509.CertPool, allowExpired bool) func([][]byte, [][]*x509.Certificate) error {
+	return func(raw [][]byte, _ [][]*x509.Certificate) error {
+		if len(raw) == 0 {
+			return nil
+		}
+		certs := make([]*x509.Certificate, len(raw))
+		for i, b := range raw {
+			cert, err := x509.ParseCertificate(b)
+			if err != nil {
+				return err
+			}
+			certs[i] = cert
+		}
+		opts := x509.VerifyOptions{
+			Roots:         roots,
+			Intermediates: x509.NewCertPool(),
+			KeyUsages:     []x509.ExtKeyUsage{x509.ExtKeyUsageClientAuth},
+		}
+		for _, cert := range certs[1:] {
+			opts.Intermediates.AddCert(cert)
+		}
+		if allowExpired && time.Now().After(certs[0].NotAfter) {
+			opts.CurrentTime = certs[0].NotBefore
+		}
+		_, err := certs[0].Verify(opts)
+		return err
+	}
+}
+
+func tlsVersion(name string) (uint16, error) {
+	switch name {
+	case "TLS_AUTO", "TLSv1_2":
+		return tls.VersionTLS12, nil
+	case "TLSv1_0":
+		return tls.VersionTLS10, nil
+	case "TLSv1_1":
+		return tls.VersionTLS11, nil
+	case "TLSv1_3":
+		return tls.VersionTLS13, nil
+	}
+	return 0, fmt.Errorf("unknown TLS version %q", name)
+}
+
+// openSSLCipherSuites maps the OpenSSL names Envoy takes to Go's suites.
+var openSSLCipherSuites = map[string]uint16{
+	"ECDHE-ECDSA-AES128-GCM-SHA256": tls.TLS_ECDHE_ECDSA_WITH_AES_128_GCM_SHA256,
+	"ECDHE-RSA-AES128-GCM-SHA256":   tls.TLS_ECDHE_RSA_WITH_AES_128_GCM_SHA256,
+	"ECDHE-ECDSA-AES256-GCM-SHA384": tls.TLS_ECDHE_ECDSA_WITH_AES_256_GCM_SHA384,
+	"ECDHE-RSA-AES256-GCM-SHA384":   tls.TLS_ECDHE_RSA_WITH_AES_256_GCM_SHA384,
+	"ECDHE-ECDSA-CHACHA20-POLY1305": tls.TLS_ECDHE_ECDSA_WITH_CHACHA20_POLY1305,
+	"ECDHE-RSA-CHACHA20-POLY1305":   tls.TLS_ECDHE_RSA_WITH_CHACHA20_POLY1305,
+	"ECDHE-ECDSA-AES128-SHA":        tls.TLS_ECDHE_ECDSA_WITH_AES_128_CBC_SHA,
+	"ECDHE-RSA-AES128-SHA":          tls.TLS_ECDHE_RSA_WITH_AES_128_CBC_SHA,
+	"ECDHE-ECDSA-AES256-SHA":        tls.TLS_ECDHE_ECDSA_WITH_AES_256_CBC_SHA,
+	"ECDHE-RSA-AES256-SHA":          tls.TLS_ECDHE_RSA_WITH_AES_256_CBC_SHA,
+	"AES128-GCM-SHA256":             tls.TLS_RSA_WITH_AES_128_GCM_SHA256,
+	"AES256-GCM-SHA384":             tls.TLS_RSA_WITH_AES_256_GCM_SHA384,
+	"AES128-SHA":                    tls.TLS_RSA_WITH_AES_128_CBC_SHA,
+	"AES256-SHA":                    tls.TLS_RSA_WITH_AES_256_CBC_SHA,
+}
+
+// cipherSuites translates cipher_suites, which only limit TLS 1.2 and
+// below, as with Envoy. Equal-preference groups such as
+// "[ECDHE-ECDSA-AES128-GCM-SHA256|ECDHE-ECDSA-CHACHA20-POLY1305]" are
+// flattened.
+func cipherSuites(names []string) ([]uint16, error) {
+	var suites []uint16
+	for _, group := range names {
+		for _, name := range strings.Split(strings.Trim(group, "[]"), "|") {
+			id, ok := openSSLCipherSuites[name]
+			if !ok {
+				return nil, fmt.Errorf("unsupported cipher suite %q", name)
+			}
+			suites = append(suites, id)
+		}
+	}
+	return suites, nil
+}
+
+// connectTimeout parses a protobuf Duration such as "0.250s".
+func connectTimeout(s string) (time.Duration, error) {
+	if s == "" {
+		return 5 * time.Second, nil
+	}
+	return time.ParseDuration(s)
+}
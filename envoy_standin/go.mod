@@ -0,0 +1,10 @@
+module envoy-standin
+
+go 1.16
+
+require (
+	gopkg.in/yaml.v2 v2.3.0
+	shared v0.0.0-00010101000000-000000000000
+)
+
+replace shared => ../shared
@@ -0,0 +1,143 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"log"
+	"net"
+	"sync"
+
+	"shared/proxyprotocol"
+	"shared/standin"
+)
+
+// levels maps the log levels Envoy's -l takes to the stand-in's.
+var levels = map[string]int{
+	"trace":    standin.LevelDebug,
+	"debug":    standin.LevelDebug,
+	"info":     standin.LevelInfo,
+	"warning":  standin.LevelWarn,
+	"warn":     standin.LevelWarn,
+	"error":    standin.LevelError,
+	"critical": standin.LevelError,
+	"off":      standin.LevelOff,
+}
+
+func main() {
+	// The flags are spelt as Envoy's, so start.sh can run either.
+	configPath := flag.String("config-path", "./envoy/envoy.yaml", "Envoy bootstrap configuration")
+	level := flag.String("l", "info", "log level: trace, debug, info, warning, error, critical or off")
+	flag.Parse()
+
+	var ok bool
+	if standin.LogLevel, ok = levels[*level]; !ok {
+		log.Fatalf("Unknown log level %q\n", *level)
+	}
+	config, err := loadBootstrap(*configPath)
+	if err != nil {
+		log.Fatalf("Failed to load configuration: %s\n", err)
+	}
+
+	clusters := map[string]*standin.Cluster{}
+	for _, c := range config.StaticResources.Clusters {
+		cl, err := newCluster(c)
+		if err != nil {
+			log.Fatalf("Cluster %s: %s\n", c.Name, err)
+		}
+		clusters[c.Name] = cl
+	}
+	if len(config.StaticResources.Listeners) == 0 {
+		log.Fatalf("No listeners in %s\n", *configPath)
+	}
+
+	var wg sync.WaitGroup
+	for _, lc := range config.StaticResources.Listeners {
+		l, err := newListener(lc, clusters)
+		if err != nil {
+			log.Fatalf("Listener %s: %s\n", lc.Name, err)
+		}
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			err := l.Serve()
+			standin.Logf(standin.LevelError, "Listener %s: %s", l.Name, err)
+		}()
+	}
+	wg.Wait()
+	log.Fatalf("All listeners have stopped\n")
+}
+
+// newCluster builds a static cluster, with the upstream proxy_protocol
+// transport socket if it has one.
+func newCluster(c clusterConfig) (*standin.Cluster, error) {
+	timeout, err := connectTimeout(c.ConnectTimeout)
+	if err != nil {
+		return nil, fmt.Errorf("connect_timeout: %s", err)
+	}
+	cl := &standin.Cluster{Name: c.Name, ConnectTimeout: timeout, MaxConnections: 1024}
+	for _, t := range c.CircuitBreakers.Thresholds {
+		if t.MaxConnections != nil {
+			cl.MaxConnections = int64(*t.MaxConnections)
+		}
+	}
+	for _, e := range c.LoadAssignment.Endpoints {
+		for _, lb := range e.LBEndpoints {
+			cl.Endpoints = append(cl.Endpoints, lb.Endpoint.Address.String())
+		}
+	}
+	if len(cl.Endpoints) == 0 {
+		return nil, fmt.Errorf("no endpoints")
+	}
+	if ts := c.TransportSocket; ts != nil {
+		if ts.TypedConfig.Type != upstreamProxyProtocolType {
+			return nil, fmt.Errorf("unsupported transport socket %q", ts.TypedConfig.Type)
+		}
+		// Envoy's default is version 1.
+		cl.ProxyProtocol = "V1"
+		if v := ts.TypedConfig.Config.Version; v != "" {
+			cl.ProxyProtocol = v
+		}
+		if cl.ProxyProtocol != "V1" && cl.ProxyProtocol != "V2" {
+			return nil, fmt.Errorf("unknown PROXY protocol version %q", cl.ProxyProtocol)
+		}
+	}
+	return cl, nil
+}
+
+// newListener opens a listener for its lone tcp_proxy filter, terminating
+// TLS if it has a DownstreamTlsContext.
+func newListener(lc listenerConfig, clusters map[string]*standin.Cluster) (*standin.Listener, error) {
+	if len(lc.FilterChains) != 1 {
+		return nil, fmt.Errorf("want one filter chain, not %d", len(lc.FilterChains))
+	}
+	chain := lc.FilterChains[0]
+	if len(chain.Filters) != 1 || chain.Filters[0].TypedConfig.Type != tcpProxyType {
+		return nil, fmt.Errorf("want a lone tcp_proxy filter")
+	}
+	l := &standin.Listener{Name: lc.Name}
+	name := chain.Filters[0].TypedConfig.Cluster
+	if l.Cluster = clusters[name]; l.Cluster == nil {
+		return nil, fmt.Errorf("no cluster %q", name)
+	}
+	if chain.TransportSocket != nil {
+		var err error
+		if l.TLSConfig, err = downstreamTLSConfig(chain.TransportSocket); err != nil {
+			return nil, err
+		}
+	}
+
+	var err error
+	if l.L, err = net.Listen("tcp", lc.Address.String()); err != nil {
+		return nil, err
+	}
+	for _, f := range lc.ListenerFilters {
+		if f.TypedConfig.Type != proxyProtocolFilterType {
+			l.L.Close()
+			return nil, fmt.Errorf("unsupported listener filter %q", f.TypedConfig.Type)
+		}
+		l.L = proxyprotocol.NewListener(l.L)
+	}
+	// The port may have been 0.
+	standin.Logf(standin.LevelInfo, "Listener %s on %s, proxying to %s", l.Name, l.L.Addr(), l.Cluster.Name)
+	return l, nil
+}
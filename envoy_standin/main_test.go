@@ -0,0 +1,234 @@
+package main
+
+import (
+	"bufio"
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"shared/proxyprotocol"
+	"shared/standin"
+)
+
+// envoyServerName is the DNS SAN of Envoy's certificate in envoy/.
+const envoyServerName = "ef54a148-4f48-45b9-7fd1-8436"
+
+// startStandin runs the stand-in on the repo's own envoy/envoy.yaml, changed
+// by edit, in front of the backend at backendAddr. It listens on an
+// ephemeral port, whose address it returns.
+func startStandin(t *testing.T, backendAddr string, edit func(*bootstrap)) string {
+	t.Helper()
+	config, err := loadBootstrap("../envoy/envoy.yaml")
+	if err != nil {
+		t.Fatal(err)
+	}
+	host, port, _ := net.SplitHostPort(backendAddr)
+	backend := &config.StaticResources.Clusters[0].LoadAssignment.Endpoints[0].LBEndpoints[0].Endpoint.Address.SocketAddress
+	backend.Address = host
+	backend.PortValue, _ = strconv.Atoi(port)
+	lc := &config.StaticResources.Listeners[0]
+	lc.Address.SocketAddress.PortValue = 0
+	tlsContext := &lc.FilterChains[0].TransportSocket.TypedConfig.CommonTLSContext
+	tlsContext.TLSCertificateSDSSecretConfigs[0].SDSConfig.Path = "../envoy/sds-server-cert-and-key.yaml"
+	tlsContext.ValidationContextSDSSecretConfig.SDSConfig.Path = "../envoy/sds-server-validation-context.yaml"
+	if edit != nil {
+		edit(config)
+	}
+
+	clusters := map[string]*standin.Cluster{}
+	for _, c := range config.StaticResources.Clusters {
+		if clusters[c.Name], err = newCluster(c); err != nil {
+			t.Fatal(err)
+		}
+	}
+	l, err := newListener(*lc, clusters)
+	if err != nil {
+		t.Fatal(err)
+	}
+	go l.Serve()
+	t.Cleanup(func() { l.L.Close() })
+	return l.L.Addr().String()
+}
+
+// clientConfig trusts Envoy's CA and presents the client certificate, as
+// the sneaky client and the reverse proxy do by default.
+func clientConfig(t *testing.T) *tls.Config {
+	t.Helper()
+	ca, err := ioutil.ReadFile("../client_certs/ca.crt")
+	if err != nil {
+		t.Fatal(err)
+	}
+	roots := x509.NewCertPool()
+	roots.AppendCertsFromPEM(ca)
+	cert, err := tls.LoadX509KeyPair("../client_certs/client.crt", "../client_certs/client.key")
+	if err != nil {
+		t.Fatal(err)
+	}
+	return &tls.Config{
+		RootCAs:      roots,
+		ServerName:   envoyServerName,
+		Certificates: []tls.Certificate{cert},
+		NextProtos:   []string{"h2", "http/1.1"},
+	}
+}
+
+// get sends a GET over conn and returns the answer's body.
+func get(t *testing.T, conn net.Conn) string {
+	t.Helper()
+	body, err := tryGet(conn)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return body
+}
+
+func tryGet(conn net.Conn) (string, error) {
+	conn.SetDeadline(time.Now().Add(5 * time.Second))
+	io.WriteString(conn, "GET / HTTP/1.1\r\nHost: envoy\r\nConnection: close\r\n\r\n")
+	resp, err := http.ReadResponse(bufio.NewReader(conn), nil)
+	if err != nil {
+		return "", err
+	}
+	defer resp.Body.Close()
+	b, err := ioutil.ReadAll(resp.Body)
+	return string(b), err
+}
+
+func TestRepoConfig(t *testing.T) {
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprintf(w, "%s from %s", r.Proto, r.RemoteAddr)
+	}))
+	defer backend.Close()
+	addr := startStandin(t, backend.Listener.Addr().String(), nil)
+
+	conn, err := tls.Dial("tcp", addr, clientConfig(t))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	// As with Envoy, no alpn_protocols means no ALPN.
+	if p := conn.ConnectionState().NegotiatedProtocol; p != "" {
+		t.Errorf("negotiated %q", p)
+	}
+	// The backend sees the stand-in's connection, not ours.
+	if got := get(t, conn); !strings.HasPrefix(got, "HTTP/1.1 from ") || got == "HTTP/1.1 from "+conn.LocalAddr().String() {
+		t.Errorf("got %q", got)
+	}
+
+	// require_client_certificate turns away clients without one.
+	noCert := clientConfig(t)
+	noCert.Certificates = nil
+	conn, err = tls.Dial("tcp", addr, noCert)
+	if err == nil {
+		conn.SetDeadline(time.Now().Add(5 * time.Second))
+		// With TLS 1.3 the client finds out on its first read.
+		_, err = conn.Read(make([]byte, 1))
+		conn.Close()
+	}
+	if err == nil {
+		t.Error("connected without a client certificate")
+	}
+}
+
+func TestProxyProtocolV2(t *testing.T) {
+	// The backend reads the PROXY header, as the apps do with
+	// -proxy-protocol.
+	backend := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		io.WriteString(w, r.RemoteAddr)
+	}))
+	backend.Listener = proxyprotocol.NewListener(backend.Listener)
+	backend.Start()
+	defer backend.Close()
+
+	// The configuration commented out in envoy/envoy.yaml: the listener
+	// filter and the upstream transport socket.
+	addr := startStandin(t, backend.Listener.Addr().String(), func(config *bootstrap) {
+		lc := &config.StaticResources.Listeners[0]
+		lc.ListenerFilters = []typedExtension{{Name: "envoy.filters.listener.proxy_protocol"}}
+		lc.ListenerFilters[0].TypedConfig.Type = proxyProtocolFilterType
+		ts := &typedExtension{Name: "envoy.transport_sockets.upstream_proxy_protocol"}
+		ts.TypedConfig.Type = upstreamProxyProtocolType
+		ts.TypedConfig.Config.Version = "V2"
+		config.StaticResources.Clusters[0].TransportSocket = ts
+	})
+
+	conn, err := net.Dial("tcp", addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	client := &net.TCPAddr{IP: net.ParseIP("203.0.113.7"), Port: 51234}
+	h := &proxyprotocol.Header{Source: client, Destination: conn.RemoteAddr().(*net.TCPAddr)}
+	b, err := h.Marshal()
+	if err != nil {
+		t.Fatal(err)
+	}
+	conn.Write(b)
+	tconn := tls.Client(conn, clientConfig(t))
+	if got := get(t, tconn); got != client.String() {
+		t.Errorf("backend got the request from %s, want %s", got, client)
+	}
+}
+
+func TestMaxConnections(t *testing.T) {
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		io.WriteString(w, "hello")
+	}))
+	defer backend.Close()
+	addr := startStandin(t, backend.Listener.Addr().String(), func(config *bootstrap) {
+		one := uint32(1)
+		thresholds := &config.StaticResources.Clusters[0].CircuitBreakers.Thresholds[0]
+		thresholds.MaxConnections = &one
+	})
+
+	first, err := tls.Dial("tcp", addr, clientConfig(t))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer first.Close()
+	// The first connection holds the one slot until it closes.
+	if got := get(t, first); got != "hello" {
+		t.Errorf("got %q", got)
+	}
+	// The second finishes its handshake, and is then closed for want of a
+	// slot upstream.
+	second, err := tls.Dial("tcp", addr, clientConfig(t))
+	if err != nil {
+		t.Fatal(err)
+	}
+	second.SetDeadline(time.Now().Add(5 * time.Second))
+	if _, err := second.Read(make([]byte, 1)); err == nil {
+		t.Error("read from the connection past max_connections")
+	}
+	second.Close()
+
+	first.Close()
+	// Its slot is given back once the stand-in has seen it close.
+	for i := 0; ; i++ {
+		conn, err := tls.Dial("tcp", addr, clientConfig(t))
+		if err != nil {
+			t.Fatal(err)
+		}
+		body, err := tryGet(conn)
+		conn.Close()
+		if err == nil {
+			if body != "hello" {
+				t.Errorf("got %q", body)
+			}
+			return
+		}
+		if i == 50 {
+			t.Fatalf("no slot after the first connection closed: %s", err)
+		}
+		time.Sleep(20 * time.Millisecond)
+	}
+}
@@ -0,0 +1,198 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"golang.org/x/net/http2"
+)
+
+// Faults the app can be told to commit, to see how clients and the reverse
+// proxy cope. All but upgradeRequired and rstStream1 only apply to requests
+// offering the h2c upgrade.
+const (
+	faultGarbageAfter101   = "garbage-after-101"   // 101, then bytes that aren't HTTP/2
+	faultNoPreface         = "no-preface"          // 101, then silence
+	faultWrongUpgradeToken = "wrong-upgrade-token" // 101 switching to something other than h2c
+	faultUpgradeRequired   = "426"                 // 426 Upgrade Required, to any HTTP/1.1 request
+	faultCloseAfter101     = "close-after-101"     // 101, then close
+	faultDelayedSettings   = "delayed-settings"    // 101, then SETTINGS only after a delay
+	faultRSTStream1        = "rst-stream-1"        // RST_STREAM instead of a response on stream 1
+	faultGoAway            = "goaway"              // 101, SETTINGS and GOAWAY straight away
+)
+
+var faultNames = []string{
+	faultGarbageAfter101, faultNoPreface, faultWrongUpgradeToken, faultUpgradeRequired,
+	faultCloseAfter101, faultDelayedSettings, faultRSTStream1, faultGoAway,
+}
+
+const (
+	faultHeader      = "X-Fault"
+	faultDelayHeader = "X-Fault-Delay"
+)
+
+// faultHoldTimeout is how long a connection left hanging by a fault is held
+// open for the client to give up on.
+const faultHoldTimeout = time.Minute
+
+// faultInjector picks a fault for each request: the one its X-Fault header
+// names, or else the one -fault gave.
+type faultInjector struct {
+	fault string
+	delay time.Duration
+}
+
+func newFaults(fault string, delay time.Duration) (*faultInjector, error) {
+	if fault != "" && !isFault(fault) {
+		return nil, fmt.Errorf("unknown fault %q, want one of %s", fault, strings.Join(faultNames, ", "))
+	}
+	return &faultInjector{fault: fault, delay: delay}, nil
+}
+
+func isFault(name string) bool {
+	for _, f := range faultNames {
+		if f == name {
+			return true
+		}
+	}
+	return false
+}
+
+func (f *faultInjector) pick(r *http.Request) (string, time.Duration) {
+	fault, delay := f.fault, f.delay
+	if h := r.Header.Get(faultHeader); isFault(h) {
+		fault = h
+	}
+	if d, err := time.ParseDuration(r.Header.Get(faultDelayHeader)); err == nil {
+		delay = d
+	}
+	return fault, delay
+}
+
+// connHandler commits the faults that happen to the connection, around the
+// upgrade. It goes in front of the h2c handler.
+func (f *faultInjector) connHandler(h http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		fault, delay := f.pick(r)
+		upgrade := strings.EqualFold(r.Header.Get("Upgrade"), "h2c")
+		if fault == faultUpgradeRequired && r.ProtoMajor == 1 && r.Method != "PRI" {
+			fmt.Printf("Fault %s for %s\n", fault, r.RemoteAddr)
+			w.Header().Set("Upgrade", "h2c")
+			w.Header().Set("Connection", "Upgrade")
+			http.Error(w, "426 Upgrade Required", http.StatusUpgradeRequired)
+			return
+		}
+		if fault == "" || fault == faultRSTStream1 || !upgrade {
+			h.ServeHTTP(w, r)
+			return
+		}
+		fmt.Printf("Fault %s for %s\n", fault, r.RemoteAddr)
+
+		switch fault {
+		case faultDelayedSettings:
+			// The first write is the 101 and the second the SETTINGS
+			// frame that starts the server's preface.
+			h.ServeHTTP(&wrappingHijacker{w, func(c net.Conn) net.Conn {
+				return &faultConn{Conn: c, before: func(n int, p []byte) []byte {
+					if n == 2 {
+						time.Sleep(delay)
+					}
+					return p
+				}}
+			}}, r)
+			return
+		case faultWrongUpgradeToken:
+			// The h2c handler carries on as if nothing were wrong, so a
+			// client that doesn't check the token gets away with it.
+			h.ServeHTTP(&wrappingHijacker{w, func(c net.Conn) net.Conn {
+				return &faultConn{Conn: c, before: func(n int, p []byte) []byte {
+					if n == 1 {
+						return bytes.Replace(p, []byte("Upgrade: h2c"), []byte("Upgrade: h2d"), 1)
+					}
+					return p
+				}}
+			}}, r)
+			return
+		}
+
+		conn, rw, err := w.(http.Hijacker).Hijack()
+		if err != nil {
+			fmt.Printf("Fault %s: hijacking: %s\n", fault, err)
+			return
+		}
+		defer conn.Close()
+		rw.WriteString("HTTP/1.1 101 Switching Protocols\r\nConnection: Upgrade\r\nUpgrade: h2c\r\n\r\n")
+		switch fault {
+		case faultGarbageAfter101:
+			rw.WriteString("This is not HTTP/2, whatever the 101 said.\r\n")
+		case faultGoAway:
+			fr := http2.NewFramer(rw, nil)
+			fr.WriteSettings()
+			fr.WriteGoAway(0, http2.ErrCodeNo, []byte("fault injection"))
+		}
+		rw.Flush()
+		if fault == faultNoPreface {
+			conn.SetReadDeadline(time.Now().Add(faultHoldTimeout))
+			io.Copy(ioutil.Discard, rw)
+		}
+	})
+}
+
+// streamHandler commits the faults that happen to a request on an HTTP/2
+// stream. It goes behind the h2c handler.
+func (f *faultInjector) streamHandler(h http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if fault, _ := f.pick(r); fault == faultRSTStream1 && r.ProtoMajor == 2 && streamID(w) == 1 {
+			fmt.Printf("Fault %s for %s\n", fault, r.RemoteAddr)
+			// The http2 server resets the stream of a handler that
+			// aborts.
+			panic(http.ErrAbortHandler)
+		}
+		h.ServeHTTP(w, r)
+	})
+}
+
+// wrappingHijacker wraps the connection it hijacks.
+type wrappingHijacker struct {
+	http.ResponseWriter
+	wrap func(net.Conn) net.Conn
+}
+
+func (w *wrappingHijacker) Hijack() (net.Conn, *bufio.ReadWriter, error) {
+	conn, rw, err := w.ResponseWriter.(http.Hijacker).Hijack()
+	if err != nil {
+		return nil, nil, err
+	}
+	conn = w.wrap(conn)
+	// Keep what has been read already, and write through the wrapper.
+	return conn, bufio.NewReadWriter(rw.Reader, bufio.NewWriter(conn)), nil
+}
+
+// faultConn lets before tamper with, or hold up, each write. n counts the
+// writes from 1.
+type faultConn struct {
+	net.Conn
+	before func(n int, p []byte) []byte
+
+	mu     sync.Mutex
+	writes int
+}
+
+func (c *faultConn) Write(p []byte) (int, error) {
+	c.mu.Lock()
+	c.writes++
+	n := c.writes
+	c.mu.Unlock()
+	if _, err := c.Conn.Write(c.before(n, p)); err != nil {
+		return 0, err
+	}
+	return len(p), nil
+}
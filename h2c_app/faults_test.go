@@ -0,0 +1,219 @@
+package main
+
+import (
+	"bytes"
+	"crypto/tls"
+	"errors"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"golang.org/x/net/http2"
+	"golang.org/x/net/http2/hpack"
+)
+
+// startFaultyApp serves the app as main does, committing fault on every
+// request offering the upgrade unless X-Fault says otherwise.
+func startFaultyApp(t *testing.T, fault string) string {
+	t.Helper()
+	faults, err := newFaults(fault, time.Second)
+	if err != nil {
+		t.Fatal(err)
+	}
+	srv := httptest.NewServer(newHandler(faults))
+	t.Cleanup(srv.Close)
+	return srv.Listener.Addr().String()
+}
+
+func get(t *testing.T, c *http.Client, url, fault string) *http.Response {
+	t.Helper()
+	req, _ := http.NewRequest(http.MethodGet, url, nil)
+	req.Header.Set(faultHeader, fault)
+	resp, err := c.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	io.Copy(ioutil.Discard, resp.Body)
+	resp.Body.Close()
+	return resp
+}
+
+// startH2 sends the client preface and SETTINGS on an upgraded connection.
+func startH2(t *testing.T, conn net.Conn, r io.Reader) *http2.Framer {
+	t.Helper()
+	io.WriteString(conn, http2.ClientPreface)
+	fr := http2.NewFramer(conn, r)
+	if err := fr.WriteSettings(); err != nil {
+		t.Fatal(err)
+	}
+	return fr
+}
+
+func TestNewFaults(t *testing.T) {
+	for _, name := range faultNames {
+		if _, err := newFaults(name, 0); err != nil {
+			t.Errorf("%s: %s", name, err)
+		}
+	}
+	if _, err := newFaults("teapot", 0); err == nil {
+		t.Error("accepted fault teapot")
+	}
+}
+
+func TestFaultUpgradeRequired(t *testing.T) {
+	addr := startFaultyApp(t, "")
+	resp := get(t, &http.Client{}, "http://"+addr+"/", faultUpgradeRequired)
+	if resp.StatusCode != http.StatusUpgradeRequired || resp.Header.Get("Upgrade") != "h2c" {
+		t.Errorf("got %s, Upgrade %q, want 426 asking for h2c", resp.Status, resp.Header.Get("Upgrade"))
+	}
+
+	// Offering the upgrade is still HTTP/1.1, and is refused too.
+	_, _, resp = offerUpgrade(t, addr, "/", faultHeader+": "+faultUpgradeRequired+"\r\n")
+	if resp.StatusCode != http.StatusUpgradeRequired {
+		t.Errorf("got %s for the upgrade offer, want 426", resp.Status)
+	}
+
+	// A client that already speaks HTTP/2 is served.
+	priorKnowledge := &http.Client{Transport: &http2.Transport{
+		AllowHTTP: true,
+		DialTLS: func(network, addr string, _ *tls.Config) (net.Conn, error) {
+			return net.Dial(network, addr)
+		},
+	}}
+	if resp := get(t, priorKnowledge, "http://"+addr+"/", faultUpgradeRequired); resp.StatusCode != http.StatusOK {
+		t.Errorf("got %s with prior knowledge, want 200", resp.Status)
+	}
+}
+
+func TestFaultDelayedSettings(t *testing.T) {
+	const delay = 300 * time.Millisecond
+	conn, br, resp := offerUpgrade(t, startFaultyApp(t, ""), "/", faultHeader+": "+faultDelayedSettings+"\r\n"+faultDelayHeader+": "+delay.String()+"\r\n")
+	if resp.StatusCode != http.StatusSwitchingProtocols {
+		t.Fatalf("got %s, want 101", resp.Status)
+	}
+	start := time.Now()
+	fr := startH2(t, conn, br)
+	f, err := fr.ReadFrame()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := f.(*http2.SettingsFrame); !ok {
+		t.Fatalf("got %v, want the server's SETTINGS", f)
+	}
+	if elapsed := time.Since(start); elapsed < delay-50*time.Millisecond {
+		t.Errorf("SETTINGS came %s after the 101, want %s", elapsed, delay)
+	}
+}
+
+func TestFaultRSTStream1(t *testing.T) {
+	conn, br, resp := offerUpgrade(t, startFaultyApp(t, faultRSTStream1), "/", "")
+	if resp.StatusCode != http.StatusSwitchingProtocols {
+		t.Fatalf("got %s, want 101", resp.Status)
+	}
+	fr := startH2(t, conn, br)
+
+	// The upgrade request is reset rather than answered, and the next
+	// request on the connection is answered.
+	var headers bytes.Buffer
+	enc := hpack.NewEncoder(&headers)
+	for _, f := range []hpack.HeaderField{
+		{Name: ":method", Value: "GET"},
+		{Name: ":scheme", Value: "http"},
+		{Name: ":authority", Value: "app"},
+		{Name: ":path", Value: "/"},
+	} {
+		enc.WriteField(f)
+	}
+	if err := fr.WriteHeaders(http2.HeadersFrameParam{StreamID: 3, BlockFragment: headers.Bytes(), EndStream: true, EndHeaders: true}); err != nil {
+		t.Fatal(err)
+	}
+	var reset, answered bool
+	for !reset || !answered {
+		f, err := fr.ReadFrame()
+		if err != nil {
+			t.Fatalf("reset %v, answered %v: %s", reset, answered, err)
+		}
+		switch f := f.(type) {
+		case *http2.RSTStreamFrame:
+			if f.StreamID != 1 {
+				t.Fatalf("stream %d reset", f.StreamID)
+			}
+			reset = true
+		case *http2.HeadersFrame:
+			if f.StreamID == 1 {
+				t.Fatal("stream 1 answered")
+			}
+			answered = true
+		case *http2.SettingsFrame:
+			if !f.IsAck() {
+				fr.WriteSettingsAck()
+			}
+		}
+	}
+}
+
+// TestFaultsAfter101 checks what follows the 101 for the faults that take
+// over the connection once the upgrade is accepted.
+func TestFaultsAfter101(t *testing.T) {
+	addr := startFaultyApp(t, "")
+	for _, c := range []struct {
+		fault string
+		check func(t *testing.T, conn net.Conn, r io.Reader, resp *http.Response)
+	}{
+		{faultGarbageAfter101, func(t *testing.T, conn net.Conn, r io.Reader, resp *http.Response) {
+			b := make([]byte, len("This is not HTTP/2"))
+			if _, err := io.ReadFull(r, b); err != nil || string(b) != "This is not HTTP/2" {
+				t.Errorf("got %q, %v", b, err)
+			}
+		}},
+		{faultNoPreface, func(t *testing.T, conn net.Conn, r io.Reader, resp *http.Response) {
+			conn.SetReadDeadline(time.Now().Add(200 * time.Millisecond))
+			var ne net.Error
+			if n, err := r.Read(make([]byte, 1)); n != 0 || !errors.As(err, &ne) || !ne.Timeout() {
+				t.Errorf("got %d bytes, %v, want silence", n, err)
+			}
+		}},
+		{faultWrongUpgradeToken, func(t *testing.T, conn net.Conn, r io.Reader, resp *http.Response) {
+			if got := resp.Header.Get("Upgrade"); got != "h2d" {
+				t.Errorf("switched to %q", got)
+			}
+		}},
+		{faultCloseAfter101, func(t *testing.T, conn net.Conn, r io.Reader, resp *http.Response) {
+			if n, err := r.Read(make([]byte, 1)); n != 0 || err != io.EOF {
+				t.Errorf("got %d bytes, %v, want the connection closed", n, err)
+			}
+		}},
+		{faultGoAway, func(t *testing.T, conn net.Conn, r io.Reader, resp *http.Response) {
+			fr := http2.NewFramer(ioutil.Discard, r)
+			if f, err := fr.ReadFrame(); err != nil {
+				t.Fatal(err)
+			} else if _, ok := f.(*http2.SettingsFrame); !ok {
+				t.Fatalf("got %v, want SETTINGS", f)
+			}
+			f, err := fr.ReadFrame()
+			if err != nil {
+				t.Fatal(err)
+			}
+			if g, ok := f.(*http2.GoAwayFrame); !ok || g.ErrCode != http2.ErrCodeNo || string(g.DebugData()) != "fault injection" {
+				t.Errorf("got %v, want a GOAWAY", f)
+			}
+		}},
+	} {
+		t.Run(c.fault, func(t *testing.T) {
+			conn, br, resp := offerUpgrade(t, addr, "/", faultHeader+": "+c.fault+"\r\n")
+			if resp.StatusCode != http.StatusSwitchingProtocols {
+				t.Fatalf("got %s, want 101", resp.Status)
+			}
+			c.check(t, conn, br, resp)
+
+			// A request that doesn't offer the upgrade is let through.
+			if resp := get(t, &http.Client{}, "http://"+addr+"/", c.fault); resp.StatusCode != http.StatusOK {
+				t.Errorf("got %s without the upgrade, want 200", resp.Status)
+			}
+		})
+	}
+}
@@ -6,4 +6,7 @@ require (
 	github.com/onsi/ginkgo v1.15.0
 	github.com/onsi/gomega v1.10.5
 	golang.org/x/net v0.0.0-20210226172049-e18ecbb05110
+	shared v0.0.0-00010101000000-000000000000
 )
+
+replace shared => ../shared
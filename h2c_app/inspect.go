@@ -0,0 +1,123 @@
+package main
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"io"
+	"net/http"
+	"reflect"
+	"strings"
+)
+
+const inspectPath = "/inspect"
+
+// requestReport is what inspect says about a request, as it reached us.
+type requestReport struct {
+	Method      string      `json:"method"`
+	Host        string      `json:"host"`
+	URI         string      `json:"uri"`
+	Proto       string      `json:"proto"`
+	Negotiation string      `json:"negotiation"` // "upgrade", "prior-knowledge" or "http1.1"
+	StreamID    uint32      `json:"stream_id,omitempty"`
+	RemoteAddr  string      `json:"remote_addr"`
+	TLS         bool        `json:"tls"`
+	Headers     http.Header `json:"headers"`
+	Trailers    http.Header `json:"trailers,omitempty"`
+	Body        bodyReport  `json:"body"`
+}
+
+type bodyReport struct {
+	Length int64  `json:"length"`
+	SHA256 string `json:"sha256"`
+	Error  string `json:"error,omitempty"`
+}
+
+// inspect answers with a JSON description of the request: the headers Envoy
+// and the reverse proxy added, how the connection got to HTTP/2 and on which
+// stream, and the size and hash of the body.
+func inspect(w http.ResponseWriter, r *http.Request) {
+	report := requestReport{
+		Method:      r.Method,
+		Host:        r.Host,
+		URI:         r.RequestURI,
+		Proto:       r.Proto,
+		Negotiation: "http1.1",
+		RemoteAddr:  r.RemoteAddr,
+		TLS:         r.TLS != nil,
+		Headers:     r.Header,
+	}
+	if r.ProtoMajor == 2 {
+		report.Negotiation, _ = r.Context().Value(negotiationKey{}).(string)
+		report.StreamID = streamID(w)
+	}
+
+	h := sha256.New()
+	if isUpgradeStream(w, r) {
+		if r.ContentLength > 0 {
+			report.Body.Error = "the upgrade request's body is dropped by the h2c package"
+		}
+	} else if n, err := io.Copy(h, r.Body); err != nil {
+		report.Body.Error = err.Error()
+	} else {
+		report.Body.Length = n
+	}
+	report.Body.SHA256 = hex.EncodeToString(h.Sum(nil))
+	// Trailers are only there once the body has been read.
+	if len(r.Trailer) > 0 {
+		report.Trailers = r.Trailer
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	enc := json.NewEncoder(w)
+	enc.SetIndent("", "  ")
+	enc.Encode(report)
+}
+
+type negotiationKey struct{}
+
+// withNegotiation notes in the context how the connection started out, for
+// inspect. The h2c handler serves an upgraded or prior-knowledge connection
+// with the context of the request that started it, so every stream on the
+// connection carries the note.
+func withNegotiation(h http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		negotiation := "http1.1"
+		switch {
+		case r.Method == "PRI" && r.URL.Path == "*":
+			negotiation = "prior-knowledge"
+		case strings.EqualFold(r.Header.Get("Upgrade"), "h2c"):
+			negotiation = "upgrade"
+		}
+		h.ServeHTTP(w, r.WithContext(context.WithValue(r.Context(), negotiationKey{}, negotiation)))
+	})
+}
+
+// isUpgradeStream says whether r is the upgrade request itself, served on
+// stream 1 of the connection it upgraded. The h2c package hands it on as a
+// stream that never ends, and drops its body, so there is nothing to read.
+func isUpgradeStream(w http.ResponseWriter, r *http.Request) bool {
+	negotiation, _ := r.Context().Value(negotiationKey{}).(string)
+	return r.ProtoMajor == 2 && negotiation == "upgrade" && streamID(w) == 1
+}
+
+// streamID digs the HTTP/2 stream ID out of the http2 package's response
+// writer, which keeps it unexported. reflect can read it, though not export
+// it. It is 0 if w isn't that writer.
+func streamID(w http.ResponseWriter) uint32 {
+	v := reflect.ValueOf(w)
+	for _, field := range []string{"rws", "stream", "id"} {
+		v = reflect.Indirect(v)
+		if v.Kind() != reflect.Struct {
+			return 0
+		}
+		if v = v.FieldByName(field); !v.IsValid() {
+			return 0
+		}
+	}
+	if v.Kind() != reflect.Uint32 {
+		return 0
+	}
+	return uint32(v.Uint())
+}
@@ -0,0 +1,121 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/tls"
+	"encoding/json"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"golang.org/x/net/http2"
+)
+
+// startApp serves the app as main does, over HTTP/1.1 and h2c, without
+// faults.
+func startApp(t *testing.T) string {
+	t.Helper()
+	srv := httptest.NewServer(newHandler(&faultInjector{}))
+	t.Cleanup(srv.Close)
+	return srv.Listener.Addr().String()
+}
+
+func inspectOver(t *testing.T, c *http.Client, url string) requestReport {
+	t.Helper()
+	resp, err := c.Get(url)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	var report requestReport
+	if err := json.NewDecoder(resp.Body).Decode(&report); err != nil {
+		t.Fatal(err)
+	}
+	return report
+}
+
+// TestStreamID fails when the reflection in streamID no longer finds the
+// stream in x/net's response writer, which it would do quietly otherwise.
+func TestStreamID(t *testing.T) {
+	addr := startApp(t)
+	priorKnowledge := &http.Client{Transport: &http2.Transport{
+		AllowHTTP: true,
+		DialTLS: func(network, addr string, _ *tls.Config) (net.Conn, error) {
+			return net.Dial(network, addr)
+		},
+	}}
+	// The streams are the client's, so odd, and one after the other.
+	var last uint32
+	for i := 0; i < 2; i++ {
+		report := inspectOver(t, priorKnowledge, "http://"+addr+inspectPath)
+		if report.Proto != "HTTP/2.0" || report.Negotiation != "prior-knowledge" {
+			t.Fatalf("got %s, %s", report.Proto, report.Negotiation)
+		}
+		if report.StreamID == 0 || report.StreamID%2 != 1 || last != 0 && report.StreamID != last+2 {
+			t.Errorf("got stream %d after %d", report.StreamID, last)
+		}
+		last = report.StreamID
+	}
+
+	if report := inspectOver(t, &http.Client{}, "http://"+addr+inspectPath); report.StreamID != 0 {
+		t.Errorf("got stream %d over HTTP/1.1", report.StreamID)
+	}
+}
+
+// offerUpgrade sends a GET for path offering the h2c upgrade, with the extra
+// header lines given, and reads the response. The connection is closed when
+// the test ends.
+func offerUpgrade(t *testing.T, addr, path, header string) (net.Conn, *bufio.Reader, *http.Response) {
+	t.Helper()
+	conn, err := net.Dial("tcp", addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { conn.Close() })
+	conn.SetDeadline(time.Now().Add(5 * time.Second))
+	io.WriteString(conn, "GET "+path+" HTTP/1.1\r\nHost: app\r\nConnection: Upgrade, HTTP2-Settings\r\nUpgrade: h2c\r\nHTTP2-Settings: AAMAAABkAARAAAAAAAIAAAAA\r\n"+header+"\r\n")
+	br := bufio.NewReader(conn)
+	resp, err := http.ReadResponse(br, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return conn, br, resp
+}
+
+// TestUpgradeStream checks that the upgrade request is answered on stream 1,
+// and at all: were it not known for the upgrade stream, inspect would wait
+// for a body that never ends.
+func TestUpgradeStream(t *testing.T) {
+	conn, br, resp := offerUpgrade(t, startApp(t), inspectPath, "")
+	if resp.StatusCode != http.StatusSwitchingProtocols {
+		t.Fatalf("got %s", resp.Status)
+	}
+
+	io.WriteString(conn, http2.ClientPreface)
+	fr := http2.NewFramer(conn, br)
+	fr.WriteSettings()
+	var body bytes.Buffer
+	for {
+		f, err := fr.ReadFrame()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if f, ok := f.(*http2.DataFrame); ok && f.StreamID == 1 {
+			body.Write(f.Data())
+			if f.StreamEnded() {
+				break
+			}
+		}
+	}
+	var report requestReport
+	if err := json.Unmarshal(body.Bytes(), &report); err != nil {
+		t.Fatal(err)
+	}
+	if report.Negotiation != "upgrade" || report.StreamID != 1 {
+		t.Errorf("got %s on stream %d", report.Negotiation, report.StreamID)
+	}
+}
@@ -1,32 +1,89 @@
 package main
 
 import (
+	"flag"
 	"fmt"
+	"net"
 	"net/http"
+	"strings"
+	"time"
 
 	"golang.org/x/net/http2"
 	"golang.org/x/net/http2/h2c"
+
+	"shared/frametap"
+	"shared/grpcecho"
+	"shared/proxyprotocol"
 )
 
 func main() {
+	addr := flag.String("addr", "0.0.0.0:8080", "address to listen on")
+	proxyProtocol := flag.Bool("proxy-protocol", false, "expect a PROXY protocol v2 header on every connection, as Envoy sends with an upstream proxy_protocol transport socket")
+	recordFrames := flag.String("record-frames", "", "append every HTTP/2 frame on upgraded and prior-knowledge connections to this JSONL file")
+	replayFrames := flag.String("replay-frames", "", "instead of serving the app, play the server side of a connection recorded with -record-frames to every client")
+	replayConn := flag.Uint64("replay-conn", 0, "which recorded connection -replay-frames plays, by its conn number; the first by default")
+	fault := flag.String("fault", "", "misbehave on every request offering the upgrade, as the X-Fault header asks for one: "+strings.Join(faultNames, ", "))
+	faultDelay := flag.Duration("fault-delay", 2*time.Second, "how long delayed-settings holds SETTINGS back, unless X-Fault-Delay says")
+	flag.Parse()
+
+	faults, err := newFaults(*fault, *faultDelay)
+	if err != nil {
+		panic(err)
+	}
+
+	server := &http.Server{
+		Addr:    *addr,
+		Handler: newHandler(faults),
+	}
+
+	l, err := net.Listen("tcp", server.Addr)
+	if err != nil {
+		panic(err)
+	}
+	if *proxyProtocol {
+		l = proxyprotocol.NewListener(l)
+	}
+
+	if *replayFrames != "" {
+		events, err := frametap.Load(*replayFrames, *replayConn)
+		if err != nil {
+			panic(err)
+		}
+		fmt.Printf("Replaying connection %d from %s on [%s]...\n", events[0].Conn, *replayFrames, *addr)
+		panic(frametap.Serve(l, events))
+	}
+	if *recordFrames != "" {
+		rec, err := frametap.NewRecorder(*recordFrames)
+		if err != nil {
+			panic(err)
+		}
+		l = frametap.NewListener(l, rec)
+		fmt.Printf("Recording frames to %s\n", *recordFrames)
+	}
+
+	fmt.Printf("Listening [%s]...\n", *addr)
+	err = server.Serve(l)
+	if err != nil {
+		panic(err)
+	}
+}
+
+// newHandler is the app: its endpoints over HTTP/1.1 and h2c, with faults
+// committed around the upgrade and on the streams.
+func newHandler(faults *faultInjector) http.Handler {
 	h2s := &http2.Server{}
 
-	handler := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/", func(w http.ResponseWriter, r *http.Request) {
 		fmt.Printf("Request %+v\n", r)
 		fmt.Printf("Headers %+v\n", r.Header)
 		fmt.Printf("Hello, %v, used tls: %v, proto: %v\n", r.URL.Path, r.TLS != nil, r.Proto)
 		fmt.Print("\n")
 		fmt.Fprintf(w, "Hello, %v, Used TLS: %v", r.URL.Path, r.TLS != nil)
 	})
+	mux.HandleFunc(grpcecho.ServicePrefix, grpcecho.Echo)
+	mux.HandleFunc(inspectPath, inspect)
+	registerStreaming(mux)
 
-	server := &http.Server{
-		Addr:    "0.0.0.0:8080",
-		Handler: h2c.NewHandler(handler, h2s),
-	}
-
-	fmt.Printf("Listening [0.0.0.0:8080]...\n")
-	err := server.ListenAndServe()
-	if err != nil {
-		panic(err)
-	}
+	return withNegotiation(faults.connHandler(h2c.NewHandler(faults.streamHandler(mux), h2s)))
 }
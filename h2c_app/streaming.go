@@ -0,0 +1,231 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Endpoints for exercising flow control end to end. Sizes take k, M and G
+// suffixes (powers of 1024), and intervals are Go durations.
+func registerStreaming(mux *http.ServeMux) {
+	mux.HandleFunc("/download", download)
+	mux.HandleFunc("/slow-write", slowWrite)
+	mux.HandleFunc("/slow-read", slowRead)
+	mux.HandleFunc("/events", events)
+	mux.HandleFunc("/duplex", duplex)
+	mux.HandleFunc("/trailers", trailers)
+}
+
+// download writes size bytes, 10M by default, as fast as the client takes
+// them.
+func download(w http.ResponseWriter, r *http.Request) {
+	size, chunk, _, ok := streamParams(w, r, 10<<20, 32<<10, 0)
+	if !ok {
+		return
+	}
+	w.Header().Set("Content-Type", "application/octet-stream")
+	w.Header().Set("Content-Length", strconv.FormatInt(size, 10))
+	writePattern(w, size, chunk, 0)
+}
+
+// slowWrite writes size bytes, 1M by default, a chunk every interval,
+// flushing each.
+func slowWrite(w http.ResponseWriter, r *http.Request) {
+	size, chunk, interval, ok := streamParams(w, r, 1<<20, 16<<10, 100*time.Millisecond)
+	if !ok {
+		return
+	}
+	w.Header().Set("Content-Type", "application/octet-stream")
+	writePattern(w, size, chunk, interval)
+}
+
+// slowRead reads the request body a chunk every interval, so the client's
+// flow-control window fills up, and then says how it went.
+func slowRead(w http.ResponseWriter, r *http.Request) {
+	_, chunk, interval, ok := streamParams(w, r, 0, 16<<10, 100*time.Millisecond)
+	if !ok {
+		return
+	}
+	start := time.Now()
+	h := sha256.New()
+	var n int64
+	body := requestBody(w, r)
+	buf := make([]byte, chunk)
+	for {
+		m, err := io.ReadFull(body, buf)
+		h.Write(buf[:m])
+		n += int64(m)
+		if err != nil {
+			break
+		}
+		time.Sleep(interval)
+	}
+	fmt.Fprintf(w, "Read %d bytes in %s, sha256 %s\n", n, time.Since(start).Round(time.Millisecond), hex.EncodeToString(h.Sum(nil)))
+}
+
+// events sends count server-sent events, 10 by default, one every interval.
+func events(w http.ResponseWriter, r *http.Request) {
+	_, _, interval, ok := streamParams(w, r, 0, 0, time.Second)
+	if !ok {
+		return
+	}
+	count := 10
+	if c := r.URL.Query().Get("count"); c != "" {
+		var err error
+		if count, err = strconv.Atoi(c); err != nil {
+			http.Error(w, "bad count: "+err.Error(), http.StatusBadRequest)
+			return
+		}
+	}
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+	for i := 1; i <= count; i++ {
+		if i > 1 {
+			select {
+			case <-time.After(interval):
+			case <-r.Context().Done():
+				return
+			}
+		}
+		fmt.Fprintf(w, "id: %d\nevent: tick\ndata: {\"n\":%d,\"time\":%q}\n\n", i, i, time.Now().Format(time.RFC3339Nano))
+		flush(w)
+	}
+}
+
+// duplex streams the request body back as it arrives, flushing after every
+// read, so the response is under way before the request is over. Only
+// HTTP/2 can do that; over HTTP/1.1 the server closes the body once the
+// response starts.
+func duplex(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/octet-stream")
+	w.WriteHeader(http.StatusOK)
+	flush(w)
+	body := requestBody(w, r)
+	buf := make([]byte, 32<<10)
+	for {
+		n, err := body.Read(buf)
+		if n > 0 {
+			if _, werr := w.Write(buf[:n]); werr != nil {
+				return
+			}
+			flush(w)
+		}
+		if err != nil {
+			return
+		}
+	}
+}
+
+// trailers writes size bytes, 64k by default, and then its length and hash
+// as trailers, along with the number of request trailers that came in.
+func trailers(w http.ResponseWriter, r *http.Request) {
+	size, chunk, _, ok := streamParams(w, r, 64<<10, 16<<10, 0)
+	if !ok {
+		return
+	}
+	io.Copy(ioutil.Discard, requestBody(w, r))
+
+	w.Header().Set("Trailer", "X-Body-Length, X-Body-Sha256, X-Request-Trailers")
+	w.Header().Set("Content-Type", "application/octet-stream")
+	// Send the headers first, or a body small enough to be buffered whole
+	// goes out with a Content-Length and the trailers are lost.
+	w.WriteHeader(http.StatusOK)
+	flush(w)
+	h := sha256.New()
+	writePattern(io.MultiWriter(w, h), size, chunk, 0)
+	w.Header().Set("X-Body-Length", strconv.FormatInt(size, 10))
+	w.Header().Set("X-Body-Sha256", hex.EncodeToString(h.Sum(nil)))
+	w.Header().Set("X-Request-Trailers", strconv.Itoa(len(r.Trailer)))
+}
+
+// requestBody is r's body, or an empty one on the upgraded stream 1, where
+// reading would wait forever.
+func requestBody(w http.ResponseWriter, r *http.Request) io.Reader {
+	if isUpgradeStream(w, r) {
+		return http.NoBody
+	}
+	return r.Body
+}
+
+// streamParams reads the size, chunk and interval query parameters, with
+// defaults, and answers 400 if one is bad.
+func streamParams(w http.ResponseWriter, r *http.Request, size, chunk int64, interval time.Duration) (int64, int64, time.Duration, bool) {
+	q := r.URL.Query()
+	var err error
+	if v := q.Get("size"); v != "" {
+		if size, err = parseSize(v); err != nil {
+			http.Error(w, "bad size: "+err.Error(), http.StatusBadRequest)
+			return 0, 0, 0, false
+		}
+	}
+	if v := q.Get("chunk"); v != "" {
+		if chunk, err = parseSize(v); err != nil || chunk < 1 {
+			http.Error(w, fmt.Sprintf("bad chunk %q", v), http.StatusBadRequest)
+			return 0, 0, 0, false
+		}
+	}
+	if v := q.Get("interval"); v != "" {
+		if interval, err = time.ParseDuration(v); err != nil {
+			http.Error(w, "bad interval: "+err.Error(), http.StatusBadRequest)
+			return 0, 0, 0, false
+		}
+	}
+	return size, chunk, interval, true
+}
+
+// parseSize reads a byte count such as 512, 64k or 10M.
+func parseSize(s string) (int64, error) {
+	shift := uint(0)
+	switch strings.ToUpper(s[len(s)-1:]) {
+	case "K":
+		shift = 10
+	case "M":
+		shift = 20
+	case "G":
+		shift = 30
+	}
+	if shift > 0 {
+		s = s[:len(s)-1]
+	}
+	n, err := strconv.ParseInt(s, 10, 64)
+	if err != nil || n < 0 {
+		return 0, fmt.Errorf("%q is not a size", s)
+	}
+	return n << shift, nil
+}
+
+// writePattern writes size bytes of a repeating pattern in chunks, flushing
+// and sleeping for interval after each when interval is set.
+func writePattern(w io.Writer, size, chunk int64, interval time.Duration) {
+	buf := make([]byte, chunk)
+	for i := range buf {
+		buf[i] = "0123456789abcdef"[i%16]
+	}
+	for size > 0 {
+		n := chunk
+		if size < n {
+			n = size
+		}
+		if _, err := w.Write(buf[:n]); err != nil {
+			return
+		}
+		size -= n
+		if interval > 0 {
+			flush(w)
+			time.Sleep(interval)
+		}
+	}
+}
+
+func flush(w io.Writer) {
+	if f, ok := w.(http.Flusher); ok {
+		f.Flush()
+	}
+}
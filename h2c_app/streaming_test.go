@@ -0,0 +1,172 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"golang.org/x/net/http2"
+)
+
+// flushRecorder records how much of the body had been written at each flush.
+type flushRecorder struct {
+	*httptest.ResponseRecorder
+	flushes []int
+}
+
+func (r *flushRecorder) Flush() {
+	r.flushes = append(r.flushes, r.Body.Len())
+	r.ResponseRecorder.Flush()
+}
+
+func serve(h http.HandlerFunc, req *http.Request) *flushRecorder {
+	rec := &flushRecorder{ResponseRecorder: httptest.NewRecorder()}
+	h(rec, req)
+	return rec
+}
+
+func TestSlowWriteFlushesEachChunk(t *testing.T) {
+	rec := serve(slowWrite, httptest.NewRequest("GET", "/slow-write?size=10k&chunk=4k&interval=1ms", nil))
+	if got, want := fmt.Sprint(rec.flushes), "[4096 8192 10240]"; got != want {
+		t.Errorf("flushed at %s, want %s", got, want)
+	}
+	body := rec.Body.Bytes()
+	if len(body) != 10<<10 {
+		t.Fatalf("got %d bytes", len(body))
+	}
+	for i, b := range body {
+		if b != "0123456789abcdef"[i%16] {
+			t.Fatalf("byte %d is %q", i, b)
+		}
+	}
+
+	// Without an interval the body goes as fast as it can, unflushed.
+	rec = serve(download, httptest.NewRequest("GET", "/download?size=10k&chunk=4k", nil))
+	if rec.flushes != nil || rec.Header().Get("Content-Length") != "10240" || rec.Body.Len() != 10<<10 {
+		t.Errorf("flushed at %v, Content-Length %q, %d bytes", rec.flushes, rec.Header().Get("Content-Length"), rec.Body.Len())
+	}
+}
+
+func TestEventsFlushesEachEvent(t *testing.T) {
+	rec := serve(events, httptest.NewRequest("GET", "/events?count=3&interval=1ms", nil))
+	if rec.Header().Get("Content-Type") != "text/event-stream" {
+		t.Errorf("Content-Type %q", rec.Header().Get("Content-Type"))
+	}
+	if len(rec.flushes) != 3 {
+		t.Fatalf("flushed %d times, want once per event", len(rec.flushes))
+	}
+	body := rec.Body.String()
+	for i, n := range rec.flushes {
+		// Each flush ends the event it sends.
+		sent := body[:n]
+		if !strings.HasSuffix(sent, "\n\n") || strings.Count(sent, "\nevent: tick\n") != i+1 {
+			t.Errorf("flush %d sent %q", i+1, sent)
+		}
+		if !strings.Contains(sent, "id: "+strconv.Itoa(i+1)+"\n") {
+			t.Errorf("flush %d has no id %d", i+1, i+1)
+		}
+	}
+
+	// A client that goes away stops the stream.
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	rec = serve(events, httptest.NewRequest("GET", "/events?count=3&interval=1h", nil).WithContext(ctx))
+	if len(rec.flushes) != 1 {
+		t.Errorf("flushed %d times after the client went away, want 1", len(rec.flushes))
+	}
+}
+
+// TestSlowWriteChunks reads the chunks of /slow-write off an HTTP/1.1
+// connection: one per write, each sent as it is written rather than all at
+// the end.
+func TestSlowWriteChunks(t *testing.T) {
+	const interval = 100 * time.Millisecond
+	conn, err := net.Dial("tcp", startApp(t))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(5 * time.Second))
+	fmt.Fprintf(conn, "GET /slow-write?size=10k&chunk=4k&interval=%s HTTP/1.1\r\nHost: app\r\n\r\n", interval)
+	br := bufio.NewReader(conn)
+	resp, err := http.ReadResponse(br, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(resp.TransferEncoding) != 1 || resp.TransferEncoding[0] != "chunked" {
+		t.Fatalf("got Transfer-Encoding %q", resp.TransferEncoding)
+	}
+
+	// The body is read raw, leaving resp.Body alone.
+	var sizes []int64
+	var arrived []time.Time
+	for {
+		line, err := br.ReadString('\n')
+		if err != nil {
+			t.Fatal(err)
+		}
+		size, err := strconv.ParseInt(strings.TrimSpace(line), 16, 64)
+		if err != nil {
+			t.Fatalf("chunk size %q: %s", line, err)
+		}
+		if size == 0 {
+			break
+		}
+		if _, err := io.CopyN(ioutil.Discard, br, size+2); err != nil {
+			t.Fatal(err)
+		}
+		sizes = append(sizes, size)
+		arrived = append(arrived, time.Now())
+	}
+	if got, want := fmt.Sprint(sizes), "[4096 4096 2048]"; got != want {
+		t.Fatalf("got chunks of %s, want %s", got, want)
+	}
+	if spread := arrived[2].Sub(arrived[0]); spread < 3*interval/2 {
+		t.Errorf("the chunks came within %s of each other, want them %s apart", spread, interval)
+	}
+}
+
+// TestEventsOverH2C reads /events off the upgraded stream: a DATA frame per
+// event.
+func TestEventsOverH2C(t *testing.T) {
+	conn, br, resp := offerUpgrade(t, startApp(t), "/events?count=3&interval=50ms", "")
+	if resp.StatusCode != http.StatusSwitchingProtocols {
+		t.Fatalf("got %s, want 101", resp.Status)
+	}
+	fr := startH2(t, conn, br)
+	var frames [][]byte
+	for {
+		f, err := fr.ReadFrame()
+		if err != nil {
+			t.Fatal(err)
+		}
+		d, ok := f.(*http2.DataFrame)
+		if !ok || d.StreamID != 1 {
+			continue
+		}
+		if len(d.Data()) > 0 {
+			frames = append(frames, append([]byte(nil), d.Data()...))
+		}
+		if d.StreamEnded() {
+			break
+		}
+	}
+	if len(frames) != 3 {
+		t.Fatalf("got %d DATA frames, want one per event: %q", len(frames), frames)
+	}
+	for i, data := range frames {
+		if !bytes.HasPrefix(data, []byte("id: "+strconv.Itoa(i+1)+"\n")) || !bytes.HasSuffix(data, []byte("\n\n")) {
+			t.Errorf("frame %d is %q, want event %d", i+1, data, i+1)
+		}
+	}
+}
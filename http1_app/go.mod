@@ -1,3 +1,7 @@
 module http1-app
 
 go 1.16
+
+require shared v0.0.0-00010101000000-000000000000
+
+replace shared => ../shared
@@ -1,17 +1,35 @@
 package main
 
 import (
+	"flag"
 	"fmt"
+	"net"
 	"net/http"
+
+	"shared/proxyprotocol"
+	"shared/websocket"
 )
 
 func main() {
+	addr := flag.String("addr", "0.0.0.0:8080", "address to listen on")
+	proxyProtocol := flag.Bool("proxy-protocol", false, "expect a PROXY protocol v2 header on every connection, as Envoy sends with an upstream proxy_protocol transport socket")
+	flag.Parse()
+
 	http.HandleFunc("/", func(w http.ResponseWriter, r *http.Request) {
 		fmt.Fprintf(w, "Hello, %v, HTTP Version: %v", r.URL.Path, r.Proto)
 	})
+	http.HandleFunc("/ws", websocket.Echo)
+
+	l, err := net.Listen("tcp", *addr)
+	if err != nil {
+		panic(err)
+	}
+	if *proxyProtocol {
+		l = proxyprotocol.NewListener(l)
+	}
 
-	fmt.Printf("Listening [0.0.0.0:8080]...\n")
-	err := http.ListenAndServe(":8080", nil)
+	fmt.Printf("Listening [%s]...\n", *addr)
+	err = http.Serve(l, nil)
 	if err != nil {
 		panic(err)
 	}
@@ -0,0 +1,419 @@
+// Package frametap records every HTTP/2 frame on a connection that gets to
+// HTTP/2 without ALPN, as JSON lines, and plays the server's side of a
+// recording back. The h2c app taps the connections it accepts, and the client
+// and the reverse proxy the ones they open to Envoy.
+package frametap
+
+import (
+	"bytes"
+	"encoding/binary"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"golang.org/x/net/http2/hpack"
+)
+
+// Event is one line of a frame recording: an HTTP/1.1 head, the client
+// preface or a frame, as one side of a connection sent it. Raw is exactly
+// what went over the wire, so a recording can be replayed byte for byte; the
+// other fields decode it for people reading the file.
+type Event struct {
+	Conn      uint64            `json:"conn"`
+	Seq       int               `json:"seq"`
+	ElapsedMS float64           `json:"elapsed_ms"`
+	From      string            `json:"from"` // FromClient or FromServer
+	Kind      string            `json:"kind"` // "http1", "preface" or "frame"
+	Head      string            `json:"head,omitempty"`
+	Type      string            `json:"type,omitempty"`
+	Flags     []string          `json:"flags,omitempty"`
+	StreamID  uint32            `json:"stream_id"`
+	Length    int               `json:"length"`
+	Headers   []HeaderField     `json:"headers,omitempty"`
+	Settings  map[string]uint32 `json:"settings,omitempty"`
+	ErrCode   string            `json:"error_code,omitempty"`
+	Increment uint32            `json:"increment,omitempty"`
+	Error     string            `json:"error,omitempty"`
+	Raw       []byte            `json:"raw"`
+}
+
+type HeaderField struct {
+	Name  string `json:"name"`
+	Value string `json:"value"`
+}
+
+const (
+	FromClient = "client"
+	FromServer = "server"
+)
+
+// clientPreface is what an HTTP/2 client sends first, upgraded or not.
+const clientPreface = "PRI * HTTP/2.0\r\n\r\nSM\r\n\r\n"
+
+// Recorder writes the events of every tapped connection to one JSONL file, a
+// line each.
+type Recorder struct {
+	mu       sync.Mutex
+	enc      *json.Encoder
+	nextConn uint64
+}
+
+// NewRecorder appends to the file at path, creating it if need be.
+func NewRecorder(path string) (*Recorder, error) {
+	f, err := os.OpenFile(path, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0644)
+	if err != nil {
+		return nil, err
+	}
+	return &Recorder{enc: json.NewEncoder(f)}, nil
+}
+
+func (r *Recorder) record(ev *Event) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if err := r.enc.Encode(ev); err != nil {
+		log.Printf("Recording frame: %s", err)
+	}
+}
+
+// NewTap starts recording a new connection, from the server's end of it or
+// the client's. The connection feeds it what it reads and writes.
+func (r *Recorder) NewTap(server bool) *Tap {
+	r.mu.Lock()
+	r.nextConn++
+	id := r.nextConn
+	r.mu.Unlock()
+	t := &Tap{rec: r, id: id, start: time.Now()}
+	t.client = &tapStream{tap: t, from: FromClient, state: tapHead}
+	t.server = &tapStream{tap: t, from: FromServer, state: tapWaiting}
+	t.in, t.out = t.server, t.client
+	if server {
+		t.in, t.out = t.client, t.server
+	}
+	return t
+}
+
+// Server taps a connection a server accepted.
+func (r *Recorder) Server(conn net.Conn) net.Conn {
+	return &Conn{Conn: conn, tap: r.NewTap(true)}
+}
+
+// Client taps a connection a client opened. Hand it to an HTTP/2 client as
+// it is: it must be the connection the frames are written to.
+func (r *Recorder) Client(conn net.Conn) net.Conn {
+	return &Conn{Conn: conn, tap: r.NewTap(false)}
+}
+
+// Listener taps every connection it accepts.
+type Listener struct {
+	net.Listener
+	rec *Recorder
+}
+
+func NewListener(l net.Listener, rec *Recorder) *Listener {
+	return &Listener{Listener: l, rec: rec}
+}
+
+func (l *Listener) Accept() (net.Conn, error) {
+	conn, err := l.Listener.Accept()
+	if err != nil {
+		return nil, err
+	}
+	return l.rec.Server(conn), nil
+}
+
+// Conn is a tapped connection.
+type Conn struct {
+	net.Conn
+	tap *Tap
+}
+
+func (c *Conn) Read(p []byte) (int, error) {
+	n, err := c.Conn.Read(p)
+	c.tap.Received(p[:n])
+	return n, err
+}
+
+func (c *Conn) Write(p []byte) (int, error) {
+	n, err := c.Conn.Write(p)
+	c.tap.Sent(p[:n])
+	return n, err
+}
+
+// Tap parses the bytes read from and written to one connection as they
+// pass. The parsing happens inline, under one lock, so events are recorded
+// in the order this end of the connection saw them.
+//
+// Only connections that get to HTTP/2 are recorded: from the upgrade request,
+// or from the prior-knowledge preface, on. Any other HTTP/1.1 connection is
+// let through untouched once its first request shows it won't upgrade.
+type Tap struct {
+	rec   *Recorder
+	id    uint64
+	start time.Time
+
+	mu             sync.Mutex
+	seq            int
+	client, server *tapStream
+	in, out        *tapStream // what this end reads and writes
+}
+
+// Received is told what this end of the connection read.
+func (t *Tap) Received(p []byte) {
+	t.feed(t.in, p)
+}
+
+// Sent is told what this end of the connection wrote.
+func (t *Tap) Sent(p []byte) {
+	t.feed(t.out, p)
+}
+
+func (t *Tap) feed(s *tapStream, p []byte) {
+	if len(p) == 0 {
+		return
+	}
+	t.mu.Lock()
+	s.feed(p)
+	t.mu.Unlock()
+}
+
+// emit numbers ev and records it. Called with mu held.
+func (t *Tap) emit(ev *Event) {
+	t.seq++
+	ev.Conn = t.id
+	ev.Seq = t.seq
+	ev.ElapsedMS = float64(time.Since(t.start).Microseconds()) / 1000
+	t.rec.record(ev)
+}
+
+// stop turns recording off for the rest of the connection.
+func (t *Tap) stop() {
+	t.client.state = tapOff
+	t.server.state = tapOff
+}
+
+type tapState int
+
+const (
+	tapWaiting tapState = iota // the server says nothing until the client has
+	tapHead                    // an HTTP/1.1 head or the preface
+	tapBody                    // the upgrade request's body
+	tapFrames
+	tapOff
+)
+
+// tapStream is one direction of a tapped connection.
+type tapStream struct {
+	tap      *Tap
+	from     string
+	state    tapState
+	buf      []byte
+	bodyLeft int
+	dec      *hpack.Decoder
+	fields   []HeaderField
+}
+
+func (s *tapStream) feed(p []byte) {
+	if s.state == tapOff || s.state == tapWaiting {
+		return
+	}
+	s.buf = append(s.buf, p...)
+	for s.state != tapOff && s.next() {
+	}
+	if s.state == tapOff {
+		s.buf = nil
+	}
+}
+
+// next takes one event off the front of buf, and reports whether it did.
+func (s *tapStream) next() bool {
+	switch s.state {
+	case tapHead:
+		if s.from == FromClient && bytes.HasPrefix(s.buf, []byte(clientPreface)) {
+			s.take(len(clientPreface), &Event{Kind: "preface"})
+			s.startFrames()
+			s.tap.server.startFrames()
+			return true
+		}
+		if s.from == FromClient && len(s.buf) < len(clientPreface) && bytes.HasPrefix([]byte(clientPreface), s.buf) {
+			return false
+		}
+		end := bytes.Index(s.buf, []byte("\r\n\r\n"))
+		if end < 0 {
+			return false
+		}
+		end += 4
+		head := string(s.buf[:end])
+		if s.from == FromClient {
+			return s.requestHead(head)
+		}
+		return s.responseHead(head)
+	case tapBody:
+		n := minInt(s.bodyLeft, len(s.buf))
+		s.buf = s.buf[n:]
+		s.bodyLeft -= n
+		if s.bodyLeft == 0 {
+			s.state = tapHead
+		}
+		return n > 0
+	case tapFrames:
+		return s.frame()
+	}
+	return false
+}
+
+// requestHead records an upgrade request, or gives up on a connection that
+// isn't one. The preface comes after it, once the server has said 101.
+func (s *tapStream) requestHead(head string) bool {
+	upgrade := headValue(head, "Upgrade")
+	if !strings.EqualFold(upgrade, "h2c") || headValue(head, "Transfer-Encoding") != "" {
+		s.tap.stop()
+		return false
+	}
+	s.take(len(head), &Event{Kind: "http1", Head: head})
+	s.tap.server.state = tapHead
+	if n, _ := strconv.Atoi(headValue(head, "Content-Length")); n > 0 {
+		s.bodyLeft = n
+		s.state = tapBody
+	}
+	return true
+}
+
+// responseHead records the answer to the upgrade request. Anything but a 101
+// means the connection stays on HTTP/1.1.
+func (s *tapStream) responseHead(head string) bool {
+	if !strings.HasPrefix(head, "HTTP/1.1 101") {
+		s.tap.stop()
+		return false
+	}
+	s.take(len(head), &Event{Kind: "http1", Head: head})
+	s.startFrames()
+	return true
+}
+
+func (s *tapStream) startFrames() {
+	s.state = tapFrames
+	s.dec = hpack.NewDecoder(4096, func(f hpack.HeaderField) {
+		s.fields = append(s.fields, HeaderField{Name: f.Name, Value: f.Value})
+	})
+}
+
+// frame records one frame, decoding what is worth reading.
+func (s *tapStream) frame() bool {
+	if len(s.buf) < 9 {
+		return false
+	}
+	length := int(s.buf[0])<<16 | int(s.buf[1])<<8 | int(s.buf[2])
+	if len(s.buf) < 9+length {
+		return false
+	}
+	typ, flags := s.buf[3], s.buf[4]
+	ev := &Event{
+		Kind:     "frame",
+		Type:     frameTypeName(typ),
+		Flags:    flagNames(typ, flags),
+		StreamID: binary.BigEndian.Uint32(s.buf[5:9]) & (1<<31 - 1),
+		Length:   length,
+	}
+	payload := s.buf[9 : 9+length]
+
+	switch typ {
+	case frameHeaders, frameContinuation, framePushPromise:
+		if fragment, err := headerBlockFragment(typ, flags, payload); err != nil {
+			ev.Error = err.Error()
+		} else if err := s.decodeHeaders(fragment, flags&flagEndHeaders != 0); err != nil {
+			ev.Error = err.Error()
+		}
+		ev.Headers = s.fields
+		s.fields = nil
+	case frameSettings:
+		if flags&flagAck == 0 {
+			ev.Settings = map[string]uint32{}
+			for p := payload; len(p) >= 6; p = p[6:] {
+				ev.Settings[settingName(binary.BigEndian.Uint16(p))] = binary.BigEndian.Uint32(p[2:])
+			}
+		}
+	case frameRSTStream:
+		if len(payload) >= 4 {
+			ev.ErrCode = errCodeName(binary.BigEndian.Uint32(payload))
+		}
+	case frameGoAway:
+		if len(payload) >= 8 {
+			ev.ErrCode = errCodeName(binary.BigEndian.Uint32(payload[4:]))
+		}
+	case frameWindowUpdate:
+		if len(payload) >= 4 {
+			ev.Increment = binary.BigEndian.Uint32(payload) & (1<<31 - 1)
+		}
+	}
+	s.take(9+length, ev)
+	return true
+}
+
+func (s *tapStream) decodeHeaders(fragment []byte, end bool) error {
+	if _, err := s.dec.Write(fragment); err != nil {
+		return err
+	}
+	if end {
+		return s.dec.Close()
+	}
+	return nil
+}
+
+// take records the first n bytes of buf as ev.
+func (s *tapStream) take(n int, ev *Event) {
+	ev.From = s.from
+	ev.Raw = append([]byte(nil), s.buf[:n]...)
+	s.buf = s.buf[n:]
+	s.tap.emit(ev)
+}
+
+// headerBlockFragment is the HPACK in a HEADERS, CONTINUATION or PUSH_PROMISE
+// payload, without the padding and priority or promised stream around it.
+func headerBlockFragment(typ, flags byte, payload []byte) ([]byte, error) {
+	if typ == frameContinuation {
+		return payload, nil
+	}
+	pad := 0
+	if flags&flagPadded != 0 {
+		if len(payload) < 1 {
+			return nil, fmt.Errorf("padded %s frame too short", frameTypeName(typ))
+		}
+		pad = int(payload[0])
+		payload = payload[1:]
+	}
+	skip := 0
+	if typ == frameHeaders && flags&flagPriority != 0 {
+		skip = 5
+	}
+	if typ == framePushPromise {
+		skip = 4
+	}
+	if len(payload) < skip+pad {
+		return nil, fmt.Errorf("%s frame too short", frameTypeName(typ))
+	}
+	return payload[skip : len(payload)-pad], nil
+}
+
+// headValue is the value of the named header in an HTTP/1.1 head.
+func headValue(head, name string) string {
+	for _, line := range strings.Split(head, "\r\n")[1:] {
+		i := strings.IndexByte(line, ':')
+		if i > 0 && strings.EqualFold(strings.TrimSpace(line[:i]), name) {
+			return strings.TrimSpace(line[i+1:])
+		}
+	}
+	return ""
+}
+
+func minInt(a, b int) int {
+	if a < b {
+		return a
+	}
+	return b
+}
@@ -0,0 +1,193 @@
+package frametap
+
+import (
+	"bytes"
+	"encoding/binary"
+	"io"
+	"io/ioutil"
+	"net"
+	"path/filepath"
+	"reflect"
+	"testing"
+	"time"
+
+	"golang.org/x/net/http2/hpack"
+)
+
+func frame(typ, flags byte, stream uint32, payload []byte) []byte {
+	b := []byte{byte(len(payload) >> 16), byte(len(payload) >> 8), byte(len(payload)), typ, flags, 0, 0, 0, 0}
+	binary.BigEndian.PutUint32(b[5:], stream)
+	return append(b, payload...)
+}
+
+func headerBlock(fields ...string) []byte {
+	var b bytes.Buffer
+	enc := hpack.NewEncoder(&b)
+	for i := 0; i < len(fields); i += 2 {
+		enc.WriteField(hpack.HeaderField{Name: fields[i], Value: fields[i+1]})
+	}
+	return b.Bytes()
+}
+
+const upgradeRequest = "GET / HTTP/1.1\r\nHost: example.com\r\nConnection: Upgrade, HTTP2-Settings\r\nUpgrade: h2c\r\nHTTP2-Settings: AAMAAABkAARAAAAAAAIAAAAA\r\n\r\n"
+const switching = "HTTP/1.1 101 Switching Protocols\r\nConnection: Upgrade\r\nUpgrade: h2c\r\n\r\n"
+
+// upgrade is both sides of an h2c upgrade, in the order they go over the
+// wire. The server's frames are split across writes to check that the tap
+// puts them back together.
+var upgrade = []struct {
+	from string
+	b    []byte
+}{
+	{FromClient, []byte(upgradeRequest)},
+	{FromServer, []byte(switching)},
+	{FromServer, frame(frameSettings, 0, 0, []byte{0, 3, 0, 0, 0, 250})},
+	{FromClient, []byte(clientPreface)},
+	{FromClient, frame(frameSettings, 0, 0, nil)},
+	{FromServer, frame(frameHeaders, flagEndHeaders, 1, headerBlock(":status", "200", "content-type", "text/plain"))[:5]},
+	{FromServer, frame(frameHeaders, flagEndHeaders, 1, headerBlock(":status", "200", "content-type", "text/plain"))[5:]},
+	{FromServer, frame(frameData, flagEndStream, 1, []byte("hello"))},
+	{FromClient, frame(frameGoAway, 0, 0, []byte{0, 0, 0, 0, 0, 0, 0, 0})},
+}
+
+// tapped has the client and the server say upgrade to each other over a
+// pipe, each end tapped and recording to a file of its own, and returns the
+// two recordings.
+func tapped(t *testing.T) (client, server []Event) {
+	dir := t.TempDir()
+	clientRec, err := NewRecorder(filepath.Join(dir, "client.jsonl"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	serverRec, err := NewRecorder(filepath.Join(dir, "server.jsonl"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	c, s := net.Pipe()
+	ends := map[string]net.Conn{FromClient: clientRec.Client(c), FromServer: serverRec.Server(s)}
+	peers := map[string]net.Conn{FromClient: ends[FromServer], FromServer: ends[FromClient]}
+	for _, w := range upgrade {
+		// Each write is seen through by both taps before the next, as a
+		// pipe's Write only returns once the other end has read it all.
+		written := make(chan struct{})
+		go func(conn net.Conn, b []byte) {
+			conn.Write(b)
+			close(written)
+		}(ends[w.from], w.b)
+		if _, err := io.ReadFull(peers[w.from], make([]byte, len(w.b))); err != nil {
+			t.Fatal(err)
+		}
+		<-written
+	}
+	c.Close()
+	s.Close()
+
+	if client, err = Load(filepath.Join(dir, "client.jsonl"), 0); err != nil {
+		t.Fatal(err)
+	}
+	if server, err = Load(filepath.Join(dir, "server.jsonl"), 0); err != nil {
+		t.Fatal(err)
+	}
+	return client, server
+}
+
+func TestTap(t *testing.T) {
+	client, server := tapped(t)
+	if !reflect.DeepEqual(client, server) {
+		// Only the timings may differ, and they are rounded to the millisecond.
+		for i := range client {
+			client[i].ElapsedMS, server[i].ElapsedMS = 0, 0
+		}
+		if !reflect.DeepEqual(client, server) {
+			t.Errorf("the client's recording\n%+v\ndiffers from the server's\n%+v", client, server)
+		}
+	}
+
+	type summary struct {
+		From, Kind, Type string
+		Flags            []string
+		StreamID         uint32
+	}
+	var got []summary
+	for _, ev := range server {
+		got = append(got, summary{ev.From, ev.Kind, ev.Type, ev.Flags, ev.StreamID})
+	}
+	want := []summary{
+		{FromClient, "http1", "", nil, 0},
+		{FromServer, "http1", "", nil, 0},
+		{FromServer, "frame", "SETTINGS", nil, 0},
+		{FromClient, "preface", "", nil, 0},
+		{FromClient, "frame", "SETTINGS", nil, 0},
+		{FromServer, "frame", "HEADERS", []string{"END_HEADERS"}, 1},
+		{FromServer, "frame", "DATA", []string{"END_STREAM"}, 1},
+		{FromClient, "frame", "GOAWAY", nil, 0},
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Fatalf("got\n%+v\nwant\n%+v", got, want)
+	}
+	for i, ev := range server {
+		if ev.Seq != i+1 || ev.Conn != 1 {
+			t.Errorf("event %d is conn %d seq %d", i, ev.Conn, ev.Seq)
+		}
+	}
+
+	if s := server[2].Settings; !reflect.DeepEqual(s, map[string]uint32{"MAX_CONCURRENT_STREAMS": 250}) {
+		t.Errorf("got settings %v", s)
+	}
+	wantHeaders := []HeaderField{{":status", "200"}, {"content-type", "text/plain"}}
+	if h := server[5].Headers; !reflect.DeepEqual(h, wantHeaders) {
+		t.Errorf("got headers %v, want %v", h, wantHeaders)
+	}
+	if server[6].Length != 5 || string(server[6].Raw[9:]) != "hello" {
+		t.Errorf("got DATA of %d bytes, raw %q", server[6].Length, server[6].Raw)
+	}
+	if server[7].ErrCode != "NO_ERROR" {
+		t.Errorf("got GOAWAY with %q", server[7].ErrCode)
+	}
+}
+
+func TestTapIgnoresHTTP1(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "frames.jsonl")
+	rec, err := NewRecorder(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tap := rec.NewTap(true)
+	tap.Received([]byte("GET / HTTP/1.1\r\nHost: example.com\r\n\r\n"))
+	tap.Sent([]byte("HTTP/1.1 200 OK\r\nContent-Length: 0\r\n\r\n"))
+	tap.Received([]byte(clientPreface))
+	if b, _ := ioutil.ReadFile(path); len(b) > 0 {
+		t.Errorf("recorded an HTTP/1.1 connection:\n%s", b)
+	}
+}
+
+func TestReplay(t *testing.T) {
+	_, server := tapped(t)
+	c, s := net.Pipe()
+	defer c.Close()
+	done := make(chan struct{})
+	go func() {
+		Replay(s, server)
+		close(done)
+	}()
+
+	// The client says its part, and gets the server's back byte for byte.
+	c.SetDeadline(time.Now().Add(5 * time.Second))
+	for _, w := range upgrade {
+		if w.from == FromClient {
+			if _, err := c.Write(w.b); err != nil {
+				t.Fatal(err)
+			}
+			continue
+		}
+		got := make([]byte, len(w.b))
+		if _, err := io.ReadFull(c, got); err != nil {
+			t.Fatal(err)
+		}
+		if !bytes.Equal(got, w.b) {
+			t.Errorf("got %q, want %q", got, w.b)
+		}
+	}
+	c.Close()
+	<-done
+}
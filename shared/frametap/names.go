@@ -0,0 +1,89 @@
+package frametap
+
+import "fmt"
+
+// Just enough of RFC 7540 to name what is in a frame, spelt as
+// golang.org/x/net/http2 spells it.
+
+const (
+	frameData         = 0x0
+	frameHeaders      = 0x1
+	frameRSTStream    = 0x3
+	frameSettings     = 0x4
+	framePushPromise  = 0x5
+	framePing         = 0x6
+	frameGoAway       = 0x7
+	frameWindowUpdate = 0x8
+	frameContinuation = 0x9
+
+	flagEndStream  = 0x1
+	flagAck        = 0x1
+	flagEndHeaders = 0x4
+	flagPadded     = 0x8
+	flagPriority   = 0x20
+)
+
+var frameTypeNames = []string{
+	"DATA", "HEADERS", "PRIORITY", "RST_STREAM", "SETTINGS",
+	"PUSH_PROMISE", "PING", "GOAWAY", "WINDOW_UPDATE", "CONTINUATION",
+}
+
+func frameTypeName(typ byte) string {
+	if int(typ) < len(frameTypeNames) {
+		return frameTypeNames[typ]
+	}
+	return fmt.Sprintf("UNKNOWN_FRAME_TYPE_%d", typ)
+}
+
+// flagNames spells out the flags that mean something for typ.
+func flagNames(typ, flags byte) []string {
+	var names []string
+	for _, f := range []struct {
+		types []byte
+		flag  byte
+		name  string
+	}{
+		{[]byte{frameData, frameHeaders}, flagEndStream, "END_STREAM"},
+		{[]byte{frameSettings, framePing}, flagAck, "ACK"},
+		{[]byte{frameHeaders, frameContinuation, framePushPromise}, flagEndHeaders, "END_HEADERS"},
+		{[]byte{frameData, frameHeaders, framePushPromise}, flagPadded, "PADDED"},
+		{[]byte{frameHeaders}, flagPriority, "PRIORITY"},
+	} {
+		for _, t := range f.types {
+			if t == typ && flags&f.flag != 0 {
+				names = append(names, f.name)
+			}
+		}
+	}
+	return names
+}
+
+var settingNames = []string{
+	1: "HEADER_TABLE_SIZE",
+	2: "ENABLE_PUSH",
+	3: "MAX_CONCURRENT_STREAMS",
+	4: "INITIAL_WINDOW_SIZE",
+	5: "MAX_FRAME_SIZE",
+	6: "MAX_HEADER_LIST_SIZE",
+}
+
+func settingName(id uint16) string {
+	if int(id) < len(settingNames) && settingNames[id] != "" {
+		return settingNames[id]
+	}
+	return fmt.Sprintf("UNKNOWN_SETTING_%d", id)
+}
+
+var errCodeNames = []string{
+	"NO_ERROR", "PROTOCOL_ERROR", "INTERNAL_ERROR", "FLOW_CONTROL_ERROR",
+	"SETTINGS_TIMEOUT", "STREAM_CLOSED", "FRAME_SIZE_ERROR", "REFUSED_STREAM",
+	"CANCEL", "COMPRESSION_ERROR", "CONNECT_ERROR", "ENHANCE_YOUR_CALM",
+	"INADEQUATE_SECURITY", "HTTP_1_1_REQUIRED",
+}
+
+func errCodeName(code uint32) string {
+	if int(code) < len(errCodeNames) {
+		return errCodeNames[code]
+	}
+	return fmt.Sprintf("unknown error code 0x%x", code)
+}
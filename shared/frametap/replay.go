@@ -0,0 +1,153 @@
+package frametap
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"net"
+	"os"
+	"strings"
+	"time"
+)
+
+// replayReadTimeout is how long the replayer waits for the client to send
+// what it sent in the recording before giving up on it.
+const replayReadTimeout = 5 * time.Second
+
+// Load reads the events of one connection from a recording. A conn of 0
+// picks the first connection in the file.
+func Load(path string, conn uint64) ([]Event, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	var events []Event
+	dec := json.NewDecoder(f)
+	for {
+		var ev Event
+		if err := dec.Decode(&ev); err == io.EOF {
+			break
+		} else if err != nil {
+			return nil, fmt.Errorf("reading %s: %s", path, err)
+		}
+		if conn == 0 {
+			conn = ev.Conn
+		}
+		if ev.Conn == conn {
+			events = append(events, ev)
+		}
+	}
+	if len(events) == 0 {
+		return nil, fmt.Errorf("no events for connection %d in %s", conn, path)
+	}
+	return events, nil
+}
+
+// Serve plays the server's side of a recording to every connection l
+// accepts.
+func Serve(l net.Listener, events []Event) error {
+	for {
+		conn, err := l.Accept()
+		if err != nil {
+			return err
+		}
+		go Replay(conn, events)
+	}
+}
+
+// Replay plays events to a client. What the server sent is written as it
+// was; what the client sent is waited for, so the server's side stays in
+// step with the client's as it did when it was recorded. Where the client
+// sends something else, the difference is logged and the replay carries on.
+func Replay(conn net.Conn, events []Event) {
+	defer conn.Close()
+	remote := conn.RemoteAddr()
+	log.Printf("Replaying %d events to %s", len(events), remote)
+
+	br := bufio.NewReader(conn)
+	for _, ev := range events {
+		if ev.From == FromServer {
+			if _, err := conn.Write(ev.Raw); err != nil {
+				log.Printf("Replay to %s: event %d: writing: %s", remote, ev.Seq, err)
+				return
+			}
+			continue
+		}
+
+		conn.SetReadDeadline(time.Now().Add(replayReadTimeout))
+		got, err := readLike(br, ev)
+		if err != nil {
+			log.Printf("Replay to %s: event %d: waiting for the client's %s: %s", remote, ev.Seq, describe(ev.Kind, ev.Raw), err)
+			return
+		}
+		if want := describe(ev.Kind, ev.Raw); describe(ev.Kind, got) != want {
+			log.Printf("Replay to %s: event %d: diverged: recorded %s, client sent %s", remote, ev.Seq, want, describe(ev.Kind, got))
+		}
+	}
+
+	// Let the client finish with the connection rather than cut it off.
+	conn.SetReadDeadline(time.Now().Add(replayReadTimeout))
+	io.Copy(ioutil.Discard, br)
+	log.Printf("Replay to %s done", remote)
+}
+
+// readLike reads what the client sends in place of ev: an HTTP/1.1 head and
+// its body, the preface or one frame.
+func readLike(br *bufio.Reader, ev Event) ([]byte, error) {
+	switch ev.Kind {
+	case "preface":
+		b := make([]byte, len(clientPreface))
+		_, err := io.ReadFull(br, b)
+		return b, err
+	case "http1":
+		var head bytes.Buffer
+		for !bytes.HasSuffix(head.Bytes(), []byte("\r\n\r\n")) {
+			line, err := br.ReadSlice('\n')
+			head.Write(line)
+			if err != nil {
+				return head.Bytes(), err
+			}
+		}
+		var n int64
+		fmt.Sscan(headValue(head.String(), "Content-Length"), &n)
+		_, err := io.CopyN(ioutil.Discard, br, n)
+		return head.Bytes(), err
+	default:
+		b := make([]byte, 9)
+		if _, err := io.ReadFull(br, b); err != nil {
+			return nil, err
+		}
+		length := int(b[0])<<16 | int(b[1])<<8 | int(b[2])
+		b = append(b, make([]byte, length)...)
+		_, err := io.ReadFull(br, b[9:])
+		return b, err
+	}
+}
+
+// describe sums up raw for comparing a recording with a replay: the request
+// line of a head, or the type, flags and stream of a frame. Payloads are
+// left out, since the client's may differ without the exchange differing.
+func describe(kind string, raw []byte) string {
+	switch kind {
+	case "preface":
+		return "preface"
+	case "http1":
+		line := string(raw)
+		if i := strings.Index(line, "\r\n"); i >= 0 {
+			line = line[:i]
+		}
+		return fmt.Sprintf("%q", line)
+	default:
+		if len(raw) < 9 {
+			return "a short frame"
+		}
+		return fmt.Sprintf("%s %v on stream %d", frameTypeName(raw[3]), flagNames(raw[3], raw[4]), binary.BigEndian.Uint32(raw[5:9])&(1<<31-1))
+	}
+}
@@ -0,0 +1,5 @@
+module shared
+
+go 1.16
+
+require golang.org/x/net v0.0.0-20210226172049-e18ecbb05110
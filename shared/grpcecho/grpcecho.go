@@ -0,0 +1,154 @@
+// Package grpcecho is a gRPC-style echo service. It speaks the gRPC wire
+// format (length-prefixed messages, grpc-status trailers) without protobuf:
+// message payloads are opaque bytes. That is enough to exercise unary,
+// server-streaming, client-streaming and bidirectional calls through the
+// reverse proxy and Envoy without vendoring grpc-go.
+package grpcecho
+
+import (
+	"bufio"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"strings"
+)
+
+// ServicePrefix is the path of every method of the service.
+const ServicePrefix = "/echo.Echo/"
+
+// gRPC status codes.
+const (
+	StatusOK            = 0
+	StatusInvalidArg    = 3
+	StatusUnimplemented = 12
+	StatusInternal      = 13
+)
+
+// Echo serves the methods under ServicePrefix: Unary, ServerStream,
+// ClientStream and Bidi.
+func Echo(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost || !strings.HasPrefix(r.Header.Get("Content-Type"), "application/grpc") {
+		http.Error(w, "expected a gRPC request", http.StatusUnsupportedMediaType)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/grpc")
+	w.Header().Set("Trailer", "Grpc-Status, Grpc-Message")
+	w.WriteHeader(http.StatusOK)
+	flusher, _ := w.(http.Flusher)
+	send := func(msg []byte) error {
+		if err := WriteMessage(w, msg); err != nil {
+			return err
+		}
+		if flusher != nil {
+			flusher.Flush()
+		}
+		return nil
+	}
+
+	body := bufio.NewReader(r.Body)
+	method := strings.TrimPrefix(r.URL.Path, ServicePrefix)
+	log.Printf("gRPC %v, proto: %v", method, r.Proto)
+
+	var err error
+	switch method {
+	case "Unary":
+		// One message in, the same message out.
+		var msg []byte
+		if msg, err = ReadMessage(body); err == nil {
+			err = send(msg)
+		}
+	case "ServerStream":
+		// One message in, echoed back once per byte of the request message,
+		// each reply tagged with its sequence number.
+		var msg []byte
+		if msg, err = ReadMessage(body); err == nil {
+			for i := 0; i < len(msg) && err == nil; i++ {
+				err = send([]byte(fmt.Sprintf("%d:%s", i, msg)))
+			}
+		}
+	case "ClientStream":
+		// Many messages in, one reply with all of them concatenated.
+		var all []byte
+		for {
+			var msg []byte
+			if msg, err = ReadMessage(body); err != nil {
+				break
+			}
+			all = append(all, msg...)
+		}
+		if err == io.EOF {
+			err = send(all)
+		}
+	case "Bidi":
+		// Each message is echoed as soon as it arrives, while the client is
+		// still sending.
+		for {
+			var msg []byte
+			if msg, err = ReadMessage(body); err != nil {
+				break
+			}
+			if err = send(msg); err != nil {
+				break
+			}
+		}
+		if err == io.EOF {
+			err = nil
+		}
+	default:
+		setStatus(w, StatusUnimplemented, "unknown method "+method)
+		return
+	}
+
+	switch {
+	case err == nil:
+		setStatus(w, StatusOK, "")
+	case err == io.EOF || err == io.ErrUnexpectedEOF:
+		setStatus(w, StatusInvalidArg, "truncated request message")
+	default:
+		setStatus(w, StatusInternal, err.Error())
+	}
+}
+
+func setStatus(w http.ResponseWriter, code int, message string) {
+	w.Header().Set("Grpc-Status", fmt.Sprint(code))
+	w.Header().Set("Grpc-Message", message)
+}
+
+// ReadMessage reads one length-prefixed message: a compression flag byte,
+// a 4 byte big-endian length and the payload. Compressed messages are not
+// supported.
+func ReadMessage(r io.Reader) ([]byte, error) {
+	var prefix [5]byte
+	if _, err := io.ReadFull(r, prefix[:]); err != nil {
+		return nil, err
+	}
+	if prefix[0] != 0 {
+		return nil, fmt.Errorf("compressed messages are not supported")
+	}
+	length := binary.BigEndian.Uint32(prefix[1:])
+	if length > 4<<20 {
+		return nil, fmt.Errorf("message of %d bytes is too large", length)
+	}
+	msg := make([]byte, length)
+	if _, err := io.ReadFull(r, msg); err != nil {
+		if err == io.EOF {
+			err = io.ErrUnexpectedEOF
+		}
+		return nil, err
+	}
+	return msg, nil
+}
+
+// WriteMessage writes msg length-prefixed and uncompressed.
+func WriteMessage(w io.Writer, msg []byte) error {
+	var prefix [5]byte
+	binary.BigEndian.PutUint32(prefix[1:], uint32(len(msg)))
+	if _, err := w.Write(prefix[:]); err != nil {
+		return err
+	}
+	_, err := w.Write(msg)
+	return err
+}
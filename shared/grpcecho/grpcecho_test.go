@@ -0,0 +1,44 @@
+package grpcecho
+
+import (
+	"bytes"
+	"io"
+	"strings"
+	"testing"
+)
+
+func TestMessageRoundTrip(t *testing.T) {
+	var b bytes.Buffer
+	for _, msg := range []string{"", "hello", strings.Repeat("x", 70000)} {
+		if err := WriteMessage(&b, []byte(msg)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	for _, want := range []string{"", "hello", strings.Repeat("x", 70000)} {
+		got, err := ReadMessage(&b)
+		if err != nil || string(got) != want {
+			t.Errorf("got %d bytes, %v, want %d bytes", len(got), err, len(want))
+		}
+	}
+	if _, err := ReadMessage(&b); err != io.EOF {
+		t.Errorf("got %v at the end, want EOF", err)
+	}
+}
+
+func TestReadMessageErrors(t *testing.T) {
+	for _, c := range []struct {
+		name string
+		in   []byte
+		want string
+	}{
+		{"compressed", []byte{1, 0, 0, 0, 1, 'x'}, "compressed messages are not supported"},
+		{"too large", []byte{0, 0x01, 0, 0, 0}, "too large"},
+		{"truncated prefix", []byte{0, 0, 0}, io.ErrUnexpectedEOF.Error()},
+		{"truncated message", []byte{0, 0, 0, 0, 5, 'x'}, io.ErrUnexpectedEOF.Error()},
+	} {
+		_, err := ReadMessage(bytes.NewReader(c.in))
+		if err == nil || !strings.Contains(err.Error(), c.want) {
+			t.Errorf("%s: got %v, want an error with %q", c.name, err, c.want)
+		}
+	}
+}
@@ -0,0 +1,386 @@
+// Package proxyprotocol is PROXY protocol version 2, as described in
+// https://www.haproxy.org/download/2.0/doc/proxy-protocol.txt. The proxy and
+// the client write headers, and the apps and the Envoy stand-in read them.
+package proxyprotocol
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"sync"
+	"time"
+)
+
+// Signature starts every version 2 header.
+var Signature = []byte("\r\n\r\n\x00\r\nQUIT\n")
+
+// TLV types. The SubtypeSSL* ones are nested in a TypeSSL.
+const (
+	TypeALPN      = 0x01
+	TypeAuthority = 0x02
+	TypeUniqueID  = 0x05
+	TypeSSL       = 0x20
+
+	SubtypeSSLVersion = 0x21
+	SubtypeSSLCN      = 0x22
+	SubtypeSSLCipher  = 0x23
+)
+
+// PP2_TYPE_SSL client flags.
+const (
+	ClientSSL      = 0x01
+	ClientCertConn = 0x02
+	ClientCertSess = 0x04
+)
+
+// Header is a PROXY protocol v2 header. A nil Source means a LOCAL header,
+// which a health check sends to say that the connection carries no client's
+// traffic.
+type Header struct {
+	Source      *net.TCPAddr
+	Destination *net.TCPAddr
+	TLVs        []TLV
+}
+
+type TLV struct {
+	Type  byte
+	Value []byte
+}
+
+// SSL is the value of a PP2_TYPE_SSL TLV.
+type SSL struct {
+	Client   byte   // Client* flags
+	Verified bool   // the client certificate was verified
+	Version  string // e.g. "TLSv1.3"
+	CN       string // the client certificate's common name
+	Cipher   string
+}
+
+// Marshal encodes the header. Both addresses must be of the same family.
+func (h *Header) Marshal() ([]byte, error) {
+	var b bytes.Buffer
+	b.Write(Signature)
+
+	var addrs []byte
+	if h.Source == nil {
+		b.WriteByte(0x20) // version 2, LOCAL
+		b.WriteByte(0x00) // AF_UNSPEC
+	} else {
+		src4, dst4 := h.Source.IP.To4(), h.Destination.IP.To4()
+		switch {
+		case src4 != nil && dst4 != nil:
+			b.WriteByte(0x21) // version 2, PROXY
+			b.WriteByte(0x11) // AF_INET, STREAM
+			addrs = append(addrs, src4...)
+			addrs = append(addrs, dst4...)
+		case src4 == nil && dst4 == nil:
+			b.WriteByte(0x21)
+			b.WriteByte(0x21) // AF_INET6, STREAM
+			addrs = append(addrs, h.Source.IP.To16()...)
+			addrs = append(addrs, h.Destination.IP.To16()...)
+		default:
+			return nil, fmt.Errorf("PROXY header: source %s and destination %s are not of the same address family", h.Source, h.Destination)
+		}
+		addrs = appendUint16(addrs, uint16(h.Source.Port))
+		addrs = appendUint16(addrs, uint16(h.Destination.Port))
+	}
+
+	tlvs := marshalTLVs(h.TLVs)
+	length := len(addrs) + len(tlvs)
+	if length > 0xffff {
+		return nil, fmt.Errorf("PROXY header: %d bytes of addresses and TLVs is too long", length)
+	}
+	binary.Write(&b, binary.BigEndian, uint16(length))
+	b.Write(addrs)
+	b.Write(tlvs)
+	return b.Bytes(), nil
+}
+
+func marshalTLVs(tlvs []TLV) []byte {
+	var b []byte
+	for _, tlv := range tlvs {
+		b = append(b, tlv.Type)
+		b = appendUint16(b, uint16(len(tlv.Value)))
+		b = append(b, tlv.Value...)
+	}
+	return b
+}
+
+func appendUint16(b []byte, v uint16) []byte {
+	return append(b, byte(v>>8), byte(v))
+}
+
+func parseTLVs(b []byte) ([]TLV, error) {
+	var tlvs []TLV
+	for len(b) > 0 {
+		if len(b) < 3 {
+			return nil, errors.New("PROXY header: truncated TLV")
+		}
+		n := int(binary.BigEndian.Uint16(b[1:3]))
+		if len(b) < 3+n {
+			return nil, fmt.Errorf("PROXY header: TLV 0x%02x is truncated", b[0])
+		}
+		tlvs = append(tlvs, TLV{Type: b[0], Value: b[3 : 3+n]})
+		b = b[3+n:]
+	}
+	return tlvs, nil
+}
+
+// ReadHeader reads a version 2 header from r. Addresses of families other
+// than IPv4 and IPv6 are skipped, leaving Source nil.
+func ReadHeader(r *bufio.Reader) (*Header, error) {
+	fixed := make([]byte, 16)
+	if _, err := io.ReadFull(r, fixed); err != nil {
+		return nil, fmt.Errorf("reading PROXY header: %s", err)
+	}
+	if !bytes.Equal(fixed[:12], Signature) {
+		return nil, errors.New("not a PROXY protocol v2 header")
+	}
+	if fixed[12]>>4 != 2 {
+		return nil, fmt.Errorf("PROXY header: unsupported version %d", fixed[12]>>4)
+	}
+	command, family := fixed[12]&0x0f, fixed[13]
+	body := make([]byte, binary.BigEndian.Uint16(fixed[14:16]))
+	if _, err := io.ReadFull(r, body); err != nil {
+		return nil, fmt.Errorf("reading PROXY header: %s", err)
+	}
+
+	h := &Header{}
+	if command == 0x0 { // LOCAL
+		return h, nil
+	}
+	if command != 0x1 {
+		return nil, fmt.Errorf("PROXY header: unknown command 0x%x", command)
+	}
+
+	var ipLen int
+	switch family {
+	case 0x11, 0x12: // AF_INET over STREAM or DGRAM
+		ipLen = net.IPv4len
+	case 0x21, 0x22: // AF_INET6
+		ipLen = net.IPv6len
+	default: // AF_UNIX or AF_UNSPEC: the addresses don't fit a TCPAddr
+		return h, nil
+	}
+	if len(body) < 2*ipLen+4 {
+		return nil, errors.New("PROXY header: addresses are truncated")
+	}
+	h.Source = &net.TCPAddr{
+		IP:   net.IP(append([]byte(nil), body[:ipLen]...)),
+		Port: int(binary.BigEndian.Uint16(body[2*ipLen:])),
+	}
+	h.Destination = &net.TCPAddr{
+		IP:   net.IP(append([]byte(nil), body[ipLen:2*ipLen]...)),
+		Port: int(binary.BigEndian.Uint16(body[2*ipLen+2:])),
+	}
+
+	tlvs, err := parseTLVs(body[2*ipLen+4:])
+	if err != nil {
+		return nil, err
+	}
+	h.TLVs = tlvs
+	return h, nil
+}
+
+// TLV returns the value of the first TLV of type typ.
+func (h *Header) TLV(typ byte) ([]byte, bool) {
+	for _, tlv := range h.TLVs {
+		if tlv.Type == typ {
+			return tlv.Value, true
+		}
+	}
+	return nil, false
+}
+
+// TLV encodes s as a PP2_TYPE_SSL TLV.
+func (s SSL) TLV() TLV {
+	v := []byte{s.Client, 0, 0, 0, 1} // client flags, then verify: 0 if verified
+	if s.Verified {
+		v[4] = 0
+	}
+	var subs []TLV
+	if s.Version != "" {
+		subs = append(subs, TLV{Type: SubtypeSSLVersion, Value: []byte(s.Version)})
+	}
+	if s.CN != "" {
+		subs = append(subs, TLV{Type: SubtypeSSLCN, Value: []byte(s.CN)})
+	}
+	if s.Cipher != "" {
+		subs = append(subs, TLV{Type: SubtypeSSLCipher, Value: []byte(s.Cipher)})
+	}
+	return TLV{Type: TypeSSL, Value: append(v, marshalTLVs(subs)...)}
+}
+
+// ParseSSL decodes the value of a PP2_TYPE_SSL TLV.
+func ParseSSL(v []byte) (SSL, error) {
+	if len(v) < 5 {
+		return SSL{}, errors.New("PROXY header: truncated SSL TLV")
+	}
+	s := SSL{Client: v[0], Verified: binary.BigEndian.Uint32(v[1:5]) == 0}
+	subs, err := parseTLVs(v[5:])
+	if err != nil {
+		return SSL{}, err
+	}
+	for _, sub := range subs {
+		switch sub.Type {
+		case SubtypeSSLVersion:
+			s.Version = string(sub.Value)
+		case SubtypeSSLCN:
+			s.CN = string(sub.Value)
+		case SubtypeSSLCipher:
+			s.Cipher = string(sub.Value)
+		}
+	}
+	return s, nil
+}
+
+// String is for logging what a header says.
+func (h *Header) String() string {
+	if h.Source == nil {
+		return "LOCAL"
+	}
+	s := fmt.Sprintf("PROXY %s -> %s", h.Source, h.Destination)
+	if v, ok := h.TLV(TypeAuthority); ok {
+		s += fmt.Sprintf(" authority=%s", v)
+	}
+	if v, ok := h.TLV(TypeALPN); ok {
+		s += fmt.Sprintf(" alpn=%s", v)
+	}
+	if v, ok := h.TLV(TypeSSL); ok {
+		if ssl, err := ParseSSL(v); err == nil {
+			s += fmt.Sprintf(" ssl=%s verified=%v", ssl.Version, ssl.Verified)
+			if ssl.CN != "" {
+				s += fmt.Sprintf(" cn=%q", ssl.CN)
+			}
+		}
+	}
+	return s
+}
+
+// Listener reads a PROXY protocol v2 header from every connection it accepts
+// and reports the header's source as the connection's RemoteAddr. Headers are
+// read in the background, so a client that is slow to send one doesn't hold
+// up the others. Connections without a valid header are closed.
+type Listener struct {
+	net.Listener
+	conns chan net.Conn
+	errs  chan error
+
+	closeOnce sync.Once
+	done      chan struct{} // closed by Close
+}
+
+// HeaderTimeout is how long a client has to send its header.
+const HeaderTimeout = 5 * time.Second
+
+func NewListener(l net.Listener) *Listener {
+	pl := &Listener{Listener: l, conns: make(chan net.Conn), errs: make(chan error), done: make(chan struct{})}
+	go pl.acceptLoop()
+	return pl
+}
+
+func (l *Listener) acceptLoop() {
+	var delay time.Duration // how long to sleep on a temporary accept failure
+	for {
+		conn, err := l.Listener.Accept()
+		if err != nil {
+			// Back off and try again, as net/http's Server does: running
+			// out of file descriptors is no reason to stop serving.
+			if ne, ok := err.(net.Error); ok && ne.Temporary() {
+				if delay == 0 {
+					delay = 5 * time.Millisecond
+				} else {
+					delay *= 2
+				}
+				if max := time.Second; delay > max {
+					delay = max
+				}
+				log.Printf("Accept error: %s; retrying in %s", err, delay)
+				select {
+				case <-time.After(delay):
+					continue
+				case <-l.done:
+					return
+				}
+			}
+			select {
+			case l.errs <- err:
+			case <-l.done:
+			}
+			return
+		}
+		delay = 0
+		go func() {
+			c, err := readConn(conn)
+			if err != nil {
+				log.Printf("Closing connection from %s: %s", conn.RemoteAddr(), err)
+				conn.Close()
+				return
+			}
+			// Nobody calls Accept once the listener is closed.
+			select {
+			case l.conns <- c:
+			case <-l.done:
+				c.Close()
+			}
+		}()
+	}
+}
+
+func (l *Listener) Accept() (net.Conn, error) {
+	select {
+	case c := <-l.conns:
+		return c, nil
+	case err := <-l.errs:
+		return nil, err
+	case <-l.done:
+		return nil, net.ErrClosed
+	}
+}
+
+// Close closes the listener, and any connection that has yet to be accepted.
+func (l *Listener) Close() error {
+	l.closeOnce.Do(func() { close(l.done) })
+	return l.Listener.Close()
+}
+
+func readConn(conn net.Conn) (net.Conn, error) {
+	conn.SetReadDeadline(time.Now().Add(HeaderTimeout))
+	br := bufio.NewReader(conn)
+	h, err := ReadHeader(br)
+	if err != nil {
+		return nil, err
+	}
+	conn.SetReadDeadline(time.Time{})
+	c := &Conn{Conn: conn, r: br, header: h}
+	log.Printf("Accepted %s: %s", conn.RemoteAddr(), h)
+	return c, nil
+}
+
+// Conn is a connection that started with a PROXY header.
+type Conn struct {
+	net.Conn
+	r      *bufio.Reader // holds whatever was read past the header
+	header *Header
+}
+
+// Header is the header the connection started with.
+func (c *Conn) Header() *Header {
+	return c.header
+}
+
+func (c *Conn) Read(p []byte) (int, error) {
+	return c.r.Read(p)
+}
+
+func (c *Conn) RemoteAddr() net.Addr {
+	if c.header.Source != nil {
+		return c.header.Source
+	}
+	return c.Conn.RemoteAddr()
+}
@@ -0,0 +1,279 @@
+package proxyprotocol
+
+import (
+	"bufio"
+	"bytes"
+	"errors"
+	"io"
+	"io/ioutil"
+	"net"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+func roundTrip(t *testing.T, h *Header) *Header {
+	t.Helper()
+	b, err := h.Marshal()
+	if err != nil {
+		t.Fatal(err)
+	}
+	r := bufio.NewReader(io.MultiReader(bytes.NewReader(b), strings.NewReader("GET / HTTP/1.1\r\n")))
+	got, err := ReadHeader(r)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if rest, _ := ioutil.ReadAll(r); string(rest) != "GET / HTTP/1.1\r\n" {
+		t.Errorf("read past the header: %q left", rest)
+	}
+	return got
+}
+
+func TestRoundTripIPv4(t *testing.T) {
+	ssl := SSL{Client: ClientSSL | ClientCertConn, Verified: true, Version: "TLSv1.3", CN: "client", Cipher: "TLS_AES_128_GCM_SHA256"}
+	h := &Header{
+		Source:      &net.TCPAddr{IP: net.IPv4(203, 0, 113, 7), Port: 51234},
+		Destination: &net.TCPAddr{IP: net.IPv4(10, 0, 0, 1), Port: 61001},
+		TLVs: []TLV{
+			{Type: TypeALPN, Value: []byte("h2")},
+			{Type: TypeAuthority, Value: []byte("example.com")},
+			ssl.TLV(),
+		},
+	}
+	got := roundTrip(t, h)
+	if !got.Source.IP.Equal(h.Source.IP) || got.Source.Port != 51234 ||
+		!got.Destination.IP.Equal(h.Destination.IP) || got.Destination.Port != 61001 {
+		t.Errorf("got %s -> %s", got.Source, got.Destination)
+	}
+	if !reflect.DeepEqual(got.TLVs, h.TLVs) {
+		t.Errorf("got TLVs %v, want %v", got.TLVs, h.TLVs)
+	}
+	v, ok := got.TLV(TypeSSL)
+	if !ok {
+		t.Fatal("no SSL TLV")
+	}
+	if gotSSL, err := ParseSSL(v); err != nil || gotSSL != ssl {
+		t.Errorf("got %+v, %v, want %+v", gotSSL, err, ssl)
+	}
+	want := `PROXY 203.0.113.7:51234 -> 10.0.0.1:61001 authority=example.com alpn=h2 ssl=TLSv1.3 verified=true cn="client"`
+	if s := got.String(); s != want {
+		t.Errorf("got %q, want %q", s, want)
+	}
+}
+
+func TestRoundTripIPv6(t *testing.T) {
+	h := &Header{
+		Source:      &net.TCPAddr{IP: net.ParseIP("2001:db8::7"), Port: 443},
+		Destination: &net.TCPAddr{IP: net.ParseIP("::1"), Port: 8080},
+	}
+	b, err := h.Marshal()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if b[13] != 0x21 {
+		t.Errorf("got family 0x%02x, want AF_INET6", b[13])
+	}
+	got := roundTrip(t, h)
+	if got.Source.String() != "[2001:db8::7]:443" || got.Destination.String() != "[::1]:8080" {
+		t.Errorf("got %s -> %s", got.Source, got.Destination)
+	}
+	if got.TLVs != nil {
+		t.Errorf("got TLVs %v", got.TLVs)
+	}
+}
+
+func TestMixedFamilies(t *testing.T) {
+	h := &Header{
+		Source:      &net.TCPAddr{IP: net.ParseIP("2001:db8::7"), Port: 443},
+		Destination: &net.TCPAddr{IP: net.IPv4(10, 0, 0, 1), Port: 8080},
+	}
+	if _, err := h.Marshal(); err == nil {
+		t.Error("marshalled IPv6 to IPv4")
+	}
+}
+
+func TestLocal(t *testing.T) {
+	b, err := (&Header{}).Marshal()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := append(append([]byte(nil), Signature...), 0x20, 0x00, 0, 0); !bytes.Equal(b, want) {
+		t.Errorf("got % x, want % x", b, want)
+	}
+	got := roundTrip(t, &Header{})
+	if got.Source != nil || got.Destination != nil || got.String() != "LOCAL" {
+		t.Errorf("got %+v", got)
+	}
+}
+
+func TestReadHeaderErrors(t *testing.T) {
+	valid, err := (&Header{
+		Source:      &net.TCPAddr{IP: net.IPv4(192, 0, 2, 1), Port: 1},
+		Destination: &net.TCPAddr{IP: net.IPv4(192, 0, 2, 2), Port: 2},
+	}).Marshal()
+	if err != nil {
+		t.Fatal(err)
+	}
+	// withBody replaces what follows the fixed part of valid.
+	withBody := func(body ...byte) []byte {
+		b := append([]byte(nil), valid[:14]...)
+		b = append(b, byte(len(body)>>8), byte(len(body)))
+		return append(b, body...)
+	}
+	addrs := valid[16:]
+
+	for _, c := range []struct {
+		name string
+		in   []byte
+		want string
+	}{
+		{name: "bad signature", in: append([]byte("\r\n\r\n\x00\r\nQUIT!"), valid[12:]...), want: "not a PROXY protocol v2 header"},
+		{name: "version 1", in: []byte("PROXY TCP4 192.0.2.1 192.0.2.2 1 2\r\n"), want: "not a PROXY protocol v2 header"},
+		{name: "short", in: valid[:10], want: "reading PROXY header"},
+		{name: "version 3", in: append(append(append([]byte(nil), valid[:12]...), 0x31), valid[13:]...), want: "unsupported version 3"},
+		{name: "unknown command", in: append(append(append([]byte(nil), valid[:12]...), 0x22), valid[13:]...), want: "unknown command 0x2"},
+		{name: "body shorter than its length", in: valid[:len(valid)-1], want: "reading PROXY header"},
+		{name: "truncated addresses", in: withBody(addrs[:11]...), want: "addresses are truncated"},
+		{name: "truncated TLV header", in: withBody(append(append([]byte(nil), addrs...), TypeALPN, 0)...), want: "truncated TLV"},
+		{name: "truncated TLV value", in: withBody(append(append([]byte(nil), addrs...), TypeALPN, 0, 3, 'h', '2')...), want: "TLV 0x01 is truncated"},
+	} {
+		t.Run(c.name, func(t *testing.T) {
+			_, err := ReadHeader(bufio.NewReader(bytes.NewReader(c.in)))
+			if err == nil || !strings.Contains(err.Error(), c.want) {
+				t.Errorf("got %v, want an error with %q", err, c.want)
+			}
+		})
+	}
+}
+
+func TestParseSSLErrors(t *testing.T) {
+	if _, err := ParseSSL([]byte{ClientSSL, 0, 0, 0}); err == nil {
+		t.Error("parsed a truncated SSL TLV")
+	}
+	if _, err := ParseSSL([]byte{ClientSSL, 0, 0, 0, 0, SubtypeSSLVersion, 0, 5, 'T'}); err == nil {
+		t.Error("parsed a truncated sub-TLV")
+	}
+}
+
+func TestListener(t *testing.T) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	pl := NewListener(l)
+	defer pl.Close()
+
+	// A client that sends no header doesn't hold up the one that does.
+	silent, err := net.Dial("tcp", l.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer silent.Close()
+	conn, err := net.Dial("tcp", l.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	source := &net.TCPAddr{IP: net.IPv4(203, 0, 113, 7), Port: 51234}
+	b, _ := (&Header{Source: source, Destination: conn.RemoteAddr().(*net.TCPAddr)}).Marshal()
+	conn.Write(append(b, "hello"...))
+
+	accepted, err := pl.Accept()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer accepted.Close()
+	if accepted.RemoteAddr().String() != source.String() {
+		t.Errorf("got RemoteAddr %s, want %s", accepted.RemoteAddr(), source)
+	}
+	if h := accepted.(*Conn).Header(); !h.Source.IP.Equal(source.IP) {
+		t.Errorf("got header %s", h)
+	}
+	hello := make([]byte, 5)
+	if _, err := io.ReadFull(accepted, hello); err != nil || string(hello) != "hello" {
+		t.Errorf("got %q, %v", hello, err)
+	}
+}
+
+// flakyListener fails its first Accepts with a temporary error.
+type flakyListener struct {
+	net.Listener
+	failures int
+}
+
+type temporaryError struct{}
+
+func (temporaryError) Error() string   { return "too many open files" }
+func (temporaryError) Timeout() bool   { return false }
+func (temporaryError) Temporary() bool { return true }
+
+func (l *flakyListener) Accept() (net.Conn, error) {
+	if l.failures > 0 {
+		l.failures--
+		return nil, temporaryError{}
+	}
+	return l.Listener.Accept()
+}
+
+func TestListenerRetriesTemporaryErrors(t *testing.T) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	pl := NewListener(&flakyListener{Listener: l, failures: 3})
+	defer pl.Close()
+
+	conn, err := net.Dial("tcp", l.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	b, _ := (&Header{}).Marshal()
+	conn.Write(b)
+
+	accepted := make(chan error, 1)
+	go func() {
+		c, err := pl.Accept()
+		if err == nil {
+			c.Close()
+		}
+		accepted <- err
+	}()
+	select {
+	case err := <-accepted:
+		if err != nil {
+			t.Errorf("got %v, want the connection after the temporary errors", err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Error("the listener stopped accepting after a temporary error")
+	}
+}
+
+func TestListenerClose(t *testing.T) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	pl := NewListener(l)
+
+	// A connection whose header has been read but that nobody accepts is
+	// closed with the listener.
+	conn, err := net.Dial("tcp", l.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	b, _ := (&Header{}).Marshal()
+	conn.Write(b)
+	time.Sleep(50 * time.Millisecond)
+
+	pl.Close()
+	if _, err := pl.Accept(); !errors.Is(err, net.ErrClosed) {
+		t.Errorf("got %v from Accept after Close", err)
+	}
+	conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+	if _, err := conn.Read(make([]byte, 1)); err != io.EOF {
+		t.Errorf("got %v, want the unaccepted connection closed", err)
+	}
+}
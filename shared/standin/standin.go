@@ -0,0 +1,188 @@
+// Package standin is the Envoy stand-in's TCP proxy: listeners that
+// terminate TLS and pass each connection to a static cluster, as Envoy's
+// tcp_proxy filter does, optionally with a PROXY header for the endpoint.
+// The envoy_standin program reads envoy/envoy.yaml into these; tests put
+// them in front of their own backends.
+package standin
+
+import (
+	"crypto/tls"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"shared/proxyprotocol"
+)
+
+// Log levels, named as Envoy's -l takes them.
+const (
+	LevelDebug = iota
+	LevelInfo
+	LevelWarn
+	LevelError
+	LevelOff
+)
+
+// LogLevel is the least severe level that Logf logs.
+var LogLevel = LevelInfo
+
+// Logf logs at level, if LogLevel lets it through.
+func Logf(level int, format string, args ...interface{}) {
+	if level >= LogLevel {
+		log.Printf(format, args...)
+	}
+}
+
+// HandshakeTimeout is how long a client has to finish its TLS handshake, so
+// that one that connects and says nothing doesn't hold a connection forever.
+const HandshakeTimeout = 10 * time.Second
+
+// Cluster is a static cluster of endpoints, picked in turn.
+type Cluster struct {
+	Name           string
+	Endpoints      []string
+	ConnectTimeout time.Duration
+	MaxConnections int64
+	ProxyProtocol  string // "", "V1" or "V2"
+
+	next        uint32
+	connections int64
+}
+
+// dial connects to the next endpoint, unless the cluster is at its
+// MaxConnections, and sends a PROXY header for downstream if the cluster
+// has a ProxyProtocol version.
+func (c *Cluster) dial(downstream net.Conn) (net.Conn, error) {
+	if atomic.AddInt64(&c.connections, 1) > c.MaxConnections {
+		atomic.AddInt64(&c.connections, -1)
+		return nil, fmt.Errorf("cluster %s is at max_connections %d", c.Name, c.MaxConnections)
+	}
+	endpoint := c.Endpoints[int(atomic.AddUint32(&c.next, 1)-1)%len(c.Endpoints)]
+	conn, err := net.DialTimeout("tcp", endpoint, c.ConnectTimeout)
+	if err != nil {
+		atomic.AddInt64(&c.connections, -1)
+		return nil, err
+	}
+	if c.ProxyProtocol != "" {
+		if err := c.writeProxyHeader(conn, downstream); err != nil {
+			conn.Close()
+			atomic.AddInt64(&c.connections, -1)
+			return nil, err
+		}
+	}
+	return &clusterConn{Conn: conn, cluster: c}, nil
+}
+
+// writeProxyHeader describes downstream to the endpoint, giving the
+// addresses from downstream's own PROXY header if it had one.
+func (c *Cluster) writeProxyHeader(conn, downstream net.Conn) error {
+	h := &proxyprotocol.Header{}
+	h.Source, _ = downstream.RemoteAddr().(*net.TCPAddr)
+	h.Destination, _ = downstream.LocalAddr().(*net.TCPAddr)
+	if pc, ok := downstream.(*proxyprotocol.Conn); ok && pc.Header().Destination != nil {
+		h.Destination = pc.Header().Destination
+	}
+	if h.Source == nil || h.Destination == nil {
+		return fmt.Errorf("no TCP addresses for the PROXY header")
+	}
+
+	var b []byte
+	if c.ProxyProtocol == "V1" {
+		family := "TCP4"
+		if h.Source.IP.To4() == nil {
+			family = "TCP6"
+		}
+		b = []byte(fmt.Sprintf("PROXY %s %s %s %d %d\r\n", family, h.Source.IP, h.Destination.IP, h.Source.Port, h.Destination.Port))
+	} else {
+		var err error
+		if b, err = h.Marshal(); err != nil {
+			return err
+		}
+	}
+	_, err := conn.Write(b)
+	return err
+}
+
+// clusterConn gives its slot in the cluster back when it is closed.
+type clusterConn struct {
+	net.Conn
+	cluster *Cluster
+	once    sync.Once
+}
+
+func (c *clusterConn) Close() error {
+	c.once.Do(func() { atomic.AddInt64(&c.cluster.connections, -1) })
+	return c.Conn.Close()
+}
+
+func (c *clusterConn) CloseWrite() error {
+	if cw, ok := c.Conn.(interface{ CloseWrite() error }); ok {
+		return cw.CloseWrite()
+	}
+	return nil
+}
+
+// Listener terminates TLS, if it has a TLSConfig, and proxies each
+// connection it accepts on L to its Cluster. For Envoy's proxy_protocol
+// listener filter, L is a proxyprotocol.Listener.
+type Listener struct {
+	Name      string
+	L         net.Listener
+	TLSConfig *tls.Config
+	Cluster   *Cluster
+}
+
+// Serve accepts connections until L fails, and returns its error.
+func (l *Listener) Serve() error {
+	for {
+		conn, err := l.L.Accept()
+		if err != nil {
+			return err
+		}
+		go l.handle(conn)
+	}
+}
+
+func (l *Listener) handle(conn net.Conn) {
+	defer conn.Close()
+	downstream := conn
+	if l.TLSConfig != nil {
+		tconn := tls.Server(conn, l.TLSConfig)
+		conn.SetDeadline(time.Now().Add(HandshakeTimeout))
+		if err := tconn.Handshake(); err != nil {
+			Logf(LevelDebug, "[%s] %s: TLS handshake: %s", l.Name, conn.RemoteAddr(), err)
+			return
+		}
+		conn.SetDeadline(time.Time{})
+		downstream = tconn
+	}
+
+	upstream, err := l.Cluster.dial(conn)
+	if err != nil {
+		Logf(LevelWarn, "[%s] %s: connecting upstream: %s", l.Name, conn.RemoteAddr(), err)
+		return
+	}
+	defer upstream.Close()
+	Logf(LevelDebug, "[%s] %s -> %s", l.Name, conn.RemoteAddr(), upstream.RemoteAddr())
+
+	// Half-close each way, as Envoy's tcp_proxy does, so that either side
+	// can finish sending and still read the other's reply.
+	var wg sync.WaitGroup
+	var sent, received int64
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		sent, _ = io.Copy(upstream, downstream)
+		upstream.(*clusterConn).CloseWrite()
+	}()
+	received, _ = io.Copy(downstream, upstream)
+	if cw, ok := downstream.(interface{ CloseWrite() error }); ok {
+		cw.CloseWrite()
+	}
+	wg.Wait()
+	Logf(LevelDebug, "[%s] %s closed, %d bytes up, %d down", l.Name, conn.RemoteAddr(), sent, received)
+}
@@ -0,0 +1,98 @@
+package standin
+
+import (
+	"bufio"
+	"io"
+	"io/ioutil"
+	"net"
+	"strconv"
+	"testing"
+	"time"
+)
+
+// startListener proxies cleartext connections to a cluster of endpoints
+// and returns its address.
+func startListener(t *testing.T, cluster *Cluster) string {
+	t.Helper()
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if cluster.MaxConnections == 0 {
+		cluster.MaxConnections = 1024
+	}
+	if cluster.ConnectTimeout == 0 {
+		cluster.ConnectTimeout = time.Second
+	}
+	sl := &Listener{Name: "test", L: l, Cluster: cluster}
+	go sl.Serve()
+	t.Cleanup(func() { l.Close() })
+	return l.Addr().String()
+}
+
+// startEndpoint accepts one connection and hands it to serve.
+func startEndpoint(t *testing.T, serve func(net.Conn)) string {
+	t.Helper()
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { l.Close() })
+	go func() {
+		conn, err := l.Accept()
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+		serve(conn)
+	}()
+	return l.Addr().String()
+}
+
+func TestHalfClose(t *testing.T) {
+	// The endpoint answers once it has read everything.
+	endpoint := startEndpoint(t, func(conn net.Conn) {
+		b, _ := ioutil.ReadAll(conn)
+		conn.Write(append([]byte("got "), b...))
+	})
+	addr := startListener(t, &Cluster{Name: "test", Endpoints: []string{endpoint}})
+
+	conn, err := net.Dial("tcp", addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(5 * time.Second))
+	io.WriteString(conn, "hello")
+	conn.(*net.TCPConn).CloseWrite()
+	b, err := ioutil.ReadAll(conn)
+	if err != nil || string(b) != "got hello" {
+		t.Errorf("got %q, %v", b, err)
+	}
+}
+
+func TestProxyHeaderV1(t *testing.T) {
+	lines := make(chan string, 1)
+	endpoint := startEndpoint(t, func(conn net.Conn) {
+		line, _ := bufio.NewReader(conn).ReadString('\n')
+		lines <- line
+	})
+	addr := startListener(t, &Cluster{Name: "test", Endpoints: []string{endpoint}, ProxyProtocol: "V1"})
+
+	conn, err := net.Dial("tcp", addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	local := conn.LocalAddr().(*net.TCPAddr)
+	_, port, _ := net.SplitHostPort(addr)
+	want := "PROXY TCP4 127.0.0.1 127.0.0.1 " + strconv.Itoa(local.Port) + " " + port + "\r\n"
+	select {
+	case got := <-lines:
+		if got != want {
+			t.Errorf("got %q, want %q", got, want)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("no PROXY header")
+	}
+}
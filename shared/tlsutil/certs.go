@@ -0,0 +1,144 @@
+// Package tlsutil is the TLS plumbing the sneaky client and the reverse proxy
+// share: key pairs reloaded from disk, the check of Envoy's certificate, and
+// the key log for decrypting captures.
+package tlsutil
+
+import (
+	"crypto/tls"
+	"fmt"
+	"log"
+	"os"
+	"os/signal"
+	"sync"
+	"syscall"
+	"time"
+)
+
+// KeyPairReloader serves a certificate and key from disk and picks up new
+// versions of the files without a restart. Certificates are only used during
+// the TLS handshake, so rotation affects new connections while established
+// ones, upgraded or not, carry on with the certificate they started with.
+type KeyPairReloader struct {
+	certPath, keyPath string
+
+	mu      sync.RWMutex
+	cert    *tls.Certificate
+	modTime time.Time
+}
+
+func NewKeyPairReloader(certPath, keyPath string) (*KeyPairReloader, error) {
+	r := &KeyPairReloader{certPath: certPath, keyPath: keyPath}
+	if err := r.reload(); err != nil {
+		return nil, err
+	}
+	return r, nil
+}
+
+func (r *KeyPairReloader) reload() error {
+	modTime, err := r.latestModTime()
+	if err != nil {
+		return err
+	}
+	cert, err := tls.LoadX509KeyPair(r.certPath, r.keyPath)
+	if err != nil {
+		return fmt.Errorf("loading %s and %s: %s", r.certPath, r.keyPath, err)
+	}
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.cert = &cert
+	r.modTime = modTime
+	return nil
+}
+
+// reloadIfChanged reloads the key pair when the latest modification time of
+// its files is not the one it was last loaded with. Any change counts, not
+// only a later time: a pair swapped in with its times kept, from a backup or
+// a copy, can be older. A half-written pair fails to load and is retried on
+// the next call, while the previous certificate stays in use.
+func (r *KeyPairReloader) reloadIfChanged() {
+	modTime, err := r.latestModTime()
+	if err != nil {
+		log.Printf("Checking %s for changes: %s", r.certPath, err)
+		return
+	}
+	r.mu.RLock()
+	changed := !modTime.Equal(r.modTime)
+	r.mu.RUnlock()
+	if !changed {
+		return
+	}
+	if err := r.reload(); err != nil {
+		log.Printf("Reloading certificate: %s", err)
+		return
+	}
+	log.Printf("Reloaded certificate %s", r.certPath)
+}
+
+func (r *KeyPairReloader) latestModTime() (time.Time, error) {
+	var latest time.Time
+	for _, path := range []string{r.certPath, r.keyPath} {
+		info, err := os.Stat(path)
+		if err != nil {
+			return time.Time{}, err
+		}
+		if info.ModTime().After(latest) {
+			latest = info.ModTime()
+		}
+	}
+	return latest, nil
+}
+
+// CertPath is the certificate file the key pair is loaded from.
+func (r *KeyPairReloader) CertPath() string {
+	return r.certPath
+}
+
+// Current is the key pair as last loaded.
+func (r *KeyPairReloader) Current() *tls.Certificate {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	return r.cert
+}
+
+// GetCertificate is for tls.Config on the listener side.
+func (r *KeyPairReloader) GetCertificate(*tls.ClientHelloInfo) (*tls.Certificate, error) {
+	return r.Current(), nil
+}
+
+// GetClientCertificate is for tls.Config on the client side.
+func (r *KeyPairReloader) GetClientCertificate(*tls.CertificateRequestInfo) (*tls.Certificate, error) {
+	return r.Current(), nil
+}
+
+// WatchCertificates reloads the key pairs whenever their files change, polling
+// every interval, and unconditionally on SIGHUP. An interval of 0 leaves only
+// SIGHUP.
+func WatchCertificates(interval time.Duration, reloaders ...*KeyPairReloader) {
+	hup := make(chan os.Signal, 1)
+	signal.Notify(hup, syscall.SIGHUP)
+
+	var tick <-chan time.Time
+	if interval > 0 {
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+		tick = ticker.C
+	}
+
+	for {
+		select {
+		case <-tick:
+			for _, r := range reloaders {
+				r.reloadIfChanged()
+			}
+		case <-hup:
+			for _, r := range reloaders {
+				if err := r.reload(); err != nil {
+					log.Printf("Reloading certificate on SIGHUP: %s", err)
+					continue
+				}
+				log.Printf("Reloaded certificate %s on SIGHUP", r.certPath)
+			}
+		}
+	}
+}
@@ -0,0 +1,100 @@
+package tlsutil
+
+import (
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+// writeKeyPair issues a self-signed certificate for name and writes it and
+// its key to dir, both modified at modTime.
+func writeKeyPair(t *testing.T, dir, name string, modTime time.Time) (certPEM, keyPEM []byte) {
+	t.Helper()
+	cert, key := issue(t, &x509.Certificate{Subject: pkix.Name{CommonName: name}}, nil, nil)
+	der, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	certPEM = pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: cert.Raw})
+	keyPEM = pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: der})
+	writeFile(t, filepath.Join(dir, "tls.crt"), certPEM, modTime)
+	writeFile(t, filepath.Join(dir, "tls.key"), keyPEM, modTime)
+	return certPEM, keyPEM
+}
+
+func writeFile(t *testing.T, path string, b []byte, modTime time.Time) {
+	t.Helper()
+	if err := ioutil.WriteFile(path, b, 0600); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Chtimes(path, modTime, modTime); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// servedName is the common name of the leaf GetCertificate hands out.
+func servedName(t *testing.T, r *KeyPairReloader) string {
+	t.Helper()
+	cert, err := r.GetCertificate(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	leaf, err := x509.ParseCertificate(cert.Certificate[0])
+	if err != nil {
+		t.Fatal(err)
+	}
+	return leaf.Subject.CommonName
+}
+
+func TestReloadIfChanged(t *testing.T) {
+	dir := t.TempDir()
+	certPath, keyPath := filepath.Join(dir, "tls.crt"), filepath.Join(dir, "tls.key")
+	t0 := time.Now().Truncate(time.Second)
+	writeKeyPair(t, dir, "one", t0)
+	r, err := NewKeyPairReloader(certPath, keyPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if name := servedName(t, r); name != "one" {
+		t.Fatalf("serving %s, want one", name)
+	}
+
+	// Nothing changed, nothing reloaded.
+	r.reloadIfChanged()
+	if name := servedName(t, r); name != "one" {
+		t.Errorf("serving %s without a change, want one", name)
+	}
+
+	// A pair swapped in with older times is still a change.
+	writeKeyPair(t, dir, "two", t0.Add(-time.Hour))
+	r.reloadIfChanged()
+	if name := servedName(t, r); name != "two" {
+		t.Errorf("serving %s after the swap, want two", name)
+	}
+
+	// A new certificate without its key yet, and then a truncated one, fail
+	// to load and leave the old pair in use.
+	certPEM, keyPEM := writeKeyPair(t, t.TempDir(), "three", t0)
+	writeFile(t, certPath, certPEM, t0.Add(time.Minute))
+	r.reloadIfChanged()
+	if name := servedName(t, r); name != "two" {
+		t.Errorf("serving %s with the key not written yet, want two", name)
+	}
+	writeFile(t, keyPath, keyPEM[:len(keyPEM)/2], t0.Add(2*time.Minute))
+	r.reloadIfChanged()
+	if name := servedName(t, r); name != "two" {
+		t.Errorf("serving %s with half the key written, want two", name)
+	}
+
+	// Once the key is complete the new pair is picked up on the next check.
+	writeFile(t, keyPath, keyPEM, t0.Add(3*time.Minute))
+	r.reloadIfChanged()
+	if name := servedName(t, r); name != "three" {
+		t.Errorf("serving %s, want three", name)
+	}
+}
@@ -0,0 +1,28 @@
+package tlsutil
+
+import (
+	"fmt"
+	"io"
+	"os"
+)
+
+// OpenKeyLog opens path for tls.Config.KeyLogWriter, or returns nil for an
+// empty path. The secrets of every TLS connection are appended to it in the
+// NSS key log format, as with SSLKEYLOGFILE, so Wireshark and tshark can
+// decrypt a capture of them.
+func OpenKeyLog(path string) (io.Writer, error) {
+	if path == "" {
+		return nil, nil
+	}
+	f, err := os.OpenFile(path, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0600)
+	if err != nil {
+		return nil, err
+	}
+	return f, nil
+}
+
+// KeyLogWarning is printed, without fail, whenever a key log is open.
+func KeyLogWarning(path string) string {
+	return fmt.Sprintf("TLS SECRETS FOR EVERY CONNECTION ARE BEING WRITTEN TO %s (-tls-key-log). "+
+		"Anyone with that file can decrypt captured traffic. Never use this outside debugging.", path)
+}
@@ -0,0 +1,125 @@
+package tlsutil
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"math/big"
+	"net"
+	"strings"
+	"testing"
+	"time"
+)
+
+const (
+	appGUID   = "dde7f1fb-485d-463f-87d5-5d90b1e3f050"
+	spaceGUID = "ff87034d-dddb-4b9f-8f5f-88bfd1e35ddd"
+	orgGUID   = "c2ac7ed1-43e2-4b60-b9f1-52ace1e84e5d"
+)
+
+// issue creates a certificate from template, signed by parent's key, or
+// self-signed when parent is nil.
+func issue(t *testing.T, template, parent *x509.Certificate, parentKey *ecdsa.PrivateKey) (*x509.Certificate, *ecdsa.PrivateKey) {
+	t.Helper()
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	template.SerialNumber = big.NewInt(time.Now().UnixNano())
+	template.NotBefore = time.Now().Add(-time.Hour)
+	template.NotAfter = time.Now().Add(time.Hour)
+	if parent == nil {
+		parent, parentKey = template, key
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, parent, &key.PublicKey, parentKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cert, err := x509.ParseCertificate(der)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return cert, key
+}
+
+func newCA(t *testing.T, name string) (*x509.Certificate, *ecdsa.PrivateKey) {
+	return issue(t, &x509.Certificate{
+		Subject:               pkix.Name{CommonName: name},
+		KeyUsage:              x509.KeyUsageCertSign,
+		IsCA:                  true,
+		BasicConstraintsValid: true,
+	}, nil, nil)
+}
+
+// instanceIdentity issues a leaf like Envoy's: the GUIDs as OUs and the
+// instance's name and IP as SANs.
+func instanceIdentity(t *testing.T, ca *x509.Certificate, caKey *ecdsa.PrivateKey, ous ...string) *x509.Certificate {
+	leaf, _ := issue(t, &x509.Certificate{
+		Subject:     pkix.Name{CommonName: "ef54a148-4f48-45b9-7fd1-8436", OrganizationalUnit: ous},
+		KeyUsage:    x509.KeyUsageDigitalSignature,
+		ExtKeyUsage: []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+		DNSNames:    []string{"ef54a148-4f48-45b9-7fd1-8436"},
+		IPAddresses: []net.IP{net.ParseIP("10.255.242.56")},
+	}, ca, caKey)
+	return leaf
+}
+
+func TestVerifyEnvoyCertificate(t *testing.T) {
+	root, rootKey := newCA(t, "appRootCA")
+	intermediate, intermediateKey := issue(t, &x509.Certificate{
+		Subject:               pkix.Name{CommonName: "instanceIdentityCA"},
+		KeyUsage:              x509.KeyUsageCertSign,
+		IsCA:                  true,
+		BasicConstraintsValid: true,
+	}, root, rootKey)
+	leaf := instanceIdentity(t, intermediate, intermediateKey,
+		"app:"+appGUID, "space:"+spaceGUID, "organization:"+orgGUID)
+	chain := [][]byte{leaf.Raw, intermediate.Raw}
+	roots := x509.NewCertPool()
+	roots.AddCert(root)
+
+	other, otherKey := newCA(t, "appRootCA")
+	untrusted := instanceIdentity(t, other, otherKey, "app:"+appGUID)
+	noOUs := instanceIdentity(t, intermediate, intermediateKey)
+
+	for _, c := range []struct {
+		name     string
+		chain    [][]byte
+		expected EnvoyIdentity
+		want     string // in the error, empty for none
+	}{
+		{name: "nothing expected", chain: chain},
+		{name: "everything matches", chain: chain, expected: EnvoyIdentity{
+			AppGUID: appGUID, SpaceGUID: spaceGUID, OrgGUID: orgGUID, SAN: "10.255.242.56",
+		}},
+		{name: "DNS SAN", chain: chain, expected: EnvoyIdentity{SAN: "ef54a148-4f48-45b9-7fd1-8436"}},
+		{name: "no certificate", want: "envoy presented no certificate"},
+		{name: "garbage", chain: [][]byte{[]byte("nope")}, want: "parsing envoy certificate"},
+		{name: "no intermediate", chain: [][]byte{leaf.Raw}, want: "verifying envoy certificate chain"},
+		{name: "another CA", chain: [][]byte{untrusted.Raw}, expected: EnvoyIdentity{AppGUID: appGUID}, want: "verifying envoy certificate chain"},
+		{name: "app GUID", chain: chain, expected: EnvoyIdentity{AppGUID: "other"},
+			want: `app GUID is "` + appGUID + `", expected "other"`},
+		{name: "space GUID", chain: chain, expected: EnvoyIdentity{AppGUID: appGUID, SpaceGUID: "other"},
+			want: `space GUID is "` + spaceGUID + `", expected "other"`},
+		{name: "organization GUID", chain: chain, expected: EnvoyIdentity{OrgGUID: "other"},
+			want: `organization GUID is "` + orgGUID + `", expected "other"`},
+		{name: "no app OU", chain: [][]byte{noOUs.Raw, intermediate.Raw}, expected: EnvoyIdentity{AppGUID: appGUID},
+			want: `no app GUID (subject has no "app:<guid>" OU)`},
+		{name: "no organization OU", chain: [][]byte{noOUs.Raw, intermediate.Raw}, expected: EnvoyIdentity{OrgGUID: orgGUID},
+			want: `no organization GUID (subject has no "organization:<guid>" OU)`},
+		{name: "SAN", chain: chain, expected: EnvoyIdentity{SAN: "localhost"},
+			want: `SANs [ef54a148-4f48-45b9-7fd1-8436, 10.255.242.56] do not include "localhost"`},
+	} {
+		t.Run(c.name, func(t *testing.T) {
+			err := VerifyEnvoyCertificate(roots, c.expected)(c.chain, nil)
+			switch {
+			case c.want == "" && err != nil:
+				t.Errorf("got %v", err)
+			case c.want != "" && (err == nil || !strings.Contains(err.Error(), c.want)):
+				t.Errorf("got %v, want an error with %q", err, c.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,192 @@
+// Package websocket is just enough of RFC 6455 to check that upgrades make it
+// through the proxy and Envoy intact: the echo the HTTP/1.1 app serves, and
+// the framing a client needs to talk to it.
+package websocket
+
+import (
+	"bufio"
+	"crypto/rand"
+	"crypto/sha1"
+	"encoding/base64"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"strings"
+)
+
+// guid is the magic value from RFC 6455 section 1.3 used to derive
+// Sec-WebSocket-Accept.
+const guid = "258EAFA5-E914-47DA-95CA-C5AB0DC85B11"
+
+const (
+	OpContinuation = 0x0
+	OpText         = 0x1
+	OpBinary       = 0x2
+	OpClose        = 0x8
+	OpPing         = 0x9
+	OpPong         = 0xA
+)
+
+// maxPayload is the largest frame ReadFrame accepts.
+const maxPayload = 1 << 20
+
+// Accept is the Sec-WebSocket-Accept a server answers key with.
+func Accept(key string) string {
+	sum := sha1.Sum([]byte(key + guid))
+	return base64.StdEncoding.EncodeToString(sum[:])
+}
+
+// Echo completes a WebSocket handshake and echoes every data frame back to
+// the client until it sends a close frame.
+func Echo(w http.ResponseWriter, r *http.Request) {
+	if !strings.EqualFold(r.Header.Get("Upgrade"), "websocket") {
+		http.Error(w, "expected a WebSocket upgrade", http.StatusUpgradeRequired)
+		return
+	}
+	key := r.Header.Get("Sec-WebSocket-Key")
+	if key == "" {
+		http.Error(w, "missing Sec-WebSocket-Key", http.StatusBadRequest)
+		return
+	}
+
+	hijacker, ok := w.(http.Hijacker)
+	if !ok {
+		http.Error(w, "connection cannot be hijacked", http.StatusInternalServerError)
+		return
+	}
+	conn, rw, err := hijacker.Hijack()
+	if err != nil {
+		log.Printf("Hijacking connection: %s", err)
+		return
+	}
+	defer conn.Close()
+
+	fmt.Fprintf(rw, "HTTP/1.1 101 Switching Protocols\r\n")
+	fmt.Fprintf(rw, "Upgrade: websocket\r\n")
+	fmt.Fprintf(rw, "Connection: Upgrade\r\n")
+	fmt.Fprintf(rw, "Sec-WebSocket-Accept: %s\r\n\r\n", Accept(key))
+	if err := rw.Flush(); err != nil {
+		return
+	}
+
+	for {
+		opcode, payload, err := ReadFrame(rw.Reader, true)
+		if err != nil {
+			if err != io.EOF {
+				log.Printf("Reading WebSocket frame: %s", err)
+			}
+			return
+		}
+
+		switch opcode {
+		case OpClose:
+			WriteFrame(rw.Writer, OpClose, payload, false)
+			rw.Flush()
+			return
+		case OpPing:
+			err = WriteFrame(rw.Writer, OpPong, payload, false)
+		case OpPong:
+			continue
+		default:
+			err = WriteFrame(rw.Writer, opcode, payload, false)
+		}
+		if err == nil {
+			err = rw.Flush()
+		}
+		if err != nil {
+			log.Printf("Writing WebSocket frame: %s", err)
+			return
+		}
+	}
+}
+
+// ReadFrame reads a single frame and returns its opcode and unmasked payload.
+// Frames from clients must be masked and frames from servers must not, as
+// masked says.
+func ReadFrame(r *bufio.Reader, masked bool) (byte, []byte, error) {
+	var header [2]byte
+	if _, err := io.ReadFull(r, header[:]); err != nil {
+		return 0, nil, err
+	}
+	opcode := header[0] & 0x0F
+	if isMasked := header[1]&0x80 != 0; isMasked != masked {
+		if masked {
+			return 0, nil, errors.New("client frame is not masked")
+		}
+		return 0, nil, errors.New("server frame is masked")
+	}
+
+	length := uint64(header[1] & 0x7F)
+	switch length {
+	case 126:
+		var ext [2]byte
+		if _, err := io.ReadFull(r, ext[:]); err != nil {
+			return 0, nil, err
+		}
+		length = uint64(binary.BigEndian.Uint16(ext[:]))
+	case 127:
+		var ext [8]byte
+		if _, err := io.ReadFull(r, ext[:]); err != nil {
+			return 0, nil, err
+		}
+		length = binary.BigEndian.Uint64(ext[:])
+	}
+	if length > maxPayload {
+		return 0, nil, fmt.Errorf("frame of %d bytes is too large", length)
+	}
+
+	var mask [4]byte
+	if masked {
+		if _, err := io.ReadFull(r, mask[:]); err != nil {
+			return 0, nil, err
+		}
+	}
+	payload := make([]byte, length)
+	if _, err := io.ReadFull(r, payload); err != nil {
+		return 0, nil, err
+	}
+	for i := range payload {
+		payload[i] ^= mask[i%4]
+	}
+	return opcode, payload, nil
+}
+
+// WriteFrame writes a single unfragmented frame, masked as a client's must
+// be or unmasked as a server's.
+func WriteFrame(w io.Writer, opcode byte, payload []byte, masked bool) error {
+	header := []byte{0x80 | opcode}
+	var maskBit byte
+	if masked {
+		maskBit = 0x80
+	}
+	switch length := len(payload); {
+	case length < 126:
+		header = append(header, maskBit|byte(length))
+	case length <= 0xFFFF:
+		header = append(header, maskBit|126, 0, 0)
+		binary.BigEndian.PutUint16(header[2:], uint16(length))
+	default:
+		header = append(header, maskBit|127, 0, 0, 0, 0, 0, 0, 0, 0)
+		binary.BigEndian.PutUint64(header[2:], uint64(length))
+	}
+	if masked {
+		var mask [4]byte
+		if _, err := rand.Read(mask[:]); err != nil {
+			return err
+		}
+		header = append(header, mask[:]...)
+		masking := make([]byte, len(payload))
+		for i := range payload {
+			masking[i] = payload[i] ^ mask[i%4]
+		}
+		payload = masking
+	}
+	if _, err := w.Write(header); err != nil {
+		return err
+	}
+	_, err := w.Write(payload)
+	return err
+}
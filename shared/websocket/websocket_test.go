@@ -0,0 +1,102 @@
+package websocket
+
+import (
+	"bufio"
+	"bytes"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestAccept(t *testing.T) {
+	// The example in RFC 6455 section 1.3.
+	if got := Accept("dGhlIHNhbXBsZSBub25jZQ=="); got != "s3pPLMBiTxaQ9kYGzzhZRbK+xOo=" {
+		t.Errorf("got %q", got)
+	}
+}
+
+func TestFrameRoundTrip(t *testing.T) {
+	for _, n := range []int{0, 125, 126, 0xFFFF, 0x10000} {
+		for _, masked := range []bool{false, true} {
+			payload := bytes.Repeat([]byte("x"), n)
+			var b bytes.Buffer
+			if err := WriteFrame(&b, OpBinary, payload, masked); err != nil {
+				t.Fatal(err)
+			}
+			opcode, got, err := ReadFrame(bufio.NewReader(&b), masked)
+			if err != nil || opcode != OpBinary || !bytes.Equal(got, payload) {
+				t.Errorf("%d bytes, masked %v: got opcode %d, %d bytes, %v", n, masked, opcode, len(got), err)
+			}
+		}
+	}
+}
+
+func TestReadFrameMasking(t *testing.T) {
+	var b bytes.Buffer
+	WriteFrame(&b, OpText, []byte("hi"), false)
+	if _, _, err := ReadFrame(bufio.NewReader(&b), true); err == nil {
+		t.Error("read an unmasked client frame")
+	}
+	WriteFrame(&b, OpText, []byte("hi"), true)
+	if _, _, err := ReadFrame(bufio.NewReader(&b), false); err == nil {
+		t.Error("read a masked server frame")
+	}
+}
+
+func TestEcho(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(Echo))
+	defer srv.Close()
+
+	resp, err := http.Get(srv.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusUpgradeRequired {
+		t.Errorf("got %s without an upgrade", resp.Status)
+	}
+
+	conn, err := net.Dial("tcp", srv.Listener.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(5 * time.Second))
+	io.WriteString(conn, "GET / HTTP/1.1\r\nHost: app\r\nConnection: Upgrade\r\nUpgrade: websocket\r\nSec-WebSocket-Version: 13\r\nSec-WebSocket-Key: dGhlIHNhbXBsZSBub25jZQ==\r\n\r\n")
+	br := bufio.NewReader(conn)
+	resp, err = http.ReadResponse(br, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if resp.StatusCode != http.StatusSwitchingProtocols || resp.Header.Get("Sec-WebSocket-Accept") != "s3pPLMBiTxaQ9kYGzzhZRbK+xOo=" {
+		t.Fatalf("got %s, %v", resp.Status, resp.Header)
+	}
+
+	for _, f := range []struct {
+		send, want byte
+		payload    string
+	}{
+		{OpText, OpText, "hello"},
+		{OpBinary, OpBinary, strings.Repeat("large ", 100)},
+		{OpPing, OpPong, "ping"},
+		{OpClose, OpClose, "\x03\xe8"},
+	} {
+		if err := WriteFrame(conn, f.send, []byte(f.payload), true); err != nil {
+			t.Fatal(err)
+		}
+		opcode, payload, err := ReadFrame(br, false)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if opcode != f.want || string(payload) != f.payload {
+			t.Errorf("sent %d %q, got %d %q", f.send, f.payload, opcode, payload)
+		}
+	}
+	if _, err := br.ReadByte(); err != io.EOF {
+		t.Errorf("got %v after the close, want EOF", err)
+	}
+}
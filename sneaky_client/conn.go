@@ -0,0 +1,242 @@
+package main
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"time"
+
+	"shared/proxyprotocol"
+	"shared/tlsutil"
+)
+
+// connFlags are the flags that say how to reach Envoy: what to trust, what
+// to present and what to send before the TLS handshake.
+type connFlags struct {
+	caFile             string
+	certFile           string
+	keyFile            string
+	sni                string
+	insecureSkipVerify bool
+	expected           tlsutil.EnvoyIdentity
+	connectTimeout     time.Duration
+	keyLogFile         string
+
+	proxyProtocol       bool
+	proxyProtocolSource string
+}
+
+func (f *connFlags) register(fs *flag.FlagSet) {
+	fs.StringVar(&f.caFile, "ca", "./client_certs/ca.crt", "CA for Envoy's certificate")
+	fs.StringVar(&f.certFile, "cert", "./client_certs/client.crt", "client certificate presented to Envoy")
+	fs.StringVar(&f.keyFile, "key", "./client_certs/client.key", "client private key presented to Envoy")
+	fs.StringVar(&f.sni, "sni", "", "server name to send in the TLS handshake instead of the URL's host")
+	fs.BoolVar(&f.insecureSkipVerify, "insecure-skip-verify", false, "do not verify Envoy's certificate at all")
+	fs.StringVar(&f.expected.AppGUID, "envoy-app-guid", "", "app GUID Envoy's instance identity certificate must carry")
+	fs.StringVar(&f.expected.SpaceGUID, "envoy-space-guid", "", "space GUID Envoy's instance identity certificate must carry")
+	fs.StringVar(&f.expected.OrgGUID, "envoy-org-guid", "", "organization GUID Envoy's instance identity certificate must carry")
+	fs.StringVar(&f.expected.SAN, "envoy-san", "", "DNS name or IP address Envoy's certificate must carry as a SAN")
+	fs.StringVar(&f.keyLogFile, "tls-key-log", "", "append TLS secrets to this file in SSLKEYLOGFILE format, to decrypt captures; for debugging only")
+	fs.DurationVar(&f.connectTimeout, "connect-timeout", 10*time.Second, "how long to wait for the TCP connection and the TLS handshake each")
+	fs.BoolVar(&f.proxyProtocol, "proxy-protocol", false, "send a PROXY protocol v2 header before the TLS handshake, as the reverse proxy does with -proxy-protocol")
+	fs.StringVar(&f.proxyProtocolSource, "proxy-protocol-source", "", "client address the PROXY header gives, instead of our own, e.g. 203.0.113.7:51234")
+}
+
+// newDialer reads the certificates and returns a dialer for them. Phases of
+// each connection are reported to phases, which may be nil.
+func (f *connFlags) newDialer(phases *phaseLog) (*dialer, error) {
+	caCert, err := ioutil.ReadFile(f.caFile)
+	if err != nil {
+		return nil, fmt.Errorf("reading CA: %s", err)
+	}
+	caCertPool := x509.NewCertPool()
+	if !caCertPool.AppendCertsFromPEM(caCert) {
+		return nil, fmt.Errorf("no certificates found in CA file %s", f.caFile)
+	}
+	cert, err := tlsutil.NewKeyPairReloader(f.certFile, f.keyFile)
+	if err != nil {
+		return nil, fmt.Errorf("reading cert/key: %s", err)
+	}
+
+	config := &tls.Config{
+		RootCAs:              caCertPool,
+		GetClientCertificate: cert.GetClientCertificate,
+		ServerName:           f.sni,
+		// VerifyEnvoyCertificate does the chain and identity checks instead.
+		InsecureSkipVerify: true,
+	}
+	config.KeyLogWriter, err = tlsutil.OpenKeyLog(f.keyLogFile)
+	if err != nil {
+		return nil, fmt.Errorf("opening -tls-key-log: %s", err)
+	}
+	if config.KeyLogWriter != nil {
+		phases.warnf("%s", tlsutil.KeyLogWarning(f.keyLogFile))
+	}
+	if f.insecureSkipVerify {
+		phases.warnf("not verifying Envoy's certificate (-insecure-skip-verify)")
+	} else {
+		config.VerifyPeerCertificate = tlsutil.VerifyEnvoyCertificate(caCertPool, f.expected)
+	}
+
+	d := &dialer{
+		cert:          cert,
+		config:        config,
+		timeout:       f.connectTimeout,
+		proxyProtocol: f.proxyProtocol,
+		phases:        phases,
+	}
+	if f.proxyProtocolSource != "" {
+		d.proxySource, err = net.ResolveTCPAddr("tcp", f.proxyProtocolSource)
+		if err != nil {
+			return nil, fmt.Errorf("parsing -proxy-protocol-source: %s", err)
+		}
+	}
+	return d, nil
+}
+
+// dialer opens TLS connections to Envoy. It does the handshake itself rather
+// than leave it to the transport so that it decides what ALPN offers, if
+// anything, whatever the transport would like.
+type dialer struct {
+	cert    *tlsutil.KeyPairReloader // the client certificate
+	config  *tls.Config
+	timeout time.Duration
+	phases  *phaseLog
+
+	proxyProtocol bool
+	proxySource   *net.TCPAddr // nil for our own address
+
+	// handshakes, if set, is told the outcome of every TLS handshake.
+	handshakes func(tls.ConnectionState)
+}
+
+// connectError is a failure to open the TCP connection.
+type connectError struct {
+	addr string
+	err  error
+}
+
+func (e *connectError) Error() string {
+	return fmt.Sprintf("connecting to %s: %s", e.addr, e.err)
+}
+
+func (e *connectError) Unwrap() error { return e.err }
+
+// tlsError is a failed TLS handshake, including a certificate that didn't
+// verify.
+type tlsError struct {
+	err error
+}
+
+func (e *tlsError) Error() string {
+	return fmt.Sprintf("TLS handshake: %s", e.err)
+}
+
+func (e *tlsError) Unwrap() error { return e.err }
+
+// dialTCP opens the TCP connection and sends the PROXY header, if there is
+// to be one.
+func (d *dialer) dialTCP(ctx context.Context, addr string) (net.Conn, error) {
+	d.phases.printf("Connecting to %s", addr)
+	nd := &net.Dialer{Timeout: d.timeout, KeepAlive: 30 * time.Second}
+	conn, err := nd.DialContext(ctx, "tcp", addr)
+	if err != nil {
+		return nil, &connectError{addr: addr, err: err}
+	}
+	d.phases.printf("Connected to %s from %s", conn.RemoteAddr(), conn.LocalAddr())
+
+	if d.proxyProtocol {
+		h := &proxyprotocol.Header{Source: d.proxySource, Destination: conn.RemoteAddr().(*net.TCPAddr)}
+		if h.Source == nil {
+			h.Source = conn.LocalAddr().(*net.TCPAddr)
+		}
+		b, err := h.Marshal()
+		if err == nil {
+			_, err = conn.Write(b)
+		}
+		if err != nil {
+			conn.Close()
+			return nil, &connectError{addr: addr, err: fmt.Errorf("sending PROXY header: %s", err)}
+		}
+		d.phases.printf("Sent %s", h)
+	}
+	return conn, nil
+}
+
+// dialTLS connects to addr and does the TLS handshake, offering alpn.
+func (d *dialer) dialTLS(ctx context.Context, addr string, alpn []string) (*tls.Conn, error) {
+	conn, err := d.dialTCP(ctx, addr)
+	if err != nil {
+		return nil, err
+	}
+
+	cfg := d.config.Clone()
+	cfg.NextProtos = alpn
+	if cfg.ServerName == "" {
+		cfg.ServerName, _, _ = net.SplitHostPort(addr)
+	}
+	if len(alpn) == 0 {
+		d.phases.printf("TLS handshake with SNI %s, offering no ALPN", cfg.ServerName)
+	} else {
+		d.phases.printf("TLS handshake with SNI %s, offering ALPN %v", cfg.ServerName, alpn)
+	}
+
+	tlsConn := tls.Client(conn, cfg)
+	tlsConn.SetDeadline(time.Now().Add(d.timeout))
+	if deadline, ok := ctx.Deadline(); ok && deadline.Before(time.Now().Add(d.timeout)) {
+		tlsConn.SetDeadline(deadline)
+	}
+	if err := tlsConn.Handshake(); err != nil {
+		conn.Close()
+		return nil, &tlsError{err: err}
+	}
+	tlsConn.SetDeadline(time.Time{})
+
+	state := tlsConn.ConnectionState()
+	if d.handshakes != nil {
+		d.handshakes(state)
+	}
+	negotiated := state.NegotiatedProtocol
+	if negotiated == "" {
+		negotiated = "none"
+	}
+	d.phases.printf("TLS handshake done: %s, %s, ALPN %s", tlsVersionName(state.Version), tls.CipherSuiteName(state.CipherSuite), negotiated)
+	if len(state.PeerCertificates) > 0 {
+		leaf := state.PeerCertificates[0]
+		d.phases.printf("Server certificate: %s, issued by %s, expires %s", leaf.Subject, leaf.Issuer, leaf.NotAfter.Format(time.RFC3339))
+	}
+	return tlsConn, nil
+}
+
+// dialerFunc adapts dialTLS to Transport.DialTLS, which has no context.
+func (d *dialer) dialerFunc(ctx context.Context, alpn []string) func(network, addr string) (net.Conn, error) {
+	return func(network, addr string) (net.Conn, error) {
+		return d.dialTLS(ctx, addr, alpn)
+	}
+}
+
+func tlsVersionName(v uint16) string {
+	switch v {
+	case tls.VersionTLS10:
+		return "TLSv1.0"
+	case tls.VersionTLS11:
+		return "TLSv1.1"
+	case tls.VersionTLS12:
+		return "TLSv1.2"
+	case tls.VersionTLS13:
+		return "TLSv1.3"
+	default:
+		return fmt.Sprintf("0x%04x", v)
+	}
+}
+
+// isTimeout reports whether err is a deadline passing.
+func isTimeout(err error) bool {
+	var ne net.Error
+	return errors.Is(err, context.DeadlineExceeded) || (errors.As(err, &ne) && ne.Timeout())
+}
@@ -0,0 +1,65 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/hex"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// TestKeyLog does one handshake with -tls-key-log and checks the file has
+// its secrets in the NSS key log format, and only its owner can read it.
+func TestKeyLog(t *testing.T) {
+	url := "https://" + startEnvoy(t, false) + "/inspect"
+	f := testFlags(t)
+	f.keyLogFile = filepath.Join(t.TempDir(), "keys.log")
+	var warnings bytes.Buffer
+	d, err := f.newDialer(newPhaseLog(&warnings, false))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.Contains(warnings.String(), "TLS SECRETS FOR EVERY CONNECTION ARE BEING WRITTEN TO "+f.keyLogFile) {
+		t.Errorf("no warning about the key log in %q", warnings.String())
+	}
+
+	c := newModeClient(context.Background(), modeHTTP1, d)
+	defer c.close()
+	if _, _, err := do(c, url, nil); err != nil {
+		t.Fatal(err)
+	}
+
+	info, err := os.Stat(f.keyLogFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if perm := info.Mode().Perm(); perm != 0600 {
+		t.Errorf("key log mode %v, want 0600", perm)
+	}
+	b, err := ioutil.ReadFile(f.keyLogFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	labels := map[string]bool{}
+	for _, line := range strings.Split(strings.TrimSpace(string(b)), "\n") {
+		fields := strings.Fields(line)
+		if len(fields) != 3 {
+			t.Fatalf("line %q is not <label> <client random> <secret>", line)
+		}
+		random, err := hex.DecodeString(fields[1])
+		if err != nil || len(random) != 32 {
+			t.Errorf("client random %q in %q", fields[1], line)
+		}
+		if _, err := hex.DecodeString(fields[2]); err != nil {
+			t.Errorf("secret %q in %q", fields[2], line)
+		}
+		labels[fields[0]] = true
+	}
+	// TLS 1.2 logs the master secret, TLS 1.3 the traffic secrets.
+	if !labels["CLIENT_RANDOM"] && !labels["CLIENT_HANDSHAKE_TRAFFIC_SECRET"] {
+		t.Errorf("got %v, want CLIENT_RANDOM or CLIENT_HANDSHAKE_TRAFFIC_SECRET", labels)
+	}
+}
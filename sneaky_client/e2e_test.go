@@ -0,0 +1,371 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/hex"
+	"encoding/json"
+	"encoding/pem"
+	"fmt"
+	"io/ioutil"
+	"math/big"
+	"net"
+	nethttp "net/http"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/gerg/net/http"
+	"golang.org/x/net/http2"
+	"golang.org/x/net/http2/h2c"
+
+	"shared/standin"
+)
+
+// concurrency is how many requests the concurrency cases keep in flight.
+const concurrency = 16
+
+// bodySize is more than the 64k flow-control windows HTTP/2 starts with.
+const bodySize = 1 << 20
+
+// localhostCert is a self-signed certificate for 127.0.0.1, good for
+// serving and for presenting as a client.
+func localhostCert(t *testing.T) tls.Certificate {
+	t.Helper()
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tmpl := &x509.Certificate{
+		SerialNumber: big.NewInt(1),
+		Subject:      pkix.Name{CommonName: "localhost"},
+		IPAddresses:  []net.IP{net.IPv4(127, 0, 0, 1)},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth, x509.ExtKeyUsageClientAuth},
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, tmpl, &key.PublicKey, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return tls.Certificate{Certificate: [][]byte{der}, PrivateKey: key}
+}
+
+// writeKeyPair writes cert and its key to PEM files in dir.
+func writeKeyPair(t *testing.T, dir, name string, cert tls.Certificate) (certFile, keyFile string) {
+	t.Helper()
+	key, err := x509.MarshalPKCS8PrivateKey(cert.PrivateKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	certFile, keyFile = filepath.Join(dir, name+".crt"), filepath.Join(dir, name+".key")
+	for file, block := range map[string]*pem.Block{
+		certFile: {Type: "CERTIFICATE", Bytes: cert.Certificate[0]},
+		keyFile:  {Type: "PRIVATE KEY", Bytes: key},
+	} {
+		if err := ioutil.WriteFile(file, pem.EncodeToMemory(block), 0600); err != nil {
+			t.Fatal(err)
+		}
+	}
+	return certFile, keyFile
+}
+
+// certDir holds the tests' client certificates. It outlives each test, as
+// the load command goes on watching its certificate after it returns.
+var certDir string
+
+func TestMain(m *testing.M) {
+	dir, err := ioutil.TempDir("", "sneaky-client")
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(1)
+	}
+	certDir = dir
+	code := m.Run()
+	os.RemoveAll(dir)
+	os.Exit(code)
+}
+
+// testFlags returns connection flags for a new client certificate, not
+// verifying Envoy's.
+func testFlags(t *testing.T) *connFlags {
+	t.Helper()
+	dir, err := ioutil.TempDir(certDir, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	certFile, keyFile := writeKeyPair(t, dir, "client", localhostCert(t))
+	return &connFlags{
+		caFile:             certFile,
+		certFile:           certFile,
+		keyFile:            keyFile,
+		insecureSkipVerify: true,
+		connectTimeout:     5 * time.Second,
+	}
+}
+
+// report is what the backend says about each request that reaches it: a
+// little of what the h2c app's /inspect says.
+type report struct {
+	Proto      string `json:"proto"`
+	RemoteAddr string `json:"remote_addr"`
+	Length     int    `json:"length"`
+	SHA256     string `json:"sha256"`
+}
+
+// reportHandler answers with a report. Only POST bodies are read: the h2c
+// package hands the upgrade request on as a stream that never ends, and the
+// client upgrades with bodyless requests.
+func reportHandler(w nethttp.ResponseWriter, r *nethttp.Request) {
+	var body []byte
+	if r.Method == nethttp.MethodPost {
+		body, _ = ioutil.ReadAll(r.Body)
+	}
+	sum := sha256.Sum256(body)
+	json.NewEncoder(w).Encode(report{
+		Proto:      r.Proto,
+		RemoteAddr: r.RemoteAddr,
+		Length:     len(body),
+		SHA256:     hex.EncodeToString(sum[:]),
+	})
+}
+
+// startEnvoy runs the report handler behind the Envoy stand-in, over
+// HTTP/1.1 alone as http1_app does or with h2c too as the h2c app does,
+// and returns the stand-in's address. The stand-in terminates TLS without
+// ALPN and asks for a client certificate, as envoy/envoy.yaml does.
+func startEnvoy(t *testing.T, http1Only bool) string {
+	t.Helper()
+	app, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	var backend nethttp.Handler = nethttp.HandlerFunc(reportHandler)
+	if !http1Only {
+		backend = h2c.NewHandler(backend, &http2.Server{})
+	}
+	srv := &nethttp.Server{Handler: backend}
+	go srv.Serve(app)
+	t.Cleanup(func() { srv.Close() })
+
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	envoy := &standin.Listener{
+		Name: "envoy",
+		L:    l,
+		TLSConfig: &tls.Config{
+			Certificates: []tls.Certificate{localhostCert(t)},
+			ClientAuth:   tls.RequireAnyClientCert,
+		},
+		Cluster: &standin.Cluster{
+			Name:           "app",
+			Endpoints:      []string{app.Addr().String()},
+			ConnectTimeout: time.Second,
+			MaxConnections: 1024,
+		},
+	}
+	go envoy.Serve()
+	t.Cleanup(func() { l.Close() })
+	return l.Addr().String()
+}
+
+// do sends a request the way c's mode says and returns the response's
+// protocol and the backend's report.
+func do(c *modeClient, url string, body []byte) (string, report, error) {
+	method := http.MethodGet
+	if body != nil {
+		method = http.MethodPost
+	}
+	var rep report
+	req, err := http.NewRequest(method, url, bytes.NewReader(body))
+	if err != nil {
+		return "", rep, err
+	}
+	if body == nil {
+		req.Body = nil
+	}
+	resp, err := c.do(req, nil)
+	if err != nil {
+		return "", rep, err
+	}
+	defer resp.Body.Close()
+	b, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return "", rep, err
+	}
+	if resp.StatusCode != http.StatusOK || json.Unmarshal(b, &rep) != nil {
+		return "", rep, fmt.Errorf("got %s: %q", resp.Status, b)
+	}
+	return resp.Proto, rep, nil
+}
+
+// TestEndToEnd runs the client in each mode against the Envoy stand-in in
+// front of each kind of backend.
+func TestEndToEnd(t *testing.T) {
+	body := make([]byte, bodySize)
+	if _, err := rand.Read(body); err != nil {
+		t.Fatal(err)
+	}
+	sum := sha256.Sum256(body)
+
+	for _, backend := range []struct {
+		name      string
+		http1Only bool
+		// The protocol each mode ends up speaking. Envoy negotiates no
+		// ALPN, so alpn mode always falls back to HTTP/1.1, and the
+		// HTTP/1.1 backend declines the upgrade.
+		protos map[string]string
+	}{
+		{"h2c", false, map[string]string{
+			modeUpgrade:        "HTTP/2.0",
+			modePriorKnowledge: "HTTP/2.0",
+			modeALPN:           "HTTP/1.1",
+			modeHTTP1:          "HTTP/1.1",
+		}},
+		{"http1", true, map[string]string{
+			modeUpgrade: "HTTP/1.1",
+			modeALPN:    "HTTP/1.1",
+			modeHTTP1:   "HTTP/1.1",
+		}},
+	} {
+		backend := backend
+		t.Run(backend.name, func(t *testing.T) {
+			url := "https://" + startEnvoy(t, backend.http1Only) + "/inspect"
+			d, err := testFlags(t).newDialer(nil)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			for _, mode := range []string{modeUpgrade, modePriorKnowledge, modeALPN, modeHTTP1} {
+				want, ok := backend.protos[mode]
+				if !ok {
+					continue
+				}
+				t.Run(mode, func(t *testing.T) {
+					c := newModeClient(context.Background(), mode, d)
+					defer c.close()
+					proto, rep, err := do(c, url, nil)
+					if err != nil {
+						t.Fatal(err)
+					}
+					if proto != want || rep.Proto != want {
+						t.Errorf("answered over %s, reached the backend over %s, want %s", proto, rep.Proto, want)
+					}
+				})
+			}
+
+			t.Run("body", func(t *testing.T) {
+				// With a body, the upgrade is offered with an OPTIONS
+				// first.
+				c := newModeClient(context.Background(), modeUpgrade, d)
+				defer c.close()
+				proto, rep, err := do(c, url, body)
+				if err != nil {
+					t.Fatal(err)
+				}
+				if proto != backend.protos[modeUpgrade] || rep.Length != len(body) || rep.SHA256 != hex.EncodeToString(sum[:]) {
+					t.Errorf("over %s, backend got %d bytes, hash %s, want %s, %d bytes, hash %x", proto, rep.Length, rep.SHA256, backend.protos[modeUpgrade], len(body), sum)
+				}
+			})
+
+			t.Run("concurrency", func(t *testing.T) {
+				c := newModeClient(context.Background(), modeUpgrade, d)
+				defer c.close()
+				reports := make([]report, concurrency)
+				var wg sync.WaitGroup
+				for i := range reports {
+					wg.Add(1)
+					go func(i int) {
+						defer wg.Done()
+						var err error
+						if _, reports[i], err = do(c, url, nil); err != nil {
+							t.Error(err)
+						}
+					}(i)
+				}
+				wg.Wait()
+				addrs := map[string]bool{}
+				for _, rep := range reports {
+					addrs[rep.RemoteAddr] = true
+				}
+				// Requests sent while the upgrade is offered wait for it,
+				// and then share the upgraded connection.
+				max := 1
+				if backend.http1Only {
+					max = concurrency
+				}
+				if len(addrs) > max {
+					t.Errorf("requests came over %d connections, want at most %d", len(addrs), max)
+				}
+			})
+		})
+	}
+}
+
+// TestLoadEndToEnd runs the load subcommand against the stand-in in front of
+// each kind of backend.
+func TestLoadEndToEnd(t *testing.T) {
+	for _, backend := range []struct {
+		name      string
+		http1Only bool
+		protos    map[string]string
+	}{
+		{"h2c", false, map[string]string{modeHTTP1: "HTTP/1.1", modeUpgrade: "HTTP/2.0"}},
+		{"http1", true, map[string]string{modeHTTP1: "HTTP/1.1", modeUpgrade: "HTTP/1.1"}},
+	} {
+		t.Run(backend.name, func(t *testing.T) {
+			url := "https://" + startEnvoy(t, backend.http1Only) + "/"
+			f := testFlags(t)
+			out := filepath.Join(t.TempDir(), "load.json")
+			args := []string{
+				"-ca", f.caFile, "-cert", f.certFile, "-key", f.keyFile, "-insecure-skip-verify",
+				"-modes", modeHTTP1 + "," + modeUpgrade, "-concurrency", fmt.Sprint(concurrency),
+				"-duration", "500ms", "-o", out, url,
+			}
+			if code := runLoad(args); code != exitOK {
+				t.Fatalf("exited with %d", code)
+			}
+			b, err := ioutil.ReadFile(out)
+			if err != nil {
+				t.Fatal(err)
+			}
+			var r loadReport
+			if err := json.Unmarshal(b, &r); err != nil {
+				t.Fatal(err)
+			}
+			if len(r.Results) != len(backend.protos) {
+				t.Fatalf("%d results, want %d", len(r.Results), len(backend.protos))
+			}
+			for _, res := range r.Results {
+				want := backend.protos[res.Mode]
+				switch {
+				case res.Errors > 0:
+					t.Errorf("%s: %d of %d requests failed, the first with %s", res.Mode, res.Errors, res.Requests, res.FirstError)
+				case res.Requests == 0:
+					t.Errorf("%s: no requests", res.Mode)
+				case res.Protos[want] != res.Requests:
+					t.Errorf("%s: responses came over %v, want all over %s", res.Mode, res.Protos, want)
+				// Every upgraded request shares the one connection.
+				case res.Mode == modeUpgrade && !backend.http1Only && res.Connections != 1:
+					t.Errorf("%s: %d connections, want 1", res.Mode, res.Connections)
+				// HTTP/1.1 needs one per worker, and a declined upgrade one
+				// more: the other workers set off while the offer's
+				// response is still being read.
+				case res.Connections > concurrency+1:
+					t.Errorf("%s: %d connections, want at most %d", res.Mode, res.Connections, concurrency+1)
+				}
+			}
+		})
+	}
+}
@@ -4,5 +4,8 @@ go 1.16
 
 require (
 	github.com/gerg/net v0.0.0-20210517205659-e3424494d943
-	golang.org/x/net v0.0.0-20210510120150-4163338589ed // indirect
+	golang.org/x/net v0.0.0-20210510120150-4163338589ed
+	shared v0.0.0-00010101000000-000000000000
 )
+
+replace shared => ../shared
@@ -0,0 +1,407 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"math"
+	"net"
+	"os"
+	"sort"
+	"strings"
+	"sync"
+	"text/tabwriter"
+	"time"
+
+	"github.com/gerg/net/http"
+
+	"shared/tlsutil"
+)
+
+// loadReport is what load writes. It has no timestamps, so two runs of the
+// same workload diff down to their numbers.
+type loadReport struct {
+	URL               string       `json:"url"`
+	Method            string       `json:"method"`
+	Concurrency       int          `json:"concurrency"`
+	RPS               float64      `json:"rps,omitempty"`
+	Duration          string       `json:"duration"`
+	Results           []loadResult `json:"results"`
+	UpgradeOverheadMS *float64     `json:"upgrade_overhead_ms,omitempty"`
+}
+
+// loadResult is one mode's share of the run.
+type loadResult struct {
+	Mode          string         `json:"mode"`
+	Requests      int            `json:"requests"`
+	Errors        int            `json:"errors"`
+	Statuses      map[string]int `json:"statuses"`
+	Protos        map[string]int `json:"protos"`
+	ThroughputRPS float64        `json:"throughput_rps"`
+	Latency       latencySummary `json:"latency_ms"`
+	Connections   int            `json:"connections"`
+	ConnectMS     float64        `json:"connect_ms"`
+	ColdRequestMS float64        `json:"cold_request_ms"`
+	FirstError    string         `json:"first_error,omitempty"`
+}
+
+type latencySummary struct {
+	Mean float64 `json:"mean"`
+	P50  float64 `json:"p50"`
+	P90  float64 `json:"p90"`
+	P99  float64 `json:"p99"`
+	Max  float64 `json:"max"`
+}
+
+// loadTemplate is the request every worker sends.
+type loadTemplate struct {
+	method  string
+	target  string
+	headers headerFlags
+	body    []byte
+}
+
+func (t *loadTemplate) request(ctx context.Context) (*http.Request, error) {
+	var body io.Reader
+	if t.body != nil {
+		body = bytes.NewReader(t.body)
+	}
+	req, err := http.NewRequestWithContext(ctx, t.method, t.target, body)
+	if err != nil {
+		return nil, err
+	}
+	for _, h := range t.headers {
+		name, value := splitHeader(h)
+		if strings.EqualFold(name, "Host") {
+			req.Host = value
+			continue
+		}
+		req.Header.Add(name, value)
+	}
+	return req, nil
+}
+
+// runLoad sends the same workload over each mode in turn and writes a report.
+func runLoad(args []string) int {
+	fs := flag.NewFlagSet("sneaky-client load", flag.ContinueOnError)
+	fs.Usage = func() {
+		fmt.Fprintf(fs.Output(), "Usage: sneaky-client load [flags] [URL]\n\n")
+		fmt.Fprintf(fs.Output(), "Sends requests to URL (default https://localhost:61001/) for a while over each\nmode in turn and reports latency, throughput and connections as JSON.\n\nFlags:\n")
+		fs.PrintDefaults()
+	}
+	var conn connFlags
+	conn.register(fs)
+	method := fs.String("X", "", "request method, GET by default or POST with a body")
+	var headers headerFlags
+	fs.Var(&headers, "H", "request header, \"Name: value\"; may be repeated")
+	data := fs.String("d", "", "request body; @file reads it from a file and @- from stdin")
+	modes := fs.String("modes", modeHTTP1+","+modeUpgrade, "comma-separated modes to compare: http1.1, upgrade or alpn")
+	concurrency := fs.Int("concurrency", 10, "requests in flight at once")
+	rps := fs.Float64("rps", 0, "requests per second to aim for across all workers, 0 for as fast as they go")
+	duration := fs.Duration("duration", 10*time.Second, "how long to run each mode for")
+	timeout := fs.Duration("timeout", 10*time.Second, "give up on each request after this long")
+	out := fs.String("o", "", "file to write the JSON report to, stdout if empty")
+	if err := fs.Parse(args); err != nil {
+		return exitUsage
+	}
+	if fs.NArg() > 1 {
+		fmt.Fprintf(os.Stderr, "Expected one URL, got %d\n", fs.NArg())
+		return exitUsage
+	}
+	if *concurrency < 1 {
+		fmt.Fprintf(os.Stderr, "-concurrency must be at least 1\n")
+		return exitUsage
+	}
+	var modeList []string
+	for _, m := range strings.Split(*modes, ",") {
+		m = strings.TrimSpace(m)
+		switch m {
+		case modeHTTP1, modeUpgrade, modeALPN:
+			modeList = append(modeList, m)
+		case "":
+		default:
+			// Prior knowledge makes a connection per request, so there's
+			// nothing to compare.
+			fmt.Fprintf(os.Stderr, "Unknown mode %q in -modes, want http1.1, upgrade or alpn\n", m)
+			return exitUsage
+		}
+	}
+
+	tmpl := &loadTemplate{method: *method, target: "https://localhost:61001/", headers: headers}
+	if fs.NArg() == 1 {
+		tmpl.target = fs.Arg(0)
+	}
+	body, err := requestBody(*data)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Reading request body: %s\n", err)
+		return exitReadFile
+	}
+	tmpl.body = body
+	if tmpl.method == "" {
+		tmpl.method = http.MethodGet
+		if body != nil {
+			tmpl.method = http.MethodPost
+		}
+	}
+	if req, err := tmpl.request(context.Background()); err != nil {
+		fmt.Fprintf(os.Stderr, "Making request: %s\n", err)
+		return exitUsage
+	} else if req.URL.Scheme != "https" {
+		fmt.Fprintf(os.Stderr, "Only https URLs are supported, got %s\n", tmpl.target)
+		return exitUsage
+	}
+
+	d, err := conn.newDialer(newPhaseLog(os.Stderr, false))
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "%s\n", err)
+		return exitFailure
+	}
+	// A load run lasts long enough for the client certificate to be
+	// rotated under it; a single request or probe does not.
+	go tlsutil.WatchCertificates(5*time.Second, d.cert)
+
+	report := &loadReport{
+		URL:         tmpl.target,
+		Method:      tmpl.method,
+		Concurrency: *concurrency,
+		RPS:         *rps,
+		Duration:    duration.String(),
+	}
+	cold := map[string]float64{}
+	for _, m := range modeList {
+		fmt.Fprintf(os.Stderr, "Running %s for %s...\n", m, *duration)
+		r := runLoadMode(m, d, tmpl, *concurrency, *rps, *duration, *timeout)
+		r.ColdRequestMS = coldRequest(m, d, tmpl, *timeout)
+		report.Results = append(report.Results, r)
+		cold[m] = r.ColdRequestMS
+	}
+	// What a request on a new connection costs on top of HTTP/1.1's when it
+	// has to upgrade the connection as well.
+	up, okUp := cold[modeUpgrade]
+	h1, okH1 := cold[modeHTTP1]
+	if okUp && okH1 {
+		overhead := round(up - h1)
+		report.UpgradeOverheadMS = &overhead
+	}
+
+	writeLoadTable(os.Stderr, report)
+	w := io.Writer(os.Stdout)
+	if *out != "" {
+		f, err := os.Create(*out)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "Creating report: %s\n", err)
+			return exitFailure
+		}
+		defer f.Close()
+		w = f
+	}
+	enc := json.NewEncoder(w)
+	enc.SetIndent("", "  ")
+	if err := enc.Encode(report); err != nil {
+		fmt.Fprintf(os.Stderr, "Writing report: %s\n", err)
+		return exitFailure
+	}
+	return exitOK
+}
+
+// loadStats gathers what the workers see. Latencies are kept whole for the
+// percentiles.
+type loadStats struct {
+	mu         sync.Mutex
+	latencies  []time.Duration
+	connects   []time.Duration
+	errors     int
+	firstError string
+	statuses   map[string]int
+	protos     map[string]int
+}
+
+// runLoadMode runs the workload over one mode, on a transport of its own.
+func runLoadMode(mode string, d *dialer, tmpl *loadTemplate, concurrency int, rps float64, duration, timeout time.Duration) loadResult {
+	ctx, cancel := context.WithTimeout(context.Background(), duration)
+	defer cancel()
+	stats := &loadStats{statuses: map[string]int{}, protos: map[string]int{}}
+
+	// The client's context is only used for dialing, so it outlives the run
+	// and doesn't cut off requests still in flight at the end.
+	c := newModeClient(context.Background(), mode, d)
+	defer c.close()
+	c.transport.MaxIdleConnsPerHost = concurrency
+	dial := c.transport.DialTLS
+	c.transport.DialTLS = func(network, addr string) (net.Conn, error) {
+		start := time.Now()
+		conn, err := dial(network, addr)
+		if err == nil {
+			stats.mu.Lock()
+			stats.connects = append(stats.connects, time.Since(start))
+			stats.mu.Unlock()
+		}
+		return conn, err
+	}
+
+	// With -rps, workers wait for a tick before each request.
+	var ticks <-chan time.Time
+	if rps > 0 {
+		ticker := time.NewTicker(time.Duration(float64(time.Second) / rps))
+		defer ticker.Stop()
+		ticks = ticker.C
+	}
+
+	start := time.Now()
+	var wg sync.WaitGroup
+	for i := 0; i < concurrency; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for {
+				if ticks != nil {
+					select {
+					case <-ticks:
+					case <-ctx.Done():
+						return
+					}
+				}
+				if ctx.Err() != nil {
+					return
+				}
+				loadRequest(c, tmpl, timeout, stats)
+			}
+		}()
+	}
+	wg.Wait()
+	elapsed := time.Since(start)
+
+	return loadResult{
+		Mode:          mode,
+		Requests:      len(stats.latencies) + stats.errors,
+		Errors:        stats.errors,
+		Statuses:      stats.statuses,
+		Protos:        stats.protos,
+		ThroughputRPS: round(float64(len(stats.latencies)) / elapsed.Seconds()),
+		Latency:       summarize(stats.latencies),
+		Connections:   len(stats.connects),
+		ConnectMS:     mean(stats.connects),
+		FirstError:    stats.firstError,
+	}
+}
+
+// loadRequest sends one request and reads the whole response.
+func loadRequest(c *modeClient, tmpl *loadTemplate, timeout time.Duration, stats *loadStats) {
+	resp, latency, err := timedRequest(c, tmpl, timeout)
+	if err != nil {
+		stats.fail(err)
+		return
+	}
+	stats.mu.Lock()
+	defer stats.mu.Unlock()
+	stats.latencies = append(stats.latencies, latency)
+	stats.statuses[fmt.Sprint(resp.StatusCode)]++
+	stats.protos[resp.Proto]++
+}
+
+// timedRequest sends a request and reads the response to the end, and says
+// how long that took.
+func timedRequest(c *modeClient, tmpl *loadTemplate, timeout time.Duration) (*http.Response, time.Duration, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+	req, err := tmpl.request(ctx)
+	if err != nil {
+		return nil, 0, err
+	}
+	start := time.Now()
+	resp, err := c.do(req, nil)
+	if err != nil {
+		return nil, 0, err
+	}
+	_, err = io.Copy(ioutil.Discard, resp.Body)
+	resp.Body.Close()
+	return resp, time.Since(start), err
+}
+
+// coldSamples is how many requests coldRequest averages over.
+const coldSamples = 5
+
+// coldRequest is the mean time a request takes on a connection of its own,
+// connecting, the TLS handshake and any upgrade included. The requests go
+// one at a time, so nothing else is competing for Envoy or the backend.
+func coldRequest(mode string, d *dialer, tmpl *loadTemplate, timeout time.Duration) float64 {
+	var samples []time.Duration
+	for i := 0; i < coldSamples; i++ {
+		c := newModeClient(context.Background(), mode, d)
+		if _, latency, err := timedRequest(c, tmpl, timeout); err == nil {
+			samples = append(samples, latency)
+		}
+		c.close()
+	}
+	return mean(samples)
+}
+
+func (s *loadStats) fail(err error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.errors++
+	if s.firstError == "" {
+		s.firstError = err.Error()
+	}
+}
+
+func summarize(latencies []time.Duration) latencySummary {
+	if len(latencies) == 0 {
+		return latencySummary{}
+	}
+	sorted := append([]time.Duration(nil), latencies...)
+	sort.Slice(sorted, func(i, j int) bool { return sorted[i] < sorted[j] })
+	at := func(p float64) float64 {
+		i := int(math.Ceil(p*float64(len(sorted)))) - 1
+		if i < 0 {
+			i = 0
+		}
+		return ms(sorted[i])
+	}
+	return latencySummary{
+		Mean: mean(sorted),
+		P50:  at(0.50),
+		P90:  at(0.90),
+		P99:  at(0.99),
+		Max:  ms(sorted[len(sorted)-1]),
+	}
+}
+
+func mean(ds []time.Duration) float64 {
+	if len(ds) == 0 {
+		return 0
+	}
+	var total time.Duration
+	for _, d := range ds {
+		total += d
+	}
+	return ms(total / time.Duration(len(ds)))
+}
+
+func ms(d time.Duration) float64 {
+	return round(float64(d.Microseconds()) / 1000)
+}
+
+// round keeps two decimal places, which is as much as the numbers are worth
+// and keeps the report readable.
+func round(f float64) float64 {
+	return math.Round(f*100) / 100
+}
+
+func writeLoadTable(w io.Writer, report *loadReport) {
+	tw := tabwriter.NewWriter(w, 0, 8, 2, ' ', 0)
+	fmt.Fprintln(tw, "MODE\tREQUESTS\tERRORS\tRPS\tP50\tP90\tP99\tMAX\tCONNS\tCOLD")
+	for _, r := range report.Results {
+		fmt.Fprintf(tw, "%s\t%d\t%d\t%.1f\t%.2fms\t%.2fms\t%.2fms\t%.2fms\t%d\t%.2fms\n",
+			r.Mode, r.Requests, r.Errors, r.ThroughputRPS, r.Latency.P50, r.Latency.P90, r.Latency.P99, r.Latency.Max,
+			r.Connections, r.ColdRequestMS)
+	}
+	tw.Flush()
+	if report.UpgradeOverheadMS != nil {
+		fmt.Fprintf(w, "Upgrade overhead: %.2fms per new connection\n", *report.UpgradeOverheadMS)
+	}
+}
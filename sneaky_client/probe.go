@@ -0,0 +1,251 @@
+package main
+
+import (
+	"context"
+	"crypto/tls"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"reflect"
+	"sort"
+	"strings"
+	"text/tabwriter"
+	"time"
+
+	"github.com/gerg/net/http"
+)
+
+// probePath is one way of getting a request to Envoy's backend.
+type probePath struct {
+	name string
+	mode string
+	alpn []string
+}
+
+// probePaths are tried in this order, each on a connection of its own.
+var probePaths = []probePath{
+	{name: "alpn-h2", mode: modeALPN, alpn: []string{"h2"}},
+	{name: "alpn-http/1.1", mode: modeHTTP1, alpn: []string{"http/1.1"}},
+	{name: "upgrade-h2c", mode: modeUpgrade},
+	{name: "prior-knowledge", mode: modePriorKnowledge},
+	{name: "http/1.1", mode: modeHTTP1},
+}
+
+// probeResult is what became of one path.
+type probeResult struct {
+	Path      string            `json:"path"`
+	OK        bool              `json:"ok"`
+	ALPN      string            `json:"alpn"` // what the server selected, "none" for nothing
+	Proto     string            `json:"proto,omitempty"`
+	Status    int               `json:"status,omitempty"`
+	Observed  string            `json:"observed"`
+	Settings  map[string]uint64 `json:"peer_settings,omitempty"`
+	LatencyMS float64           `json:"latency_ms"`
+	Error     string            `json:"error,omitempty"`
+}
+
+// runProbe tries every path against a URL and reports which of them work. It
+// returns exitOK if at least one did.
+func runProbe(args []string) int {
+	fs := flag.NewFlagSet("sneaky-client probe", flag.ContinueOnError)
+	fs.Usage = func() {
+		fmt.Fprintf(fs.Output(), "Usage: sneaky-client probe [flags] [URL]\n\n")
+		fmt.Fprintf(fs.Output(), "Sends a GET for URL (default https://localhost:61001/) over ALPN h2, ALPN\nhttp/1.1, Upgrade: h2c, prior-knowledge h2 and plain HTTP/1.1, and reports\nwhich worked.\n\nFlags:\n")
+		fs.PrintDefaults()
+	}
+	var conn connFlags
+	conn.register(fs)
+	var headers headerFlags
+	fs.Var(&headers, "H", "request header, \"Name: value\"; may be repeated")
+	asJSON := fs.Bool("json", false, "write the results as JSON instead of a table")
+	verbose := fs.Bool("v", false, "show each phase of every connection on stderr")
+	timeout := fs.Duration("timeout", 10*time.Second, "give up on each path after this long")
+	if err := fs.Parse(args); err != nil {
+		return exitUsage
+	}
+	if fs.NArg() > 1 {
+		fmt.Fprintf(os.Stderr, "Expected one URL, got %d\n", fs.NArg())
+		return exitUsage
+	}
+	target := "https://localhost:61001/"
+	if fs.NArg() == 1 {
+		target = fs.Arg(0)
+	}
+
+	phases := newPhaseLog(os.Stderr, *verbose)
+	d, err := conn.newDialer(phases)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "%s\n", err)
+		return exitFailure
+	}
+
+	var results []probeResult
+	for _, p := range probePaths {
+		req, err := http.NewRequest(http.MethodGet, target, nil)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "Making request: %s\n", err)
+			return exitUsage
+		}
+		if req.URL.Scheme != "https" {
+			fmt.Fprintf(os.Stderr, "Only https URLs are supported, got %s\n", target)
+			return exitUsage
+		}
+		for _, h := range headers {
+			name, value := splitHeader(h)
+			if strings.EqualFold(name, "Host") {
+				req.Host = value
+				continue
+			}
+			req.Header.Add(name, value)
+		}
+		phases.printf("Probing %s", p.name)
+		results = append(results, probe(p, d, req, *timeout))
+	}
+
+	if *asJSON {
+		enc := json.NewEncoder(os.Stdout)
+		enc.SetIndent("", "  ")
+		enc.Encode(results)
+	} else {
+		writeProbeTable(os.Stdout, results)
+	}
+	for _, r := range results {
+		if r.OK {
+			return exitOK
+		}
+	}
+	return exitFailure
+}
+
+// probe sends req down path p with a client of its own, so nothing is
+// reused from another path.
+func probe(p probePath, d *dialer, req *http.Request, timeout time.Duration) probeResult {
+	r := probeResult{Path: p.name, ALPN: "none"}
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+
+	pd := *d
+	pd.handshakes = func(state tls.ConnectionState) {
+		if state.NegotiatedProtocol != "" {
+			r.ALPN = state.NegotiatedProtocol
+		}
+	}
+	c := newModeClientOffering(ctx, p.mode, &pd, p.alpn)
+	defer c.close()
+
+	start := time.Now()
+	resp, err := c.do(req.WithContext(ctx), d.phases)
+	r.LatencyMS = float64(time.Since(start).Microseconds()) / 1000
+	if err != nil {
+		r.Error = err.Error()
+		r.Observed = "no response"
+		if p.mode == modePriorKnowledge {
+			r.Observed = "no preface"
+		}
+		return r
+	}
+	defer resp.Body.Close()
+	io.Copy(ioutil.Discard, io.LimitReader(resp.Body, 1<<20))
+
+	r.Proto = resp.Proto
+	r.Status = resp.StatusCode
+	r.Settings = peerSettings(resp)
+	r.Observed = fmt.Sprintf("%d over %s", resp.StatusCode, resp.Proto)
+	switch p.mode {
+	case modeALPN:
+		r.OK = resp.ProtoMajor == 2
+		if !r.OK {
+			r.Error = "server did not select h2"
+		}
+	case modeUpgrade:
+		r.OK = resp.ProtoMajor == 2
+		if r.OK {
+			r.Observed = fmt.Sprintf("101, then %d on stream 1", resp.StatusCode)
+		} else {
+			r.Error = "upgrade declined"
+		}
+	default:
+		r.OK = true
+	}
+	return r
+}
+
+// peerSettings digs the settings the server sent out of the fork's HTTP/2
+// client connection that carried resp, or returns nil if resp came over
+// HTTP/1.1. The connection keeps them in unexported fields, which reflect
+// can read though not export; a setting the server left out shows as the
+// spec's default.
+func peerSettings(resp *http.Response) map[string]uint64 {
+	if resp.ProtoMajor != 2 {
+		return nil
+	}
+	// The body is an http2transportResponseBody, maybe inside an
+	// http2gzipReader, and its stream points at the connection.
+	v := reflect.ValueOf(resp.Body)
+	for _, field := range []string{"body", "cs", "cc"} {
+		for v.Kind() == reflect.Interface || v.Kind() == reflect.Ptr {
+			v = v.Elem()
+		}
+		if v.Kind() != reflect.Struct {
+			return nil
+		}
+		if f := v.FieldByName(field); f.IsValid() {
+			v = f
+		} else if field != "body" {
+			return nil
+		}
+	}
+	v = reflect.Indirect(v)
+	if v.Kind() != reflect.Struct {
+		return nil
+	}
+
+	settings := map[string]uint64{}
+	for name, field := range map[string]string{
+		"MAX_CONCURRENT_STREAMS": "maxConcurrentStreams",
+		"INITIAL_WINDOW_SIZE":    "initialWindowSize",
+		"MAX_FRAME_SIZE":         "maxFrameSize",
+		"MAX_HEADER_LIST_SIZE":   "peerMaxHeaderListSize",
+	} {
+		if f := v.FieldByName(field); f.IsValid() {
+			settings[name] = f.Uint()
+		}
+	}
+	return settings
+}
+
+func writeProbeTable(w io.Writer, results []probeResult) {
+	tw := tabwriter.NewWriter(w, 0, 8, 2, ' ', 0)
+	fmt.Fprintln(tw, "PATH\tOK\tALPN\tOBSERVED\tLATENCY\tPEER SETTINGS")
+	for _, r := range results {
+		ok := "yes"
+		if !r.OK {
+			ok = "no"
+		}
+		observed := r.Observed
+		if r.Error != "" {
+			observed += ": " + r.Error
+		}
+		fmt.Fprintf(tw, "%s\t%s\t%s\t%s\t%.1fms\t%s\n", r.Path, ok, r.ALPN, observed, r.LatencyMS, settingsString(r.Settings))
+	}
+	tw.Flush()
+}
+
+func settingsString(settings map[string]uint64) string {
+	if settings == nil {
+		return "-"
+	}
+	var parts []string
+	for name, v := range settings {
+		if name == "MAX_HEADER_LIST_SIZE" && v == 1<<64-1 {
+			parts = append(parts, name+"=unlimited")
+			continue
+		}
+		parts = append(parts, fmt.Sprintf("%s=%d", name, v))
+	}
+	sort.Strings(parts)
+	return strings.Join(parts, " ")
+}
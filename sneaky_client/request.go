@@ -0,0 +1,476 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/tls"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/textproto"
+	"net/url"
+	"os"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gerg/net/http"
+	"github.com/gerg/net/http/httptrace"
+)
+
+// Exit codes. They are curl's where curl has one for the same thing, so
+// scripts written against curl keep working.
+const (
+	exitOK        = 0
+	exitFailure   = 1  // anything not covered below
+	exitUsage     = 2  // bad flags or arguments
+	exitResolve   = 6  // couldn't resolve the host
+	exitConnect   = 7  // couldn't connect
+	exitHTTP2     = 16 // HTTP/2 framing or stream error
+	exitHTTPError = 22 // status 400 or above, with -fail
+	exitReadFile  = 26 // couldn't read the request body
+	exitTimeout   = 28 // -timeout passed
+	exitTLS       = 35 // TLS handshake failed
+	exitRecv      = 56 // the request failed after connecting
+)
+
+// Modes say how a request gets to speak HTTP/2 to Envoy, if at all.
+const (
+	modeUpgrade        = "upgrade"         // no ALPN, then Upgrade: h2c
+	modePriorKnowledge = "prior-knowledge" // no ALPN, then the HTTP/2 preface
+	modeALPN           = "alpn"            // ALPN h2, falling back to http/1.1
+	modeHTTP1          = "http1.1"         // HTTP/1.1 only
+)
+
+// h2cSettings is the base64url-encoded SETTINGS payload sent in the
+// HTTP2-Settings header of the upgrade request.
+const h2cSettings = "AAMAAABkAARAAAAAAAIAAAAA"
+
+// headerFlags collects repeated -H flags.
+type headerFlags []string
+
+func (h *headerFlags) String() string { return strings.Join(*h, ", ") }
+
+func (h *headerFlags) Set(v string) error {
+	if !strings.Contains(v, ":") {
+		return fmt.Errorf("%q is not a header, expected \"Name: value\"", v)
+	}
+	*h = append(*h, v)
+	return nil
+}
+
+// runRequest sends one request, like curl, and writes the response body to
+// stdout. It returns the exit code.
+func runRequest(args []string) int {
+	fs := flag.NewFlagSet("sneaky-client", flag.ContinueOnError)
+	fs.Usage = func() {
+		fmt.Fprintf(fs.Output(), "Usage: sneaky-client [flags] [URL]\n\n")
+		fmt.Fprintf(fs.Output(), "Sends a request to URL (default https://localhost:61001/) and writes the\nresponse body to stdout.\n\nFlags:\n")
+		fs.PrintDefaults()
+	}
+	var conn connFlags
+	conn.register(fs)
+	method := fs.String("X", "", "request method, GET by default or POST with a body")
+	var headers headerFlags
+	fs.Var(&headers, "H", "request header, \"Name: value\"; may be repeated")
+	data := fs.String("d", "", "request body; @file reads it from a file and @- from stdin")
+	mode := fs.String("mode", modeUpgrade, "how to get to HTTP/2: upgrade, prior-knowledge, alpn or http1.1")
+	verbose := fs.Bool("v", false, "show each phase of the connection and the headers on stderr")
+	include := fs.Bool("i", false, "write the status line and response headers to stdout before the body")
+	fail := fs.Bool("fail", false, "exit with 22 on a status of 400 or above")
+	timeout := fs.Duration("timeout", 0, "give up on the whole request after this long, 0 for never")
+	if err := fs.Parse(args); err != nil {
+		return exitUsage
+	}
+	if fs.NArg() > 1 {
+		fmt.Fprintf(os.Stderr, "Expected one URL, got %d\n", fs.NArg())
+		return exitUsage
+	}
+	target := "https://localhost:61001/"
+	if fs.NArg() == 1 {
+		target = fs.Arg(0)
+	}
+	switch *mode {
+	case modeUpgrade, modePriorKnowledge, modeALPN, modeHTTP1:
+	default:
+		fmt.Fprintf(os.Stderr, "Unknown -mode %q, want upgrade, prior-knowledge, alpn or http1.1\n", *mode)
+		return exitUsage
+	}
+
+	phases := newPhaseLog(os.Stderr, *verbose)
+	d, err := conn.newDialer(phases)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "%s\n", err)
+		return exitFailure
+	}
+
+	body, err := requestBody(*data)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Reading request body: %s\n", err)
+		return exitReadFile
+	}
+	if *method == "" {
+		*method = http.MethodGet
+		if body != nil {
+			*method = http.MethodPost
+		}
+	}
+
+	ctx := context.Background()
+	if *timeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, *timeout)
+		defer cancel()
+	}
+
+	var bodyReader io.Reader
+	if body != nil {
+		bodyReader = bytes.NewReader(body)
+	}
+	req, err := http.NewRequestWithContext(ctx, *method, target, bodyReader)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Making request: %s\n", err)
+		return exitUsage
+	}
+	if req.URL.Scheme != "https" {
+		fmt.Fprintf(os.Stderr, "Only https URLs are supported, got %s\n", target)
+		return exitUsage
+	}
+	for _, h := range headers {
+		name, value := splitHeader(h)
+		if strings.EqualFold(name, "Host") {
+			req.Host = value
+			continue
+		}
+		req.Header.Add(name, value)
+	}
+
+	c := newModeClient(ctx, *mode, d)
+	defer c.close()
+	resp, err := c.do(req, phases)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "%s\n", err)
+		return exitCode(err)
+	}
+	defer resp.Body.Close()
+
+	phases.response(resp)
+	if *include {
+		writeResponseHead(os.Stdout, resp)
+	}
+	if _, err := io.Copy(os.Stdout, resp.Body); err != nil {
+		fmt.Fprintf(os.Stderr, "Reading response body: %s\n", err)
+		return exitCode(err)
+	}
+	phases.trailers(resp)
+	phases.printf("Done")
+
+	if *fail && resp.StatusCode >= 400 {
+		return exitHTTPError
+	}
+	return exitOK
+}
+
+// requestBody reads -d: the string itself, or a file or stdin with @.
+func requestBody(data string) ([]byte, error) {
+	switch {
+	case data == "":
+		return nil, nil
+	case data == "@-":
+		return ioutil.ReadAll(os.Stdin)
+	case strings.HasPrefix(data, "@"):
+		return ioutil.ReadFile(data[1:])
+	default:
+		return []byte(data), nil
+	}
+}
+
+func splitHeader(h string) (string, string) {
+	i := strings.IndexByte(h, ':')
+	return textproto.TrimString(h[:i]), textproto.TrimString(h[i+1:])
+}
+
+// exitCode picks the exit code for a failed request.
+func exitCode(err error) int {
+	var connErr *connectError
+	var dnsErr *net.DNSError
+	var tlsErr *tlsError
+	switch {
+	case isTimeout(err):
+		return exitTimeout
+	case errors.As(err, &dnsErr):
+		return exitResolve
+	case errors.As(err, &connErr):
+		return exitConnect
+	case errors.As(err, &tlsErr):
+		return exitTLS
+	case strings.Contains(err.Error(), "http2:"), strings.Contains(err.Error(), "stream error"):
+		return exitHTTP2
+	default:
+		return exitRecv
+	}
+}
+
+// modeClient sends requests the way its mode says. Redirects are not
+// followed, like curl without -L.
+type modeClient struct {
+	ctx       context.Context
+	mode      string
+	dialer    *dialer
+	transport *http.Transport
+	client    *http.Client
+
+	upgradeMu      sync.Mutex
+	upgradeOffered bool
+}
+
+// offers is the ALPN each mode offers in the TLS handshake.
+var offers = map[string][]string{
+	modeALPN:  {"h2", "http/1.1"},
+	modeHTTP1: {"http/1.1"},
+}
+
+func newModeClient(ctx context.Context, mode string, d *dialer) *modeClient {
+	return newModeClientOffering(ctx, mode, d, offers[mode])
+}
+
+// newModeClientOffering is newModeClient offering alpn instead of the mode's
+// usual ALPN.
+func newModeClientOffering(ctx context.Context, mode string, d *dialer, alpn []string) *modeClient {
+	t := &http.Transport{ForceAttemptHTTP2: true}
+	// With no ALPN, upgrade connections start out as HTTP/1.1 and the
+	// transport takes the h2c upgrade when Envoy's backend offers it.
+	// Prior-knowledge connections are made by priorKnowledge instead.
+	t.DialTLS = d.dialerFunc(ctx, alpn)
+	if mode == modeHTTP1 {
+		// A non-nil, empty TLSNextProto turns HTTP/2 off.
+		t.TLSNextProto = map[string]func(string, *tls.Conn) http.RoundTripper{}
+	}
+	// This sets HTTP/2 up, which fills in TLSNextProto for priorKnowledge.
+	t.CloseIdleConnections()
+
+	c := &modeClient{ctx: ctx, mode: mode, dialer: d, transport: t}
+	var rt http.RoundTripper = t
+	if mode == modePriorKnowledge {
+		rt = roundTripperFunc(c.priorKnowledge)
+	}
+	c.client = &http.Client{
+		Transport: rt,
+		CheckRedirect: func(*http.Request, []*http.Request) error {
+			return http.ErrUseLastResponse
+		},
+	}
+	return c
+}
+
+type roundTripperFunc func(*http.Request) (*http.Response, error)
+
+func (f roundTripperFunc) RoundTrip(req *http.Request) (*http.Response, error) { return f(req) }
+
+// priorKnowledge sends req as HTTP/2 straight after a TLS handshake without
+// ALPN. The fork's HTTP/2 client doesn't care how the connection came to
+// speak HTTP/2: handing it a connection through TLSNextProto, as the
+// transport would after negotiating h2, is enough.
+func (c *modeClient) priorKnowledge(req *http.Request) (*http.Response, error) {
+	addr := canonicalAddr(req.URL)
+	conn, err := c.dialer.dialTLS(c.ctx, addr, nil)
+	if err != nil {
+		return nil, err
+	}
+	c.dialer.phases.printf("Sending the HTTP/2 preface without negotiating it")
+	return c.transport.TLSNextProto["h2"](addr, conn).RoundTrip(req)
+}
+
+// do sends req. In upgrade mode it offers the upgrade with it, or, if req has
+// a body, with a bodyless OPTIONS request first: the upgrade request is sent
+// whole as HTTP/1.1 before the switch, and h2c backends drop its body.
+//
+// The upgrade is offered once per client, and requests sent meanwhile wait
+// for it. Once a connection is upgraded the transport sends everything over
+// it, and the fork's HTTP/2 client refuses requests with Upgrade headers.
+func (c *modeClient) do(req *http.Request, phases *phaseLog) (*http.Response, error) {
+	if c.mode != modeUpgrade {
+		return c.client.Do(phases.trace(req))
+	}
+	c.upgradeMu.Lock()
+	if c.upgradeOffered {
+		c.upgradeMu.Unlock()
+		return c.client.Do(phases.trace(req))
+	}
+	defer c.upgradeMu.Unlock()
+	c.upgradeOffered = true
+
+	if req.Body == nil {
+		resp, err := c.client.Do(phases.trace(withUpgradeHeaders(req)))
+		if err != nil {
+			return nil, err
+		}
+		if err := checkSwitch(resp); err != nil {
+			return nil, err
+		}
+		phases.upgradeResult(resp)
+		return resp, nil
+	}
+
+	phases.printf("The request has a body, so offering the upgrade with OPTIONS first")
+	primer, err := http.NewRequestWithContext(req.Context(), http.MethodOptions, req.URL.Scheme+"://"+req.URL.Host, nil)
+	if err != nil {
+		return nil, err
+	}
+	primer.Host = req.Host
+	resp, err := c.client.Do(phases.trace(withUpgradeHeaders(primer)))
+	if err != nil {
+		return nil, err
+	}
+	if err := checkSwitch(resp); err != nil {
+		return nil, err
+	}
+	phases.response(resp)
+	io.Copy(ioutil.Discard, resp.Body)
+	resp.Body.Close()
+	phases.upgradeResult(resp)
+	return c.client.Do(phases.trace(req))
+}
+
+// checkSwitch turns down a 101 the transport didn't take as the h2c upgrade,
+// such as one switching to another protocol. Its body would be the raw
+// connection, which nothing ever ends.
+func checkSwitch(resp *http.Response) error {
+	if resp.StatusCode != http.StatusSwitchingProtocols {
+		return nil
+	}
+	resp.Body.Close()
+	return fmt.Errorf("server switched protocols to %q instead of h2c", resp.Header.Get("Upgrade"))
+}
+
+func (c *modeClient) close() {
+	c.transport.CloseIdleConnections()
+}
+
+func withUpgradeHeaders(req *http.Request) *http.Request {
+	req = req.Clone(req.Context())
+	req.Header.Set("Upgrade", "h2c")
+	req.Header.Set("HTTP2-Settings", h2cSettings)
+	req.Header.Set("Connection", "Upgrade, HTTP2-Settings")
+	return req
+}
+
+// canonicalAddr is u's host and port, with the port defaulting to 443.
+func canonicalAddr(u *url.URL) string {
+	port := u.Port()
+	if port == "" {
+		port = "443"
+	}
+	return net.JoinHostPort(u.Hostname(), port)
+}
+
+func writeResponseHead(w io.Writer, resp *http.Response) {
+	fmt.Fprintf(w, "%s %s\r\n", resp.Proto, resp.Status)
+	for _, line := range headerLines(resp.Header) {
+		fmt.Fprintf(w, "%s\r\n", line)
+	}
+	fmt.Fprint(w, "\r\n")
+}
+
+func headerLines(h http.Header) []string {
+	var lines []string
+	for name, values := range h {
+		for _, v := range values {
+			lines = append(lines, name+": "+v)
+		}
+	}
+	sort.Strings(lines)
+	return lines
+}
+
+// phaseLog writes what -v shows: "*" lines for each phase of a connection,
+// with the time since the start, and ">" and "<" lines for the headers as
+// they went out and came back, like curl.
+type phaseLog struct {
+	w       io.Writer
+	verbose bool
+	start   time.Time
+}
+
+func newPhaseLog(w io.Writer, verbose bool) *phaseLog {
+	return &phaseLog{w: w, verbose: verbose, start: time.Now()}
+}
+
+func (l *phaseLog) printf(format string, args ...interface{}) {
+	if l == nil || !l.verbose {
+		return
+	}
+	fmt.Fprintf(l.w, "* [%7.1fms] %s\n", float64(time.Since(l.start).Microseconds())/1000, fmt.Sprintf(format, args...))
+}
+
+// warnf is shown whether or not -v is.
+func (l *phaseLog) warnf(format string, args ...interface{}) {
+	if l == nil {
+		return
+	}
+	fmt.Fprintf(l.w, "WARNING: %s\n", fmt.Sprintf(format, args...))
+}
+
+// trace adds a client trace reporting req's phases.
+func (l *phaseLog) trace(req *http.Request) *http.Request {
+	if l == nil || !l.verbose {
+		return req
+	}
+	l.printf("Sending %s %s", req.Method, req.URL)
+	trace := &httptrace.ClientTrace{
+		GotConn: func(info httptrace.GotConnInfo) {
+			if info.Reused {
+				l.printf("Reusing the connection to %s", info.Conn.RemoteAddr())
+			}
+		},
+		WroteHeaderField: func(name string, values []string) {
+			for _, v := range values {
+				fmt.Fprintf(l.w, "> %s: %s\n", name, v)
+			}
+		},
+		WroteRequest: func(info httptrace.WroteRequestInfo) {
+			if info.Err != nil {
+				l.printf("Writing the request failed: %s", info.Err)
+				return
+			}
+			l.printf("Request sent")
+		},
+		GotFirstResponseByte: func() {
+			l.printf("First response byte")
+		},
+	}
+	return req.WithContext(httptrace.WithClientTrace(req.Context(), trace))
+}
+
+func (l *phaseLog) response(resp *http.Response) {
+	if l == nil || !l.verbose {
+		return
+	}
+	fmt.Fprintf(l.w, "< %s %s\n", resp.Proto, resp.Status)
+	for _, line := range headerLines(resp.Header) {
+		fmt.Fprintf(l.w, "< %s\n", line)
+	}
+}
+
+func (l *phaseLog) trailers(resp *http.Response) {
+	if l == nil || !l.verbose {
+		return
+	}
+	for _, line := range headerLines(resp.Trailer) {
+		fmt.Fprintf(l.w, "< (trailer) %s\n", line)
+	}
+}
+
+// upgradeResult says what became of an upgrade offer. The fork's transport
+// takes the 101 itself and hands back the response to stream 1.
+func (l *phaseLog) upgradeResult(resp *http.Response) {
+	if resp.ProtoMajor == 2 {
+		l.printf("Upgraded to h2c: 101 Switching Protocols, the response came on stream 1")
+	} else {
+		l.printf("Upgrade declined, the response came over %s", resp.Proto)
+	}
+}
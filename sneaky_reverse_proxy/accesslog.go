@@ -0,0 +1,275 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"math/rand"
+	"net"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gerg/net/http"
+	"github.com/gerg/net/http/httptrace"
+)
+
+// Upstream negotiation results recorded in the access log.
+const (
+	negotiationUpgraded    = "upgraded"    // Envoy's backend answered the h2c upgrade with 101
+	negotiationDeclined    = "declined"    // the upgrade was offered but the request stayed on HTTP/1.1
+	negotiationReused      = "reused"      // sent as a stream on an already upgraded connection
+	negotiationPassthrough = "passthrough" // client-initiated upgrade forwarded over HTTP/1.1
+	negotiationNone        = "none"        // sent over HTTP/1.1 without offering the upgrade
+)
+
+// accessLogEntry is one access log line. Timings are in milliseconds and are
+// zero when the step did not happen for this request.
+type accessLogEntry struct {
+	mu sync.Mutex
+
+	Time                 time.Time `json:"time"`
+	RequestID            string    `json:"request_id"`
+	Method               string    `json:"method"`
+	Authority            string    `json:"authority"`
+	Path                 string    `json:"path"`
+	RemoteAddr           string    `json:"remote_addr"`
+	DownstreamProto      string    `json:"downstream_proto"`
+	DownstreamALPN       string    `json:"downstream_alpn"`
+	DownstreamTLSVersion string    `json:"downstream_tls_version"`
+	ClientCertSubject    string    `json:"client_cert_subject"`
+	UpstreamNegotiation  string    `json:"upstream_negotiation"`
+	UpstreamProto        string    `json:"upstream_proto"`
+	UpstreamConnReused   bool      `json:"upstream_conn_reused"`
+	Status               int       `json:"status"`
+	BytesReceived        int64     `json:"bytes_received"`
+	BytesSent            int64     `json:"bytes_sent"`
+	DurationMs           float64   `json:"duration_ms"`
+	UpstreamTLSMs        float64   `json:"upstream_tls_ms"`
+	UpgradeMs            float64   `json:"upgrade_ms"`
+	FirstByteMs          float64   `json:"first_byte_ms"`
+	Error                string    `json:"error,omitempty"`
+}
+
+type accessLogKey struct{}
+
+// accessLogFromContext returns the entry for the request being served, or
+// nil when the request is not being logged.
+func accessLogFromContext(ctx context.Context) *accessLogEntry {
+	e, _ := ctx.Value(accessLogKey{}).(*accessLogEntry)
+	return e
+}
+
+func (e *accessLogEntry) update(f func(e *accessLogEntry)) {
+	if e == nil {
+		return
+	}
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	f(e)
+}
+
+// accessLogger writes an entry per request in either JSON or a key=value text
+// format. sample is the fraction of requests that get logged.
+type accessLogger struct {
+	out    *log.Logger
+	format string
+	sample float64
+}
+
+func newAccessLogger(w io.Writer, format string, sample float64) (*accessLogger, error) {
+	if format != "json" && format != "text" {
+		return nil, fmt.Errorf("unknown access log format %q, want json or text", format)
+	}
+	if sample < 0 || sample > 1 {
+		return nil, fmt.Errorf("access log sample rate %v is not between 0 and 1", sample)
+	}
+	return &accessLogger{out: log.New(w, "", 0), format: format, sample: sample}, nil
+}
+
+// wrap logs every request that h serves.
+func (l *accessLogger) wrap(h http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if l.sample == 0 || (l.sample < 1 && rand.Float64() >= l.sample) {
+			h.ServeHTTP(w, r)
+			return
+		}
+
+		start := time.Now()
+		e := &accessLogEntry{
+			Time:            start.UTC(),
+			RequestID:       requestIDFromContext(r.Context()),
+			Method:          r.Method,
+			Authority:       r.Host,
+			Path:            r.URL.RequestURI(),
+			RemoteAddr:      r.RemoteAddr,
+			DownstreamProto: r.Proto,
+		}
+		if r.TLS != nil {
+			e.DownstreamALPN = r.TLS.NegotiatedProtocol
+			e.DownstreamTLSVersion = tlsVersionName(r.TLS.Version)
+			if len(r.TLS.PeerCertificates) > 0 {
+				e.ClientCertSubject = r.TLS.PeerCertificates[0].Subject.String()
+			}
+		}
+
+		ctx := context.WithValue(r.Context(), accessLogKey{}, e)
+		ctx = httptrace.WithClientTrace(ctx, e.clientTrace(start))
+		r = r.WithContext(ctx)
+
+		body := &countingReader{ReadCloser: r.Body}
+		if r.Body != nil {
+			r.Body = body
+		}
+		lw := &recordingResponseWriter{ResponseWriter: w}
+
+		defer func() {
+			e.update(func(e *accessLogEntry) {
+				e.Status = lw.status
+				if e.Status == 0 {
+					e.Status = http.StatusOK
+				}
+				e.BytesReceived = body.n
+				e.BytesSent = lw.n
+				e.DurationMs = millis(time.Since(start))
+			})
+			l.write(e)
+		}()
+		h.ServeHTTP(lw, r)
+	})
+}
+
+// clientTrace records what happened on the way to Envoy. A request that had
+// to upgrade a connection first shows up with the primer's TLS handshake and
+// the connection the request itself went out on.
+//
+// The upstream dialer does the TLS handshake itself, out of sight of the
+// trace, so its duration is read off a new connection instead.
+func (e *accessLogEntry) clientTrace(start time.Time) *httptrace.ClientTrace {
+	return &httptrace.ClientTrace{
+		GotConn: func(info httptrace.GotConnInfo) {
+			var handshake time.Duration
+			if c, ok := info.Conn.(interface{ tlsHandshakeDuration() time.Duration }); ok && !info.Reused {
+				handshake = c.tlsHandshakeDuration()
+			}
+			e.update(func(e *accessLogEntry) {
+				e.UpstreamConnReused = info.Reused
+				e.UpstreamTLSMs += millis(handshake)
+			})
+		},
+		GotFirstResponseByte: func() {
+			d := time.Since(start)
+			e.update(func(e *accessLogEntry) {
+				if e.FirstByteMs == 0 {
+					e.FirstByteMs = millis(d)
+				}
+			})
+		},
+	}
+}
+
+func (l *accessLogger) write(e *accessLogEntry) {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+
+	if l.format == "json" {
+		line, err := json.Marshal(e)
+		if err != nil {
+			log.Printf("Encoding access log entry: %s\n", err)
+			return
+		}
+		l.out.Print(string(line))
+		return
+	}
+
+	// The text format is the JSON fields as key=value pairs, in a stable order.
+	var fields map[string]interface{}
+	line, _ := json.Marshal(e)
+	json.Unmarshal(line, &fields)
+	keys := make([]string, 0, len(fields))
+	for k := range fields {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	var b strings.Builder
+	for i, k := range keys {
+		if i > 0 {
+			b.WriteByte(' ')
+		}
+		v := fmt.Sprint(fields[k])
+		if v == "" || strings.ContainsAny(v, " \"=") {
+			v = fmt.Sprintf("%q", v)
+		}
+		fmt.Fprintf(&b, "%s=%s", k, v)
+	}
+	l.out.Print(b.String())
+}
+
+func millis(d time.Duration) float64 {
+	return float64(d.Microseconds()) / 1000
+}
+
+type countingReader struct {
+	io.ReadCloser
+	n int64
+}
+
+func (r *countingReader) Read(p []byte) (int, error) {
+	n, err := r.ReadCloser.Read(p)
+	r.n += int64(n)
+	return n, err
+}
+
+// recordingResponseWriter records the status and body size. It passes Flush,
+// Hijack and CloseNotify through, since ReverseProxy relies on all three for
+// streaming, WebSocket upgrades and cancellation.
+type recordingResponseWriter struct {
+	http.ResponseWriter
+	status int
+	n      int64
+}
+
+func (w *recordingResponseWriter) WriteHeader(status int) {
+	if w.status == 0 {
+		w.status = status
+	}
+	w.ResponseWriter.WriteHeader(status)
+}
+
+func (w *recordingResponseWriter) Write(p []byte) (int, error) {
+	if w.status == 0 {
+		w.status = http.StatusOK
+	}
+	n, err := w.ResponseWriter.Write(p)
+	w.n += int64(n)
+	return n, err
+}
+
+func (w *recordingResponseWriter) Flush() {
+	if f, ok := w.ResponseWriter.(http.Flusher); ok {
+		f.Flush()
+	}
+}
+
+func (w *recordingResponseWriter) Hijack() (net.Conn, *bufio.ReadWriter, error) {
+	h, ok := w.ResponseWriter.(http.Hijacker)
+	if !ok {
+		return nil, nil, errors.New("connection does not support hijacking")
+	}
+	if w.status == 0 {
+		w.status = http.StatusSwitchingProtocols
+	}
+	return h.Hijack()
+}
+
+func (w *recordingResponseWriter) CloseNotify() <-chan bool {
+	if cn, ok := w.ResponseWriter.(http.CloseNotifier); ok {
+		return cn.CloseNotify()
+	}
+	return make(chan bool)
+}
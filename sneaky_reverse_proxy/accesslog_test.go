@@ -0,0 +1,190 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	nethttp "net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/gerg/net/http"
+)
+
+// logBuffer collects access log lines written while the proxy serves.
+type logBuffer struct {
+	mu  sync.Mutex
+	buf bytes.Buffer
+}
+
+func (b *logBuffer) Write(p []byte) (int, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.buf.Write(p)
+}
+
+func (b *logBuffer) lines() []string {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if b.buf.Len() == 0 {
+		return nil
+	}
+	return strings.Split(strings.TrimSuffix(b.buf.String(), "\n"), "\n")
+}
+
+// entries waits for n JSON access log lines and decodes them.
+func (b *logBuffer) entries(t *testing.T, n int) []map[string]interface{} {
+	t.Helper()
+	waitFor(t, "the access log", func() bool { return len(b.lines()) >= n })
+	var entries []map[string]interface{}
+	for _, line := range b.lines() {
+		var e map[string]interface{}
+		if err := json.Unmarshal([]byte(line), &e); err != nil {
+			t.Fatalf("%q: %s", line, err)
+		}
+		entries = append(entries, e)
+	}
+	return entries
+}
+
+// checkEntry compares the fields of e that want has, and checks that the
+// timings and sizes that always get filled in are.
+func checkEntry(t *testing.T, e map[string]interface{}, want map[string]interface{}) {
+	t.Helper()
+	for k, v := range want {
+		if e[k] != v {
+			t.Errorf("%s: got %v, want %v in %v", k, e[k], v, e)
+		}
+	}
+	for _, k := range []string{"bytes_sent", "duration_ms", "first_byte_ms"} {
+		if n, _ := e[k].(float64); n <= 0 {
+			t.Errorf("%s: got %v, want more than 0", k, e[k])
+		}
+	}
+	if id, _ := e["request_id"].(string); id == "" {
+		t.Error("no request_id")
+	}
+}
+
+func TestAccessLog(t *testing.T) {
+	t.Run("h2c", func(t *testing.T) {
+		log := &logBuffer{}
+		cfg := testConfig(t)
+		cfg.accessLog = log
+		_, addr := startProxy(t, cfg, startEnvoy(t, nethttp.HandlerFunc(reportHandler)))
+
+		// The first request upgrades the connection to Envoy, and the
+		// second goes out on it as a stream. Each line is written once its
+		// response has gone, so the first is waited for.
+		do(t, http1Client(), "https://"+addr+"/inspect?q=1", nil)
+		log.entries(t, 1)
+		do(t, h2Client(), "https://"+addr+"/inspect", nil)
+
+		entries := log.entries(t, 2)
+		checkEntry(t, entries[0], map[string]interface{}{
+			"method":                 "GET",
+			"authority":              addr,
+			"path":                   "/inspect?q=1",
+			"downstream_proto":       "HTTP/1.1",
+			"downstream_tls_version": "TLSv1.3",
+			"upstream_negotiation":   negotiationUpgraded,
+			"upstream_proto":         "HTTP/2.0",
+			"upstream_conn_reused":   false,
+			"status":                 float64(200),
+		})
+		if e := entries[0]; e["upgrade_ms"].(float64) <= 0 || e["upstream_tls_ms"].(float64) <= 0 {
+			t.Errorf("upgrade_ms %v, upstream_tls_ms %v, want both more than 0", e["upgrade_ms"], e["upstream_tls_ms"])
+		}
+		checkEntry(t, entries[1], map[string]interface{}{
+			"path":                 "/inspect",
+			"downstream_proto":     "HTTP/2.0",
+			"downstream_alpn":      "h2",
+			"upstream_negotiation": negotiationReused,
+			"upstream_proto":       "HTTP/2.0",
+			"upstream_conn_reused": true,
+			"upgrade_ms":           float64(0),
+			"status":               float64(200),
+		})
+	})
+
+	t.Run("http1", func(t *testing.T) {
+		log := &logBuffer{}
+		cfg := testConfig(t)
+		cfg.accessLog = log
+		_, addr := startProxy(t, cfg, startEnvoyWith(t, nethttp.HandlerFunc(reportHandler), envoyOptions{http1Only: true}))
+
+		do(t, h2Client(), "https://"+addr+"/inspect", []byte("hello"))
+		entries := log.entries(t, 1)
+		checkEntry(t, entries[0], map[string]interface{}{
+			"method":               "POST",
+			"downstream_proto":     "HTTP/2.0",
+			"upstream_negotiation": negotiationDeclined,
+			"upstream_proto":       "HTTP/1.1",
+			"bytes_received":       float64(5),
+			"status":               float64(200),
+		})
+	})
+}
+
+func TestAccessLogSample(t *testing.T) {
+	for _, c := range []struct {
+		sample   float64
+		min, max int
+	}{
+		{sample: 0, min: 0, max: 0},
+		{sample: 0.5, min: 350, max: 650},
+		{sample: 1, min: 1000, max: 1000},
+	} {
+		log := &logBuffer{}
+		l, err := newAccessLogger(log, "text", c.sample)
+		if err != nil {
+			t.Fatal(err)
+		}
+		h := l.wrap(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+		for i := 0; i < 1000; i++ {
+			req, _ := http.NewRequest(http.MethodGet, "https://example.com/", nil)
+			h.ServeHTTP(&stdResponseWriter{httptest.NewRecorder()}, req)
+		}
+		if n := len(log.lines()); n < c.min || n > c.max {
+			t.Errorf("sample %v: %d of 1000 requests logged, want %d to %d", c.sample, n, c.min, c.max)
+		}
+	}
+}
+
+func TestAccessLogText(t *testing.T) {
+	log := &logBuffer{}
+	l, err := newAccessLogger(log, "text", 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	h := l.wrap(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusTeapot)
+	}))
+	req, _ := http.NewRequest(http.MethodGet, "https://example.com/a%20b", nil)
+	req.RemoteAddr = "203.0.113.7:51234"
+	h.ServeHTTP(&stdResponseWriter{httptest.NewRecorder()}, req)
+	line := log.lines()[0]
+	for _, want := range []string{
+		` method=GET `,
+		` path=/a%20b `,
+		` remote_addr=203.0.113.7:51234 `,
+		` status=418 `,
+		` upstream_negotiation="" `,
+	} {
+		if !strings.Contains(line, want) {
+			t.Errorf("no %q in %s", want, line)
+		}
+	}
+}
+
+func TestNewAccessLoggerErrors(t *testing.T) {
+	if _, err := newAccessLogger(&logBuffer{}, "xml", 1); err == nil {
+		t.Error("accepted format xml")
+	}
+	for _, sample := range []float64{-0.1, 1.1} {
+		if _, err := newAccessLogger(&logBuffer{}, "json", sample); err == nil {
+			t.Errorf("accepted sample rate %v", sample)
+		}
+	}
+}
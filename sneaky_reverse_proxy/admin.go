@@ -0,0 +1,211 @@
+package main
+
+import (
+	"crypto/x509"
+	"encoding/json"
+	"encoding/pem"
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"net"
+	"time"
+
+	"github.com/gerg/net/http"
+
+	"shared/tlsutil"
+)
+
+// admin serves the debugging endpoints on the admin listener: what the proxy
+// is configured with and what its connections to Envoy look like, plus a
+// couple of controls. It replaces reaching for ngrep and tshark for most
+// questions.
+type admin struct {
+	conns    *upstreamConns
+	h2c      *h2cUpgradeTransport
+	policies map[string]routePolicy
+
+	keyPairs []*tlsutil.KeyPairReloader // the listener and client certificates
+	caFiles  []string
+}
+
+const adminIndex = `Sneaky reverse proxy admin
+
+GET  /connections            upstream connections, their mode, streams, SETTINGS and last GOAWAY
+POST /connections/drain?id=  send GOAWAY on a connection and close it once idle
+GET  /protocol-cache         origins believed to have an upgraded connection
+POST /protocol-cache/reset   offer the h2c upgrade to every origin again
+GET  /config                 command line flags
+GET  /routes                 per-route timeouts, retries and circuit breakers
+GET  /certs                  certificates in use and when they expire
+GET  /metrics                Prometheus metrics
+`
+
+func (a *admin) register(mux *http.ServeMux) {
+	mux.HandleFunc("/", func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/" {
+			http.NotFound(w, r)
+			return
+		}
+		w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+		fmt.Fprint(w, adminIndex)
+	})
+	mux.HandleFunc("/connections", a.connections)
+	mux.HandleFunc("/connections/drain", a.drain)
+	mux.HandleFunc("/protocol-cache", func(w http.ResponseWriter, r *http.Request) {
+		writeJSON(w, a.h2c.protocolCache())
+	})
+	mux.HandleFunc("/protocol-cache/reset", func(w http.ResponseWriter, r *http.Request) {
+		if !requirePost(w, r) {
+			return
+		}
+		a.h2c.resetProtocolCache()
+		log.Printf("Admin: reset the protocol cache")
+		writeJSON(w, a.h2c.protocolCache())
+	})
+	mux.HandleFunc("/config", a.config)
+	mux.HandleFunc("/routes", func(w http.ResponseWriter, r *http.Request) {
+		writeJSON(w, a.policies)
+	})
+	mux.HandleFunc("/certs", a.certs)
+}
+
+func (a *admin) connections(w http.ResponseWriter, r *http.Request) {
+	statuses := []connStatus{}
+	for _, c := range a.conns.list() {
+		statuses = append(statuses, c.status())
+	}
+	writeJSON(w, statuses)
+}
+
+func (a *admin) drain(w http.ResponseWriter, r *http.Request) {
+	if !requirePost(w, r) {
+		return
+	}
+	id := r.URL.Query().Get("id")
+	c := a.conns.get(id)
+	if c == nil {
+		http.Error(w, fmt.Sprintf("no upstream connection %q", id), http.StatusNotFound)
+		return
+	}
+	log.Printf("Admin: draining upstream connection %s", id)
+	c.drain()
+	writeJSON(w, c.status())
+}
+
+func (a *admin) config(w http.ResponseWriter, r *http.Request) {
+	flags := map[string]string{}
+	flag.VisitAll(func(f *flag.Flag) {
+		flags[f.Name] = f.Value.String()
+	})
+	writeJSON(w, flags)
+}
+
+type certStatus struct {
+	File      string    `json:"file"`
+	Subject   string    `json:"subject"`
+	Issuer    string    `json:"issuer"`
+	NotAfter  time.Time `json:"not_after"`
+	ExpiresIn string    `json:"expires_in"`
+	Expired   bool      `json:"expired"`
+	Error     string    `json:"error,omitempty"`
+}
+
+func (a *admin) certs(w http.ResponseWriter, r *http.Request) {
+	statuses := []certStatus{}
+	for _, kp := range a.keyPairs {
+		leaf, err := x509.ParseCertificate(kp.Current().Certificate[0])
+		if err != nil {
+			statuses = append(statuses, certStatus{File: kp.CertPath(), Error: err.Error()})
+			continue
+		}
+		statuses = append(statuses, newCertStatus(kp.CertPath(), leaf))
+	}
+	for _, file := range a.caFiles {
+		statuses = append(statuses, caStatuses(file)...)
+	}
+	writeJSON(w, statuses)
+}
+
+func caStatuses(file string) []certStatus {
+	data, err := ioutil.ReadFile(file)
+	if err != nil {
+		return []certStatus{{File: file, Error: err.Error()}}
+	}
+	var statuses []certStatus
+	for {
+		var block *pem.Block
+		block, data = pem.Decode(data)
+		if block == nil {
+			return statuses
+		}
+		if block.Type != "CERTIFICATE" {
+			continue
+		}
+		cert, err := x509.ParseCertificate(block.Bytes)
+		if err != nil {
+			statuses = append(statuses, certStatus{File: file, Error: err.Error()})
+			continue
+		}
+		statuses = append(statuses, newCertStatus(file, cert))
+	}
+}
+
+func newCertStatus(file string, cert *x509.Certificate) certStatus {
+	left := time.Until(cert.NotAfter)
+	return certStatus{
+		File:      file,
+		Subject:   cert.Subject.String(),
+		Issuer:    cert.Issuer.String(),
+		NotAfter:  cert.NotAfter,
+		ExpiresIn: left.Round(time.Second).String(),
+		Expired:   left <= 0,
+	}
+}
+
+func requirePost(w http.ResponseWriter, r *http.Request) bool {
+	if r.Method == http.MethodPost {
+		return true
+	}
+	w.Header().Set("Allow", http.MethodPost)
+	http.Error(w, "use POST", http.StatusMethodNotAllowed)
+	return false
+}
+
+func writeJSON(w http.ResponseWriter, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	enc := json.NewEncoder(w)
+	enc.SetIndent("", "  ")
+	if err := enc.Encode(v); err != nil {
+		log.Printf("Admin: encoding response: %s", err)
+	}
+}
+
+// loopbackOnly refuses requests from anywhere but the loopback interface, in
+// case the admin listener is reached some other way, such as through a port
+// forward.
+func loopbackOnly(h http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if !isLoopback(r.RemoteAddr) {
+			log.Printf("Admin: refused %s %s from %s", r.Method, r.URL.Path, r.RemoteAddr)
+			http.Error(w, "the admin endpoints are only for loopback clients", http.StatusForbidden)
+			return
+		}
+		h.ServeHTTP(w, r)
+	})
+}
+
+// isLoopback reports whether addr, a host and port, is on the loopback
+// interface. The admin endpoints can drain connections and show the
+// configuration, so they are not for anyone else.
+func isLoopback(addr string) bool {
+	host, _, err := net.SplitHostPort(addr)
+	if err != nil {
+		return false
+	}
+	if host == "localhost" {
+		return true
+	}
+	ip := net.ParseIP(host)
+	return ip != nil && ip.IsLoopback()
+}
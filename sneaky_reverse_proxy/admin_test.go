@@ -0,0 +1,156 @@
+package main
+
+import (
+	"encoding/json"
+	nethttp "net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/gerg/net/http"
+)
+
+// adminCall sends a request to the proxy's admin listener and decodes the
+// JSON answer into v.
+func adminCall(t *testing.T, p *proxy, method, path string, v interface{}) int {
+	t.Helper()
+	req, _ := nethttp.NewRequest(method, "http://"+p.adminListener.Addr().String()+path, nil)
+	resp, err := nethttp.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode == nethttp.StatusOK && v != nil {
+		if err := json.NewDecoder(resp.Body).Decode(v); err != nil {
+			t.Fatal(err)
+		}
+	}
+	return resp.StatusCode
+}
+
+func startAdminProxy(t *testing.T) (*proxy, string) {
+	t.Helper()
+	cfg := testConfig(t)
+	cfg.adminAddr = "127.0.0.1:0"
+	return startProxy(t, cfg, startEnvoy(t, nethttp.HandlerFunc(reportHandler)))
+}
+
+func TestAdminDrain(t *testing.T) {
+	p, addr := startAdminProxy(t)
+	do(t, h2Client(), "https://"+addr+"/inspect", nil)
+
+	var conns []connStatus
+	adminCall(t, p, nethttp.MethodGet, "/connections", &conns)
+	if len(conns) != 1 || conns[0].Draining {
+		t.Fatalf("got %+v, want one connection that isn't draining", conns)
+	}
+	id := conns[0].ID
+
+	if code := adminCall(t, p, nethttp.MethodGet, "/connections/drain?id="+id, nil); code != nethttp.StatusMethodNotAllowed {
+		t.Errorf("GET drain: got %d", code)
+	}
+	if code := adminCall(t, p, nethttp.MethodPost, "/connections/drain?id=nope", nil); code != nethttp.StatusNotFound {
+		t.Errorf("draining an unknown connection: got %d", code)
+	}
+
+	var status connStatus
+	if code := adminCall(t, p, nethttp.MethodPost, "/connections/drain?id="+id, &status); code != nethttp.StatusOK || !status.Draining {
+		t.Fatalf("got %d, %+v, want the connection draining", code, status)
+	}
+	// With nothing in flight it is closed straight away, and the next
+	// request goes out on a new one.
+	waitFor(t, "the drained connection to close", func() bool {
+		conns = nil
+		adminCall(t, p, nethttp.MethodGet, "/connections", &conns)
+		return len(conns) == 0
+	})
+	do(t, h2Client(), "https://"+addr+"/inspect", nil)
+	adminCall(t, p, nethttp.MethodGet, "/connections", &conns)
+	if len(conns) != 1 || conns[0].ID == id || conns[0].Draining {
+		t.Errorf("got %+v, want a new connection", conns)
+	}
+}
+
+func TestAdminProtocolCacheReset(t *testing.T) {
+	p, addr := startAdminProxy(t)
+	do(t, h2Client(), "https://"+addr+"/inspect", nil)
+
+	var origins []string
+	adminCall(t, p, nethttp.MethodGet, "/protocol-cache", &origins)
+	if len(origins) != 1 || origins[0] != envoyHost {
+		t.Fatalf("got %q, want %s", origins, envoyHost)
+	}
+	if code := adminCall(t, p, nethttp.MethodGet, "/protocol-cache/reset", nil); code != nethttp.StatusMethodNotAllowed {
+		t.Errorf("GET reset: got %d", code)
+	}
+	if code := adminCall(t, p, nethttp.MethodPost, "/protocol-cache/reset", &origins); code != nethttp.StatusOK || len(origins) != 0 {
+		t.Fatalf("got %d, %q, want an empty cache", code, origins)
+	}
+	if p.h2c.isUpgraded(envoyHost) {
+		t.Error("the transport still believes Envoy is upgraded")
+	}
+	// The next request offers the upgrade again. While the upgraded
+	// connection is still in the pool the HTTP/2 client turns the offer
+	// down, and the request puts Envoy back in the cache.
+	do(t, h2Client(), "https://"+addr+"/inspect", nil)
+	adminCall(t, p, nethttp.MethodGet, "/protocol-cache", &origins)
+	if len(origins) != 1 || counterValue(p.metrics.upgradeAttempts) != 1 {
+		t.Errorf("got %q after %v upgrade attempts, want %s after 1", origins, counterValue(p.metrics.upgradeAttempts), envoyHost)
+	}
+
+	// Once the connection is drained, the offer after a reset reaches
+	// Envoy.
+	var conns []connStatus
+	adminCall(t, p, nethttp.MethodGet, "/connections", &conns)
+	for _, c := range conns {
+		adminCall(t, p, nethttp.MethodPost, "/connections/drain?id="+c.ID, nil)
+	}
+	waitFor(t, "the drained connection to close", func() bool {
+		conns = nil
+		adminCall(t, p, nethttp.MethodGet, "/connections", &conns)
+		return len(conns) == 0
+	})
+	adminCall(t, p, nethttp.MethodPost, "/protocol-cache/reset", nil)
+	do(t, h2Client(), "https://"+addr+"/inspect", nil)
+	if n := counterValue(p.metrics.upgradeAttempts); n != 2 {
+		t.Errorf("%v upgrade attempts, want 2", n)
+	}
+}
+
+func TestLoopbackOnly(t *testing.T) {
+	h := loopbackOnly(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	for addr, want := range map[string]int{
+		"127.0.0.1:51234":    http.StatusOK,
+		"[::1]:51234":        http.StatusOK,
+		"192.0.2.1:51234":    http.StatusForbidden,
+		"[2001:db8::1]:5123": http.StatusForbidden,
+		"127.0.0.1":          http.StatusForbidden,
+	} {
+		req, _ := http.NewRequest(http.MethodGet, "http://127.0.0.1:8001/config", nil)
+		req.RemoteAddr = addr
+		rec := httptest.NewRecorder()
+		h.ServeHTTP(&stdResponseWriter{rec}, req)
+		if rec.Code != want {
+			t.Errorf("%s: got %d, want %d", addr, rec.Code, want)
+		}
+	}
+}
+
+func TestAdminAddrMustBeLoopback(t *testing.T) {
+	for addr, want := range map[string]bool{
+		"127.0.0.1:8001": true,
+		"[::1]:8001":     true,
+		"localhost:8001": true,
+		"0.0.0.0:8001":   false,
+		":8001":          false,
+		"10.0.0.1:8001":  false,
+	} {
+		if got := isLoopback(addr); got != want {
+			t.Errorf("%s: got %v, want %v", addr, got, want)
+		}
+	}
+	cfg := testConfig(t)
+	cfg.adminAddr = "0.0.0.0:0"
+	if _, err := newProxy(cfg); err == nil {
+		t.Error("started an admin listener on every interface")
+	}
+}
@@ -0,0 +1,212 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"errors"
+	"log"
+	"net"
+	nethttp "net/http"
+	"strings"
+	"sync"
+
+	"golang.org/x/net/http2"
+	"golang.org/x/net/http2/h2c"
+
+	"github.com/gerg/net/http"
+)
+
+// newCleartextServers returns a plaintext server per address in addrs, which
+// is comma separated. They accept HTTP/1.1, h2c via Upgrade and h2c with prior
+// knowledge, and hand every request to h, so they share the TLS listener's
+// routing, upstream pools and HTTP/2 stream limit.
+//
+// The fork's server only runs HTTP/2 on TLS connections, so these are the
+// standard library's server with the h2c package in front, which both need
+// net/http's types. fromStdHandler bridges the two.
+func newCleartextServers(addrs string, h http.Handler, errorLog *log.Logger, maxStreams uint32) ([]*cleartextServer, error) {
+	var servers []*cleartextServer
+	for _, addr := range strings.Split(addrs, ",") {
+		addr = strings.TrimSpace(addr)
+		if addr == "" {
+			continue
+		}
+		s := &cleartextServer{requests: &inFlight{}}
+		h2s := newH2Server(maxStreams)
+		s.Server = &nethttp.Server{
+			Addr:     addr,
+			Handler:  h2c.NewHandler(s.requests.wrap(fromStdHandler{h}), h2s),
+			ErrorLog: errorLog,
+		}
+		// This is what has Shutdown send GOAWAY on the h2c connections.
+		if err := http2.ConfigureServer(s.Server, h2s); err != nil {
+			return nil, err
+		}
+		servers = append(servers, s)
+	}
+	return servers, nil
+}
+
+// cleartextServer is a plaintext listener. The h2c package hijacks the
+// connections it serves, so net/http stops tracking them: Shutdown has the
+// HTTP/2 server send them GOAWAY, and requests is how it waits for what is
+// still in flight on them.
+type cleartextServer struct {
+	*nethttp.Server
+	listener net.Listener
+	requests *inFlight
+}
+
+func (s *cleartextServer) listen() error {
+	l, err := net.Listen("tcp", s.Addr)
+	if err != nil {
+		return err
+	}
+	s.listener = l
+	return nil
+}
+
+func (s *cleartextServer) serve() error {
+	return s.Serve(s.listener)
+}
+
+// Shutdown gracefully shuts the server down, like net/http's, and then waits
+// for the requests on hijacked connections too.
+func (s *cleartextServer) Shutdown(ctx context.Context) error {
+	if err := s.Server.Shutdown(ctx); err != nil {
+		return err
+	}
+	return s.requests.wait(ctx)
+}
+
+// inFlight counts the requests a handler is serving, or the connections a
+// server is.
+type inFlight struct {
+	mu   sync.Mutex
+	n    int
+	idle chan struct{} // closed when n drops to 0, for wait
+}
+
+func (f *inFlight) wrap(h nethttp.Handler) nethttp.Handler {
+	return nethttp.HandlerFunc(func(w nethttp.ResponseWriter, r *nethttp.Request) {
+		f.add()
+		defer f.done()
+		h.ServeHTTP(w, r)
+	})
+}
+
+func (f *inFlight) add() {
+	f.mu.Lock()
+	f.n++
+	f.mu.Unlock()
+}
+
+func (f *inFlight) count() int {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return f.n
+}
+
+func (f *inFlight) done() {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if f.n--; f.n == 0 && f.idle != nil {
+		close(f.idle)
+		f.idle = nil
+	}
+}
+
+// wait waits until no requests are in flight, or ctx is done.
+func (f *inFlight) wait(ctx context.Context) error {
+	f.mu.Lock()
+	if f.n == 0 {
+		f.mu.Unlock()
+		return nil
+	}
+	if f.idle == nil {
+		f.idle = make(chan struct{})
+	}
+	idle := f.idle
+	f.mu.Unlock()
+
+	select {
+	case <-idle:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// fromStdHandler serves net/http requests with a handler written against the
+// fork. The two packages' types have the same shape, so the request is copied
+// field by field and the response writer is wrapped.
+type fromStdHandler struct {
+	h http.Handler
+}
+
+func (a fromStdHandler) ServeHTTP(w nethttp.ResponseWriter, r *nethttp.Request) {
+	req := &http.Request{
+		Method:           r.Method,
+		URL:              r.URL,
+		Proto:            r.Proto,
+		ProtoMajor:       r.ProtoMajor,
+		ProtoMinor:       r.ProtoMinor,
+		Header:           http.Header(r.Header),
+		Body:             r.Body,
+		GetBody:          r.GetBody,
+		ContentLength:    r.ContentLength,
+		TransferEncoding: r.TransferEncoding,
+		Close:            r.Close,
+		Host:             r.Host,
+		Trailer:          http.Header(r.Trailer),
+		RemoteAddr:       r.RemoteAddr,
+		RequestURI:       r.RequestURI,
+		TLS:              r.TLS,
+	}
+	// The fork's server would have put our local address in the context,
+	// under its own key.
+	ctx := r.Context()
+	if addr, ok := ctx.Value(nethttp.LocalAddrContextKey).(net.Addr); ok {
+		ctx = context.WithValue(ctx, http.LocalAddrContextKey, addr)
+	}
+	a.h.ServeHTTP(&stdResponseWriter{w}, req.WithContext(ctx))
+}
+
+// stdResponseWriter is a net/http ResponseWriter as the fork's. Like
+// recordingResponseWriter, it passes Flush, Hijack and CloseNotify through.
+type stdResponseWriter struct {
+	w nethttp.ResponseWriter
+}
+
+func (w *stdResponseWriter) Header() http.Header {
+	return http.Header(w.w.Header())
+}
+
+func (w *stdResponseWriter) Write(p []byte) (int, error) {
+	return w.w.Write(p)
+}
+
+func (w *stdResponseWriter) WriteHeader(status int) {
+	w.w.WriteHeader(status)
+}
+
+func (w *stdResponseWriter) Flush() {
+	if f, ok := w.w.(nethttp.Flusher); ok {
+		f.Flush()
+	}
+}
+
+func (w *stdResponseWriter) Hijack() (net.Conn, *bufio.ReadWriter, error) {
+	h, ok := w.w.(nethttp.Hijacker)
+	if !ok {
+		return nil, nil, errors.New("connection does not support hijacking")
+	}
+	return h.Hijack()
+}
+
+func (w *stdResponseWriter) CloseNotify() <-chan bool {
+	if cn, ok := w.w.(nethttp.CloseNotifier); ok {
+		return cn.CloseNotify()
+	}
+	return make(chan bool)
+}
@@ -0,0 +1,107 @@
+package main
+
+import (
+	"context"
+	"io"
+	"io/ioutil"
+	"log"
+	"net"
+	nethttp "net/http"
+	"testing"
+	"time"
+
+	"golang.org/x/net/http2"
+
+	"github.com/gerg/net/http"
+)
+
+// startCleartext serves h on a cleartext server on an ephemeral port.
+func startCleartext(t *testing.T, h http.Handler) (*cleartextServer, string) {
+	srvs, err := newCleartextServers("127.0.0.1:0", h, log.New(ioutil.Discard, "", 0), 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := srvs[0].listen(); err != nil {
+		t.Fatal(err)
+	}
+	go srvs[0].serve()
+	t.Cleanup(func() { srvs[0].Close() })
+	return srvs[0], srvs[0].listener.Addr().String()
+}
+
+// dialH2C opens an h2c connection with prior knowledge to addr.
+func dialH2C(t *testing.T, addr string) *http2.ClientConn {
+	conn, err := net.Dial("tcp", addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cc, err := (&http2.Transport{AllowHTTP: true}).NewClientConn(conn)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { conn.Close() })
+	return cc
+}
+
+func TestCleartextShutdownDrainsH2C(t *testing.T) {
+	release := make(chan struct{})
+	srv, addr := startCleartext(t, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		io.WriteString(w, "started ")
+		w.(http.Flusher).Flush()
+		<-release
+		io.WriteString(w, "finished")
+	}))
+	cc := dialH2C(t, addr)
+	req, _ := nethttp.NewRequest("GET", "http://"+addr+"/", nil)
+	resp, err := cc.RoundTrip(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	started := make([]byte, len("started "))
+	if _, err := io.ReadFull(resp.Body, started); err != nil {
+		t.Fatal(err)
+	}
+
+	shutdown := make(chan error, 1)
+	go func() {
+		ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+		defer cancel()
+		shutdown <- srv.Shutdown(ctx)
+	}()
+	waitFor(t, "GOAWAY", func() bool { return !cc.CanTakeNewRequest() })
+	select {
+	case err := <-shutdown:
+		t.Fatalf("Shutdown returned %v with a request in flight", err)
+	case <-time.After(100 * time.Millisecond):
+	}
+
+	close(release)
+	rest, err := ioutil.ReadAll(resp.Body)
+	if err != nil || string(rest) != "finished" {
+		t.Errorf("got %q, %v after the drain started", rest, err)
+	}
+	if err := <-shutdown; err != nil {
+		t.Errorf("Shutdown: %s", err)
+	}
+}
+
+func TestCleartextShutdownDeadline(t *testing.T) {
+	srv, addr := startCleartext(t, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.(http.Flusher).Flush()
+		<-r.Context().Done()
+	}))
+	cc := dialH2C(t, addr)
+	req, _ := nethttp.NewRequest("GET", "http://"+addr+"/", nil)
+	resp, err := cc.RoundTrip(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+	defer cancel()
+	if err := srv.Shutdown(ctx); err != context.DeadlineExceeded {
+		t.Errorf("got %v, want the deadline to pass", err)
+	}
+}
@@ -0,0 +1,87 @@
+package main
+
+import (
+	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/hex"
+	"fmt"
+	"io/ioutil"
+	"strings"
+
+	"github.com/gerg/net/http"
+)
+
+const xfccHeader = "X-Forwarded-Client-Cert"
+
+// downstreamClientAuth returns the listener's client certificate policy. With
+// no CA, clients are not asked for a certificate at all. With one, a
+// certificate is verified against it when offered, and required when require
+// is set, as Envoy's require_client_certificate does.
+func downstreamClientAuth(caFile string, require bool) (tls.ClientAuthType, *x509.CertPool, error) {
+	if caFile == "" {
+		if require {
+			return tls.NoClientCert, nil, fmt.Errorf("requiring client certificates needs a CA to verify them against")
+		}
+		return tls.NoClientCert, nil, nil
+	}
+	pem, err := ioutil.ReadFile(caFile)
+	if err != nil {
+		return tls.NoClientCert, nil, err
+	}
+	pool := x509.NewCertPool()
+	if !pool.AppendCertsFromPEM(pem) {
+		return tls.NoClientCert, nil, fmt.Errorf("no certificates found in %s", caFile)
+	}
+	if require {
+		return tls.RequireAndVerifyClientCert, pool, nil
+	}
+	return tls.VerifyClientCertIfGiven, pool, nil
+}
+
+// forwardClientCert adds the verified downstream client certificate to the
+// X-Forwarded-Client-Cert header in Envoy's format, e.g.
+//
+//	Hash=<sha256 of the DER>;Subject="CN=client";URI=spiffe://...;DNS=client.example
+//
+// An element from a trusted proxy in front of us is kept and ours is appended
+// after it, like Envoy's APPEND_FORWARD. Untrusted values have already been
+// stripped by rewrite.
+func forwardClientCert(req *http.Request) {
+	if req.TLS == nil || len(req.TLS.VerifiedChains) == 0 {
+		return
+	}
+	element := xfccElement(req.TLS.VerifiedChains[0][0])
+	if prior := req.Header[xfccHeader]; len(prior) > 0 {
+		element = strings.Join(prior, ",") + "," + element
+	}
+	req.Header.Set(xfccHeader, element)
+}
+
+func xfccElement(cert *x509.Certificate) string {
+	hash := sha256.Sum256(cert.Raw)
+	pairs := []string{
+		"Hash=" + hex.EncodeToString(hash[:]),
+		"Subject=" + quoteString(cert.Subject.String()),
+	}
+	for _, uri := range cert.URIs {
+		pairs = append(pairs, "URI="+quoteXFCC(uri.String()))
+	}
+	for _, name := range cert.DNSNames {
+		pairs = append(pairs, "DNS="+quoteXFCC(name))
+	}
+	return strings.Join(pairs, ";")
+}
+
+// quoteXFCC quotes a value that contains one of the header's separators.
+// Envoy always quotes the subject, which is full of them anyway.
+func quoteXFCC(v string) string {
+	if !strings.ContainsAny(v, `,;="`) {
+		return v
+	}
+	return quoteString(v)
+}
+
+func quoteString(v string) string {
+	return `"` + strings.NewReplacer(`\`, `\\`, `"`, `\"`).Replace(v) + `"`
+}
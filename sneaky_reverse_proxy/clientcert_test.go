@@ -0,0 +1,105 @@
+package main
+
+import (
+	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/hex"
+	"net/url"
+	"path/filepath"
+	"reflect"
+	"testing"
+
+	"github.com/gerg/net/http"
+)
+
+// xfccCert is a client certificate as it comes out of verification. Only the
+// fields xfccElement reads are set.
+func xfccCert(t *testing.T) (*x509.Certificate, string) {
+	t.Helper()
+	spiffe, _ := url.Parse("spiffe://example.org/ns/default/sa/client")
+	query, _ := url.Parse("https://example.org/?a=b")
+	cert := &x509.Certificate{
+		Raw:      []byte("not really DER"),
+		Subject:  pkix.Name{CommonName: `client "one", eu`, Organization: []string{"Acme"}},
+		URIs:     []*url.URL{spiffe, query},
+		DNSNames: []string{"client.example"},
+	}
+	hash := sha256.Sum256(cert.Raw)
+	return cert, hex.EncodeToString(hash[:])
+}
+
+func TestXFCCElement(t *testing.T) {
+	cert, hash := xfccCert(t)
+	// The subject is always quoted, with the quotes and backslashes of its
+	// RFC 2253 escaping escaped again; other values only when they hold a
+	// separator.
+	want := "Hash=" + hash +
+		`;Subject="CN=client \\\"one\\\"\\, eu,O=Acme"` +
+		`;URI=spiffe://example.org/ns/default/sa/client` +
+		`;URI="https://example.org/?a=b"` +
+		`;DNS=client.example`
+	if got := xfccElement(cert); got != want {
+		t.Errorf("got  %s\nwant %s", got, want)
+	}
+}
+
+func TestForwardClientCert(t *testing.T) {
+	fwd, err := newForwarder("10.0.0.0/8")
+	if err != nil {
+		t.Fatal(err)
+	}
+	cert, _ := xfccCert(t)
+	ours := xfccElement(cert)
+	verified := &tls.ConnectionState{Version: tls.VersionTLS13, VerifiedChains: [][]*x509.Certificate{{cert}}}
+	for _, c := range []struct {
+		name       string
+		remoteAddr string
+		tls        *tls.ConnectionState
+		want       []string
+	}{
+		{"untrusted peer", "203.0.113.7:51234", verified, []string{ours}},
+		{"trusted peer", "10.1.2.3:4000", verified, []string{`Hash=abc;Subject="CN=edge"` + "," + ours}},
+		// A certificate that was offered but not verified, or none at
+		// all, adds nothing, and what an untrusted peer sent is still
+		// dropped.
+		{"unverified", "203.0.113.7:51234", &tls.ConnectionState{Version: tls.VersionTLS13}, nil},
+		{"no TLS", "203.0.113.7:51234", nil, nil},
+		{"no TLS, trusted peer", "10.1.2.3:4000", nil, []string{`Hash=abc;Subject="CN=edge"`}},
+	} {
+		t.Run(c.name, func(t *testing.T) {
+			req, _ := http.NewRequest(http.MethodGet, "https://example.com/", nil)
+			req.RemoteAddr = c.remoteAddr
+			req.Header.Set(xfccHeader, `Hash=abc;Subject="CN=edge"`)
+			req.TLS = c.tls
+			if got := forwardedHeaders(t, fwd, req)[xfccHeader]; !reflect.DeepEqual(got, c.want) {
+				t.Errorf("got %q, want %q", got, c.want)
+			}
+		})
+	}
+}
+
+func TestDownstreamClientAuth(t *testing.T) {
+	dir := t.TempDir()
+	caFile, keyFile := writeKeyPair(t, dir, "ca", localhostCert(t))
+	for _, c := range []struct {
+		caFile  string
+		require bool
+		want    tls.ClientAuthType
+		pool    bool
+		err     bool
+	}{
+		{caFile: "", want: tls.NoClientCert},
+		{caFile: "", require: true, err: true},
+		{caFile: caFile, want: tls.VerifyClientCertIfGiven, pool: true},
+		{caFile: caFile, require: true, want: tls.RequireAndVerifyClientCert, pool: true},
+		{caFile: filepath.Join(dir, "missing.crt"), err: true},
+		{caFile: keyFile, err: true}, // no certificates in it
+	} {
+		auth, pool, err := downstreamClientAuth(c.caFile, c.require)
+		if (err != nil) != c.err || auth != c.want || (pool != nil) != c.pool {
+			t.Errorf("%q, require %v: got %v, pool %v, %v", c.caFile, c.require, auth, pool != nil, err)
+		}
+	}
+}
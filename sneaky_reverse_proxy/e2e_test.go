@@ -0,0 +1,342 @@
+package main
+
+import (
+	"bytes"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/tls"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	nethttp "net/http"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+
+	"golang.org/x/net/http2"
+)
+
+// concurrency is how many requests the concurrency cases keep in flight.
+const concurrency = 16
+
+// bodySize is more than the 64k flow-control windows HTTP/2 starts with.
+const bodySize = 1 << 20
+
+// report is what the backend says about each request that reaches it: a
+// little of what the h2c app's /inspect says.
+type report struct {
+	Proto      string         `json:"proto"`
+	RemoteAddr string         `json:"remote_addr"`
+	Length     int            `json:"length"`
+	SHA256     string         `json:"sha256"`
+	Header     nethttp.Header `json:"header"`
+}
+
+// reportHandler answers /duplex by echoing the body as it arrives, and
+// anything else with a report. Only POST bodies are read: the h2c package
+// hands the upgrade request on as a stream that never ends, and the proxy
+// upgrades with bodyless requests.
+func reportHandler(w nethttp.ResponseWriter, r *nethttp.Request) {
+	if r.URL.Path == "/duplex" {
+		w.WriteHeader(nethttp.StatusOK)
+		flusher := w.(nethttp.Flusher)
+		buf := make([]byte, 32<<10)
+		for {
+			n, err := r.Body.Read(buf)
+			if n > 0 {
+				w.Write(buf[:n])
+				flusher.Flush()
+			}
+			if err != nil {
+				return
+			}
+		}
+	}
+	var body []byte
+	if r.Method == nethttp.MethodPost {
+		body, _ = ioutil.ReadAll(r.Body)
+	}
+	sum := sha256.Sum256(body)
+	json.NewEncoder(w).Encode(report{
+		Proto:      r.Proto,
+		RemoteAddr: r.RemoteAddr,
+		Length:     len(body),
+		SHA256:     hex.EncodeToString(sum[:]),
+		Header:     r.Header,
+	})
+}
+
+// http1Client speaks HTTP/1.1 to the proxy, trusting any certificate.
+func http1Client() *nethttp.Client {
+	return &nethttp.Client{Transport: &nethttp.Transport{
+		TLSClientConfig:     &tls.Config{InsecureSkipVerify: true},
+		TLSNextProto:        map[string]func(string, *tls.Conn) nethttp.RoundTripper{},
+		MaxIdleConnsPerHost: concurrency,
+	}}
+}
+
+// do sends a request through the proxy and returns the backend's report.
+func do(t *testing.T, c *nethttp.Client, url string, body []byte) (*nethttp.Response, report) {
+	t.Helper()
+	resp, rep, err := tryDo(c, url, body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return resp, rep
+}
+
+func tryDo(c *nethttp.Client, url string, body []byte) (*nethttp.Response, report, error) {
+	method := nethttp.MethodGet
+	if body != nil {
+		method = nethttp.MethodPost
+	}
+	var rep report
+	req, err := nethttp.NewRequest(method, url, bytes.NewReader(body))
+	if err != nil {
+		return nil, rep, err
+	}
+	resp, err := c.Do(req)
+	if err != nil {
+		return nil, rep, err
+	}
+	defer resp.Body.Close()
+	b, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return nil, rep, err
+	}
+	if resp.StatusCode != nethttp.StatusOK || json.Unmarshal(b, &rep) != nil {
+		return nil, rep, fmt.Errorf("got %s: %q", resp.Status, b)
+	}
+	return resp, rep, nil
+}
+
+func randomBody(t *testing.T) []byte {
+	t.Helper()
+	b := make([]byte, bodySize)
+	if _, err := rand.Read(b); err != nil {
+		t.Fatal(err)
+	}
+	return b
+}
+
+// TestEndToEnd runs the proxy in front of the Envoy stand-in and each kind
+// of backend: one that takes the h2c upgrade, as the h2c app does, and one
+// that only speaks HTTP/1.1, as http1_app does.
+func TestEndToEnd(t *testing.T) {
+	for _, backend := range []struct {
+		name      string
+		http1Only bool
+		proto     string // what requests reach the backend over
+	}{
+		{"h2c", false, "HTTP/2.0"},
+		{"http1", true, "HTTP/1.1"},
+	} {
+		backend := backend
+		t.Run(backend.name, func(t *testing.T) {
+			envoyAddr := startEnvoyWith(t, nethttp.HandlerFunc(reportHandler), envoyOptions{http1Only: backend.http1Only})
+			_, addr := startProxy(t, testConfig(t), envoyAddr)
+			url := "https://" + addr
+
+			for _, downstream := range []struct {
+				name   string
+				client *nethttp.Client
+				major  int
+			}{
+				{"h2", h2Client(), 2},
+				{"http1.1", http1Client(), 1},
+			} {
+				t.Run(downstream.name, func(t *testing.T) {
+					resp, rep := do(t, downstream.client, url+"/inspect", nil)
+					if resp.ProtoMajor != downstream.major || rep.Proto != backend.proto {
+						t.Errorf("answered over %s, reached the backend over %s, want HTTP/%d and %s", resp.Proto, rep.Proto, downstream.major, backend.proto)
+					}
+				})
+			}
+
+			t.Run("body", func(t *testing.T) {
+				body := randomBody(t)
+				sum := sha256.Sum256(body)
+				_, rep := do(t, h2Client(), url+"/inspect", body)
+				if rep.Length != len(body) || rep.SHA256 != hex.EncodeToString(sum[:]) {
+					t.Errorf("backend got %d bytes, hash %s, want %d bytes, hash %x", rep.Length, rep.SHA256, len(body), sum)
+				}
+			})
+
+			t.Run("concurrency", func(t *testing.T) {
+				c := h2Client()
+				// The first request settles how the proxy reaches Envoy.
+				do(t, c, url+"/inspect", nil)
+				reports := make([]report, concurrency)
+				var wg sync.WaitGroup
+				for i := range reports {
+					wg.Add(1)
+					go func(i int) {
+						defer wg.Done()
+						var err error
+						if _, reports[i], err = tryDo(c, url+"/inspect", nil); err != nil {
+							t.Error(err)
+						}
+					}(i)
+				}
+				wg.Wait()
+				addrs := map[string]bool{}
+				for _, rep := range reports {
+					addrs[rep.RemoteAddr] = true
+				}
+				// Every request shares the upgraded connection, or the
+				// HTTP/1.1 ones share a pool of them.
+				max := 1
+				if backend.http1Only {
+					max = concurrency
+				}
+				if len(addrs) > max {
+					t.Errorf("requests came over %d connections, want at most %d", len(addrs), max)
+				}
+			})
+		})
+	}
+}
+
+func TestFullDuplexThroughEnvoy(t *testing.T) {
+	_, addr := startProxy(t, testConfig(t), startEnvoy(t, nethttp.HandlerFunc(reportHandler)))
+	pr, pw := io.Pipe()
+	defer pw.Close()
+	req, _ := nethttp.NewRequest(nethttp.MethodPost, "https://"+addr+"/duplex", pr)
+	done := make(chan *nethttp.Response, 1)
+	go func() {
+		resp, err := h2Client().Do(req)
+		if err != nil {
+			t.Error(err)
+			pw.Close()
+		}
+		done <- resp
+	}()
+
+	// Each chunk comes back before the next is sent.
+	var resp *nethttp.Response
+	for i := 0; i < 8; i++ {
+		chunk := []byte(fmt.Sprintf("chunk %d;", i))
+		if _, err := pw.Write(chunk); err != nil {
+			t.Fatal(err)
+		}
+		if resp == nil {
+			if resp = <-done; resp == nil {
+				return
+			}
+			defer resp.Body.Close()
+		}
+		got := make([]byte, len(chunk))
+		if _, err := io.ReadFull(resp.Body, got); err != nil || !bytes.Equal(got, chunk) {
+			t.Fatalf("got %q, %v, want %q", got, err, chunk)
+		}
+	}
+	pw.Close()
+	if rest, err := ioutil.ReadAll(resp.Body); err != nil || len(rest) != 0 {
+		t.Errorf("got %q, %v after the request ended", rest, err)
+	}
+}
+
+func TestProxyProtocolThroughEnvoy(t *testing.T) {
+	envoyAddr := startEnvoyWith(t, nethttp.HandlerFunc(reportHandler), envoyOptions{proxyProtocol: true})
+	cfg := testConfig(t)
+	cfg.proxyProtocol = true
+	_, addr := startProxy(t, cfg, envoyAddr)
+
+	// Each client's address makes it to the backend, in the PROXY header
+	// the proxy sends Envoy and Envoy passes on.
+	for i := 0; i < 2; i++ {
+		var local string
+		c := &nethttp.Client{Transport: &http2.Transport{
+			DialTLS: func(network, addr string, cfg *tls.Config) (net.Conn, error) {
+				conn, err := tls.Dial(network, addr, cfg)
+				if err == nil {
+					local = conn.LocalAddr().String()
+				}
+				return conn, err
+			},
+			TLSClientConfig: &tls.Config{InsecureSkipVerify: true},
+		}}
+		for j := 0; j < 2; j++ {
+			_, rep := do(t, c, "https://"+addr+"/inspect", nil)
+			if rep.RemoteAddr != local || rep.Proto != "HTTP/2.0" {
+				t.Errorf("client %d: request %d reached the backend over %s from %s, want HTTP/2.0 from %s", i, j, rep.Proto, rep.RemoteAddr, local)
+			}
+		}
+	}
+}
+
+func TestHeaderRulesThroughEnvoy(t *testing.T) {
+	cfg := testConfig(t)
+	cfg.routesFile = filepath.Join(t.TempDir(), "routes.json")
+	routes := `{"h2c": {
+		"request_headers": [
+			{"action": "set", "name": "X-Via", "value": "sneaky %ROUTE_NAME% %PROTOCOL%"},
+			{"action": "remove", "name": "X-Debug-Token"}
+		],
+		"response_headers": [
+			{"action": "set", "name": "X-Request-Id", "value": "%REQUEST_ID%"}
+		]
+	}}`
+	if err := ioutil.WriteFile(cfg.routesFile, []byte(routes), 0600); err != nil {
+		t.Fatal(err)
+	}
+	_, addr := startProxy(t, cfg, startEnvoy(t, nethttp.HandlerFunc(reportHandler)))
+
+	req, _ := nethttp.NewRequest(nethttp.MethodGet, "https://"+addr+"/inspect", nil)
+	req.Header.Set("X-Debug-Token", "secret")
+	resp, err := h2Client().Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	var rep report
+	if err := json.NewDecoder(resp.Body).Decode(&rep); err != nil {
+		t.Fatal(err)
+	}
+	if got := rep.Header.Get("X-Via"); got != "sneaky h2c HTTP/2.0" {
+		t.Errorf("backend got X-Via %q", got)
+	}
+	if got, ok := rep.Header["X-Debug-Token"]; ok {
+		t.Errorf("backend got X-Debug-Token %q", got)
+	}
+	// The ID Envoy was given comes back to the client.
+	if id := resp.Header.Get("X-Request-Id"); id == "" || id != rep.Header.Get("X-Request-Id") {
+		t.Errorf("got X-Request-Id %q, backend got %q", id, rep.Header.Get("X-Request-Id"))
+	}
+}
+
+func TestMetricsThroughEnvoy(t *testing.T) {
+	cfg := testConfig(t)
+	cfg.adminAddr = "127.0.0.1:0"
+	p, addr := startProxy(t, cfg, startEnvoy(t, nethttp.HandlerFunc(reportHandler)))
+	c := h2Client()
+	for i := 0; i < 3; i++ {
+		do(t, c, "https://"+addr+"/inspect", nil)
+	}
+
+	resp, err := nethttp.Get("http://" + p.adminListener.Addr().String() + "/metrics")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	b, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, line := range []string{
+		`sneaky_proxy_requests_total{route="h2c",status="200"} 3`,
+		`sneaky_proxy_request_duration_seconds_count{route="h2c",status="200"} 3`,
+		`sneaky_proxy_upstream_upgrade_attempts_total 1`,
+		`sneaky_proxy_upstream_upgrades_total{result="upgraded"} 1`,
+		`sneaky_proxy_upstream_h2_connections 1`,
+		`sneaky_proxy_upstream_connections{pool="h2c"} 1`,
+	} {
+		if !strings.Contains(string(b), line+"\n") {
+			t.Errorf("no %s in\n%s", line, b)
+		}
+	}
+}
@@ -0,0 +1,165 @@
+package main
+
+import (
+	"crypto/tls"
+	"fmt"
+	"net"
+	"strings"
+
+	"github.com/gerg/net/http"
+)
+
+// forwardingHeaders are the request headers that describe the original
+// client. We only believe them when the peer that sent them is trusted.
+var forwardingHeaders = []string{
+	"Forwarded",
+	"X-Forwarded-For",
+	"X-Forwarded-Host",
+	"X-Forwarded-Proto",
+	"X-Forwarded-Tls-Version",
+	"X-Forwarded-Alpn",
+	xfccHeader,
+}
+
+// forwarder rewrites the RFC 7239 Forwarded and the X-Forwarded-* request
+// headers, including X-Forwarded-Client-Cert. Values sent by a peer in one of
+// the trusted networks are kept and extended, anything else is dropped before
+// we add our own.
+type forwarder struct {
+	trusted []*net.IPNet
+}
+
+// newForwarder parses a comma separated list of trusted proxy CIDRs. Bare IPs
+// are accepted as single-address networks.
+func newForwarder(cidrs string) (*forwarder, error) {
+	f := &forwarder{}
+	for _, s := range strings.Split(cidrs, ",") {
+		s = strings.TrimSpace(s)
+		if s == "" {
+			continue
+		}
+		if !strings.Contains(s, "/") {
+			if ip := net.ParseIP(s); ip != nil && ip.To4() != nil {
+				s += "/32"
+			} else {
+				s += "/128"
+			}
+		}
+		_, network, err := net.ParseCIDR(s)
+		if err != nil {
+			return nil, fmt.Errorf("parsing trusted proxy %q: %s", s, err)
+		}
+		f.trusted = append(f.trusted, network)
+	}
+	return f, nil
+}
+
+func (f *forwarder) isTrusted(ip net.IP) bool {
+	for _, network := range f.trusted {
+		if network.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// isTrustedAddr is isTrusted for a request's RemoteAddr.
+func (f *forwarder) isTrustedAddr(remoteAddr string) bool {
+	host, _, err := net.SplitHostPort(remoteAddr)
+	if err != nil {
+		host = remoteAddr
+	}
+	ip := net.ParseIP(host)
+	return ip != nil && f.isTrusted(ip)
+}
+
+// rewrite sets the forwarding headers on an outgoing request. ReverseProxy
+// appends the peer address to X-Forwarded-For itself after the Director has
+// run, so all we do for that header is drop untrusted values.
+func (f *forwarder) rewrite(req *http.Request) {
+	host, _, err := net.SplitHostPort(req.RemoteAddr)
+	if err != nil {
+		host = req.RemoteAddr
+	}
+	peer := net.ParseIP(host)
+
+	if peer == nil || !f.isTrusted(peer) {
+		for _, h := range forwardingHeaders {
+			req.Header.Del(h)
+		}
+	}
+
+	proto := "http"
+	if req.TLS != nil {
+		proto = "https"
+	}
+
+	element := fmt.Sprintf("for=%s;host=%s;proto=%s", forwardedNode(peer, host), quoteForwarded(req.Host), proto)
+	if prior := req.Header["Forwarded"]; len(prior) > 0 {
+		element = strings.Join(prior, ", ") + ", " + element
+	}
+	req.Header.Set("Forwarded", element)
+
+	setIfAbsent(req.Header, "X-Forwarded-Host", req.Host)
+	setIfAbsent(req.Header, "X-Forwarded-Proto", proto)
+	if req.TLS != nil {
+		setIfAbsent(req.Header, "X-Forwarded-Tls-Version", tlsVersionName(req.TLS.Version))
+		setIfAbsent(req.Header, "X-Forwarded-Alpn", req.TLS.NegotiatedProtocol)
+	}
+	forwardClientCert(req)
+}
+
+// setIfAbsent keeps a value a trusted proxy in front of us has already set,
+// since it is closer to the client than we are.
+func setIfAbsent(h http.Header, key, value string) {
+	if value == "" || h.Get(key) != "" {
+		return
+	}
+	h.Set(key, value)
+}
+
+// forwardedNode formats a node identifier for the Forwarded header. IPv6
+// addresses must be bracketed and quoted (RFC 7239 section 6).
+func forwardedNode(ip net.IP, raw string) string {
+	switch {
+	case ip == nil:
+		return quoteForwarded(raw)
+	case ip.To4() == nil:
+		return `"[` + ip.String() + `]"`
+	default:
+		return ip.String()
+	}
+}
+
+// quoteForwarded quotes a value unless it is a plain RFC 7230 token.
+func quoteForwarded(v string) string {
+	for _, r := range v {
+		if !isTokenChar(r) {
+			return `"` + strings.NewReplacer(`\`, `\\`, `"`, `\"`).Replace(v) + `"`
+		}
+	}
+	return v
+}
+
+func isTokenChar(r rune) bool {
+	switch {
+	case r >= 'a' && r <= 'z', r >= 'A' && r <= 'Z', r >= '0' && r <= '9':
+		return true
+	}
+	return strings.ContainsRune("!#$%&'*+-.^_`|~", r)
+}
+
+func tlsVersionName(v uint16) string {
+	switch v {
+	case tls.VersionTLS10:
+		return "TLSv1.0"
+	case tls.VersionTLS11:
+		return "TLSv1.1"
+	case tls.VersionTLS12:
+		return "TLSv1.2"
+	case tls.VersionTLS13:
+		return "TLSv1.3"
+	default:
+		return fmt.Sprintf("0x%04x", v)
+	}
+}
@@ -0,0 +1,173 @@
+package main
+
+import (
+	"crypto/tls"
+	"io/ioutil"
+	"net/http/httptest"
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/gerg/net/http"
+	"github.com/gerg/net/http/httputil"
+)
+
+// roundTripFunc is a transport that never leaves the process.
+type roundTripFunc func(*http.Request) (*http.Response, error)
+
+func (f roundTripFunc) RoundTrip(req *http.Request) (*http.Response, error) { return f(req) }
+
+// forwardedHeaders sends req through a ReverseProxy with the h2c route's
+// director and returns the forwarding headers that leave it. ReverseProxy
+// appends to X-Forwarded-For itself, after the director.
+func forwardedHeaders(t *testing.T, fwd *forwarder, req *http.Request) http.Header {
+	t.Helper()
+	var out http.Header
+	proxy := &httputil.ReverseProxy{
+		Director: newDirector(fwd, "h2c", nil, nil),
+		Transport: roundTripFunc(func(r *http.Request) (*http.Response, error) {
+			out = r.Header
+			return &http.Response{
+				StatusCode: http.StatusOK,
+				Header:     http.Header{},
+				Body:       ioutil.NopCloser(strings.NewReader("")),
+				Request:    r,
+			}, nil
+		}),
+	}
+	rec := httptest.NewRecorder()
+	proxy.ServeHTTP(&stdResponseWriter{rec}, req)
+	if rec.Code != http.StatusOK || out == nil {
+		t.Fatalf("got %d from the proxy", rec.Code)
+	}
+	got := http.Header{}
+	for _, h := range append([]string{"Forwarded"}, forwardingHeaders...) {
+		if v, ok := out[h]; ok {
+			got[h] = v
+		}
+	}
+	return got
+}
+
+func TestForwardingHeaders(t *testing.T) {
+	fwd, err := newForwarder("10.0.0.0/8, 2001:db8::1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	// What a client, or a proxy in front of us, says about the client.
+	inbound := http.Header{
+		"Forwarded":         {"for=198.51.100.1;proto=https"},
+		"X-Forwarded-For":   {"198.51.100.1"},
+		"X-Forwarded-Host":  {"public.example"},
+		"X-Forwarded-Proto": {"https"},
+		xfccHeader:          {"Hash=abc"},
+	}
+	for _, c := range []struct {
+		name       string
+		remoteAddr string
+		tls        bool
+		want       http.Header
+	}{
+		{
+			name:       "untrusted",
+			remoteAddr: "203.0.113.7:51234",
+			tls:        true,
+			want: http.Header{
+				"Forwarded":               {"for=203.0.113.7;host=example.com;proto=https"},
+				"X-Forwarded-For":         {"203.0.113.7"},
+				"X-Forwarded-Host":        {"example.com"},
+				"X-Forwarded-Proto":       {"https"},
+				"X-Forwarded-Tls-Version": {"TLSv1.3"},
+				"X-Forwarded-Alpn":        {"h2"},
+			},
+		},
+		{
+			name:       "trusted",
+			remoteAddr: "10.1.2.3:4000",
+			want: http.Header{
+				"Forwarded":         {"for=198.51.100.1;proto=https, for=10.1.2.3;host=example.com;proto=http"},
+				"X-Forwarded-For":   {"198.51.100.1, 10.1.2.3"},
+				"X-Forwarded-Host":  {"public.example"},
+				"X-Forwarded-Proto": {"https"},
+				xfccHeader:          {"Hash=abc"},
+			},
+		},
+		{
+			name:       "trusted IPv6",
+			remoteAddr: "[2001:db8::1]:443",
+			want: http.Header{
+				"Forwarded":         {`for=198.51.100.1;proto=https, for="[2001:db8::1]";host=example.com;proto=http`},
+				"X-Forwarded-For":   {"198.51.100.1, 2001:db8::1"},
+				"X-Forwarded-Host":  {"public.example"},
+				"X-Forwarded-Proto": {"https"},
+				xfccHeader:          {"Hash=abc"},
+			},
+		},
+		{
+			name:       "untrusted IPv6",
+			remoteAddr: "[2001:db8::2]:443",
+			want: http.Header{
+				"Forwarded":         {`for="[2001:db8::2]";host=example.com;proto=http`},
+				"X-Forwarded-For":   {"2001:db8::2"},
+				"X-Forwarded-Host":  {"example.com"},
+				"X-Forwarded-Proto": {"http"},
+			},
+		},
+		{
+			// Without a port ReverseProxy can't find the IP to append.
+			name:       "malformed",
+			remoteAddr: "not-an-address",
+			want: http.Header{
+				"Forwarded":         {"for=not-an-address;host=example.com;proto=http"},
+				"X-Forwarded-Host":  {"example.com"},
+				"X-Forwarded-Proto": {"http"},
+			},
+		},
+		{
+			// A trusted IP is still trusted without a port, but is not
+			// appended.
+			name:       "trusted without a port",
+			remoteAddr: "10.1.2.3",
+			want: http.Header{
+				"Forwarded":         {"for=198.51.100.1;proto=https, for=10.1.2.3;host=example.com;proto=http"},
+				"X-Forwarded-For":   {"198.51.100.1"},
+				"X-Forwarded-Host":  {"public.example"},
+				"X-Forwarded-Proto": {"https"},
+				xfccHeader:          {"Hash=abc"},
+			},
+		},
+	} {
+		t.Run(c.name, func(t *testing.T) {
+			req, _ := http.NewRequest(http.MethodGet, "https://example.com/", nil)
+			req.RemoteAddr = c.remoteAddr
+			req.Header = inbound.Clone()
+			if c.tls {
+				req.TLS = &tls.ConnectionState{Version: tls.VersionTLS13, NegotiatedProtocol: "h2"}
+			}
+			if got := forwardedHeaders(t, fwd, req); !reflect.DeepEqual(got, c.want) {
+				t.Errorf("got %v, want %v", got, c.want)
+			}
+		})
+	}
+}
+
+func TestIsTrustedAddr(t *testing.T) {
+	fwd, err := newForwarder("10.0.0.0/8, 2001:db8::1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	for addr, want := range map[string]bool{
+		"10.1.2.3:4000":     true,
+		"10.1.2.3":          true,
+		"11.0.0.1:4000":     false,
+		"[2001:db8::1]:443": true,
+		"2001:db8::1":       true,
+		"[2001:db8::2]:443": false,
+		"not-an-address":    false,
+		"":                  false,
+	} {
+		if got := fwd.isTrustedAddr(addr); got != want {
+			t.Errorf("%q: got %v, want %v", addr, got, want)
+		}
+	}
+}
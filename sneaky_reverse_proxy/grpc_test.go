@@ -0,0 +1,155 @@
+package main
+
+import (
+	"io"
+	nethttp "net/http"
+	"reflect"
+	"testing"
+
+	"shared/grpcecho"
+)
+
+// grpcCall is a call to the echo service through the proxy, its request body
+// written as the test goes. Like a gRPC server, the echo only sends its
+// headers with the first reply, so the response is waited for lazily.
+type grpcCall struct {
+	t    *testing.T
+	body *io.PipeWriter
+	done chan error
+	resp *nethttp.Response
+}
+
+func startGRPC(t *testing.T, c *nethttp.Client, url string) *grpcCall {
+	t.Helper()
+	pr, pw := io.Pipe()
+	req, err := nethttp.NewRequest(nethttp.MethodPost, url, pr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	req.Header.Set("Content-Type", "application/grpc")
+	req.Header.Set("Te", "trailers")
+
+	call := &grpcCall{t: t, body: pw, done: make(chan error, 1)}
+	go func() {
+		resp, err := c.Do(req)
+		call.resp = resp
+		call.done <- err
+	}()
+	t.Cleanup(func() { pw.Close() })
+	return call
+}
+
+func (c *grpcCall) send(msg string) {
+	c.t.Helper()
+	if err := grpcecho.WriteMessage(c.body, []byte(msg)); err != nil {
+		c.t.Fatal(err)
+	}
+}
+
+// response waits for the response headers.
+func (c *grpcCall) response() *nethttp.Response {
+	c.t.Helper()
+	if c.done != nil {
+		err := <-c.done
+		c.done = nil
+		if err != nil {
+			c.t.Fatal(err)
+		}
+		if c.resp.StatusCode != nethttp.StatusOK || c.resp.Header.Get("Content-Type") != "application/grpc" {
+			c.t.Fatalf("got %s, %v", c.resp.Status, c.resp.Header)
+		}
+	}
+	return c.resp
+}
+
+func (c *grpcCall) recv() string {
+	c.t.Helper()
+	msg, err := grpcecho.ReadMessage(c.response().Body)
+	if err != nil {
+		c.t.Fatal(err)
+	}
+	return string(msg)
+}
+
+// finish ends the request and returns the rest of the response and its
+// grpc-status trailer.
+func (c *grpcCall) finish() ([]string, string) {
+	c.t.Helper()
+	c.body.Close()
+	resp := c.response()
+	var rest []string
+	for {
+		msg, err := grpcecho.ReadMessage(resp.Body)
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			c.t.Fatal(err)
+		}
+		rest = append(rest, string(msg))
+	}
+	resp.Body.Close()
+	return rest, resp.Trailer.Get("Grpc-Status")
+}
+
+func TestGRPCThroughProxy(t *testing.T) {
+	mux := nethttp.NewServeMux()
+	mux.HandleFunc(grpcecho.ServicePrefix, grpcecho.Echo)
+	_, addr := startProxy(t, testConfig(t), startEnvoy(t, mux))
+	c := h2Client()
+	url := "https://" + addr + grpcecho.ServicePrefix
+
+	t.Run("unary", func(t *testing.T) {
+		call := startGRPC(t, c, url+"Unary")
+		call.send("hello")
+		if got := call.recv(); got != "hello" {
+			t.Errorf("got %q", got)
+		}
+		if rest, status := call.finish(); len(rest) != 0 || status != "0" {
+			t.Errorf("got %q more, grpc-status %q", rest, status)
+		}
+	})
+
+	t.Run("server streaming", func(t *testing.T) {
+		call := startGRPC(t, c, url+"ServerStream")
+		call.send("abc")
+		rest, status := call.finish()
+		if want := []string{"0:abc", "1:abc", "2:abc"}; !reflect.DeepEqual(rest, want) || status != "0" {
+			t.Errorf("got %q, grpc-status %q, want %q", rest, status, want)
+		}
+	})
+
+	t.Run("client streaming", func(t *testing.T) {
+		call := startGRPC(t, c, url+"ClientStream")
+		call.send("one ")
+		call.send("two ")
+		call.send("three")
+		if rest, status := call.finish(); !reflect.DeepEqual(rest, []string{"one two three"}) || status != "0" {
+			t.Errorf("got %q, grpc-status %q", rest, status)
+		}
+	})
+
+	t.Run("bidi", func(t *testing.T) {
+		// Each reply comes back before the next message is sent.
+		call := startGRPC(t, c, url+"Bidi")
+		for _, msg := range []string{"ping", "pong"} {
+			call.send(msg)
+			if got := call.recv(); got != msg {
+				t.Errorf("got %q, want %q", got, msg)
+			}
+		}
+		if rest, status := call.finish(); len(rest) != 0 || status != "0" {
+			t.Errorf("got %q more, grpc-status %q", rest, status)
+		}
+	})
+
+	t.Run("unknown method", func(t *testing.T) {
+		call := startGRPC(t, c, url+"Nope")
+		if rest, status := call.finish(); len(rest) != 0 || status != "12" {
+			t.Errorf("got %q, grpc-status %q", rest, status)
+		}
+		if msg := call.response().Trailer.Get("Grpc-Message"); msg != "unknown method Nope" {
+			t.Errorf("got grpc-message %q", msg)
+		}
+	})
+}
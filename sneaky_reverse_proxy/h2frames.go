@@ -0,0 +1,142 @@
+package main
+
+import (
+	"encoding/binary"
+	"fmt"
+	"time"
+)
+
+// The fork's HTTP/2 client keeps the peer's SETTINGS and any GOAWAY to
+// itself, so for the admin endpoint we read them off the wire instead. This
+// file has just enough of RFC 7540's framing for that.
+
+const (
+	frameSettings = 0x4
+	frameGoAway   = 0x7
+
+	flagSettingsAck = 0x1
+)
+
+// clientPreface is what an HTTP/2 client sends first, upgraded or not.
+const clientPreface = "PRI * HTTP/2.0\r\n\r\nSM\r\n\r\n"
+
+// frameScanner splits a byte stream into HTTP/2 frames. Only SETTINGS and
+// GOAWAY frames are buffered and handed to onFrame; the payloads of all other
+// frames, DATA especially, are skipped as they go by.
+type frameScanner struct {
+	onFrame func(typ, flags byte, payload []byte)
+
+	buf  []byte // a partial frame header, or a partial SETTINGS/GOAWAY frame
+	skip int    // bytes left of a frame we are not interested in
+}
+
+func (s *frameScanner) write(p []byte) {
+	for len(p) > 0 {
+		if s.skip > 0 {
+			n := minInt(s.skip, len(p))
+			s.skip -= n
+			p = p[n:]
+			continue
+		}
+
+		if len(s.buf) < 9 {
+			n := minInt(9-len(s.buf), len(p))
+			s.buf = append(s.buf, p[:n]...)
+			p = p[n:]
+			if len(s.buf) < 9 {
+				return
+			}
+		}
+
+		length := int(s.buf[0])<<16 | int(s.buf[1])<<8 | int(s.buf[2])
+		typ := s.buf[3]
+		if typ != frameSettings && typ != frameGoAway {
+			s.buf = s.buf[:0]
+			s.skip = length
+			continue
+		}
+
+		n := minInt(9+length-len(s.buf), len(p))
+		s.buf = append(s.buf, p[:n]...)
+		p = p[n:]
+		if len(s.buf) < 9+length {
+			return
+		}
+		s.onFrame(typ, s.buf[4], s.buf[9:])
+		s.buf = nil
+	}
+}
+
+// atBoundary reports whether the stream so far ends between two frames.
+func (s *frameScanner) atBoundary() bool {
+	return len(s.buf) == 0 && s.skip == 0
+}
+
+// goAway is a GOAWAY frame seen on an upstream connection.
+type goAway struct {
+	Direction    string    `json:"direction"` // "received" or "sent"
+	LastStreamID uint32    `json:"last_stream_id"`
+	ErrorCode    string    `json:"error_code"`
+	DebugData    string    `json:"debug_data,omitempty"`
+	At           time.Time `json:"at"`
+}
+
+func parseGoAway(payload []byte) (goAway, bool) {
+	if len(payload) < 8 {
+		return goAway{}, false
+	}
+	return goAway{
+		LastStreamID: binary.BigEndian.Uint32(payload[0:4]) & 0x7fffffff,
+		ErrorCode:    errorCodeName(binary.BigEndian.Uint32(payload[4:8])),
+		DebugData:    string(payload[8:]),
+	}, true
+}
+
+// parseSettings calls set for each parameter in a SETTINGS payload.
+func parseSettings(payload []byte, set func(name string, value uint32)) {
+	for len(payload) >= 6 {
+		set(settingName(binary.BigEndian.Uint16(payload[0:2])), binary.BigEndian.Uint32(payload[2:6]))
+		payload = payload[6:]
+	}
+}
+
+func settingName(id uint16) string {
+	switch id {
+	case 0x1:
+		return "HEADER_TABLE_SIZE"
+	case 0x2:
+		return "ENABLE_PUSH"
+	case 0x3:
+		return "MAX_CONCURRENT_STREAMS"
+	case 0x4:
+		return "INITIAL_WINDOW_SIZE"
+	case 0x5:
+		return "MAX_FRAME_SIZE"
+	case 0x6:
+		return "MAX_HEADER_LIST_SIZE"
+	case 0x8:
+		return "ENABLE_CONNECT_PROTOCOL"
+	default:
+		return fmt.Sprintf("0x%x", id)
+	}
+}
+
+func errorCodeName(code uint32) string {
+	names := []string{
+		"NO_ERROR", "PROTOCOL_ERROR", "INTERNAL_ERROR", "FLOW_CONTROL_ERROR",
+		"SETTINGS_TIMEOUT", "STREAM_CLOSED", "FRAME_SIZE_ERROR", "REFUSED_STREAM",
+		"CANCEL", "COMPRESSION_ERROR", "CONNECT_ERROR", "ENHANCE_YOUR_CALM",
+		"INADEQUATE_SECURITY", "HTTP_1_1_REQUIRED",
+	}
+	if int(code) < len(names) {
+		return names[code]
+	}
+	return fmt.Sprintf("0x%x", code)
+}
+
+func minInt(a, b int) int {
+	if a < b {
+		return a
+	}
+	return b
+}
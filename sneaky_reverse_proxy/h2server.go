@@ -0,0 +1,148 @@
+package main
+
+import (
+	"context"
+	"crypto/tls"
+	"net"
+	nethttp "net/http"
+	"sync"
+	"time"
+
+	"golang.org/x/net/http2"
+
+	"github.com/gerg/net/http"
+)
+
+// newH2Server returns the HTTP/2 server for downstream connections, TLS and
+// h2c alike. It advertises maxStreams, 0 for its default of 250, as
+// SETTINGS_MAX_CONCURRENT_STREAMS and refuses any stream over it with
+// REFUSED_STREAM.
+func newH2Server(maxStreams uint32) *http2.Server {
+	return &http2.Server{MaxConcurrentStreams: maxStreams}
+}
+
+// shutdownPollInterval is how often Shutdown checks whether the HTTP/2
+// connections have gone, as the fork's does for the rest.
+const shutdownPollInterval = 500 * time.Millisecond
+
+// tlsServer is the TLS listener. Connections on which the client chooses h2
+// are served by an HTTP/2 server of our own instead of the fork's bundled
+// one, which configures itself with no way in from outside.
+type tlsServer struct {
+	*http.Server
+	listener *stoppableListener
+
+	// hooks is a net/http server that never serves anything. Configuring
+	// HTTP/2 on it is the only way to have h2s send GOAWAY when asked to,
+	// which its Shutdown does.
+	hooks   *nethttp.Server
+	h2conns inFlight
+}
+
+func newTLSServer(srv *http.Server, h2s *http2.Server) (*tlsServer, error) {
+	s := &tlsServer{Server: srv, hooks: &nethttp.Server{ErrorLog: srv.ErrorLog}}
+	if err := http2.ConfigureServer(s.hooks, h2s); err != nil {
+		return nil, err
+	}
+	srv.RegisterOnShutdown(s.goAway)
+
+	srv.TLSConfig.NextProtos = append([]string{http2.NextProtoTLS}, srv.TLSConfig.NextProtos...)
+	srv.TLSNextProto = map[string]func(*http.Server, *tls.Conn, http.Handler){
+		http2.NextProtoTLS: func(_ *http.Server, c *tls.Conn, h http.Handler) {
+			s.h2conns.add()
+			defer s.h2conns.done()
+			// h is srv's handler, with the connection's context, which the
+			// fork hands over the way net/http does.
+			ctx := context.Background()
+			if bc, ok := h.(interface{ BaseContext() context.Context }); ok {
+				ctx = bc.BaseContext()
+			}
+			h2s.ServeConn(c, &http2.ServeConnOpts{
+				Context:    ctx,
+				BaseConfig: s.hooks,
+				Handler:    fromStdHandler{h},
+			})
+		},
+	}
+	return s, nil
+}
+
+func (s *tlsServer) listen() error {
+	l, err := net.Listen("tcp", s.Addr)
+	if err != nil {
+		return err
+	}
+	s.listener = newStoppableListener(l)
+	return nil
+}
+
+func (s *tlsServer) serve() error {
+	return s.ServeTLS(s.listener, "", "")
+}
+
+// goAway has the HTTP/2 server send GOAWAY on the connections it is serving.
+func (s *tlsServer) goAway() {
+	s.hooks.Shutdown(context.Background())
+}
+
+// Shutdown stops accepting connections and lets the HTTP/2 ones finish their
+// requests before it shuts the fork's server down. That would close any
+// connection handed to TLSNextProto that is more than five seconds old,
+// streams or not, because the fork never marks them active.
+func (s *tlsServer) Shutdown(ctx context.Context) error {
+	s.listener.stop()
+	ticker := time.NewTicker(shutdownPollInterval)
+	defer ticker.Stop()
+	for {
+		// Again each time, for connections that were still in their TLS
+		// handshake the time before.
+		s.goAway()
+		if s.h2conns.count() == 0 {
+			break
+		}
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-ticker.C:
+		}
+	}
+	return s.Server.Shutdown(ctx)
+}
+
+// stoppableListener can stop accepting connections before it is closed.
+// Until then, the server serving it does not see the error, and so carries
+// on as if nothing had happened.
+type stoppableListener struct {
+	net.Listener
+	stopOnce, closeOnce sync.Once
+	stopped, closed     chan struct{}
+}
+
+func newStoppableListener(l net.Listener) *stoppableListener {
+	return &stoppableListener{Listener: l, stopped: make(chan struct{}), closed: make(chan struct{})}
+}
+
+func (l *stoppableListener) Accept() (net.Conn, error) {
+	c, err := l.Listener.Accept()
+	if err != nil {
+		select {
+		case <-l.stopped:
+			<-l.closed
+		default:
+		}
+	}
+	return c, err
+}
+
+func (l *stoppableListener) stop() {
+	l.stopOnce.Do(func() {
+		close(l.stopped)
+		l.Listener.Close()
+	})
+}
+
+func (l *stoppableListener) Close() error {
+	l.stop()
+	l.closeOnce.Do(func() { close(l.closed) })
+	return nil
+}
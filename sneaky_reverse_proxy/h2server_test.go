@@ -0,0 +1,174 @@
+package main
+
+import (
+	"bytes"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"io"
+	"io/ioutil"
+	"log"
+	"math/big"
+	"net"
+	nethttp "net/http"
+	"testing"
+	"time"
+
+	"golang.org/x/net/http2"
+	"golang.org/x/net/http2/hpack"
+
+	"github.com/gerg/net/http"
+)
+
+// localhostCert is a self-signed certificate for localhost and 127.0.0.1.
+func localhostCert(t *testing.T) tls.Certificate {
+	t.Helper()
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(1),
+		Subject:      pkix.Name{CommonName: "localhost"},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		KeyUsage:     x509.KeyUsageDigitalSignature | x509.KeyUsageCertSign,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+		DNSNames:     []string{"localhost"},
+		IPAddresses:  []net.IP{net.IPv4(127, 0, 0, 1)},
+		IsCA:         true,
+
+		BasicConstraintsValid: true,
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return tls.Certificate{Certificate: [][]byte{der}, PrivateKey: key}
+}
+
+// startTLS serves h over TLS on an ephemeral port, with HTTP/2 from h2s.
+func startTLS(t *testing.T, h http.Handler, h2s *http2.Server) (*tlsServer, string) {
+	t.Helper()
+	srv, err := newTLSServer(&http.Server{
+		Addr:      "127.0.0.1:0",
+		Handler:   h,
+		TLSConfig: &tls.Config{Certificates: []tls.Certificate{localhostCert(t)}},
+		ErrorLog:  log.New(ioutil.Discard, "", 0),
+	}, h2s)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := srv.listen(); err != nil {
+		t.Fatal(err)
+	}
+	go srv.serve()
+	t.Cleanup(func() { srv.Close() })
+	return srv, srv.listener.Addr().String()
+}
+
+func TestServeHTTP2(t *testing.T) {
+	_, addr := startTLS(t, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.TLS == nil || r.TLS.NegotiatedProtocol != "h2" {
+			t.Errorf("request's TLS state is %+v", r.TLS)
+		}
+		if _, ok := r.Context().Value(http.LocalAddrContextKey).(net.Addr); !ok {
+			t.Error("no local address in the request's context")
+		}
+		w.Header().Set("Trailer", "X-Trailer")
+		io.WriteString(w, r.Proto)
+		w.Header().Set("X-Trailer", "yes")
+	}), newH2Server(0))
+
+	client := &nethttp.Client{Transport: &http2.Transport{TLSClientConfig: &tls.Config{InsecureSkipVerify: true}}}
+	resp, err := client.Get("https://" + addr + "/")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	body, _ := ioutil.ReadAll(resp.Body)
+	if string(body) != "HTTP/2.0" || resp.Trailer.Get("X-Trailer") != "yes" {
+		t.Errorf("got %q with trailers %v", body, resp.Trailer)
+	}
+}
+
+func TestServeHTTP2KeepsHTTP1(t *testing.T) {
+	_, addr := startTLS(t, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		io.WriteString(w, r.Proto)
+	}), newH2Server(0))
+
+	client := &nethttp.Client{Transport: &nethttp.Transport{TLSClientConfig: &tls.Config{InsecureSkipVerify: true}}}
+	resp, err := client.Get("https://" + addr + "/")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	body, _ := ioutil.ReadAll(resp.Body)
+	if string(body) != "HTTP/1.1" {
+		t.Errorf("got %q", body)
+	}
+}
+
+func TestMaxConcurrentStreams(t *testing.T) {
+	release := make(chan struct{})
+	defer close(release)
+	_, addr := startTLS(t, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		<-release
+	}), newH2Server(1))
+
+	conn, err := tls.Dial("tcp", addr, &tls.Config{InsecureSkipVerify: true, NextProtos: []string{"h2"}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(10 * time.Second))
+	io.WriteString(conn, http2.ClientPreface)
+	fr := http2.NewFramer(conn, conn)
+	fr.WriteSettings()
+
+	f, err := fr.ReadFrame()
+	if err != nil {
+		t.Fatal(err)
+	}
+	settings, ok := f.(*http2.SettingsFrame)
+	if !ok {
+		t.Fatalf("got %v, want the server's SETTINGS", f)
+	}
+	if v, ok := settings.Value(http2.SettingMaxConcurrentStreams); !ok || v != 1 {
+		t.Errorf("got MAX_CONCURRENT_STREAMS %d, %t, want 1", v, ok)
+	}
+	// A client that has yet to acknowledge the SETTINGS may not know about
+	// the limit, so going over it is not its fault, and the stream is
+	// refused for it to retry. Once acknowledged, the limit is the client's
+	// to keep, and going over it is a PROTOCOL_ERROR.
+
+	var headers bytes.Buffer
+	enc := hpack.NewEncoder(&headers)
+	for _, f := range []hpack.HeaderField{
+		{Name: ":method", Value: "GET"},
+		{Name: ":scheme", Value: "https"},
+		{Name: ":authority", Value: addr},
+		{Name: ":path", Value: "/"},
+	} {
+		enc.WriteField(f)
+	}
+	for _, id := range []uint32{1, 3} {
+		fr.WriteHeaders(http2.HeadersFrameParam{StreamID: id, BlockFragment: headers.Bytes(), EndStream: true, EndHeaders: true})
+	}
+
+	for {
+		f, err := fr.ReadFrame()
+		if err != nil {
+			t.Fatalf("reading frames: %s", err)
+		}
+		if rst, ok := f.(*http2.RSTStreamFrame); ok {
+			if rst.StreamID != 3 || rst.ErrCode != http2.ErrCodeRefusedStream {
+				t.Errorf("got %v %v, want stream 3 refused", rst, rst.ErrCode)
+			}
+			return
+		}
+	}
+}
@@ -0,0 +1,239 @@
+package main
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"fmt"
+	"net"
+	"strings"
+
+	"golang.org/x/net/http/httpguts"
+
+	"github.com/gerg/net/http"
+)
+
+// headerRule adds, sets or removes a request or response header. Values are
+// templates in the style of Envoy's custom headers, e.g.
+//
+//	{"action": "set", "name": "X-Client-Ip", "value": "%DOWNSTREAM_REMOTE_ADDRESS_WITHOUT_PORT%"}
+//
+// A rule whose value comes out empty is skipped.
+type headerRule struct {
+	Action string `json:"action"` // "add", "set" or "remove"
+	Name   string `json:"name"`
+	Value  string `json:"value,omitempty"`
+
+	value template
+}
+
+// protectedHeaders can't be touched by rules. Hop-by-hop and upgrade headers
+// decide how the request or response travels, so a rule that set them would
+// at best be stripped again by ReverseProxy and at worst start an upgrade
+// nobody asked for. Host and Content-Length describe the message itself.
+var protectedHeaders = []string{
+	"Connection",
+	"Proxy-Connection",
+	"Keep-Alive",
+	"Te",
+	"Trailer",
+	"Transfer-Encoding",
+	"Upgrade",
+	"Http2-Settings",
+	"Proxy-Authenticate",
+	"Proxy-Authorization",
+	"Host",
+	"Content-Length",
+}
+
+// headerRules is a compiled list of rules, applied in order.
+type headerRules []headerRule
+
+func compileHeaderRules(rules []headerRule) (headerRules, error) {
+	compiled := make(headerRules, len(rules))
+	for i, rule := range rules {
+		if !httpguts.ValidHeaderFieldName(rule.Name) {
+			return nil, fmt.Errorf("header rule %d: invalid header name %q", i, rule.Name)
+		}
+		rule.Name = http.CanonicalHeaderKey(rule.Name)
+		for _, h := range protectedHeaders {
+			if rule.Name == h {
+				return nil, fmt.Errorf("header rule %d: %s is a protected header", i, rule.Name)
+			}
+		}
+
+		switch rule.Action {
+		case "add", "set":
+			t, err := parseTemplate(rule.Value)
+			if err != nil {
+				return nil, fmt.Errorf("header rule %d (%s): %s", i, rule.Name, err)
+			}
+			rule.value = t
+		case "remove":
+			if rule.Value != "" {
+				return nil, fmt.Errorf("header rule %d (%s): remove takes no value", i, rule.Name)
+			}
+		default:
+			return nil, fmt.Errorf("header rule %d (%s): unknown action %q, want add, set or remove", i, rule.Name, rule.Action)
+		}
+		compiled[i] = rule
+	}
+	return compiled, nil
+}
+
+// apply rewrites h. The template values are taken from req, the downstream
+// request or ReverseProxy's outgoing copy of it.
+func (rules headerRules) apply(h http.Header, req *http.Request, route string) {
+	for _, rule := range rules {
+		if rule.Action == "remove" {
+			h.Del(rule.Name)
+			continue
+		}
+		v := rule.value.expand(req, route)
+		if v == "" {
+			continue
+		}
+		if !httpguts.ValidHeaderFieldValue(v) {
+			// A client-controlled value such as %REQ(...)% must not be able
+			// to smuggle in a header of its own.
+			continue
+		}
+		if rule.Action == "add" {
+			h.Add(rule.Name, v)
+		} else {
+			h.Set(rule.Name, v)
+		}
+	}
+}
+
+// template is a header value with %VARIABLE% and %REQ(header)% substitutions.
+// "%%" is a literal percent sign.
+type template []templatePart
+
+type templatePart struct {
+	literal  string
+	variable string // empty for a literal
+	arg      string // the header name for REQ
+}
+
+// templateVariables are the variables a template can use.
+var templateVariables = map[string]func(req *http.Request, route, arg string) string{
+	"DOWNSTREAM_REMOTE_ADDRESS": func(req *http.Request, _, _ string) string {
+		return req.RemoteAddr
+	},
+	"DOWNSTREAM_REMOTE_ADDRESS_WITHOUT_PORT": func(req *http.Request, _, _ string) string {
+		host, _, err := net.SplitHostPort(req.RemoteAddr)
+		if err != nil {
+			return req.RemoteAddr
+		}
+		return host
+	},
+	"PROTOCOL": func(req *http.Request, _, _ string) string {
+		return req.Proto
+	},
+	"DOWNSTREAM_TLS_VERSION": func(req *http.Request, _, _ string) string {
+		if req.TLS == nil {
+			return ""
+		}
+		return tlsVersionName(req.TLS.Version)
+	},
+	"DOWNSTREAM_PEER_SUBJECT": func(req *http.Request, _, _ string) string {
+		if req.TLS == nil || len(req.TLS.PeerCertificates) == 0 {
+			return ""
+		}
+		return req.TLS.PeerCertificates[0].Subject.String()
+	},
+	"ROUTE_NAME": func(_ *http.Request, route, _ string) string {
+		return route
+	},
+	"REQUEST_ID": func(req *http.Request, _, _ string) string {
+		return requestIDFromContext(req.Context())
+	},
+	"REQ": func(req *http.Request, _, arg string) string {
+		return req.Header.Get(arg)
+	},
+}
+
+func parseTemplate(s string) (template, error) {
+	var t template
+	for s != "" {
+		i := strings.IndexByte(s, '%')
+		if i < 0 {
+			t = append(t, templatePart{literal: s})
+			break
+		}
+		if i > 0 {
+			t = append(t, templatePart{literal: s[:i]})
+		}
+		s = s[i+1:]
+		if strings.HasPrefix(s, "%") {
+			t = append(t, templatePart{literal: "%"})
+			s = s[1:]
+			continue
+		}
+		end := strings.IndexByte(s, '%')
+		if end < 0 {
+			return nil, fmt.Errorf("unterminated variable in %q", s)
+		}
+		name, arg := s[:end], ""
+		if open := strings.IndexByte(name, '('); open >= 0 && strings.HasSuffix(name, ")") {
+			name, arg = name[:open], name[open+1:len(name)-1]
+		}
+		if _, ok := templateVariables[name]; !ok {
+			return nil, fmt.Errorf("unknown variable %%%s%%", name)
+		}
+		switch {
+		case name == "REQ" && arg == "":
+			return nil, fmt.Errorf("%%REQ%% takes a header name, as in %%REQ(user-agent)%%")
+		case name != "REQ" && arg != "":
+			return nil, fmt.Errorf("%%%s%% takes no argument", name)
+		}
+		t = append(t, templatePart{variable: name, arg: arg})
+		s = s[end+1:]
+	}
+	return t, nil
+}
+
+func (t template) expand(req *http.Request, route string) string {
+	var b strings.Builder
+	for _, part := range t {
+		if part.variable == "" {
+			b.WriteString(part.literal)
+			continue
+		}
+		b.WriteString(templateVariables[part.variable](req, route, part.arg))
+	}
+	return b.String()
+}
+
+type requestIDKey struct{}
+
+// withRequestID gives every request an ID for logs and header rules, and
+// passes it on in X-Request-Id like Envoy does. An X-Request-Id sent by a
+// trusted proxy is kept; anyone else's is replaced.
+func withRequestID(fwd *forwarder, h http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		id := r.Header.Get("X-Request-Id")
+		if id == "" || !fwd.isTrustedAddr(r.RemoteAddr) {
+			id = newRequestID()
+			r.Header.Set("X-Request-Id", id)
+		}
+		h.ServeHTTP(w, r.WithContext(context.WithValue(r.Context(), requestIDKey{}, id)))
+	})
+}
+
+func requestIDFromContext(ctx context.Context) string {
+	id, _ := ctx.Value(requestIDKey{}).(string)
+	return id
+}
+
+// newRequestID returns a random version 4 UUID, the format Envoy uses for
+// x-request-id.
+func newRequestID() string {
+	var b [16]byte
+	rand.Read(b[:])
+	b[6] = b[6]&0x0f | 0x40
+	b[8] = b[8]&0x3f | 0x80
+	s := hex.EncodeToString(b[:])
+	return s[0:8] + "-" + s[8:12] + "-" + s[12:16] + "-" + s[16:20] + "-" + s[20:]
+}
@@ -0,0 +1,163 @@
+package main
+
+import (
+	"context"
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/gerg/net/http"
+)
+
+func TestParseTemplate(t *testing.T) {
+	for _, c := range []struct {
+		in   string
+		want template
+	}{
+		{in: "", want: nil},
+		{in: "plain", want: template{{literal: "plain"}}},
+		{in: "100%%", want: template{{literal: "100"}, {literal: "%"}}},
+		{in: "%%%PROTOCOL%%%", want: template{{literal: "%"}, {variable: "PROTOCOL"}, {literal: "%"}}},
+		{in: "ip=%DOWNSTREAM_REMOTE_ADDRESS_WITHOUT_PORT%;", want: template{
+			{literal: "ip="},
+			{variable: "DOWNSTREAM_REMOTE_ADDRESS_WITHOUT_PORT"},
+			{literal: ";"},
+		}},
+		{in: "%REQ(user-agent)%", want: template{{variable: "REQ", arg: "user-agent"}}},
+	} {
+		got, err := parseTemplate(c.in)
+		if err != nil {
+			t.Errorf("%q: %s", c.in, err)
+			continue
+		}
+		if !reflect.DeepEqual(got, c.want) {
+			t.Errorf("%q: got %+v, want %+v", c.in, got, c.want)
+		}
+	}
+}
+
+func TestParseTemplateErrors(t *testing.T) {
+	for in, want := range map[string]string{
+		"%PROTOCOL":         "unterminated variable",
+		"50%":               "unterminated variable",
+		"%NOPE%":            "unknown variable %NOPE%",
+		"%REQ%":             "takes a header name",
+		"%REQ()%":           "takes a header name",
+		"%PROTOCOL(x)%":     "%PROTOCOL% takes no argument",
+		"%REQ(user-agent%":  "unknown variable %REQ(user-agent%",
+		"a %ROUTE_NAME% %X": "unterminated variable",
+	} {
+		_, err := parseTemplate(in)
+		if err == nil || !strings.Contains(err.Error(), want) {
+			t.Errorf("%q: got %v, want an error with %q", in, err, want)
+		}
+	}
+}
+
+func TestCompileHeaderRules(t *testing.T) {
+	rules, err := compileHeaderRules([]headerRule{
+		{Action: "set", Name: "x-client-ip", Value: "%DOWNSTREAM_REMOTE_ADDRESS_WITHOUT_PORT%"},
+		{Action: "remove", Name: "server"},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if rules[0].Name != "X-Client-Ip" || rules[1].Name != "Server" {
+		t.Errorf("names not canonicalized: %q, %q", rules[0].Name, rules[1].Name)
+	}
+	if len(rules[0].value) != 1 || rules[0].value[0].variable != "DOWNSTREAM_REMOTE_ADDRESS_WITHOUT_PORT" {
+		t.Errorf("value not compiled: %+v", rules[0].value)
+	}
+}
+
+func TestCompileHeaderRulesErrors(t *testing.T) {
+	for _, c := range []struct {
+		rule headerRule
+		want string
+	}{
+		{rule: headerRule{Action: "set", Name: "bad name", Value: "x"}, want: "invalid header name"},
+		{rule: headerRule{Action: "set", Name: "", Value: "x"}, want: "invalid header name"},
+		{rule: headerRule{Action: "move", Name: "X-A"}, want: `unknown action "move"`},
+		{rule: headerRule{Action: "remove", Name: "X-A", Value: "x"}, want: "remove takes no value"},
+		{rule: headerRule{Action: "add", Name: "X-A", Value: "%NOPE%"}, want: "unknown variable"},
+	} {
+		_, err := compileHeaderRules([]headerRule{c.rule})
+		if err == nil || !strings.Contains(err.Error(), c.want) {
+			t.Errorf("%+v: got %v, want an error with %q", c.rule, err, c.want)
+		}
+	}
+}
+
+func TestCompileHeaderRulesProtected(t *testing.T) {
+	for _, name := range protectedHeaders {
+		for _, action := range []string{"add", "set", "remove"} {
+			rule := headerRule{Action: action, Name: strings.ToLower(name)}
+			if action != "remove" {
+				rule.Value = "x"
+			}
+			_, err := compileHeaderRules([]headerRule{rule})
+			if err == nil || !strings.Contains(err.Error(), name+" is a protected header") {
+				t.Errorf("%s %s: got %v, want it protected", action, name, err)
+			}
+		}
+	}
+}
+
+func TestHeaderRulesApply(t *testing.T) {
+	rules, err := compileHeaderRules([]headerRule{
+		{Action: "set", Name: "X-Client-Ip", Value: "%DOWNSTREAM_REMOTE_ADDRESS_WITHOUT_PORT%"},
+		{Action: "add", Name: "X-Via", Value: "sneaky %PROTOCOL% on %ROUTE_NAME%, 100%%"},
+		{Action: "set", Name: "X-Agent", Value: "%REQ(user-agent)%"},
+		{Action: "set", Name: "X-Id", Value: "%REQUEST_ID%"},
+		{Action: "set", Name: "X-Empty", Value: "%REQ(x-missing)%"},
+		{Action: "remove", Name: "X-Secret"},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	req, _ := http.NewRequest("GET", "https://envoy/", nil)
+	req.RemoteAddr = "192.0.2.1:1234"
+	req.Header.Set("User-Agent", "curl")
+	req = req.WithContext(context.WithValue(req.Context(), requestIDKey{}, "id-1"))
+
+	h := http.Header{
+		"X-Client-Ip": {"spoofed"},
+		"X-Via":       {"first"},
+		"X-Empty":     {"kept"},
+		"X-Secret":    {"s"},
+	}
+	rules.apply(h, req, "h2c")
+
+	want := http.Header{
+		"X-Client-Ip": {"192.0.2.1"},
+		"X-Via":       {"first", "sneaky HTTP/1.1 on h2c, 100%"},
+		"X-Agent":     {"curl"},
+		"X-Id":        {"id-1"},
+		"X-Empty":     {"kept"},
+	}
+	if !reflect.DeepEqual(h, want) {
+		t.Errorf("got %v, want %v", h, want)
+	}
+}
+
+func TestHeaderRulesApplyDropsCRLF(t *testing.T) {
+	rules, err := compileHeaderRules([]headerRule{
+		{Action: "set", Name: "X-Agent", Value: "%REQ(user-agent)%"},
+		{Action: "add", Name: "X-Other", Value: "ok"},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, agent := range []string{"a\r\nX-Injected: 1", "a\nX-Injected: 1", "a\rb"} {
+		req, _ := http.NewRequest("GET", "https://envoy/", nil)
+		req.Header["User-Agent"] = []string{agent}
+		h := http.Header{}
+		rules.apply(h, req, "h2c")
+		if _, ok := h["X-Agent"]; ok {
+			t.Errorf("%q: got X-Agent %q, want it dropped", agent, h["X-Agent"])
+		}
+		if h.Get("X-Other") != "ok" {
+			t.Errorf("%q: the rules after it were not applied: %v", agent, h)
+		}
+	}
+}
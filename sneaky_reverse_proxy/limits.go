@@ -0,0 +1,144 @@
+package main
+
+import (
+	"fmt"
+	"math"
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gerg/net/http"
+)
+
+// limiter turns clients away with 429 when they go over their request rate.
+// The limit on requests in flight per connection is the HTTP/2 server's, see
+// newH2Server.
+type limiter struct {
+	fwd     *forwarder
+	metrics *proxyMetrics
+
+	rate  float64 // tokens per second, 0 for no rate limit
+	burst float64
+	key   string // "ip", "cert" or "header:<name>"
+
+	mu        sync.Mutex
+	buckets   map[string]*tokenBucket
+	lastSweep time.Time
+}
+
+type tokenBucket struct {
+	tokens float64
+	last   time.Time
+}
+
+func newLimiter(fwd *forwarder, metrics *proxyMetrics, rate float64, burst int, key string) (*limiter, error) {
+	if rate < 0 {
+		return nil, fmt.Errorf("rate limit %v is negative", rate)
+	}
+	if key != "ip" && key != "cert" && !(strings.HasPrefix(key, "header:") && len(key) > len("header:")) {
+		return nil, fmt.Errorf("unknown rate limit key %q, want ip, cert or header:<name>", key)
+	}
+	l := &limiter{
+		fwd:     fwd,
+		metrics: metrics,
+		rate:    rate,
+		burst:   float64(burst),
+		key:     key,
+		buckets: map[string]*tokenBucket{},
+	}
+	if l.burst <= 0 {
+		l.burst = math.Max(1, math.Ceil(rate))
+	}
+	return l, nil
+}
+
+func (l *limiter) wrap(h http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if l.rate > 0 {
+			if wait, ok := l.take(l.clientKey(r), time.Now()); !ok {
+				l.metrics.rateLimited.inc("rate")
+				w.Header().Set("Retry-After", strconv.Itoa(int(math.Ceil(wait.Seconds()))))
+				http.Error(w, "rate limit exceeded", http.StatusTooManyRequests)
+				return
+			}
+		}
+		h.ServeHTTP(w, r)
+	})
+}
+
+// clientKey is who a request counts against. Requests without the client
+// certificate or header the limit is keyed on count against their IP.
+func (l *limiter) clientKey(r *http.Request) string {
+	switch {
+	case l.key == "cert" && r.TLS != nil && len(r.TLS.VerifiedChains) > 0:
+		return "cert:" + r.TLS.VerifiedChains[0][0].Subject.String()
+	case strings.HasPrefix(l.key, "header:"):
+		if v := r.Header.Get(strings.TrimPrefix(l.key, "header:")); v != "" {
+			return l.key + ":" + v
+		}
+	}
+	return "ip:" + l.clientIP(r)
+}
+
+// clientIP is the peer's address or, when the peer is a trusted proxy, the
+// last address in X-Forwarded-For that isn't one.
+func (l *limiter) clientIP(r *http.Request) string {
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		host = r.RemoteAddr
+	}
+	if !l.fwd.isTrustedAddr(r.RemoteAddr) {
+		return host
+	}
+	hops := strings.Split(strings.Join(r.Header["X-Forwarded-For"], ","), ",")
+	for i := len(hops) - 1; i >= 0; i-- {
+		hop := strings.TrimSpace(hops[i])
+		ip := net.ParseIP(hop)
+		if ip == nil {
+			break
+		}
+		host = hop
+		if !l.fwd.isTrusted(ip) {
+			break
+		}
+	}
+	return host
+}
+
+// take takes a token from key's bucket. When there is none it returns how
+// long until there will be.
+func (l *limiter) take(key string, now time.Time) (time.Duration, bool) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	l.sweep(now)
+	b, ok := l.buckets[key]
+	if !ok {
+		b = &tokenBucket{tokens: l.burst, last: now}
+		l.buckets[key] = b
+	}
+	b.tokens = math.Min(l.burst, b.tokens+now.Sub(b.last).Seconds()*l.rate)
+	b.last = now
+	if b.tokens < 1 {
+		return time.Duration((1 - b.tokens) / l.rate * float64(time.Second)), false
+	}
+	b.tokens--
+	return 0, true
+}
+
+// sweep forgets the buckets that have filled up again, about once a minute,
+// so that clients that have gone away don't stay in memory.
+func (l *limiter) sweep(now time.Time) {
+	if now.Sub(l.lastSweep) < time.Minute {
+		return
+	}
+	l.lastSweep = now
+	refill := time.Duration(l.burst / l.rate * float64(time.Second))
+	for key, b := range l.buckets {
+		if now.Sub(b.last) >= refill {
+			delete(l.buckets, key)
+		}
+	}
+}
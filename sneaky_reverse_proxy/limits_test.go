@@ -0,0 +1,162 @@
+package main
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/gerg/net/http"
+)
+
+func newTestLimiter(t *testing.T, rate float64, burst int, key string) *limiter {
+	t.Helper()
+	fwd, err := newForwarder("10.0.0.0/8")
+	if err != nil {
+		t.Fatal(err)
+	}
+	l, err := newLimiter(fwd, newProxyMetrics(newUpstreamConns()), rate, burst, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return l
+}
+
+func TestTake(t *testing.T) {
+	l := newTestLimiter(t, 2, 3, "ip")
+	t0 := time.Unix(1000, 0)
+	take := func(key string, at time.Duration, wantOK bool, wantWait time.Duration) {
+		t.Helper()
+		wait, ok := l.take(key, t0.Add(at))
+		if ok != wantOK || wait != wantWait {
+			t.Errorf("%s at %s: got %v, %s, want %v, %s", key, at, ok, wait, wantOK, wantWait)
+		}
+	}
+
+	// The burst goes at once, and then a token comes every half second.
+	take("a", 0, true, 0)
+	take("a", 0, true, 0)
+	take("a", 0, true, 0)
+	take("a", 0, false, 500*time.Millisecond)
+	take("a", 250*time.Millisecond, false, 250*time.Millisecond)
+	take("a", 500*time.Millisecond, true, 0)
+	take("a", 500*time.Millisecond, false, 500*time.Millisecond)
+	// Other clients have their own buckets.
+	take("b", 500*time.Millisecond, true, 0)
+	// A bucket fills up to the burst and no further.
+	take("a", 10*time.Second, true, 0)
+	take("a", 10*time.Second, true, 0)
+	take("a", 10*time.Second, true, 0)
+	take("a", 10*time.Second, false, 500*time.Millisecond)
+}
+
+func TestRetryAfter(t *testing.T) {
+	for _, c := range []struct {
+		rate float64
+		want string
+	}{
+		{rate: 2, want: "1"},   // half a second, rounded up
+		{rate: 0.3, want: "4"}, // 3.33 seconds
+		{rate: 0.25, want: "4"},
+	} {
+		l := newTestLimiter(t, c.rate, 1, "ip")
+		h := l.wrap(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+		var rec *httptest.ResponseRecorder
+		for i := 0; i < 2; i++ {
+			req, _ := http.NewRequest(http.MethodGet, "https://example.com/", nil)
+			req.RemoteAddr = "203.0.113.7:51234"
+			rec = httptest.NewRecorder()
+			h.ServeHTTP(&stdResponseWriter{rec}, req)
+		}
+		if rec.Code != http.StatusTooManyRequests || rec.Header().Get("Retry-After") != c.want {
+			t.Errorf("rate %v: got %d, Retry-After %q, want 429, %q", c.rate, rec.Code, rec.Header().Get("Retry-After"), c.want)
+		}
+		if n := counterValue(l.metrics.rateLimited, "rate"); n != 1 {
+			t.Errorf("rate %v: %v requests counted as rate limited, want 1", c.rate, n)
+		}
+	}
+}
+
+func TestClientIP(t *testing.T) {
+	l := newTestLimiter(t, 1, 1, "ip")
+	for _, c := range []struct {
+		remoteAddr string
+		xff        []string
+		want       string
+	}{
+		// An untrusted peer is the client, whatever it says.
+		{"203.0.113.7:51234", []string{"198.51.100.1"}, "203.0.113.7"},
+		{"[2001:db8::2]:443", []string{"198.51.100.1"}, "2001:db8::2"},
+		// Behind trusted proxies, the client is the last hop that isn't
+		// one.
+		{"10.0.0.1:4000", nil, "10.0.0.1"},
+		{"10.0.0.1:4000", []string{"198.51.100.1, 203.0.113.9, 10.0.0.2"}, "203.0.113.9"},
+		{"10.0.0.1:4000", []string{"198.51.100.1", "203.0.113.9, 10.0.0.2"}, "203.0.113.9"},
+		{"10.0.0.1:4000", []string{"10.0.0.3, 10.0.0.2"}, "10.0.0.3"},
+		// The walk stops at a hop it can't parse.
+		{"10.0.0.1:4000", []string{"198.51.100.1, junk, 10.0.0.2"}, "10.0.0.2"},
+		{"10.0.0.1:4000", []string{"198.51.100.1, junk"}, "10.0.0.1"},
+	} {
+		req, _ := http.NewRequest(http.MethodGet, "https://example.com/", nil)
+		req.RemoteAddr = c.remoteAddr
+		req.Header["X-Forwarded-For"] = c.xff
+		if got := l.clientIP(req); got != c.want {
+			t.Errorf("%s with %q: got %s, want %s", c.remoteAddr, c.xff, got, c.want)
+		}
+	}
+}
+
+func TestClientKey(t *testing.T) {
+	cert := &x509.Certificate{Subject: pkix.Name{CommonName: "client"}}
+	for _, c := range []struct {
+		key    string
+		tls    *tls.ConnectionState
+		header string
+		want   string
+	}{
+		{key: "ip", want: "ip:203.0.113.7"},
+		{key: "cert", tls: &tls.ConnectionState{VerifiedChains: [][]*x509.Certificate{{cert}}}, want: "cert:CN=client"},
+		// Without a verified certificate or the header, the IP is the key.
+		{key: "cert", tls: &tls.ConnectionState{}, want: "ip:203.0.113.7"},
+		{key: "cert", want: "ip:203.0.113.7"},
+		{key: "header:X-Api-Key", header: "abc", want: "header:X-Api-Key:abc"},
+		{key: "header:X-Api-Key", want: "ip:203.0.113.7"},
+	} {
+		l := newTestLimiter(t, 1, 1, c.key)
+		req, _ := http.NewRequest(http.MethodGet, "https://example.com/", nil)
+		req.RemoteAddr = "203.0.113.7:51234"
+		req.TLS = c.tls
+		if c.header != "" {
+			req.Header.Set("X-Api-Key", c.header)
+		}
+		if got := l.clientKey(req); got != c.want {
+			t.Errorf("%s: got %q, want %q", c.key, got, c.want)
+		}
+	}
+}
+
+func TestSweep(t *testing.T) {
+	// A bucket takes 100s to fill up again.
+	l := newTestLimiter(t, 0.01, 1, "ip")
+	t0 := time.Unix(1000, 0)
+	l.take("a", t0)
+	l.take("b", t0.Add(61*time.Second))
+	if len(l.buckets) != 2 {
+		t.Fatalf("%d buckets after the first sweep, want a's and b's", len(l.buckets))
+	}
+	l.take("c", t0.Add(122*time.Second))
+	if _, ok := l.buckets["a"]; ok || len(l.buckets) != 2 {
+		t.Errorf("buckets %v after the second sweep, want b's and c's", l.buckets)
+	}
+	// Sweeps are a minute apart.
+	l.take("d", t0.Add(170*time.Second))
+	if len(l.buckets) != 3 {
+		t.Errorf("%d buckets, want b's, c's and d's", len(l.buckets))
+	}
+	// A forgotten client starts again with a full bucket.
+	if _, ok := l.take("a", t0.Add(170*time.Second)); !ok {
+		t.Error("a was turned away")
+	}
+}
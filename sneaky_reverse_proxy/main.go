@@ -2,16 +2,24 @@ package main
 
 import (
 	"bytes"
-	"crypto/tls"
-	"crypto/x509"
-	"io/ioutil"
+	"errors"
+	"flag"
 	"log"
+	"os"
+	"os/signal"
+	"syscall"
+	"time"
 
-	"github.com/gerg/net/http/httputil"
+	"golang.org/x/net/http/httpguts"
 
 	"github.com/gerg/net/http"
+
+	"shared/tlsutil"
 )
 
+// envoyHost is where Envoy listens, set by -envoy-addr.
+var envoyHost = "localhost:61001"
+
 type buffer struct {
 	bytes.Buffer
 }
@@ -23,57 +31,119 @@ func (b *buffer) Close() error {
 }
 
 func main() {
-	// Create a server on port 8000
-	// Exactly how you would run an HTTP/1.1 server
-	srv := &http.Server{Addr: ":8000", Handler: http.HandlerFunc(handle)}
-
-	// Start the server with TLS, since we are running HTTP/2 it must be
-	// run with TLS.
-	// Exactly how you would run an HTTP/1.1 server with TLS connection.
-	log.Printf("Serving on https://0.0.0.0:8000")
-	log.Fatal(srv.ListenAndServeTLS("./sneaky_reverse_proxy/server.crt", "./sneaky_reverse_proxy/server.key"))
-}
+	cfg := config{accessLog: os.Stdout}
+	flag.StringVar(&cfg.addr, "addr", ":8000", "address to listen on")
+	flag.StringVar(&envoyHost, "envoy-addr", envoyHost, "Envoy's address")
+	flag.StringVar(&cfg.trustedProxies, "trusted-proxies", "", "comma separated CIDRs whose Forwarded and X-Forwarded-* headers are kept")
+	flag.StringVar(&cfg.accessLogFormat, "access-log-format", "json", "access log format: json or text")
+	flag.Float64Var(&cfg.accessLogSample, "access-log-sample", 1, "fraction of requests to write to the access log, 0 turns it off")
+	flag.StringVar(&cfg.adminAddr, "admin-addr", "127.0.0.1:8001", "loopback address of the admin listener, empty turns it off")
+	drainTimeout := flag.Duration("drain-timeout", 30*time.Second, "how long in-flight requests get to finish after SIGTERM")
+	flag.StringVar(&cfg.certFile, "cert", "./sneaky_reverse_proxy/server.crt", "listener certificate")
+	flag.StringVar(&cfg.keyFile, "key", "./sneaky_reverse_proxy/server.key", "listener private key")
+	flag.StringVar(&cfg.caFile, "ca", "./client_certs/ca.crt", "CA for Envoy's certificate")
+	flag.StringVar(&cfg.clientCertFile, "client-cert", "./client_certs/client.crt", "client certificate presented to Envoy")
+	flag.StringVar(&cfg.clientKeyFile, "client-key", "./client_certs/client.key", "client private key presented to Envoy")
+	flag.BoolVar(&cfg.insecureSkipVerify, "insecure-skip-verify", false, "do not verify Envoy's certificate at all")
+	flag.StringVar(&cfg.expected.AppGUID, "envoy-app-guid", "", "app GUID Envoy's instance identity certificate must carry")
+	flag.StringVar(&cfg.expected.SpaceGUID, "envoy-space-guid", "", "space GUID Envoy's instance identity certificate must carry")
+	flag.StringVar(&cfg.expected.OrgGUID, "envoy-org-guid", "", "organization GUID Envoy's instance identity certificate must carry")
+	flag.StringVar(&cfg.expected.SAN, "envoy-san", "", "DNS name or IP address Envoy's certificate must carry as a SAN")
+	flag.StringVar(&cfg.clientCAFile, "client-ca", "", "CA to verify downstream client certificates against, empty to not ask for one")
+	flag.BoolVar(&cfg.requireClientCert, "require-client-cert", false, "reject clients without a certificate signed by -client-ca")
+	flag.StringVar(&cfg.routesFile, "routes", "", "JSON file with per-route timeouts, retries and circuit breakers")
+	flag.Float64Var(&cfg.rateLimit, "rate-limit", 0, "requests per second allowed per client, 0 for no limit")
+	flag.IntVar(&cfg.rateLimitBurst, "rate-limit-burst", 0, "requests a client can make at once before -rate-limit applies, 0 for one second's worth")
+	flag.StringVar(&cfg.rateLimitKey, "rate-limit-key", "ip", "what identifies a client for -rate-limit: ip, cert or header:<name>")
+	flag.UintVar(&cfg.maxConcurrentStreams, "max-concurrent-streams", 0, "streams allowed per downstream HTTP/2 connection, advertised in SETTINGS, 0 for the default of 250")
+	flag.BoolVar(&cfg.proxyProtocol, "proxy-protocol", false, "send Envoy a PROXY protocol v2 header with each client's address, over an upstream connection of its own")
+	flag.StringVar(&cfg.cleartextAddrs, "cleartext-addrs", "", "comma separated addresses of extra plaintext listeners for HTTP/1.1 and h2c, e.g. 127.0.0.1:8002")
+	flag.StringVar(&cfg.keyLogFile, "tls-key-log", "", "append the TLS secrets of the listener's and Envoy's connections to this file in SSLKEYLOGFILE format, to decrypt captures; for debugging only")
+	flag.StringVar(&cfg.recordFrames, "record-frames", "", "append every HTTP/2 frame on connections to Envoy upgraded to h2c to this JSONL file")
+	certReloadInterval := flag.Duration("cert-reload-interval", 5*time.Second, "how often to check certificate files for changes, 0 to only reload on SIGHUP")
+	flag.Parse()
 
-func handle(w http.ResponseWriter, r *http.Request) {
-	envoyHost := "localhost:61001"
-	director := func(req *http.Request) {
-		req.Header.Add("X-Forwarded-Host", req.Host)
-		req.Header.Add("X-Origin-Host", envoyHost)
-		req.Header.Add("Upgrade", "h2c")
-		req.Header.Add("HTTP2-Settings", "AAMAAABkAARAAAAAAAIAAAAA")
-		req.Header.Add("Connection", "Upgrade, HTTP2-Settings")
-		req.Header.Add("X-Debug", "Upgrade Request")
-		req.URL.Scheme = "https"
-		req.URL.Host = envoyHost
-	}
-
-	proxy := &httputil.ReverseProxy{Director: director}
-
-	var transport http.RoundTripper
-
-	caCert, err := ioutil.ReadFile("./client_certs/ca.crt")
+	p, err := newProxy(cfg)
 	if err != nil {
-		log.Fatalf("Reading CA: %s\n", err)
+		log.Fatalf("%s\n", err)
 	}
-	caCertPool := x509.NewCertPool()
-	caCertPool.AppendCertsFromPEM(caCert)
-	cert, err := tls.LoadX509KeyPair("./client_certs/client.crt", "./client_certs/client.key")
-	if err != nil {
-		log.Fatalf("Reading cert/key: %s\n", err)
+	go tlsutil.WatchCertificates(*certReloadInterval, p.serverCert, p.clientCert)
+	if err := p.listen(); err != nil {
+		log.Fatal(err)
 	}
 
-	tlsConfig := &tls.Config{
-		RootCAs:            caCertPool,
-		InsecureSkipVerify: true,
-		Certificates:       []tls.Certificate{cert},
+	// SIGTERM or an interrupt drains the proxy. serve returns as soon as the
+	// listeners stop, so we wait for the drain to finish before exiting.
+	drained := make(chan struct{})
+	go func() {
+		signals := make(chan os.Signal, 1)
+		signal.Notify(signals, syscall.SIGTERM, os.Interrupt)
+		sig := <-signals
+		log.Printf("Received %s, draining for up to %s", sig, *drainTimeout)
+		p.drain(*drainTimeout)
+		close(drained)
+	}()
+
+	if err := p.serve(); err != nil {
+		log.Fatal(err)
 	}
+	<-drained
+	log.Printf("Drained, exiting")
+}
 
-	transport = &http.Transport{
-		TLSClientConfig:   tlsConfig,
-		ForceAttemptHTTP2: true,
+// isClientUpgrade reports whether the downstream client asked for a protocol
+// upgrade of its own, e.g. a WebSocket handshake.
+//
+// Over HTTP/2 downstream connections this is never true: the HTTP/2 server
+// rejects connection-specific headers and does not implement RFC 8441
+// extended CONNECT, so WebSocket clients have to reach us over HTTP/1.1.
+func isClientUpgrade(r *http.Request) bool {
+	return r.Header.Get("Upgrade") != "" &&
+		httpguts.HeaderValuesContainsToken(r.Header["Connection"], "Upgrade")
+}
+
+// proxyError is ReverseProxy's default error handler, plus a note of the
+// error in the access log. Like Envoy, it answers a timeout with 504 and an
+// open circuit breaker with 503 and x-envoy-overflow.
+func proxyError(w http.ResponseWriter, r *http.Request, err error) {
+	log.Printf("http: proxy error: %v", err)
+	accessLogFromContext(r.Context()).update(func(e *accessLogEntry) {
+		e.Error = err.Error()
+	})
+	var timeout *timeoutError
+	var overflow *overflowError
+	switch {
+	case errors.As(err, &timeout):
+		w.WriteHeader(http.StatusGatewayTimeout)
+	case errors.As(err, &overflow):
+		w.Header().Set("X-Envoy-Overflow", "true")
+		w.WriteHeader(http.StatusServiceUnavailable)
+	default:
+		w.WriteHeader(http.StatusBadGateway)
 	}
+}
 
-	proxy.Transport = transport
+// newDirector points requests at Envoy and applies the route's request header
+// rules. It leaves Upgrade and Connection alone: client-initiated upgrades are
+// forwarded by ReverseProxy as they are, and the h2c upgrade headers are added
+// by h2cUpgradeTransport. With origins, each downstream connection's requests
+// go to an origin of its own.
+func newDirector(fwd *forwarder, route string, rules headerRules, origins *proxyOrigins) func(*http.Request) {
+	return func(req *http.Request) {
+		fwd.rewrite(req)
+		rules.apply(req.Header, req, route)
+		req.URL.Scheme = "https"
+		req.URL.Host = envoyHost
+		if origins != nil {
+			req.URL.Host = origins.origin(req)
+		}
+	}
+}
 
-	proxy.ServeHTTP(w, r)
+// rewriteResponse applies the route's response header rules.
+func rewriteResponse(route string, rules headerRules) func(*http.Response) error {
+	return func(resp *http.Response) error {
+		rules.apply(resp.Header, resp.Request, route)
+		return nil
+	}
 }
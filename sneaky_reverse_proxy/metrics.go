@@ -0,0 +1,334 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"math"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/gerg/net/http"
+)
+
+// There is no metrics library vendored, so this file has just enough of the
+// Prometheus text exposition format (version 0.0.4) for counters, gauges and
+// histograms with labels.
+
+// durationBuckets are the upper bounds, in seconds, of the request latency
+// histogram.
+var durationBuckets = []float64{.001, .0025, .005, .01, .025, .05, .1, .25, .5, 1, 2.5, 5, 10}
+
+type metric interface {
+	writeTo(w io.Writer)
+}
+
+type registry struct {
+	mu      sync.Mutex
+	metrics []metric
+}
+
+func (r *registry) register(m metric) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.metrics = append(r.metrics, m)
+}
+
+func (r *registry) ServeHTTP(w http.ResponseWriter, _ *http.Request) {
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4; charset=utf-8")
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	for _, m := range r.metrics {
+		m.writeTo(w)
+	}
+}
+
+// counterVec is a counter with a fixed set of label names.
+type counterVec struct {
+	name, help string
+	labels     []string
+
+	mu     sync.Mutex
+	values map[string]float64
+}
+
+func newCounterVec(r *registry, name, help string, labels ...string) *counterVec {
+	c := &counterVec{name: name, help: help, labels: labels, values: map[string]float64{}}
+	r.register(c)
+	return c
+}
+
+func (c *counterVec) inc(labelValues ...string) {
+	key := strings.Join(labelValues, "\x00")
+	c.mu.Lock()
+	c.values[key]++
+	c.mu.Unlock()
+}
+
+func (c *counterVec) writeTo(w io.Writer) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	writeHeader(w, c.name, c.help, "counter")
+	for _, key := range sortedKeys(c.values) {
+		fmt.Fprintf(w, "%s%s %s\n", c.name, formatLabels(c.labels, splitKey(key), "", ""), formatValue(c.values[key]))
+	}
+}
+
+// gaugeFunc reports a value computed at scrape time.
+type gaugeFunc struct {
+	name, help string
+	labels     []string
+	fn         func() map[string]float64
+}
+
+func newGaugeFunc(r *registry, name, help string, labels []string, fn func() map[string]float64) {
+	r.register(&gaugeFunc{name: name, help: help, labels: labels, fn: fn})
+}
+
+func (g *gaugeFunc) writeTo(w io.Writer) {
+	writeHeader(w, g.name, g.help, "gauge")
+	values := g.fn()
+	for _, key := range sortedKeys(values) {
+		fmt.Fprintf(w, "%s%s %s\n", g.name, formatLabels(g.labels, splitKey(key), "", ""), formatValue(values[key]))
+	}
+}
+
+// histogramVec is a histogram with a fixed set of label names.
+type histogramVec struct {
+	name, help string
+	labels     []string
+	buckets    []float64
+
+	mu     sync.Mutex
+	series map[string]*histogram
+}
+
+type histogram struct {
+	counts []uint64 // per bucket, not cumulative
+	count  uint64
+	sum    float64
+}
+
+func newHistogramVec(r *registry, name, help string, buckets []float64, labels ...string) *histogramVec {
+	h := &histogramVec{name: name, help: help, labels: labels, buckets: buckets, series: map[string]*histogram{}}
+	r.register(h)
+	return h
+}
+
+func (h *histogramVec) observe(v float64, labelValues ...string) {
+	key := strings.Join(labelValues, "\x00")
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	s, ok := h.series[key]
+	if !ok {
+		s = &histogram{counts: make([]uint64, len(h.buckets))}
+		h.series[key] = s
+	}
+	for i, upper := range h.buckets {
+		if v <= upper {
+			s.counts[i]++
+			break
+		}
+	}
+	s.count++
+	s.sum += v
+}
+
+func (h *histogramVec) writeTo(w io.Writer) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	writeHeader(w, h.name, h.help, "histogram")
+	keys := make([]string, 0, len(h.series))
+	for k := range h.series {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	for _, key := range keys {
+		s := h.series[key]
+		values := splitKey(key)
+		var cumulative uint64
+		for i, upper := range h.buckets {
+			cumulative += s.counts[i]
+			fmt.Fprintf(w, "%s_bucket%s %d\n", h.name, formatLabels(h.labels, values, "le", formatValue(upper)), cumulative)
+		}
+		fmt.Fprintf(w, "%s_bucket%s %d\n", h.name, formatLabels(h.labels, values, "le", "+Inf"), s.count)
+		fmt.Fprintf(w, "%s_sum%s %s\n", h.name, formatLabels(h.labels, values, "", ""), formatValue(s.sum))
+		fmt.Fprintf(w, "%s_count%s %d\n", h.name, formatLabels(h.labels, values, "", ""), s.count)
+	}
+}
+
+func writeHeader(w io.Writer, name, help, kind string) {
+	fmt.Fprintf(w, "# HELP %s %s\n", name, strings.NewReplacer(`\`, `\\`, "\n", `\n`).Replace(help))
+	fmt.Fprintf(w, "# TYPE %s %s\n", name, kind)
+}
+
+// formatLabels renders {name="value",...}, with an optional extra label such
+// as a histogram's le.
+func formatLabels(names, values []string, extraName, extraValue string) string {
+	var pairs []string
+	for i, name := range names {
+		if i < len(values) {
+			pairs = append(pairs, name+`="`+escapeLabelValue(values[i])+`"`)
+		}
+	}
+	if extraName != "" {
+		pairs = append(pairs, extraName+`="`+extraValue+`"`)
+	}
+	if len(pairs) == 0 {
+		return ""
+	}
+	return "{" + strings.Join(pairs, ",") + "}"
+}
+
+func escapeLabelValue(v string) string {
+	return strings.NewReplacer(`\`, `\\`, "\n", `\n`, `"`, `\"`).Replace(v)
+}
+
+func formatValue(v float64) string {
+	switch {
+	case math.IsInf(v, 1):
+		return "+Inf"
+	case math.IsInf(v, -1):
+		return "-Inf"
+	}
+	return strconv.FormatFloat(v, 'g', -1, 64)
+}
+
+func sortedKeys(m map[string]float64) []string {
+	keys := make([]string, 0, len(m))
+	for k := range m {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+func splitKey(key string) []string {
+	if key == "" {
+		return nil
+	}
+	return strings.Split(key, "\x00")
+}
+
+// proxyMetrics are the metrics the reverse proxy exports on the admin
+// listener.
+type proxyMetrics struct {
+	registry *registry
+
+	requests        *counterVec
+	requestDuration *histogramVec
+	upgradeAttempts *counterVec
+	upgradeResults  *counterVec
+	tlsFailures     *counterVec
+	retries         *counterVec
+	timeouts        *counterVec
+	overflows       *counterVec
+	rateLimited     *counterVec
+
+	h2Streams int64
+}
+
+func newProxyMetrics(conns *upstreamConns) *proxyMetrics {
+	r := &registry{}
+	m := &proxyMetrics{
+		registry: r,
+		requests: newCounterVec(r, "sneaky_proxy_requests_total",
+			"Requests served, by route and response status.", "route", "status"),
+		requestDuration: newHistogramVec(r, "sneaky_proxy_request_duration_seconds",
+			"Time to serve a request, by route and response status.", durationBuckets, "route", "status"),
+		upgradeAttempts: newCounterVec(r, "sneaky_proxy_upstream_upgrade_attempts_total",
+			"Requests sent to Envoy offering the h2c upgrade."),
+		upgradeResults: newCounterVec(r, "sneaky_proxy_upstream_upgrades_total",
+			"Outcome of h2c upgrade offers: upgraded, declined or error.", "result"),
+		tlsFailures: newCounterVec(r, "sneaky_proxy_tls_handshake_failures_total",
+			"Failed TLS handshakes, downstream (clients) or upstream (Envoy).", "side"),
+		retries: newCounterVec(r, "sneaky_proxy_upstream_retries_total",
+			"Requests retried after a connection-level failure, by route.", "route"),
+		timeouts: newCounterVec(r, "sneaky_proxy_upstream_timeouts_total",
+			"Requests that timed out waiting for Envoy, by route and timeout: upgrade or response.", "route", "timeout"),
+		overflows: newCounterVec(r, "sneaky_proxy_circuit_breaker_overflows_total",
+			"Requests turned away or not retried by an open circuit breaker, by route and breaker: pending or retries.", "route", "breaker"),
+		rateLimited: newCounterVec(r, "sneaky_proxy_rate_limited_total",
+			"Requests answered with 429, by limit: rate.", "limit"),
+	}
+	newGaugeFunc(r, "sneaky_proxy_upstream_h2_connections",
+		"Open upstream connections that were upgraded to HTTP/2.", nil, func() map[string]float64 {
+			var n float64
+			for _, c := range conns.list() {
+				if c.isUpgraded() {
+					n++
+				}
+			}
+			return map[string]float64{"": n}
+		})
+	newGaugeFunc(r, "sneaky_proxy_upstream_h2_streams",
+		"In-flight requests on upgraded upstream connections.", nil, func() map[string]float64 {
+			return map[string]float64{"": float64(atomic.LoadInt64(&m.h2Streams))}
+		})
+	newGaugeFunc(r, "sneaky_proxy_upstream_connections",
+		"Open upstream connections, by transport pool.", []string{"pool"}, func() map[string]float64 {
+			sizes := map[string]float64{}
+			for _, c := range conns.list() {
+				sizes[c.pool]++
+			}
+			return sizes
+		})
+	return m
+}
+
+// instrument counts and times the requests that h serves for a route. Failed
+// TLS handshakes with Envoy are counted by the upstream dialer.
+func (m *proxyMetrics) instrument(route string, h http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		start := time.Now()
+		rw := &recordingResponseWriter{ResponseWriter: w}
+		defer func() {
+			status := rw.status
+			if status == 0 {
+				status = http.StatusOK
+			}
+			code := strconv.Itoa(status)
+			m.requests.inc(route, code)
+			m.requestDuration.observe(time.Since(start).Seconds(), route, code)
+		}()
+		h.ServeHTTP(rw, r)
+	})
+}
+
+// trackH2Stream counts resp as an in-flight HTTP/2 stream until its body is
+// closed.
+func (m *proxyMetrics) trackH2Stream(resp *http.Response) {
+	if resp == nil || resp.ProtoMajor != 2 {
+		return
+	}
+	atomic.AddInt64(&m.h2Streams, 1)
+	resp.Body = &streamBody{ReadCloser: resp.Body, done: func() { atomic.AddInt64(&m.h2Streams, -1) }}
+}
+
+type streamBody struct {
+	io.ReadCloser
+	once sync.Once
+	done func()
+}
+
+func (b *streamBody) Close() error {
+	b.once.Do(b.done)
+	return b.ReadCloser.Close()
+}
+
+// tlsErrorCounter is an io.Writer for http.Server's ErrorLog that counts the
+// handshake failures the server reports there before passing them on.
+type tlsErrorCounter struct {
+	io.Writer
+	metrics *proxyMetrics
+}
+
+func (w *tlsErrorCounter) Write(p []byte) (int, error) {
+	if strings.Contains(string(p), "TLS handshake error") {
+		w.metrics.tlsFailures.inc("downstream")
+	}
+	return w.Writer.Write(p)
+}
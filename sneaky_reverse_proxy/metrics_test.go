@@ -0,0 +1,145 @@
+package main
+
+import (
+	"io/ioutil"
+	"math"
+	nethttp "net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/gerg/net/http"
+)
+
+// scrape serves r over HTTP, as the admin listener does, and returns what a
+// Prometheus scrape of it gets.
+func scrape(t *testing.T, r *registry) string {
+	t.Helper()
+	srv := httptest.NewServer(fromStdHandler{r})
+	defer srv.Close()
+	resp, err := nethttp.Get(srv.URL + "/metrics")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	if ct := resp.Header.Get("Content-Type"); !strings.HasPrefix(ct, "text/plain; version=0.0.4") {
+		t.Errorf("got Content-Type %q", ct)
+	}
+	body, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return string(body)
+}
+
+func TestHistogramExposition(t *testing.T) {
+	r := &registry{}
+	h := newHistogramVec(r, "test_duration_seconds", "Time taken.", []float64{.1, 1}, "route")
+	h.observe(.05, "a")
+	h.observe(.5, "a")
+	h.observe(.5, "a")
+	h.observe(5, "a")
+
+	want := `# HELP test_duration_seconds Time taken.
+# TYPE test_duration_seconds histogram
+test_duration_seconds_bucket{route="a",le="0.1"} 1
+test_duration_seconds_bucket{route="a",le="1"} 3
+test_duration_seconds_bucket{route="a",le="+Inf"} 4
+test_duration_seconds_sum{route="a"} 6.05
+test_duration_seconds_count{route="a"} 4
+`
+	if got := scrape(t, r); got != want {
+		t.Errorf("got\n%s\nwant\n%s", got, want)
+	}
+}
+
+func TestCounterExposition(t *testing.T) {
+	r := &registry{}
+	c := newCounterVec(r, "test_total", "Things, by path\\name.\nSecond line.", "path", "status")
+	c.inc(`C:\dir`, "200")
+	c.inc(`say "hi"`, "200")
+	c.inc("two\nlines", "500")
+	c.inc("two\nlines", "500")
+	newCounterVec(r, "test_unlabelled_total", "Nothing yet.")
+
+	want := `# HELP test_total Things, by path\\name.\nSecond line.
+# TYPE test_total counter
+test_total{path="C:\\dir",status="200"} 1
+test_total{path="say \"hi\"",status="200"} 1
+test_total{path="two\nlines",status="500"} 2
+# HELP test_unlabelled_total Nothing yet.
+# TYPE test_unlabelled_total counter
+`
+	if got := scrape(t, r); got != want {
+		t.Errorf("got\n%s\nwant\n%s", got, want)
+	}
+}
+
+func TestGaugeExposition(t *testing.T) {
+	r := &registry{}
+	newGaugeFunc(r, "test_open", "Open things.", nil, func() map[string]float64 {
+		return map[string]float64{"": 3}
+	})
+	newGaugeFunc(r, "test_limit", "Limits, by pool.", []string{"pool"}, func() map[string]float64 {
+		return map[string]float64{"h2c": math.Inf(1), "passthrough": 0.5}
+	})
+
+	want := `# HELP test_open Open things.
+# TYPE test_open gauge
+test_open 3
+# HELP test_limit Limits, by pool.
+# TYPE test_limit gauge
+test_limit{pool="h2c"} +Inf
+test_limit{pool="passthrough"} 0.5
+`
+	if got := scrape(t, r); got != want {
+		t.Errorf("got\n%s\nwant\n%s", got, want)
+	}
+}
+
+func TestFormatValue(t *testing.T) {
+	for v, want := range map[float64]string{
+		0:            "0",
+		2.5:          "2.5",
+		1e21:         "1e+21",
+		math.Inf(1):  "+Inf",
+		math.Inf(-1): "-Inf",
+	} {
+		if got := formatValue(v); got != want {
+			t.Errorf("formatValue(%v) = %q, want %q", v, got, want)
+		}
+	}
+	if got := formatValue(math.NaN()); got != "NaN" {
+		t.Errorf("formatValue(NaN) = %q", got)
+	}
+}
+
+func TestInstrument(t *testing.T) {
+	m := newProxyMetrics(newUpstreamConns())
+	h := m.instrument("h2c", http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/missing" {
+			w.WriteHeader(http.StatusNotFound)
+		}
+	}))
+	srv := httptest.NewServer(fromStdHandler{h})
+	defer srv.Close()
+	for _, path := range []string{"/", "/", "/missing"} {
+		resp, err := nethttp.Get(srv.URL + path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp.Body.Close()
+	}
+
+	got := scrape(t, m.registry)
+	for _, line := range []string{
+		`sneaky_proxy_requests_total{route="h2c",status="200"} 2`,
+		`sneaky_proxy_requests_total{route="h2c",status="404"} 1`,
+		`sneaky_proxy_request_duration_seconds_bucket{route="h2c",status="200",le="+Inf"} 2`,
+		`sneaky_proxy_request_duration_seconds_count{route="h2c",status="404"} 1`,
+	} {
+		if !strings.Contains(got, line+"\n") {
+			t.Errorf("no %s in\n%s", line, got)
+		}
+	}
+}
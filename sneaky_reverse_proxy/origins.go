@@ -0,0 +1,136 @@
+package main
+
+import (
+	"crypto/rand"
+	"crypto/tls"
+	"encoding/hex"
+	"fmt"
+	"net"
+	"strings"
+	"sync"
+
+	"github.com/gerg/net/http"
+
+	"shared/proxyprotocol"
+)
+
+// proxyOrigins gives every downstream connection an upstream origin of its
+// own when the proxy sends PROXY protocol headers to Envoy (-proxy-protocol).
+//
+// A PROXY header describes a whole connection, so an upstream connection can
+// only carry the requests of the one client its header names. Requests from
+// different clients must not share one, which the transports would otherwise
+// do: they pool connections by host. So the director points each downstream
+// connection's requests at a host of its own,
+//
+//	<token>.proxy-protocol.invalid:61001
+//
+// and the dialer looks the token up, connects to Envoy and writes the
+// connection's header before starting TLS. This is what Envoy itself does with
+// an upstream PROXY protocol transport socket: connections are pooled per
+// downstream connection.
+type proxyOrigins struct {
+	mu      sync.Mutex
+	tokens  map[string]string                // by downstream RemoteAddr
+	headers map[string]*proxyprotocol.Header // by token
+}
+
+// proxyOriginSuffix ends the hosts the director makes up. .invalid is
+// reserved, so they can never be real names.
+const proxyOriginSuffix = ".proxy-protocol.invalid"
+
+func newProxyOrigins() *proxyOrigins {
+	return &proxyOrigins{tokens: map[string]string{}, headers: map[string]*proxyprotocol.Header{}}
+}
+
+// origin returns the host requests on req's downstream connection go to,
+// registering the connection on its first request.
+func (o *proxyOrigins) origin(req *http.Request) string {
+	_, port, _ := net.SplitHostPort(envoyHost)
+
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	token, ok := o.tokens[req.RemoteAddr]
+	if !ok {
+		var b [8]byte
+		rand.Read(b[:])
+		token = hex.EncodeToString(b[:])
+		o.tokens[req.RemoteAddr] = token
+		o.headers[token] = downstreamProxyHeader(req)
+	}
+	return net.JoinHostPort(token+proxyOriginSuffix, port)
+}
+
+// resolve is used by the dialer: it maps an origin back to Envoy's address
+// and the header to send first. Other addresses are returned as they are.
+func (o *proxyOrigins) resolve(addr string) (string, *proxyprotocol.Header, error) {
+	host, port, err := net.SplitHostPort(addr)
+	if err != nil || !strings.HasSuffix(host, proxyOriginSuffix) {
+		return addr, nil, nil
+	}
+	o.mu.Lock()
+	h, ok := o.headers[strings.TrimSuffix(host, proxyOriginSuffix)]
+	o.mu.Unlock()
+	if !ok {
+		return "", nil, fmt.Errorf("downstream connection for %s has closed", host)
+	}
+	envoy, _, _ := net.SplitHostPort(envoyHost)
+	return net.JoinHostPort(envoy, port), h, nil
+}
+
+// forget is called when a downstream connection closes, or is hijacked for a
+// client-initiated upgrade, and returns the origin it had, if any. Its
+// upstream connections are for the caller to drain.
+func (o *proxyOrigins) forget(remoteAddr string) (string, bool) {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	token, ok := o.tokens[remoteAddr]
+	if !ok {
+		return "", false
+	}
+	delete(o.tokens, remoteAddr)
+	delete(o.headers, token)
+	_, port, _ := net.SplitHostPort(envoyHost)
+	return net.JoinHostPort(token+proxyOriginSuffix, port), true
+}
+
+// downstreamProxyHeader describes req's downstream connection: the client's
+// address, ours, and what the client negotiated in its TLS handshake.
+func downstreamProxyHeader(req *http.Request) *proxyprotocol.Header {
+	h := &proxyprotocol.Header{}
+	src, err := net.ResolveTCPAddr("tcp", req.RemoteAddr)
+	if err != nil {
+		return h
+	}
+	dst, _ := req.Context().Value(http.LocalAddrContextKey).(*net.TCPAddr)
+	if dst == nil {
+		return h
+	}
+	if (src.IP.To4() == nil) != (dst.IP.To4() == nil) {
+		return h // can't be said in one header; Envoy falls back to our address
+	}
+	h.Source, h.Destination = src, dst
+
+	if req.TLS == nil {
+		return h
+	}
+	if req.TLS.NegotiatedProtocol != "" {
+		h.TLVs = append(h.TLVs, proxyprotocol.TLV{Type: proxyprotocol.TypeALPN, Value: []byte(req.TLS.NegotiatedProtocol)})
+	}
+	if req.TLS.ServerName != "" {
+		h.TLVs = append(h.TLVs, proxyprotocol.TLV{Type: proxyprotocol.TypeAuthority, Value: []byte(req.TLS.ServerName)})
+	}
+	ssl := proxyprotocol.SSL{
+		Client:   proxyprotocol.ClientSSL,
+		Verified: true,
+		Version:  tlsVersionName(req.TLS.Version),
+		Cipher:   tls.CipherSuiteName(req.TLS.CipherSuite),
+	}
+	if len(req.TLS.PeerCertificates) > 0 {
+		ssl.Client |= proxyprotocol.ClientCertConn
+		ssl.Verified = len(req.TLS.VerifiedChains) > 0
+		ssl.CN = req.TLS.PeerCertificates[0].Subject.CommonName
+	}
+	h.TLVs = append(h.TLVs, ssl.TLV())
+	return h
+}
@@ -0,0 +1,370 @@
+package main
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"math"
+	"net"
+	nethttp "net/http"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/gerg/net/http/httputil"
+
+	"github.com/gerg/net/http"
+
+	"shared/frametap"
+	"shared/tlsutil"
+)
+
+// config is what the command line sets.
+type config struct {
+	addr           string
+	adminAddr      string
+	cleartextAddrs string // comma separated
+
+	trustedProxies  string
+	accessLog       io.Writer
+	accessLogFormat string
+	accessLogSample float64
+
+	certFile, keyFile             string // the listener's
+	caFile                        string // for Envoy's certificate
+	clientCertFile, clientKeyFile string // presented to Envoy
+	insecureSkipVerify            bool
+	expected                      tlsutil.EnvoyIdentity
+	clientCAFile                  string
+	requireClientCert             bool
+	keyLogFile                    string
+	recordFrames                  string
+
+	routesFile           string
+	rateLimit            float64
+	rateLimitBurst       int
+	rateLimitKey         string
+	maxConcurrentStreams uint
+	proxyProtocol        bool
+}
+
+// proxy is the reverse proxy: its listeners, and the transports and
+// connections to Envoy behind them.
+type proxy struct {
+	srv           *tlsServer
+	cleartext     []*cleartextServer
+	admin         *http.Server
+	adminListener net.Listener
+
+	conns       *upstreamConns
+	metrics     *proxyMetrics
+	h2c         *h2cUpgradeTransport
+	passthrough *http.Transport
+
+	serverCert, clientCert *tlsutil.KeyPairReloader
+}
+
+func newProxy(cfg config) (*proxy, error) {
+	fwd, err := newForwarder(cfg.trustedProxies)
+	if err != nil {
+		return nil, fmt.Errorf("parsing -trusted-proxies: %s", err)
+	}
+	accessLog, err := newAccessLogger(cfg.accessLog, cfg.accessLogFormat, cfg.accessLogSample)
+	if err != nil {
+		return nil, fmt.Errorf("configuring access log: %s", err)
+	}
+
+	p := &proxy{}
+	if p.serverCert, err = tlsutil.NewKeyPairReloader(cfg.certFile, cfg.keyFile); err != nil {
+		return nil, fmt.Errorf("reading server cert/key: %s", err)
+	}
+	if p.clientCert, err = tlsutil.NewKeyPairReloader(cfg.clientCertFile, cfg.clientKeyFile); err != nil {
+		return nil, fmt.Errorf("reading cert/key: %s", err)
+	}
+	clientAuth, clientCAs, err := downstreamClientAuth(cfg.clientCAFile, cfg.requireClientCert)
+	if err != nil {
+		return nil, fmt.Errorf("configuring client certificates: %s", err)
+	}
+	if cfg.requireClientCert && cfg.cleartextAddrs != "" {
+		return nil, errors.New("-require-client-cert can't be enforced on -cleartext-addrs")
+	}
+	if cfg.maxConcurrentStreams > math.MaxUint32 {
+		return nil, fmt.Errorf("-max-concurrent-streams %d is more than HTTP/2 allows", cfg.maxConcurrentStreams)
+	}
+	keyLog, err := tlsutil.OpenKeyLog(cfg.keyLogFile)
+	if err != nil {
+		return nil, fmt.Errorf("opening -tls-key-log: %s", err)
+	}
+	if keyLog != nil {
+		log.Printf("WARNING: %s", tlsutil.KeyLogWarning(cfg.keyLogFile))
+	}
+
+	policies, err := loadRoutePolicies(cfg.routesFile, "h2c", "passthrough")
+	if err != nil {
+		return nil, fmt.Errorf("reading -routes: %s", err)
+	}
+
+	p.conns = newUpstreamConns()
+	if cfg.proxyProtocol {
+		p.conns.origins = newProxyOrigins()
+	}
+	if cfg.recordFrames != "" {
+		if p.conns.frames, err = frametap.NewRecorder(cfg.recordFrames); err != nil {
+			return nil, fmt.Errorf("opening -record-frames: %s", err)
+		}
+	}
+	p.metrics = newProxyMetrics(p.conns)
+	tlsConfig, err := upstreamTLSConfig(cfg.caFile, p.clientCert, cfg.expected, cfg.insecureSkipVerify)
+	if err != nil {
+		return nil, err
+	}
+	tlsConfig.KeyLogWriter = keyLog
+
+	// h2cTransport attempts the h2c upgrade on the first request to Envoy and
+	// then keeps the upgraded connection around for the requests after it.
+	p.h2c = &h2cUpgradeTransport{
+		Transport: &http.Transport{
+			TLSClientConfig:   tlsConfig,
+			ForceAttemptHTTP2: true,
+			MaxConnsPerHost:   policies["h2c"].maxConnsPerHost(),
+		},
+		conns:          p.conns,
+		metrics:        p.metrics,
+		upgradeTimeout: time.Duration(policies["h2c"].UpgradeTimeout),
+	}
+	p.h2c.DialTLS = p.conns.dialer("h2c", time.Duration(policies["h2c"].ConnectTimeout), p.h2c.TLSClientConfig, p.metrics)
+
+	// passthroughTransport never speaks HTTP/2, so client-initiated upgrades
+	// (WebSockets etc.) go out as real HTTP/1.1 upgrades on their own
+	// connection instead of being multiplexed onto an upgraded one. A non-nil,
+	// empty TLSNextProto turns HTTP/2 off.
+	p.passthrough = &http.Transport{
+		TLSClientConfig: tlsConfig.Clone(),
+		TLSNextProto:    map[string]func(string, *tls.Conn) http.RoundTripper{},
+		MaxConnsPerHost: policies["passthrough"].maxConnsPerHost(),
+	}
+	p.passthrough.DialTLS = p.conns.dialer("passthrough", time.Duration(policies["passthrough"].ConnectTimeout), p.passthrough.TLSClientConfig, p.metrics)
+
+	// Flush every write straight away: gRPC and other streaming responses
+	// must not sit in a buffer waiting for more data.
+	h2cProxy := &httputil.ReverseProxy{
+		Director:       newDirector(fwd, "h2c", policies["h2c"].requestRules, p.conns.origins),
+		ModifyResponse: rewriteResponse("h2c", policies["h2c"].responseRules),
+		Transport:      &routeTransport{route: "h2c", policy: policies["h2c"], next: p.h2c, conns: p.conns, metrics: p.metrics},
+		FlushInterval:  -1,
+		ErrorHandler:   proxyError,
+	}
+	passthroughProxy := &httputil.ReverseProxy{
+		Director:       newDirector(fwd, "passthrough", policies["passthrough"].requestRules, p.conns.origins),
+		ModifyResponse: rewriteResponse("passthrough", policies["passthrough"].responseRules),
+		Transport:      &routeTransport{route: "passthrough", policy: policies["passthrough"], next: p.passthrough, conns: p.conns, metrics: p.metrics},
+		ErrorHandler:   proxyError,
+	}
+
+	// There are two routes, one per proxy, each with its own policy from -routes.
+	h2cRoute := p.metrics.instrument("h2c", h2cProxy)
+	passthroughRoute := p.metrics.instrument("passthrough", passthroughProxy)
+
+	limits, err := newLimiter(fwd, p.metrics, cfg.rateLimit, cfg.rateLimitBurst, cfg.rateLimitKey)
+	if err != nil {
+		return nil, fmt.Errorf("configuring limits: %s", err)
+	}
+
+	router := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if isClientUpgrade(r) {
+			accessLogFromContext(r.Context()).update(func(e *accessLogEntry) {
+				e.UpstreamNegotiation = negotiationPassthrough
+			})
+			passthroughRoute.ServeHTTP(w, r)
+			return
+		}
+		h2cRoute.ServeHTTP(w, r)
+	})
+	handler := withRequestID(fwd, accessLog.wrap(limits.wrap(router)))
+
+	if cfg.adminAddr != "" {
+		if !isLoopback(cfg.adminAddr) {
+			return nil, fmt.Errorf("admin address %s is not a loopback address", cfg.adminAddr)
+		}
+		mux := http.NewServeMux()
+		mux.Handle("/metrics", p.metrics.registry)
+		adm := &admin{
+			conns:    p.conns,
+			h2c:      p.h2c,
+			policies: policies,
+			keyPairs: []*tlsutil.KeyPairReloader{p.serverCert, p.clientCert},
+			caFiles:  []string{cfg.caFile},
+		}
+		if cfg.clientCAFile != "" {
+			adm.caFiles = append(adm.caFiles, cfg.clientCAFile)
+		}
+		adm.register(mux)
+		p.admin = &http.Server{Addr: cfg.adminAddr, Handler: loopbackOnly(mux)}
+	}
+
+	// Create a server on -addr, port 8000 by default
+	// Exactly how you would run an HTTP/1.1 server
+	srv := &http.Server{
+		Addr:    cfg.addr,
+		Handler: handler,
+		TLSConfig: &tls.Config{
+			GetCertificate: p.serverCert.GetCertificate,
+			ClientAuth:     clientAuth,
+			ClientCAs:      clientCAs,
+			KeyLogWriter:   keyLog,
+		},
+		ErrorLog: log.New(&tlsErrorCounter{Writer: os.Stderr, metrics: p.metrics}, "", log.LstdFlags),
+	}
+	h2s := newH2Server(uint32(cfg.maxConcurrentStreams))
+	if p.srv, err = newTLSServer(srv, h2s); err != nil {
+		return nil, fmt.Errorf("configuring HTTP/2: %s", err)
+	}
+	if p.cleartext, err = newCleartextServers(cfg.cleartextAddrs, handler, srv.ErrorLog, uint32(cfg.maxConcurrentStreams)); err != nil {
+		return nil, fmt.Errorf("configuring HTTP/2: %s", err)
+	}
+	if p.conns.origins != nil {
+		// Once a client has gone, so have the upstream connections that
+		// carried its PROXY header.
+		forget := func(c net.Conn, closed bool) {
+			if !closed {
+				return
+			}
+			if origin, ok := p.conns.origins.forget(c.RemoteAddr().String()); ok {
+				p.h2c.setUpgraded(origin, false)
+				p.conns.drainOrigin(origin)
+			}
+		}
+		srv.ConnState = func(c net.Conn, state http.ConnState) {
+			forget(c, state == http.StateClosed || state == http.StateHijacked)
+		}
+		for _, s := range p.cleartext {
+			s.ConnState = func(c net.Conn, state nethttp.ConnState) {
+				forget(c, state == nethttp.StateClosed || state == nethttp.StateHijacked)
+			}
+		}
+	}
+	return p, nil
+}
+
+// listen opens the listeners, so that their addresses are known before
+// serve.
+func (p *proxy) listen() error {
+	if err := p.srv.listen(); err != nil {
+		return err
+	}
+	for _, s := range p.cleartext {
+		if err := s.listen(); err != nil {
+			return err
+		}
+	}
+	if p.admin != nil {
+		l, err := net.Listen("tcp", p.admin.Addr)
+		if err != nil {
+			return err
+		}
+		p.adminListener = l
+	}
+	return nil
+}
+
+// serve serves the listeners until drain has been called, and returns once
+// the TLS listener has stopped.
+func (p *proxy) serve() error {
+	if p.admin != nil {
+		go func() {
+			log.Printf("Serving admin endpoints on http://%s", p.adminListener.Addr())
+			if err := p.admin.Serve(p.adminListener); err != http.ErrServerClosed {
+				log.Fatal(err)
+			}
+		}()
+	}
+	for _, s := range p.cleartext {
+		s := s
+		go func() {
+			log.Printf("Serving cleartext HTTP/1.1 and h2c on http://%s", s.listener.Addr())
+			if err := s.serve(); err != nethttp.ErrServerClosed {
+				log.Fatal(err)
+			}
+		}()
+	}
+	log.Printf("Serving on https://%s", p.srv.listener.Addr())
+	if err := p.srv.serve(); err != http.ErrServerClosed {
+		return err
+	}
+	return nil
+}
+
+// drain stops the listeners from accepting connections, sends GOAWAY to
+// HTTP/2 clients and waits up to timeout for in-flight requests to finish
+// before closing whatever is left. Then it closes the admin listener and,
+// with no more requests to carry, the connections to Envoy.
+func (p *proxy) drain(timeout time.Duration) {
+	servers := []server{p.srv}
+	for _, s := range p.cleartext {
+		servers = append(servers, s)
+	}
+	shutdown(servers, timeout)
+	if p.admin != nil {
+		p.admin.Close()
+	}
+	// GOAWAY has to go out before the transports close their idle
+	// connections, which they do without one.
+	p.conns.closeAll()
+	p.h2c.CloseIdleConnections()
+	p.passthrough.CloseIdleConnections()
+}
+
+// server is the TLS listener's, or the standard library's for the cleartext
+// listeners.
+type server interface {
+	Shutdown(ctx context.Context) error
+	Close() error
+}
+
+// shutdown shuts servers down gracefully, giving them up to timeout before
+// closing them.
+func shutdown(servers []server, timeout time.Duration) {
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+	var wg sync.WaitGroup
+	for _, srv := range servers {
+		wg.Add(1)
+		go func(srv server) {
+			defer wg.Done()
+			if err := srv.Shutdown(ctx); err != nil {
+				log.Printf("Drain deadline passed, closing remaining connections: %s", err)
+				srv.Close()
+			}
+		}(srv)
+	}
+	wg.Wait()
+}
+
+func upstreamTLSConfig(caFile string, clientCert *tlsutil.KeyPairReloader, expected tlsutil.EnvoyIdentity, insecure bool) (*tls.Config, error) {
+	caCert, err := ioutil.ReadFile(caFile)
+	if err != nil {
+		return nil, fmt.Errorf("reading CA: %s", err)
+	}
+	caCertPool := x509.NewCertPool()
+	if !caCertPool.AppendCertsFromPEM(caCert) {
+		return nil, fmt.Errorf("no certificates found in CA file %s", caFile)
+	}
+
+	config := &tls.Config{
+		RootCAs:              caCertPool,
+		GetClientCertificate: clientCert.GetClientCertificate,
+		// VerifyEnvoyCertificate does the chain and identity checks instead.
+		InsecureSkipVerify: true,
+	}
+	if insecure {
+		log.Printf("WARNING: not verifying Envoy's certificate (-insecure-skip-verify)")
+	} else {
+		config.VerifyPeerCertificate = tlsutil.VerifyEnvoyCertificate(caCertPool, expected)
+	}
+	return config, nil
+}
@@ -0,0 +1,254 @@
+package main
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/pem"
+	"io"
+	"io/ioutil"
+	"net"
+	nethttp "net/http"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"golang.org/x/net/http2"
+	"golang.org/x/net/http2/h2c"
+
+	"shared/frametap"
+	"shared/proxyprotocol"
+	"shared/standin"
+)
+
+// writeKeyPair writes cert and its key to PEM files in dir.
+func writeKeyPair(t *testing.T, dir, name string, cert tls.Certificate) (certFile, keyFile string) {
+	t.Helper()
+	key, err := x509.MarshalPKCS8PrivateKey(cert.PrivateKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	certFile, keyFile = filepath.Join(dir, name+".crt"), filepath.Join(dir, name+".key")
+	for file, block := range map[string]*pem.Block{
+		certFile: {Type: "CERTIFICATE", Bytes: cert.Certificate[0]},
+		keyFile:  {Type: "PRIVATE KEY", Bytes: key},
+	} {
+		if err := ioutil.WriteFile(file, pem.EncodeToMemory(block), 0600); err != nil {
+			t.Fatal(err)
+		}
+	}
+	return certFile, keyFile
+}
+
+// envoyOptions say how startEnvoyWith runs Envoy and the app behind it.
+type envoyOptions struct {
+	http1Only     bool // serve the app over HTTP/1.1 alone, as http1_app does
+	proxyProtocol bool // read the proxy's PROXY header and pass it on to the app
+}
+
+// startEnvoy runs backend over HTTP/1.1 and h2c, as the h2c app does, behind
+// the Envoy stand-in, and returns the stand-in's address.
+func startEnvoy(t *testing.T, backend nethttp.Handler) string {
+	return startEnvoyWith(t, backend, envoyOptions{})
+}
+
+// startEnvoyWith is startEnvoy with opts. The stand-in terminates TLS and
+// asks for a client certificate, as envoy/envoy.yaml does.
+func startEnvoyWith(t *testing.T, backend nethttp.Handler, opts envoyOptions) string {
+	t.Helper()
+	app, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	cluster := &standin.Cluster{
+		Name:           "app",
+		Endpoints:      []string{app.Addr().String()},
+		ConnectTimeout: time.Second,
+		MaxConnections: 1024,
+	}
+	if opts.proxyProtocol {
+		app = proxyprotocol.NewListener(app)
+		cluster.ProxyProtocol = "V2"
+	}
+	if !opts.http1Only {
+		backend = h2c.NewHandler(backend, &http2.Server{})
+	}
+	srv := &nethttp.Server{Handler: backend}
+	go srv.Serve(app)
+	t.Cleanup(func() { srv.Close() })
+
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if opts.proxyProtocol {
+		l = proxyprotocol.NewListener(l)
+	}
+	envoy := &standin.Listener{
+		Name: "envoy",
+		L:    l,
+		TLSConfig: &tls.Config{
+			Certificates: []tls.Certificate{localhostCert(t)},
+			ClientAuth:   tls.RequireAnyClientCert,
+		},
+		Cluster: cluster,
+	}
+	go envoy.Serve()
+	t.Cleanup(func() { l.Close() })
+	return l.Addr().String()
+}
+
+// testConfig is the configuration main would build with no flags set, with
+// the listener on an ephemeral port and certificates from a temporary
+// directory.
+func testConfig(t *testing.T) config {
+	t.Helper()
+	dir := t.TempDir()
+	certFile, keyFile := writeKeyPair(t, dir, "server", localhostCert(t))
+	clientCertFile, clientKeyFile := writeKeyPair(t, dir, "client", localhostCert(t))
+	return config{
+		addr:               "127.0.0.1:0",
+		accessLog:          ioutil.Discard,
+		accessLogFormat:    "json",
+		accessLogSample:    1,
+		certFile:           certFile,
+		keyFile:            keyFile,
+		caFile:             certFile,
+		clientCertFile:     clientCertFile,
+		clientKeyFile:      clientKeyFile,
+		insecureSkipVerify: true,
+		rateLimitKey:       "ip",
+	}
+}
+
+// startProxy runs a proxy for cfg in front of the Envoy at envoyAddr and
+// returns it with the address of its TLS listener.
+func startProxy(t *testing.T, cfg config, envoyAddr string) (*proxy, string) {
+	t.Helper()
+	saved := envoyHost
+	envoyHost = envoyAddr
+	t.Cleanup(func() { envoyHost = saved })
+
+	p, err := newProxy(cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := p.listen(); err != nil {
+		t.Fatal(err)
+	}
+	served := make(chan struct{})
+	go func() {
+		defer close(served)
+		if err := p.serve(); err != nil {
+			t.Errorf("serving: %s", err)
+		}
+	}()
+	t.Cleanup(func() {
+		p.drain(time.Second)
+		<-served
+	})
+	return p, p.srv.listener.Addr().String()
+}
+
+// h2Client speaks HTTP/2 to the proxy, trusting any certificate.
+func h2Client() *nethttp.Client {
+	return &nethttp.Client{Transport: &http2.Transport{TLSClientConfig: &tls.Config{InsecureSkipVerify: true}}}
+}
+
+func TestDrainLetsLongStreamsFinish(t *testing.T) {
+	if testing.Short() {
+		t.Skip("streams for more than five seconds")
+	}
+	release := make(chan struct{})
+	envoyAddr := startEnvoy(t, nethttp.HandlerFunc(func(w nethttp.ResponseWriter, r *nethttp.Request) {
+		io.WriteString(w, "started ")
+		w.(nethttp.Flusher).Flush()
+		<-release
+		io.WriteString(w, "finished")
+	}))
+	p, addr := startProxy(t, testConfig(t), envoyAddr)
+
+	// The connection has to be older than five seconds when the drain
+	// reaches the fork's Shutdown, which would close it then.
+	opened := time.Now()
+	resp, err := h2Client().Get("https://" + addr + "/stream")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	started := make([]byte, len("started "))
+	if _, err := io.ReadFull(resp.Body, started); err != nil {
+		t.Fatal(err)
+	}
+
+	drained := make(chan struct{})
+	go func() {
+		p.drain(30 * time.Second)
+		close(drained)
+	}()
+	waitFor(t, "the listener to stop", func() bool {
+		c, err := net.Dial("tcp", addr)
+		if err == nil {
+			c.Close()
+		}
+		return err != nil
+	})
+	time.Sleep(time.Until(opened.Add(6 * time.Second)))
+	select {
+	case <-drained:
+		t.Fatal("the drain finished with a request in flight")
+	default:
+	}
+
+	close(release)
+	rest, err := ioutil.ReadAll(resp.Body)
+	if err != nil || string(rest) != "finished" {
+		t.Errorf("got %q, %v after the drain started", rest, err)
+	}
+	select {
+	case <-drained:
+	case <-time.After(10 * time.Second):
+		t.Error("the drain did not finish once the request had")
+	}
+}
+
+func TestRecordFrames(t *testing.T) {
+	envoyAddr := startEnvoy(t, nethttp.HandlerFunc(func(w nethttp.ResponseWriter, r *nethttp.Request) {
+		io.WriteString(w, "hello")
+	}))
+	cfg := testConfig(t)
+	cfg.recordFrames = filepath.Join(t.TempDir(), "frames.jsonl")
+	p, addr := startProxy(t, cfg, envoyAddr)
+
+	resp, err := h2Client().Get("https://" + addr + "/")
+	if err != nil {
+		t.Fatal(err)
+	}
+	ioutil.ReadAll(resp.Body)
+	resp.Body.Close()
+	p.drain(time.Second)
+
+	events, err := frametap.Load(cfg.recordFrames, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var upgrade, switched, preface, status, goAway bool
+	for _, ev := range events {
+		switch {
+		case ev.Kind == "http1" && ev.From == frametap.FromClient:
+			upgrade = strings.Contains(ev.Head, "Upgrade: h2c")
+		case ev.Kind == "http1" && ev.From == frametap.FromServer:
+			switched = strings.HasPrefix(ev.Head, "HTTP/1.1 101")
+		case ev.Kind == "preface":
+			preface = ev.From == frametap.FromClient
+		case ev.Type == "HEADERS" && ev.From == frametap.FromServer && ev.StreamID == 1:
+			status = len(ev.Headers) > 0 && ev.Headers[0] == frametap.HeaderField{Name: ":status", Value: "200"}
+		case ev.Type == "GOAWAY" && ev.From == frametap.FromClient:
+			// The one drain sends, which the HTTP/2 client knows nothing of.
+			goAway = ev.ErrCode == "NO_ERROR"
+		}
+	}
+	if !upgrade || !switched || !preface || !status || !goAway {
+		t.Errorf("upgrade %v, 101 %v, preface %v, status %v, GOAWAY %v in %d events", upgrade, switched, preface, status, goAway, len(events))
+	}
+}
@@ -0,0 +1,304 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"math"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/gerg/net/http"
+	"github.com/gerg/net/http/httptrace"
+)
+
+// routePolicy is how hard a route tries to reach Envoy, and how it rewrites
+// the headers on the way. The circuit breaker defaults are the ones in
+// envoy.yaml's circuit_breakers block, and Envoy's own defaults where that
+// block doesn't set one.
+type routePolicy struct {
+	ConnectTimeout  duration `json:"connect_timeout"`  // TCP connect to Envoy
+	UpgradeTimeout  duration `json:"upgrade_timeout"`  // until the response to an upgrade offer
+	ResponseTimeout duration `json:"response_timeout"` // until the response headers, 0 for none
+
+	// Retries is how many times an idempotent, bodyless request is retried
+	// after a connection-level failure, including a failed upgrade.
+	Retries int `json:"retries"`
+
+	MaxConnections     uint32 `json:"max_connections"` // a uint32, as in Envoy
+	MaxPendingRequests int64  `json:"max_pending_requests"`
+	MaxRetries         int64  `json:"max_retries"` // retries in flight across the route
+
+	RequestHeaders  []headerRule `json:"request_headers,omitempty"`
+	ResponseHeaders []headerRule `json:"response_headers,omitempty"`
+
+	requestRules, responseRules headerRules
+}
+
+var defaultRoutePolicy = routePolicy{
+	ConnectTimeout:     duration(250 * time.Millisecond),
+	UpgradeTimeout:     duration(5 * time.Second),
+	ResponseTimeout:    duration(15 * time.Second),
+	Retries:            1,
+	MaxConnections:     math.MaxUint32,
+	MaxPendingRequests: 1024,
+	MaxRetries:         3,
+}
+
+// maxConnsPerHost is MaxConnections for http.Transport, which takes an int:
+// where an int is 32 bits, Envoy's default is more than it holds.
+func (p routePolicy) maxConnsPerHost() int {
+	const maxInt = int(^uint(0) >> 1)
+	if uint64(p.MaxConnections) > uint64(maxInt) {
+		return maxInt
+	}
+	return int(p.MaxConnections)
+}
+
+// loadRoutePolicies reads per-route overrides of defaultRoutePolicy from a
+// JSON file keyed by route name, e.g.
+//
+//	{"h2c": {"response_timeout": "30s", "retries": 2}}
+//
+// An empty path gives every route the defaults.
+func loadRoutePolicies(path string, routes ...string) (map[string]routePolicy, error) {
+	policies := map[string]routePolicy{}
+	for _, route := range routes {
+		policies[route] = defaultRoutePolicy
+	}
+	if path == "" {
+		return policies, nil
+	}
+
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	var overrides map[string]json.RawMessage
+	if err := json.Unmarshal(data, &overrides); err != nil {
+		return nil, fmt.Errorf("parsing %s: %s", path, err)
+	}
+	for route, raw := range overrides {
+		policy, ok := policies[route]
+		if !ok {
+			return nil, fmt.Errorf("%s: unknown route %q", path, route)
+		}
+		if err := json.Unmarshal(raw, &policy); err != nil {
+			return nil, fmt.Errorf("parsing %s route %q: %s", path, route, err)
+		}
+		if policy.requestRules, err = compileHeaderRules(policy.RequestHeaders); err != nil {
+			return nil, fmt.Errorf("%s route %q request_headers: %s", path, route, err)
+		}
+		if policy.responseRules, err = compileHeaderRules(policy.ResponseHeaders); err != nil {
+			return nil, fmt.Errorf("%s route %q response_headers: %s", path, route, err)
+		}
+		policies[route] = policy
+	}
+	return policies, nil
+}
+
+// duration is a time.Duration written as a string ("250ms") in JSON.
+type duration time.Duration
+
+func (d *duration) UnmarshalJSON(b []byte) error {
+	var s string
+	if err := json.Unmarshal(b, &s); err != nil {
+		return fmt.Errorf("duration must be a string like \"250ms\": %s", err)
+	}
+	v, err := time.ParseDuration(s)
+	if err != nil {
+		return err
+	}
+	*d = duration(v)
+	return nil
+}
+
+func (d duration) MarshalJSON() ([]byte, error) {
+	return json.Marshal(time.Duration(d).String())
+}
+
+// timeoutError is returned when Envoy takes longer than the route allows.
+type timeoutError struct {
+	kind  string // "upgrade" or "response"
+	after time.Duration
+}
+
+func (e *timeoutError) Error() string {
+	return fmt.Sprintf("upstream %s timeout after %s", e.kind, e.after)
+}
+
+// overflowError is returned when a circuit breaker is open.
+type overflowError struct {
+	breaker string
+}
+
+func (e *overflowError) Error() string {
+	return fmt.Sprintf("upstream circuit breaker open: %s", e.breaker)
+}
+
+// routeTransport applies a route's timeouts, retries and circuit breakers
+// around the transport that talks to Envoy.
+type routeTransport struct {
+	route   string
+	policy  routePolicy
+	next    http.RoundTripper
+	conns   *upstreamConns
+	metrics *proxyMetrics
+
+	pending  int64 // requests waiting for a connection
+	retrying int64 // retries in flight
+}
+
+func (t *routeTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	resp, err := t.attempt(req)
+	for retry := 0; err != nil && retry < t.policy.Retries && isRetryable(req, err); retry++ {
+		if atomic.AddInt64(&t.retrying, 1) > t.policy.MaxRetries {
+			atomic.AddInt64(&t.retrying, -1)
+			t.metrics.overflows.inc(t.route, "retries")
+			break
+		}
+		t.metrics.retries.inc(t.route)
+		resp, err = t.attempt(req)
+		atomic.AddInt64(&t.retrying, -1)
+	}
+
+	var timeout *timeoutError
+	if errors.As(err, &timeout) {
+		t.metrics.timeouts.inc(t.route, timeout.kind)
+	}
+	return resp, err
+}
+
+// attempt sends req once, counting it as pending until it has a connection
+// and as a stream on that connection until the response body is closed. It
+// is turned away if that would make more pending than the route allows. A
+// client-initiated upgrade is waiting on a 101 rather than a response, so it
+// gets the upgrade timeout.
+func (t *routeTransport) attempt(req *http.Request) (*http.Response, error) {
+	if atomic.AddInt64(&t.pending, 1) > t.policy.MaxPendingRequests {
+		atomic.AddInt64(&t.pending, -1)
+		t.metrics.overflows.inc(t.route, "pending")
+		return nil, &overflowError{breaker: "max_pending_requests"}
+	}
+	var once sync.Once
+	connected := func() { once.Do(func() { atomic.AddInt64(&t.pending, -1) }) }
+	defer connected()
+
+	// A request that primes an upgrade gets two connections, the primer's
+	// and its own, and only holds on to the last.
+	var stream *trackedConn
+	trace := &httptrace.ClientTrace{
+		GotConn: func(info httptrace.GotConnInfo) {
+			connected()
+			if stream != nil {
+				stream.endStream()
+			}
+			if stream = t.conns.lookup(info.Conn); stream != nil {
+				stream.beginStream()
+			}
+		},
+	}
+	req = req.WithContext(httptrace.WithClientTrace(req.Context(), trace))
+
+	timeout, kind := t.policy.ResponseTimeout, "response"
+	if isClientUpgrade(req) {
+		timeout, kind = t.policy.UpgradeTimeout, "upgrade"
+	}
+	resp, err := roundTripWithin(t.next, req, time.Duration(timeout), kind)
+	if stream != nil {
+		if err != nil {
+			stream.endStream()
+		} else {
+			onBodyClose(resp, stream.endStream)
+		}
+	}
+	return resp, err
+}
+
+// isRetryable reports whether req can safely be sent again after err: the
+// method is idempotent, there is no body that has already been consumed, the
+// client is still waiting, and the failure happened at the connection level,
+// i.e. not a response timeout or an open circuit breaker.
+func isRetryable(req *http.Request, err error) bool {
+	switch req.Method {
+	case http.MethodGet, http.MethodHead, http.MethodOptions, http.MethodPut, http.MethodDelete, http.MethodTrace:
+	default:
+		return false
+	}
+	if hasBody(req) || req.Context().Err() != nil {
+		return false
+	}
+	var timeout *timeoutError
+	if errors.As(err, &timeout) {
+		return timeout.kind == "upgrade"
+	}
+	var overflow *overflowError
+	return !errors.As(err, &overflow)
+}
+
+// roundTripWithin fails the request with a timeoutError when rt has not
+// returned a response within d. A zero d waits forever. Once the response is
+// in, the body is read without a deadline.
+func roundTripWithin(rt http.RoundTripper, req *http.Request, d time.Duration, kind string) (*http.Response, error) {
+	if d <= 0 {
+		return rt.RoundTrip(req)
+	}
+	ctx, cancel := context.WithCancel(req.Context())
+	var timedOut int32
+	timer := time.AfterFunc(d, func() {
+		atomic.StoreInt32(&timedOut, 1)
+		cancel()
+	})
+
+	resp, err := rt.RoundTrip(req.WithContext(ctx))
+	if !timer.Stop() && atomic.LoadInt32(&timedOut) == 1 {
+		if resp != nil {
+			resp.Body.Close()
+		}
+		cancel()
+		return nil, &timeoutError{kind: kind, after: d}
+	}
+	if err != nil {
+		cancel()
+		return nil, err
+	}
+	// The request's context is released once the body is done with.
+	onBodyClose(resp, func() { cancel() })
+	return resp, nil
+}
+
+// onBodyClose calls done once, after resp's body has been closed.
+func onBodyClose(resp *http.Response, done func()) {
+	body := &closeHookBody{ReadCloser: resp.Body, done: done}
+	if rw, ok := resp.Body.(io.ReadWriteCloser); ok {
+		// ReverseProxy needs a writable body to pass on a 101.
+		resp.Body = &closeHookWriter{closeHookBody: body, w: rw}
+	} else {
+		resp.Body = body
+	}
+}
+
+type closeHookBody struct {
+	io.ReadCloser
+	once sync.Once
+	done func()
+}
+
+func (b *closeHookBody) Close() error {
+	err := b.ReadCloser.Close()
+	b.once.Do(b.done)
+	return err
+}
+
+type closeHookWriter struct {
+	*closeHookBody
+	w io.Writer
+}
+
+func (b *closeHookWriter) Write(p []byte) (int, error) {
+	return b.w.Write(p)
+}
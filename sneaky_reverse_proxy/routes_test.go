@@ -0,0 +1,333 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"io/ioutil"
+	"net"
+	nethttp "net/http"
+	"net/http/httptest"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/gerg/net/http"
+)
+
+// hangingServer accepts requests, counting them, and never answers them
+// until the test ends.
+func hangingServer(t *testing.T, requests *int64) *httptest.Server {
+	release := make(chan struct{})
+	srv := httptest.NewServer(nethttp.HandlerFunc(func(w nethttp.ResponseWriter, r *nethttp.Request) {
+		atomic.AddInt64(requests, 1)
+		select {
+		case <-release:
+		case <-r.Context().Done():
+		}
+	}))
+	t.Cleanup(func() {
+		close(release)
+		srv.Close()
+	})
+	return srv
+}
+
+// resettingServer resets the connection of every request it gets, and counts
+// them.
+func resettingServer(t *testing.T, requests *int64) *httptest.Server {
+	srv := httptest.NewServer(nethttp.HandlerFunc(func(w nethttp.ResponseWriter, r *nethttp.Request) {
+		atomic.AddInt64(requests, 1)
+		c, _, err := w.(nethttp.Hijacker).Hijack()
+		if err != nil {
+			t.Errorf("hijacking: %s", err)
+			return
+		}
+		c.(*net.TCPConn).SetLinger(0)
+		c.Close()
+	}))
+	t.Cleanup(srv.Close)
+	return srv
+}
+
+func newTestRouteTransport(policy routePolicy, next http.RoundTripper) *routeTransport {
+	conns := newUpstreamConns()
+	return &routeTransport{route: "h2c", policy: policy, next: next, conns: conns, metrics: newProxyMetrics(conns)}
+}
+
+func counterValue(c *counterVec, labelValues ...string) float64 {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.values[strings.Join(labelValues, "\x00")]
+}
+
+func newRequest(t *testing.T, method, url string) *http.Request {
+	req, err := http.NewRequest(method, url, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return req
+}
+
+func TestRoundTripWithinTimesOut(t *testing.T) {
+	var requests int64
+	srv := hangingServer(t, &requests)
+	start := time.Now()
+	resp, err := roundTripWithin(&http.Transport{}, newRequest(t, "GET", srv.URL), 50*time.Millisecond, "response")
+	var timeout *timeoutError
+	if !errors.As(err, &timeout) {
+		t.Fatalf("got %v, %v, want a timeoutError", resp, err)
+	}
+	if timeout.kind != "response" || timeout.after != 50*time.Millisecond {
+		t.Errorf("got %+v", timeout)
+	}
+	if elapsed := time.Since(start); elapsed > 5*time.Second {
+		t.Errorf("took %s to time out", elapsed)
+	}
+}
+
+func TestRoundTripWithinReadsBodyPastDeadline(t *testing.T) {
+	srv := httptest.NewServer(nethttp.HandlerFunc(func(w nethttp.ResponseWriter, r *nethttp.Request) {
+		w.Write([]byte("first "))
+		w.(nethttp.Flusher).Flush()
+		time.Sleep(200 * time.Millisecond)
+		w.Write([]byte("second"))
+	}))
+	defer srv.Close()
+
+	resp, err := roundTripWithin(&http.Transport{}, newRequest(t, "GET", srv.URL), 100*time.Millisecond, "response")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	body, err := ioutil.ReadAll(resp.Body)
+	if err != nil || string(body) != "first second" {
+		t.Errorf("got %q, %v", body, err)
+	}
+}
+
+func TestRoundTripWithinZeroWaits(t *testing.T) {
+	srv := httptest.NewServer(nethttp.HandlerFunc(func(w nethttp.ResponseWriter, r *nethttp.Request) {
+		time.Sleep(100 * time.Millisecond)
+	}))
+	defer srv.Close()
+
+	resp, err := roundTripWithin(&http.Transport{}, newRequest(t, "GET", srv.URL), 0, "response")
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+}
+
+func TestRoundTripWithinPassesErrorsOn(t *testing.T) {
+	var requests int64
+	srv := resettingServer(t, &requests)
+	_, err := roundTripWithin(&http.Transport{}, newRequest(t, "GET", srv.URL), time.Second, "response")
+	var timeout *timeoutError
+	if err == nil || errors.As(err, &timeout) {
+		t.Errorf("got %v, want the connection error", err)
+	}
+}
+
+func TestIsRetryable(t *testing.T) {
+	canceled, cancel := context.WithCancel(context.Background())
+	cancel()
+	reset := errors.New("read: connection reset by peer")
+
+	for _, c := range []struct {
+		name   string
+		method string
+		body   string
+		ctx    context.Context
+		err    error
+		want   bool
+	}{
+		{name: "GET reset", method: "GET", err: reset, want: true},
+		{name: "PUT reset", method: "PUT", err: reset, want: true},
+		{name: "POST reset", method: "POST", err: reset},
+		{name: "PATCH reset", method: "PATCH", err: reset},
+		{name: "PUT with a body", method: "PUT", body: "x", err: reset},
+		{name: "client gone", method: "GET", ctx: canceled, err: reset},
+		{name: "upgrade timeout", method: "GET", err: &timeoutError{kind: "upgrade"}, want: true},
+		{name: "response timeout", method: "GET", err: &timeoutError{kind: "response"}},
+		{name: "open breaker", method: "GET", err: &overflowError{breaker: "max_pending_requests"}},
+	} {
+		t.Run(c.name, func(t *testing.T) {
+			req, err := http.NewRequest(c.method, "https://envoy/", strings.NewReader(c.body))
+			if err != nil {
+				t.Fatal(err)
+			}
+			if c.body == "" {
+				req.Body, req.ContentLength = http.NoBody, 0
+			}
+			if c.ctx != nil {
+				req = req.WithContext(c.ctx)
+			}
+			if got := isRetryable(req, c.err); got != c.want {
+				t.Errorf("got %t, want %t", got, c.want)
+			}
+		})
+	}
+}
+
+func TestRouteTransportRetriesConnectionFailures(t *testing.T) {
+	var requests int64
+	srv := resettingServer(t, &requests)
+	policy := defaultRoutePolicy
+	policy.Retries = 2
+	rt := newTestRouteTransport(policy, &http.Transport{})
+
+	if _, err := rt.RoundTrip(newRequest(t, "GET", srv.URL)); err == nil {
+		t.Fatal("got a response from a server that resets every connection")
+	}
+	if n := atomic.LoadInt64(&requests); n != 3 {
+		t.Errorf("got %d attempts, want 3", n)
+	}
+	if n := counterValue(rt.metrics.retries, "h2c"); n != 2 {
+		t.Errorf("got %v retries counted, want 2", n)
+	}
+	if n := atomic.LoadInt64(&rt.retrying); n != 0 {
+		t.Errorf("%d retries still counted as in flight", n)
+	}
+}
+
+func TestRouteTransportDoesNotRetryPost(t *testing.T) {
+	var requests int64
+	srv := resettingServer(t, &requests)
+	rt := newTestRouteTransport(defaultRoutePolicy, &http.Transport{})
+
+	if _, err := rt.RoundTrip(newRequest(t, "POST", srv.URL)); err == nil {
+		t.Fatal("got a response from a server that resets every connection")
+	}
+	if n := atomic.LoadInt64(&requests); n != 1 {
+		t.Errorf("got %d attempts, want 1", n)
+	}
+}
+
+func TestRouteTransportRetryBudget(t *testing.T) {
+	var requests int64
+	srv := resettingServer(t, &requests)
+	policy := defaultRoutePolicy
+	policy.Retries = 2
+	policy.MaxRetries = 1
+	rt := newTestRouteTransport(policy, &http.Transport{})
+	// Another request's retry is already in flight, using up the budget.
+	rt.retrying = 1
+
+	if _, err := rt.RoundTrip(newRequest(t, "GET", srv.URL)); err == nil {
+		t.Fatal("got a response from a server that resets every connection")
+	}
+	if n := atomic.LoadInt64(&requests); n != 1 {
+		t.Errorf("got %d attempts, want 1", n)
+	}
+	if n := counterValue(rt.metrics.overflows, "h2c", "retries"); n != 1 {
+		t.Errorf("got %v retry overflows counted, want 1", n)
+	}
+	if n := atomic.LoadInt64(&rt.retrying); n != 1 {
+		t.Errorf("got %d retries in flight, want the other request's 1", n)
+	}
+}
+
+func TestRouteTransportPendingBreaker(t *testing.T) {
+	var requests int64
+	srv := hangingServer(t, &requests)
+	policy := defaultRoutePolicy
+	policy.MaxPendingRequests = 1
+	policy.ResponseTimeout = 0
+	// With one connection, which the first request holds on to, the second
+	// request is left pending.
+	rt := newTestRouteTransport(policy, &http.Transport{MaxConnsPerHost: 1})
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	errs := make(chan error, 2)
+	send := func() {
+		_, err := rt.RoundTrip(newRequest(t, "GET", srv.URL).WithContext(ctx))
+		errs <- err
+	}
+	go send()
+	waitFor(t, "the first request to arrive", func() bool { return atomic.LoadInt64(&requests) == 1 })
+	go send()
+	waitFor(t, "the second request to be pending", func() bool { return atomic.LoadInt64(&rt.pending) == 1 })
+
+	_, err := rt.RoundTrip(newRequest(t, "GET", srv.URL))
+	var overflow *overflowError
+	if !errors.As(err, &overflow) || overflow.breaker != "max_pending_requests" {
+		t.Fatalf("got %v, want the pending breaker open", err)
+	}
+	if n := counterValue(rt.metrics.overflows, "h2c", "pending"); n != 1 {
+		t.Errorf("got %v pending overflows counted, want 1", n)
+	}
+
+	cancel()
+	for i := 0; i < 2; i++ {
+		<-errs
+	}
+	if n := atomic.LoadInt64(&rt.pending); n != 0 {
+		t.Errorf("%d requests still counted as pending", n)
+	}
+}
+
+func TestRouteTransportPendingBreakerUnderLoad(t *testing.T) {
+	var requests int64
+	srv := hangingServer(t, &requests)
+	policy := defaultRoutePolicy
+	policy.MaxPendingRequests = 3
+	policy.ResponseTimeout = 0
+	rt := newTestRouteTransport(policy, &http.Transport{MaxConnsPerHost: 1})
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	errs := make(chan error, 21)
+	send := func() {
+		_, err := rt.RoundTrip(newRequest(t, "GET", srv.URL).WithContext(ctx))
+		errs <- err
+	}
+	go send()
+	waitFor(t, "the first request to arrive", func() bool { return atomic.LoadInt64(&requests) == 1 })
+
+	// Of twenty requests at once, as many wait as the breaker allows and
+	// the rest are turned away.
+	for i := 0; i < 20; i++ {
+		go send()
+	}
+	var overflows int
+	for i := 0; i < 17; i++ {
+		var overflow *overflowError
+		if err := <-errs; errors.As(err, &overflow) {
+			overflows++
+		}
+	}
+	if n := atomic.LoadInt64(&rt.pending); overflows != 17 || n != 3 {
+		t.Errorf("%d requests turned away and %d pending, want 17 and 3", overflows, n)
+	}
+
+	cancel()
+	for i := 0; i < 4; i++ {
+		<-errs
+	}
+	if n := atomic.LoadInt64(&rt.pending); n != 0 {
+		t.Errorf("%d requests still counted as pending", n)
+	}
+}
+
+func waitFor(t *testing.T, what string, cond func() bool) {
+	t.Helper()
+	deadline := time.Now().Add(5 * time.Second)
+	for !cond() {
+		if time.Now().After(deadline) {
+			t.Fatalf("timed out waiting for %s", what)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func TestMaxConnsPerHost(t *testing.T) {
+	if got := defaultRoutePolicy.maxConnsPerHost(); got <= 0 {
+		t.Errorf("Envoy's default max_connections came out as %d", got)
+	}
+	policy := routePolicy{MaxConnections: 100}
+	if got := policy.maxConnsPerHost(); got != 100 {
+		t.Errorf("got %d, want 100", got)
+	}
+}
@@ -0,0 +1,242 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/gerg/net/http"
+	"github.com/gerg/net/http/httptrace"
+)
+
+// h2cSettings is the base64url-encoded SETTINGS payload sent in the
+// HTTP2-Settings header of the upgrade request.
+const h2cSettings = "AAMAAABkAARAAAAAAAIAAAAA"
+
+// h2cUpgradeTransport offers the h2c upgrade (RFC 7540 section 3.2) to Envoy
+// until one of its requests comes back over HTTP/2, after which the
+// transport's connection pool carries requests on the upgraded connection.
+//
+// The upgrade headers are added here rather than in a Director because
+// ReverseProxy strips Connection and every header it names after the Director
+// has run, which would leave the backend without HTTP2-Settings.
+type h2cUpgradeTransport struct {
+	*http.Transport
+	conns   *upstreamConns
+	metrics *proxyMetrics
+
+	// upgradeTimeout bounds how long an offer waits for its response.
+	upgradeTimeout time.Duration
+
+	// upgraded is the protocol cache: the origins for which we believe the
+	// pool holds an upgraded connection. Offering the upgrade then would be
+	// rejected by the HTTP/2 client ("invalid Upgrade request header"), so we
+	// don't.
+	mu       sync.Mutex
+	upgraded map[string]bool
+}
+
+func (t *h2cUpgradeTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	entry := accessLogFromContext(req.Context())
+
+	if !t.isUpgraded(req.URL.Host) {
+		if !hasBody(req) {
+			start := time.Now()
+			resp, err := t.offer(req)
+			if err == errUpgradeRejected {
+				// Someone else upgraded a connection in the meantime.
+				t.setUpgraded(req.URL.Host, true)
+				resp, err = t.Transport.RoundTrip(req)
+				t.finish(entry, resp, negotiationReused, 0)
+				return resp, err
+			}
+			t.finish(entry, resp, offerResult(resp), time.Since(start))
+			return resp, err
+		}
+
+		// The upgrade request has to be sent, body and all, as HTTP/1.1 before
+		// the switch. A streaming body (gRPC, anything full-duplex) would never
+		// finish, and the h2c backends don't forward upgrade bodies anyway, so
+		// upgrade the connection with a bodyless request first.
+		start := time.Now()
+		if primed := t.prime(req); primed != "" {
+			resp, err := t.Transport.RoundTrip(req)
+			t.finish(entry, resp, primed, time.Since(start))
+			return resp, err
+		}
+	}
+
+	resp, err := t.Transport.RoundTrip(req)
+	t.finish(entry, resp, "", 0)
+	return resp, err
+}
+
+// offer sends req with the h2c upgrade headers.
+func (t *h2cUpgradeTransport) offer(req *http.Request) (*http.Response, error) {
+	var conn net.Conn
+	trace := &httptrace.ClientTrace{
+		GotConn: func(info httptrace.GotConnInfo) { conn = info.Conn },
+	}
+	req = withUpgradeHeaders(req.WithContext(httptrace.WithClientTrace(req.Context(), trace)))
+
+	resp, err := roundTripWithin(t.Transport, req, t.upgradeTimeout, "upgrade")
+	if err != nil && err.Error() == upgradeHeaderError(req) {
+		err = errUpgradeRejected
+	}
+	switch {
+	case err == errUpgradeRejected:
+		// Not an attempt as far as Envoy is concerned.
+	case err != nil:
+		t.metrics.upgradeAttempts.inc()
+		t.metrics.upgradeResults.inc("error")
+	case resp.ProtoMajor == 2:
+		t.metrics.upgradeAttempts.inc()
+		t.metrics.upgradeResults.inc(negotiationUpgraded)
+		t.conns.markUpgraded(conn)
+	default:
+		t.metrics.upgradeAttempts.inc()
+		t.metrics.upgradeResults.inc(negotiationDeclined)
+	}
+	return resp, err
+}
+
+// prime upgrades a connection to the request's host with a bodyless
+// OPTIONS request so that req can go out on it as a regular HTTP/2 stream.
+// It returns the outcome of the offer, or "" if the primer failed, in which
+// case req is sent like it would have been without the upgrade.
+func (t *h2cUpgradeTransport) prime(req *http.Request) string {
+	primer, err := http.NewRequestWithContext(req.Context(), http.MethodOptions, req.URL.Scheme+"://"+req.URL.Host, nil)
+	if err != nil {
+		return ""
+	}
+	primer.Host = req.Host
+
+	resp, err := t.offer(primer)
+	if err != nil {
+		if err == errUpgradeRejected {
+			t.setUpgraded(req.URL.Host, true)
+		}
+		return ""
+	}
+	io.Copy(ioutil.Discard, resp.Body)
+	resp.Body.Close()
+	t.observe(resp)
+	return offerResult(resp)
+}
+
+// finish updates what we know about the pool from a response and hands it
+// back to ReverseProxy.
+func (t *h2cUpgradeTransport) finish(entry *accessLogEntry, resp *http.Response, negotiation string, upgrade time.Duration) {
+	t.observe(resp)
+	t.record(entry, resp, negotiation, upgrade)
+	t.metrics.trackH2Stream(resp)
+}
+
+// record fills in the upstream side of the access log entry. An empty
+// negotiation means the upgrade was not offered for this request, so the
+// result is read off the response.
+func (t *h2cUpgradeTransport) record(entry *accessLogEntry, resp *http.Response, negotiation string, upgrade time.Duration) {
+	if resp == nil {
+		return
+	}
+	if negotiation == "" {
+		negotiation = negotiationNone
+		if resp.ProtoMajor == 2 {
+			negotiation = negotiationReused
+		}
+	}
+	entry.update(func(e *accessLogEntry) {
+		e.UpstreamNegotiation = negotiation
+		e.UpstreamProto = resp.Proto
+		e.UpgradeMs = millis(upgrade)
+	})
+}
+
+func offerResult(resp *http.Response) string {
+	if resp != nil && resp.ProtoMajor == 2 {
+		return negotiationUpgraded
+	}
+	return negotiationDeclined
+}
+
+// observe tracks whether the pool still holds an upgraded connection: an
+// HTTP/2 response means it does, and an HTTP/1.1 response to a request that
+// did not offer the upgrade means it has gone away.
+func (t *h2cUpgradeTransport) observe(resp *http.Response) {
+	if resp == nil || resp.Request == nil {
+		return
+	}
+	t.setUpgraded(resp.Request.URL.Host, resp.ProtoMajor == 2)
+}
+
+func (t *h2cUpgradeTransport) isUpgraded(origin string) bool {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	return t.upgraded[origin]
+}
+
+func (t *h2cUpgradeTransport) setUpgraded(origin string, upgraded bool) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if t.upgraded == nil {
+		t.upgraded = map[string]bool{}
+	}
+	if upgraded {
+		t.upgraded[origin] = true
+	} else {
+		delete(t.upgraded, origin)
+	}
+}
+
+// protocolCache lists the origins we believe to have an upgraded connection
+// to.
+func (t *h2cUpgradeTransport) protocolCache() []string {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	origins := make([]string, 0, len(t.upgraded))
+	for origin := range t.upgraded {
+		origins = append(origins, origin)
+	}
+	sort.Strings(origins)
+	return origins
+}
+
+// resetProtocolCache forgets what we know about every origin, so the next
+// request to each offers the upgrade again. If the pool still holds an
+// upgraded connection the offer is rejected, and the request goes out on that
+// connection and puts the origin back in the cache.
+func (t *h2cUpgradeTransport) resetProtocolCache() {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.upgraded = nil
+}
+
+func withUpgradeHeaders(req *http.Request) *http.Request {
+	req = req.Clone(req.Context())
+	req.Header.Set("Upgrade", "h2c")
+	req.Header.Set("HTTP2-Settings", h2cSettings)
+	req.Header.Set("Connection", "Upgrade, HTTP2-Settings")
+	req.Header.Set("X-Debug", "Upgrade Request")
+	return req
+}
+
+func hasBody(req *http.Request) bool {
+	return req.Body != nil && req.Body != http.NoBody && req.ContentLength != 0
+}
+
+// errUpgradeRejected is what offer returns when the HTTP/2 client refused the
+// upgrade request because it carried Upgrade, which happens when the pool
+// already holds an upgraded connection for the host.
+var errUpgradeRejected = errors.New("h2c upgrade offered on an upgraded connection")
+
+// upgradeHeaderError is the message of the error the fork's HTTP/2 client
+// gives req for carrying Upgrade. The fork has no sentinel or type for it, so
+// the message is rebuilt from req's own header and compared whole.
+func upgradeHeaderError(req *http.Request) string {
+	return fmt.Sprintf("http2: invalid Upgrade request header: %q", req.Header["Upgrade"])
+}
@@ -0,0 +1,31 @@
+package main
+
+import (
+	nethttp "net/http"
+	"testing"
+
+	"github.com/gerg/net/http"
+)
+
+// The fork's HTTP/2 client has no sentinel for a request that carries
+// Upgrade, so offer recognises the rejection by its message. Offering the
+// upgrade again once the pool holds an upgraded connection catches the
+// message changing under a new fork revision.
+func TestOfferOnUpgradedConnection(t *testing.T) {
+	p, addr := startProxy(t, testConfig(t), startEnvoy(t, nethttp.HandlerFunc(reportHandler)))
+	do(t, h2Client(), "https://"+addr+"/inspect", nil)
+	if !p.h2c.isUpgraded(envoyHost) {
+		t.Fatal("the first request did not upgrade the connection to Envoy")
+	}
+
+	resp, err := p.h2c.offer(newRequest(t, http.MethodGet, "https://"+envoyHost+"/inspect"))
+	if resp != nil {
+		resp.Body.Close()
+	}
+	if err != errUpgradeRejected {
+		t.Fatalf("got %v, want the HTTP/2 client to reject the upgrade headers", err)
+	}
+	if n := counterValue(p.metrics.upgradeAttempts); n != 1 {
+		t.Errorf("%v upgrade attempts, want 1", n)
+	}
+}
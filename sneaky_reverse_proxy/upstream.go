@@ -0,0 +1,550 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/tls"
+	"net"
+	"sort"
+	"sync"
+	"time"
+
+	"golang.org/x/net/http2"
+
+	"shared/frametap"
+	"shared/proxyprotocol"
+)
+
+// tlsHandshakeTimeout bounds the TLS handshake with Envoy, like
+// http.DefaultTransport's.
+const tlsHandshakeTimeout = 10 * time.Second
+
+// upstreamConns keeps track of the connections the transports open to Envoy,
+// so they can be counted, inspected and drained.
+type upstreamConns struct {
+	mu    sync.Mutex
+	conns map[string]*trackedConn // by local address
+
+	// origins is set with -proxy-protocol: connections to its made-up
+	// origins go to Envoy and start with a PROXY header.
+	origins *proxyOrigins
+
+	// frames is set with -record-frames, to record the connections that
+	// are upgraded.
+	frames *frametap.Recorder
+}
+
+func newUpstreamConns() *upstreamConns {
+	return &upstreamConns{conns: map[string]*trackedConn{}}
+}
+
+// dialer returns a DialTLS for the transport serving pool. It gives up
+// connecting after timeout and keeps track of the connections it opens.
+//
+// We do the TLS handshake here rather than leave it to the transport so that
+// the connection the transport gets is ours: once a connection has been
+// upgraded to HTTP/2 it is the only place the frames are in the clear. The
+// transport reads the client config's NextProtos when it first sends a
+// request, after setting up HTTP/2, so config must be its TLSClientConfig.
+func (u *upstreamConns) dialer(pool string, timeout time.Duration, config *tls.Config, metrics *proxyMetrics) func(network, addr string) (net.Conn, error) {
+	d := &net.Dialer{Timeout: timeout, KeepAlive: 30 * time.Second}
+	return func(network, addr string) (net.Conn, error) {
+		dialAddr, header := addr, (*proxyprotocol.Header)(nil)
+		if u.origins != nil {
+			var err error
+			if dialAddr, header, err = u.origins.resolve(addr); err != nil {
+				return nil, err
+			}
+		}
+		conn, err := d.Dial(network, dialAddr)
+		if err != nil {
+			return nil, err
+		}
+		c := &trackedConn{Conn: conn, pool: pool, origin: addr, opened: time.Now(), owner: u}
+		u.mu.Lock()
+		u.conns[conn.LocalAddr().String()] = c
+		u.mu.Unlock()
+
+		if header != nil {
+			if err := writeProxyHeader(conn, header); err != nil {
+				c.Close()
+				return nil, err
+			}
+			c.proxyHeader = header.String()
+		}
+
+		cfg := config.Clone()
+		if cfg.ServerName == "" {
+			cfg.ServerName, _, _ = net.SplitHostPort(dialAddr)
+		}
+		tlsConn := tls.Client(c, cfg)
+		start := time.Now()
+		tlsConn.SetDeadline(start.Add(tlsHandshakeTimeout))
+		if err := tlsConn.Handshake(); err != nil {
+			c.Close()
+			metrics.tlsFailures.inc("upstream")
+			return nil, err
+		}
+		tlsConn.SetDeadline(time.Time{})
+
+		c.mu.Lock()
+		c.alpn = tlsConn.ConnectionState().NegotiatedProtocol
+		c.mu.Unlock()
+		if c.alpn == "h2" {
+			// The transport only hands a *tls.Conn to its ALPN HTTP/2
+			// client, so this one goes unwatched.
+			return tlsConn, nil
+		}
+		tc := &upstreamTLSConn{Conn: tlsConn, tracked: c, handshake: time.Since(start)}
+		if u.frames != nil {
+			tc.tap = u.frames.NewTap(false)
+		}
+		return tc, nil
+	}
+}
+
+func (u *upstreamConns) list() []*trackedConn {
+	u.mu.Lock()
+	defer u.mu.Unlock()
+	conns := make([]*trackedConn, 0, len(u.conns))
+	for _, c := range u.conns {
+		conns = append(conns, c)
+	}
+	sort.Slice(conns, func(i, j int) bool { return conns[i].opened.Before(conns[j].opened) })
+	return conns
+}
+
+// lookup finds the tracked connection under conn, which may be the TCP
+// connection or anything layered on top of it.
+func (u *upstreamConns) lookup(conn net.Conn) *trackedConn {
+	if conn == nil {
+		return nil
+	}
+	return u.get(conn.LocalAddr().String())
+}
+
+func (u *upstreamConns) get(localAddr string) *trackedConn {
+	u.mu.Lock()
+	defer u.mu.Unlock()
+	return u.conns[localAddr]
+}
+
+// markUpgraded records that conn, the TLS connection a request went out on,
+// now speaks HTTP/2.
+func (u *upstreamConns) markUpgraded(conn net.Conn) {
+	if c := u.lookup(conn); c != nil {
+		c.mu.Lock()
+		c.upgraded = conn
+		c.mu.Unlock()
+	}
+}
+
+// drainOrigin drains the connections to origin, once the downstream
+// connection it was made up for has gone.
+func (u *upstreamConns) drainOrigin(origin string) {
+	for _, c := range u.list() {
+		if c.origin == origin {
+			c.drain()
+		}
+	}
+}
+
+// closeAll closes every upstream connection. Upgraded connections are sent a
+// GOAWAY first so Envoy's backend knows we are going away on purpose.
+//
+// This is only safe once no streams are left on the connection, i.e. after
+// the downstream server has drained. A GOAWAY that has to wait for the end of
+// a frame the HTTP/2 client is writing gets up to goAwayTimeout to go out.
+func (u *upstreamConns) closeAll() {
+	conns := u.list()
+	sent := make([]<-chan struct{}, len(conns))
+	for i, c := range conns {
+		if conn := c.upgradedConn(); conn != nil {
+			conn.SetWriteDeadline(time.Now().Add(goAwayTimeout))
+			sent[i] = sendGoAway(conn)
+		}
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), goAwayTimeout)
+	defer cancel()
+	for i, c := range conns {
+		if sent[i] != nil {
+			select {
+			case <-sent[i]:
+			case <-ctx.Done():
+			}
+			c.upgradedConn().Close()
+		}
+		c.Close()
+	}
+}
+
+// goAwayTimeout is how long a connection is kept open for a GOAWAY still
+// waiting to be written on it.
+const goAwayTimeout = time.Second
+
+// sendGoAway writes a GOAWAY on an upgraded connection, between two of the
+// HTTP/2 client's frames. The channel it returns is closed once the GOAWAY
+// has been written, or failed to be. A connection that isn't one of ours
+// can't be written to without cutting into a frame, so it gets none.
+func sendGoAway(conn net.Conn) <-chan struct{} {
+	if tc, ok := conn.(*upstreamTLSConn); ok {
+		return tc.goAway()
+	}
+	sent := make(chan struct{})
+	close(sent)
+	return sent
+}
+
+// writeProxyHeader sends h, before anything else, on a new connection to
+// Envoy.
+func writeProxyHeader(conn net.Conn, h *proxyprotocol.Header) error {
+	b, err := h.Marshal()
+	if err != nil {
+		return err
+	}
+	conn.SetWriteDeadline(time.Now().Add(tlsHandshakeTimeout))
+	defer conn.SetWriteDeadline(time.Time{})
+	_, err = conn.Write(b)
+	return err
+}
+
+// trackedConn is the TCP connection under a transport's TLS connection.
+type trackedConn struct {
+	net.Conn
+	pool   string
+	origin string
+	opened time.Time
+	owner  *upstreamConns
+	once   sync.Once
+
+	proxyHeader string // what the PROXY header sent first said, if one was
+
+	mu         sync.Mutex
+	upgraded   net.Conn // the TLS connection on top, once it speaks HTTP/2
+	alpn       string
+	streams    int // requests in flight
+	draining   bool
+	goAwaySent <-chan struct{}   // from sendGoAway, when drain sent one
+	settings   map[string]uint32 // the peer's, once upgraded
+	lastGoAway *goAway
+}
+
+func (c *trackedConn) isUpgraded() bool {
+	return c.upgradedConn() != nil
+}
+
+func (c *trackedConn) upgradedConn() net.Conn {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.upgraded
+}
+
+// mode is how the connection speaks to Envoy: "101-upgraded" after an h2c
+// upgrade, "alpn" for HTTP/2 negotiated in the TLS handshake, or "http/1.1".
+func (c *trackedConn) mode() string {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	switch {
+	case c.alpn == "h2":
+		return "alpn"
+	case c.upgraded != nil:
+		return "101-upgraded"
+	default:
+		return "http/1.1"
+	}
+}
+
+func (c *trackedConn) beginStream() {
+	c.mu.Lock()
+	c.streams++
+	c.mu.Unlock()
+}
+
+func (c *trackedConn) endStream() {
+	c.mu.Lock()
+	c.streams--
+	idle := c.draining && c.streams <= 0
+	c.mu.Unlock()
+	if idle {
+		c.closeDrained()
+	}
+}
+
+// drain stops Envoy's backend from expecting more from the connection and
+// closes it once the requests in flight on it have finished. An upgraded
+// connection is sent a GOAWAY first. Requests the transport sends on it in
+// the meantime are let finish too, and new ones go out on a new connection
+// after it is closed.
+func (c *trackedConn) drain() {
+	c.mu.Lock()
+	c.draining = true
+	idle := c.streams <= 0
+	conn := c.upgraded
+	c.mu.Unlock()
+
+	if conn != nil {
+		sent := sendGoAway(conn)
+		c.mu.Lock()
+		c.goAwaySent = sent
+		c.mu.Unlock()
+	}
+	if idle {
+		c.closeDrained()
+	}
+}
+
+// closeDrained closes the connection, once the GOAWAY drain sent has been
+// written if it is still waiting for the end of a frame. It does not block
+// for that: the caller may be a request finishing.
+func (c *trackedConn) closeDrained() {
+	c.mu.Lock()
+	sent := c.goAwaySent
+	c.mu.Unlock()
+	closeConn := func() {
+		if conn := c.upgradedConn(); conn != nil {
+			conn.Close()
+		}
+		c.Close()
+	}
+	if sent == nil {
+		closeConn()
+		return
+	}
+	go func() {
+		select {
+		case <-sent:
+		case <-time.After(goAwayTimeout):
+		}
+		closeConn()
+	}()
+}
+
+func (c *trackedConn) recordGoAway(g goAway) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	g.At = time.Now()
+	c.lastGoAway = &g
+}
+
+func (c *trackedConn) setPeerSetting(name string, value uint32) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.settings == nil {
+		c.settings = map[string]uint32{}
+	}
+	c.settings[name] = value
+}
+
+// connStatus is a trackedConn as the admin endpoint shows it.
+type connStatus struct {
+	ID           string            `json:"id"` // the local address
+	Pool         string            `json:"pool"`
+	Origin       string            `json:"origin"`
+	RemoteAddr   string            `json:"remote_addr"`
+	Mode         string            `json:"mode"`
+	ProxyHeader  string            `json:"proxy_header,omitempty"`
+	Opened       time.Time         `json:"opened"`
+	Streams      int               `json:"streams"`
+	Draining     bool              `json:"draining"`
+	PeerSettings map[string]uint32 `json:"peer_settings,omitempty"`
+	LastGoAway   *goAway           `json:"last_goaway,omitempty"`
+}
+
+func (c *trackedConn) status() connStatus {
+	s := connStatus{
+		ID:          c.LocalAddr().String(),
+		Pool:        c.pool,
+		Origin:      c.origin,
+		RemoteAddr:  c.RemoteAddr().String(),
+		Mode:        c.mode(),
+		ProxyHeader: c.proxyHeader,
+		Opened:      c.opened,
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	s.Streams = c.streams
+	s.Draining = c.draining
+	if len(c.settings) > 0 {
+		s.PeerSettings = map[string]uint32{}
+		for k, v := range c.settings {
+			s.PeerSettings[k] = v
+		}
+	}
+	if c.lastGoAway != nil {
+		g := *c.lastGoAway
+		s.LastGoAway = &g
+	}
+	return s
+}
+
+func (c *trackedConn) Close() error {
+	c.once.Do(func() {
+		c.owner.mu.Lock()
+		delete(c.owner.conns, c.LocalAddr().String())
+		c.owner.mu.Unlock()
+	})
+	return c.Conn.Close()
+}
+
+// upstreamTLSConn is the TLS connection the transport gets from dialer. It
+// watches the HTTP/2 frames both ways once the connection has been upgraded:
+// Envoy's backend's SETTINGS and GOAWAY go into the trackedConn, and the
+// frames we send are followed so a GOAWAY of our own can be slipped in
+// between two of them, under the same lock as the HTTP/2 client's writes.
+// With -record-frames, everything is also fed to a tap, GOAWAYs of our own
+// included.
+type upstreamTLSConn struct {
+	*tls.Conn
+	tracked   *trackedConn
+	handshake time.Duration
+	tap       *frametap.Tap // nil unless recording
+
+	readMu  sync.Mutex
+	h2      bool
+	history []byte // the tail of what was read before the upgrade
+	in      frameScanner
+
+	writeMu       sync.Mutex
+	h2Out         bool
+	out           frameScanner
+	framer        *http2.Framer // for our own frames, once h2Out
+	prefaceLeft   int
+	pendingGoAway bool
+	goAwaySent    chan struct{} // closed by writeGoAway
+}
+
+// historySize is how much of the HTTP/1.1 stream we keep to find the end of
+// the 101 response in once the HTTP/2 client starts.
+const historySize = 64 << 10
+
+func (c *upstreamTLSConn) Read(p []byte) (int, error) {
+	n, err := c.Conn.Read(p)
+	if c.tap != nil {
+		c.tap.Received(p[:n])
+	}
+	if n > 0 {
+		c.readMu.Lock()
+		if c.h2 {
+			c.in.write(p[:n])
+		} else {
+			c.history = append(c.history, p[:n]...)
+			if over := len(c.history) - historySize; over > 0 {
+				c.history = append([]byte(nil), c.history[over:]...)
+			}
+		}
+		c.readMu.Unlock()
+	}
+	return n, err
+}
+
+func (c *upstreamTLSConn) Write(p []byte) (int, error) {
+	c.writeMu.Lock()
+	defer c.writeMu.Unlock()
+
+	if !c.h2Out && bytes.HasPrefix(p, []byte(clientPreface)) {
+		c.startH2()
+	}
+
+	n, err := c.send(p)
+	if c.h2Out {
+		written := p[:n]
+		if c.prefaceLeft > 0 {
+			skip := minInt(c.prefaceLeft, len(written))
+			c.prefaceLeft -= skip
+			written = written[skip:]
+		}
+		c.out.write(written)
+		// Once a write has failed, the frame will never be finished: the
+		// GOAWAY fails now rather than keep its caller waiting.
+		if c.pendingGoAway && (err != nil || c.prefaceLeft == 0 && c.out.atBoundary()) {
+			c.writeGoAway()
+		}
+	}
+	return n, err
+}
+
+// startH2 is called when the HTTP/2 client sends its preface, which it does
+// straight after the 101. Everything read after the 101's headers is HTTP/2.
+func (c *upstreamTLSConn) startH2() {
+	c.h2Out = true
+	c.prefaceLeft = len(clientPreface)
+	c.out.onFrame = func(typ, flags byte, payload []byte) {} // only followed
+	c.framer = http2.NewFramer(sender{c}, nil)
+
+	c.readMu.Lock()
+	defer c.readMu.Unlock()
+	c.h2 = true
+	c.in.onFrame = c.received
+	if i := bytes.LastIndex(c.history, []byte("HTTP/1.1 101")); i >= 0 {
+		if j := bytes.Index(c.history[i:], []byte("\r\n\r\n")); j >= 0 {
+			c.in.write(c.history[i+j+4:])
+		}
+	}
+	c.history = nil
+}
+
+func (c *upstreamTLSConn) received(typ, flags byte, payload []byte) {
+	switch {
+	case typ == frameSettings && flags&flagSettingsAck == 0:
+		parseSettings(payload, c.tracked.setPeerSetting)
+	case typ == frameGoAway:
+		if g, ok := parseGoAway(payload); ok {
+			g.Direction = "received"
+			c.tracked.recordGoAway(g)
+		}
+	}
+}
+
+// goAway sends a GOAWAY with a last stream ID of 0 (we never accept pushed
+// streams) and NO_ERROR now if the HTTP/2 client is between frames, or else
+// straight after the write that finishes the frame it is in. The channel it
+// returns is closed once it has been written.
+func (c *upstreamTLSConn) goAway() <-chan struct{} {
+	c.writeMu.Lock()
+	defer c.writeMu.Unlock()
+	if c.goAwaySent == nil {
+		c.goAwaySent = make(chan struct{})
+	}
+	sent := c.goAwaySent
+	if c.prefaceLeft == 0 && c.out.atBoundary() {
+		c.writeGoAway()
+	} else {
+		c.pendingGoAway = true
+	}
+	return sent
+}
+
+func (c *upstreamTLSConn) writeGoAway() {
+	c.pendingGoAway = false
+	defer func() {
+		if c.goAwaySent != nil {
+			close(c.goAwaySent)
+			c.goAwaySent = nil
+		}
+	}()
+	if err := c.framer.WriteGoAway(0, http2.ErrCodeNo, nil); err != nil {
+		return
+	}
+	c.tracked.recordGoAway(goAway{Direction: "sent", ErrorCode: errorCodeName(uint32(http2.ErrCodeNo))})
+}
+
+// send writes p on the connection, and to the tap when recording. The caller
+// holds writeMu.
+func (c *upstreamTLSConn) send(p []byte) (int, error) {
+	n, err := c.Conn.Write(p)
+	if c.tap != nil {
+		c.tap.Sent(p[:n])
+	}
+	return n, err
+}
+
+// sender is what the framer for our own frames writes to.
+type sender struct{ c *upstreamTLSConn }
+
+func (s sender) Write(p []byte) (int, error) { return s.c.send(p) }
+
+// tlsHandshakeDuration is for the access log, which no longer sees the
+// handshake in its client trace now that dialer does it.
+func (c *upstreamTLSConn) tlsHandshakeDuration() time.Duration {
+	return c.handshake
+}
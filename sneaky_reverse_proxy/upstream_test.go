@@ -0,0 +1,189 @@
+package main
+
+import (
+	"crypto/tls"
+	"io"
+	"io/ioutil"
+	"net"
+	nethttp "net/http"
+	"testing"
+	"time"
+
+	"golang.org/x/net/http2"
+)
+
+// upgradedConn dials a TLS listener through conns' dialer and has the
+// connection speak HTTP/2, as an h2c upgrade leaves it. It returns the
+// connection and Envoy's end of it, past the client preface.
+func upgradedConn(t *testing.T, conns *upstreamConns) (net.Conn, *http2.Framer) {
+	t.Helper()
+	l, err := tls.Listen("tcp", "127.0.0.1:0", &tls.Config{Certificates: []tls.Certificate{localhostCert(t)}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { l.Close() })
+	accepted := make(chan net.Conn, 1)
+	go func() {
+		c, err := l.Accept()
+		if err != nil {
+			return
+		}
+		c.(*tls.Conn).Handshake()
+		accepted <- c
+	}()
+
+	dial := conns.dialer("h2c", time.Second, &tls.Config{InsecureSkipVerify: true}, newProxyMetrics(conns))
+	conn, err := dial("tcp", l.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { conn.Close() })
+	if _, err := io.WriteString(conn, clientPreface); err != nil {
+		t.Fatal(err)
+	}
+	conns.markUpgraded(conn)
+
+	envoy := <-accepted
+	t.Cleanup(func() { envoy.Close() })
+	envoy.SetDeadline(time.Now().Add(10 * time.Second))
+	preface := make([]byte, len(clientPreface))
+	if _, err := io.ReadFull(envoy, preface); err != nil {
+		t.Fatal(err)
+	}
+	return conn, http2.NewFramer(envoy, envoy)
+}
+
+// writeHalfFrame writes the first half of a DATA frame on conn and returns
+// the rest.
+func writeHalfFrame(t *testing.T, conn net.Conn) []byte {
+	t.Helper()
+	frame := []byte{0, 0, 4, 0x0, 0, 0, 0, 0, 1, 'd', 'a', 't', 'a'}
+	if _, err := conn.Write(frame[:11]); err != nil {
+		t.Fatal(err)
+	}
+	return frame[11:]
+}
+
+// readGoAway reads the DATA frame writeHalfFrame started and the GOAWAY after
+// it.
+func readGoAway(t *testing.T, fr *http2.Framer) {
+	t.Helper()
+	if f, err := fr.ReadFrame(); err != nil {
+		t.Fatalf("reading the DATA frame: %s", err)
+	} else if _, ok := f.(*http2.DataFrame); !ok {
+		t.Fatalf("got %v, want the DATA frame", f)
+	}
+	f, err := fr.ReadFrame()
+	if err != nil {
+		t.Fatalf("reading the GOAWAY: %s", err)
+	}
+	if _, ok := f.(*http2.GoAwayFrame); !ok {
+		t.Fatalf("got %v, want a GOAWAY", f)
+	}
+}
+
+func TestCloseAllWritesPendingGoAway(t *testing.T) {
+	conns := newUpstreamConns()
+	conn, envoy := upgradedConn(t, conns)
+	rest := writeHalfFrame(t, conn)
+
+	closed := make(chan struct{})
+	go func() {
+		conns.closeAll()
+		close(closed)
+	}()
+	select {
+	case <-closed:
+		t.Fatal("closeAll returned before the GOAWAY could be written")
+	case <-time.After(100 * time.Millisecond):
+	}
+	if _, err := conn.Write(rest); err != nil {
+		t.Fatalf("finishing the frame: %s", err)
+	}
+	readGoAway(t, envoy)
+	<-closed
+	if n := len(conns.list()); n != 0 {
+		t.Errorf("%d connections left open", n)
+	}
+}
+
+func TestCloseAllGivesUpOnPendingGoAway(t *testing.T) {
+	conns := newUpstreamConns()
+	conn, _ := upgradedConn(t, conns)
+	writeHalfFrame(t, conn)
+
+	start := time.Now()
+	conns.closeAll()
+	if elapsed := time.Since(start); elapsed < goAwayTimeout || elapsed > 5*time.Second {
+		t.Errorf("closeAll took %s, want %s", elapsed, goAwayTimeout)
+	}
+	if n := len(conns.list()); n != 0 {
+		t.Errorf("%d connections left open", n)
+	}
+}
+
+func TestDrainWritesPendingGoAway(t *testing.T) {
+	conns := newUpstreamConns()
+	conn, envoy := upgradedConn(t, conns)
+	rest := writeHalfFrame(t, conn)
+
+	conns.lookup(conn).drain()
+	if _, err := conn.Write(rest); err != nil {
+		t.Fatalf("finishing the frame: %s", err)
+	}
+	readGoAway(t, envoy)
+	waitFor(t, "the connection to close", func() bool { return len(conns.list()) == 0 })
+}
+
+func TestDrainLetsStreamsInFlightFinish(t *testing.T) {
+	release := make(chan struct{})
+	envoyAddr := startEnvoy(t, nethttp.HandlerFunc(func(w nethttp.ResponseWriter, r *nethttp.Request) {
+		if r.URL.Path != "/stream" {
+			reportHandler(w, r)
+			return
+		}
+		io.WriteString(w, "started ")
+		w.(nethttp.Flusher).Flush()
+		select {
+		case <-release:
+		case <-r.Context().Done():
+			return
+		}
+		io.WriteString(w, "finished")
+	}))
+	p, addr := startProxy(t, testConfig(t), envoyAddr)
+
+	// The first request upgrades the connection, and the second is a stream
+	// on it that is still going when the connection is drained.
+	do(t, h2Client(), "https://"+addr+"/inspect", nil)
+	resp, err := h2Client().Get("https://" + addr + "/stream")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	started := make([]byte, len("started "))
+	if _, err := io.ReadFull(resp.Body, started); err != nil {
+		t.Fatal(err)
+	}
+	conns := p.conns.list()
+	if len(conns) != 1 || !conns[0].isUpgraded() {
+		t.Fatalf("got %d connections, want one upgraded", len(conns))
+	}
+	c := conns[0]
+
+	c.drain()
+	waitFor(t, "the GOAWAY", func() bool {
+		g := c.status().LastGoAway
+		return g != nil && g.Direction == "sent"
+	})
+	if s := c.status(); !s.Draining || s.Streams != 1 || len(p.conns.list()) != 1 {
+		t.Fatalf("got %+v, want the connection open with its stream", s)
+	}
+
+	close(release)
+	rest, err := ioutil.ReadAll(resp.Body)
+	if err != nil || string(rest) != "finished" {
+		t.Errorf("got %q, %v after the drain started", rest, err)
+	}
+	waitFor(t, "the drained connection to close", func() bool { return len(p.conns.list()) == 0 })
+}
@@ -0,0 +1,69 @@
+package main
+
+import (
+	"bufio"
+	"crypto/tls"
+	"io"
+	nethttp "net/http"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	"shared/websocket"
+)
+
+func TestWebSocketThroughProxy(t *testing.T) {
+	upgrades := make(chan []string, 1)
+	envoyAddr := startEnvoy(t, nethttp.HandlerFunc(func(w nethttp.ResponseWriter, r *nethttp.Request) {
+		upgrades <- r.Header["Upgrade"]
+		websocket.Echo(w, r)
+	}))
+	_, addr := startProxy(t, testConfig(t), envoyAddr)
+
+	// WebSocket clients reach the proxy over HTTP/1.1.
+	conn, err := tls.Dial("tcp", addr, &tls.Config{InsecureSkipVerify: true, NextProtos: []string{"http/1.1"}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(5 * time.Second))
+	key := "dGhlIHNhbXBsZSBub25jZQ=="
+	io.WriteString(conn, "GET /ws HTTP/1.1\r\nHost: localhost\r\nConnection: Upgrade\r\nUpgrade: websocket\r\nSec-WebSocket-Version: 13\r\nSec-WebSocket-Key: "+key+"\r\n\r\n")
+	br := bufio.NewReader(conn)
+	resp, err := nethttp.ReadResponse(br, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if resp.StatusCode != nethttp.StatusSwitchingProtocols || !strings.EqualFold(resp.Header.Get("Upgrade"), "websocket") {
+		t.Fatalf("got %s, %v", resp.Status, resp.Header)
+	}
+	if got := resp.Header.Get("Sec-WebSocket-Accept"); got != websocket.Accept(key) {
+		t.Errorf("got Sec-WebSocket-Accept %q", got)
+	}
+	// No h2c upgrade was asked for on the way to Envoy.
+	if got := <-upgrades; !reflect.DeepEqual(got, []string{"websocket"}) {
+		t.Errorf("Envoy got Upgrade %q", got)
+	}
+
+	for _, f := range []struct {
+		send, want byte
+		payload    string
+	}{
+		{websocket.OpText, websocket.OpText, "hello"},
+		{websocket.OpBinary, websocket.OpBinary, strings.Repeat("through the proxy ", 1000)},
+		{websocket.OpPing, websocket.OpPong, "ping"},
+		{websocket.OpClose, websocket.OpClose, "\x03\xe8"},
+	} {
+		if err := websocket.WriteFrame(conn, f.send, []byte(f.payload), true); err != nil {
+			t.Fatal(err)
+		}
+		opcode, payload, err := websocket.ReadFrame(br, false)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if opcode != f.want || string(payload) != f.payload {
+			t.Errorf("sent opcode %d with %d bytes, got opcode %d with %d bytes", f.send, len(f.payload), opcode, len(payload))
+		}
+	}
+}
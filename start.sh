@@ -16,6 +16,10 @@ pushd ./sneaky_reverse_proxy
   go build
 popd
 
+pushd ./envoy_standin
+  go build
+popd
+
 trap 'kill $(jobs -p)' EXIT
 
 if [[ "$H2C" = "true" ]]; then
@@ -30,9 +34,14 @@ fi
 cp ./envoy/sds-server-cert-and-key.yaml /tmp
 cp ./envoy/sds-server-validation-context.yaml /tmp
 
-# Hint: you need envoy
-echo "Starting Envoy on 61001"
-envoy --config-path ./envoy/envoy.yaml -l error &
+# Without Envoy, the Go stand-in reads the same configuration.
+if command -v envoy >/dev/null; then
+  echo "Starting Envoy on 61001"
+  envoy --config-path ./envoy/envoy.yaml -l error &
+else
+  echo "Starting Envoy stand-in on 61001"
+  ./envoy_standin/envoy-standin --config-path ./envoy/envoy.yaml -l error &
+fi
 
 echo "Starting Reverse Proxy on 8000"
 ./sneaky_reverse_proxy/sneaky_reverse_proxy &